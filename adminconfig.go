@@ -0,0 +1,208 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// runtimeLock guards the settings that can be changed with the admin config API.
+var runtimeLock sync.RWMutex
+
+// defaultRetryPolicy is used for targets whose template doesn't define a retry policy. Zero values mean the built-in defaults.
+var defaultRetryPolicy RetryPolicy
+
+var logLevels = map[string]log.Level{
+	"debug": log.LevelDebug,
+	"info":  log.LevelInfo,
+	"warn":  log.LevelWarn,
+	"error": log.LevelError,
+}
+
+func getKeyRequestRateLimit() int {
+	runtimeLock.RLock()
+	defer runtimeLock.RUnlock()
+	return cfg.KeyRequestRateLimit
+}
+
+func getDefaultRetryPolicy() RetryPolicy {
+	runtimeLock.RLock()
+	defer runtimeLock.RUnlock()
+	return defaultRetryPolicy
+}
+
+func currentLogLevel() string {
+	for name, level := range logLevels {
+		if level.Severity == log.DefaultLogger.PrintLevel {
+			return name
+		}
+	}
+	return fmt.Sprint(log.DefaultLogger.PrintLevel)
+}
+
+// RetryPolicyJSON is the JSON form of RetryPolicy, with durations as strings like "2s".
+type RetryPolicyJSON struct {
+	SyncInitial        string `json:"sync_initial,omitempty"`
+	SyncMax            string `json:"sync_max,omitempty"`
+	TransactionInitial string `json:"transaction_initial,omitempty"`
+	TransactionMax     string `json:"transaction_max,omitempty"`
+
+	SyncMultiplier        float64 `json:"sync_multiplier,omitempty"`
+	TransactionMultiplier float64 `json:"transaction_multiplier,omitempty"`
+}
+
+func formatOptionalDuration(dur time.Duration) string {
+	if dur <= 0 {
+		return ""
+	}
+	return dur.String()
+}
+
+func parseOptionalDuration(name, val string) (time.Duration, error) {
+	if len(val) == 0 {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	} else if dur < 0 {
+		return 0, fmt.Errorf("invalid %s: must not be negative", name)
+	}
+	return dur, nil
+}
+
+func (rpj *RetryPolicyJSON) Parse() (policy RetryPolicy, err error) {
+	if policy.SyncInitial, err = parseOptionalDuration("sync_initial", rpj.SyncInitial); err != nil {
+		return
+	} else if policy.SyncMax, err = parseOptionalDuration("sync_max", rpj.SyncMax); err != nil {
+		return
+	} else if policy.TransactionInitial, err = parseOptionalDuration("transaction_initial", rpj.TransactionInitial); err != nil {
+		return
+	} else if policy.TransactionMax, err = parseOptionalDuration("transaction_max", rpj.TransactionMax); err != nil {
+		return
+	} else if err = validateRetryMultiplier("sync_multiplier", rpj.SyncMultiplier); err != nil {
+		return
+	} else if err = validateRetryMultiplier("transaction_multiplier", rpj.TransactionMultiplier); err != nil {
+		return
+	}
+	policy.SyncMultiplier = rpj.SyncMultiplier
+	policy.TransactionMultiplier = rpj.TransactionMultiplier
+	return
+}
+
+func retryPolicyToJSON(policy RetryPolicy) *RetryPolicyJSON {
+	return &RetryPolicyJSON{
+		SyncInitial:        formatOptionalDuration(policy.SyncInitial),
+		SyncMax:            formatOptionalDuration(policy.SyncMax),
+		TransactionInitial: formatOptionalDuration(policy.TransactionInitial),
+		TransactionMax:     formatOptionalDuration(policy.TransactionMax),
+
+		SyncMultiplier:        policy.SyncMultiplier,
+		TransactionMultiplier: policy.TransactionMultiplier,
+	}
+}
+
+// RuntimeConfig contains the settings that can be changed without restarting. In requests,
+// omitted fields are left unchanged. Retry policy changes apply when sync loops and deliveries next start.
+type RuntimeConfig struct {
+	LogLevel            string           `json:"log_level,omitempty"`
+	KeyRequestRateLimit *int             `json:"key_request_rate_limit,omitempty"`
+	Retry               *RetryPolicyJSON `json:"retry,omitempty"`
+}
+
+func getRuntimeConfig() *RuntimeConfig {
+	runtimeLock.RLock()
+	defer runtimeLock.RUnlock()
+	keyRequestRateLimit := cfg.KeyRequestRateLimit
+	return &RuntimeConfig{
+		LogLevel:            currentLogLevel(),
+		KeyRequestRateLimit: &keyRequestRateLimit,
+		Retry:               retryPolicyToJSON(defaultRetryPolicy),
+	}
+}
+
+// Apply validates the whole config first, so that invalid requests don't change anything.
+// It returns a description of the changes for the audit log.
+func (rc *RuntimeConfig) Apply() ([]string, error) {
+	var level log.Level
+	if len(rc.LogLevel) > 0 {
+		var ok bool
+		level, ok = logLevels[strings.ToLower(rc.LogLevel)]
+		if !ok {
+			return nil, fmt.Errorf("unknown log level %q", rc.LogLevel)
+		}
+	}
+	if rc.KeyRequestRateLimit != nil && *rc.KeyRequestRateLimit < 0 {
+		return nil, fmt.Errorf("key_request_rate_limit must not be negative")
+	}
+	var retry RetryPolicy
+	if rc.Retry != nil {
+		var err error
+		if retry, err = rc.Retry.Parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	runtimeLock.Lock()
+	defer runtimeLock.Unlock()
+	var changes []string
+	if len(rc.LogLevel) > 0 {
+		changes = append(changes, fmt.Sprintf("log_level: %s -> %s", currentLogLevel(), strings.ToLower(rc.LogLevel)))
+		log.DefaultLogger.PrintLevel = level.Severity
+	}
+	if rc.KeyRequestRateLimit != nil {
+		changes = append(changes, fmt.Sprintf("key_request_rate_limit: %d -> %d", cfg.KeyRequestRateLimit, *rc.KeyRequestRateLimit))
+		cfg.KeyRequestRateLimit = *rc.KeyRequestRateLimit
+	}
+	if rc.Retry != nil {
+		changes = append(changes, fmt.Sprintf("retry: %+v -> %+v", defaultRetryPolicy, retry))
+		defaultRetryPolicy = retry
+	}
+	return changes, nil
+}
+
+func getAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, getRuntimeConfig())
+}
+
+func postAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	var req RuntimeConfig
+	if !getJSON(w, r, &req) {
+		return
+	}
+	changes, err := req.Apply()
+	if err != nil {
+		formatError(errInvalidRuntimeConfig, err).Write(w)
+		return
+	}
+	for _, change := range changes {
+		log.Infofln("Runtime config changed by %s: %s", clientIP(r), change)
+	}
+	writeJSON(w, http.StatusOK, getRuntimeConfig())
+}
@@ -14,18 +14,23 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package syncproxy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "maunium.net/go/maulogger/v2"
 
 	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
 )
 
 var (
@@ -44,108 +49,805 @@ var (
 		ErrorCode:  "FI.MAU.SYNCPROXY.UPSERT_FAILED",
 		Message:    "Failed to insert appservice details into database",
 	}
+	errDeviceIDMismatch = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.DEVICE_ID_MISMATCH",
+		Message:    "The device ID in the request body doesn't match the one in the path",
+	}
+	errInvalidAppserviceID = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "Appservice IDs can't contain " + profileSeparator,
+	}
+	errAppserviceIDMismatch = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.APPSERVICE_ID_MISMATCH",
+		Message:    "The appservice ID in the registration doesn't match the one in the path",
+	}
+	errRegistrationInvalid = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_NOT_JSON",
+		Message:    "Failed to parse appservice registration",
+	}
+	errUnknownTemplate = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.UNKNOWN_TEMPLATE",
+		Message:    "No target template found with that name",
+	}
+	errMissingAddress = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Request didn't specify an address and the template doesn't have a default",
+	}
+	errMissingTokens = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "At least one of bot_access_token and hs_token must be specified",
+	}
+	errInvalidTokenLifetime = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "expires_in_ms must be positive and at most 30 days",
+	}
+	errPurgeFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "FI.MAU.SYNCPROXY.PURGE_FAILED",
+		Message:    "Failed to delete appservice details from database",
+	}
+	errPendingExportFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "FI.MAU.SYNCPROXY.PENDING_EXPORT_FAILED",
+		Message:    "Failed to export undelivered transactions",
+	}
+	errConfirmationRequired = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.CONFIRMATION_REQUIRED",
+		Message:    "The %s operation requires a confirmation token from a dry_run=true request",
+	}
+	errInvalidConfirmation = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.CONFIRMATION_REQUIRED",
+		Message:    "Confirmation token is invalid or expired",
+	}
+	errInvalidSuspendDuration = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "duration_ms must be positive and at most 7 days",
+	}
+	errTransactionNotFound = appservice.Error{
+		HTTPStatus: http.StatusNotFound,
+		ErrorCode:  "M_NOT_FOUND",
+		Message:    "No transaction found with that ID",
+	}
+	errInvalidQueryParam = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "Invalid query parameter: %s",
+	}
+	errDatabaseQueryFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "FI.MAU.SYNCPROXY.QUERY_FAILED",
+		Message:    "Failed to query database",
+	}
+	errSupportBundleFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "M_UNKNOWN",
+		Message:    "Failed to generate support bundle",
+	}
+	errMissingToken = appservice.Error{
+		HTTPStatus: http.StatusUnauthorized,
+		ErrorCode:  "M_MISSING_TOKEN",
+		Message:    "Missing authorization header",
+	}
+	errUnknownToken = appservice.Error{
+		HTTPStatus: http.StatusUnauthorized,
+		ErrorCode:  "M_UNKNOWN_TOKEN",
+		Message:    "Unknown authorization token",
+	}
+	errAddressNotAllowed = appservice.Error{
+		HTTPStatus: http.StatusForbidden,
+		ErrorCode:  "M_FORBIDDEN",
+		Message:    "Management requests aren't allowed from this address",
+	}
+	errBadJSON = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Failed to decode request JSON",
+	}
+
+	// Errors with parameters, the message is filled with formatError.
+	errWhoamiFailed = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.WHOAMI_FAILED",
+		Message:    "user_id not specified and fetching it failed: %s",
+	}
+	errTokenValidationFailed = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.TOKEN_VALIDATION_FAILED",
+		Message:    "New credentials failed validation: %s",
+	}
+	errDraining = appservice.Error{
+		HTTPStatus: http.StatusServiceUnavailable,
+		ErrorCode:  "FI.MAU.SYNCPROXY.DRAINING",
+		Message:    "The proxy is draining and doesn't accept new targets",
+	}
+	errTargetNotPaused = appservice.Error{
+		HTTPStatus: http.StatusConflict,
+		ErrorCode:  "FI.MAU.SYNCPROXY.NOT_PAUSED",
+		Message:    "That target is not paused",
+	}
+	errInvalidNextBatchReset = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Exactly one of next_batch and skip_to_now must be set",
+	}
+	errSkipBacklogFailed = appservice.Error{
+		HTTPStatus: http.StatusBadGateway,
+		ErrorCode:  "FI.MAU.SYNCPROXY.SKIP_BACKLOG_FAILED",
+		Message:    "Failed to skip to the current sync position: %s",
+	}
+	errNextBatchResetFailed = appservice.Error{
+		HTTPStatus: http.StatusBadGateway,
+		ErrorCode:  "FI.MAU.SYNCPROXY.NEXT_BATCH_RESET_FAILED",
+		Message:    "Failed to reset sync token: %s",
+	}
+	errVerifyCredentialsFailed = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.WHOAMI_FAILED",
+		Message:    "Failed to verify bot access token: %s",
+	}
+	errCredentialsUserMismatch = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.USER_MISMATCH",
+		Message:    "The bot access token belongs to %s instead of %s",
+	}
+	errCredentialsDeviceMismatch = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.DEVICE_MISMATCH",
+		Message:    "The bot access token belongs to device %s instead of %s",
+	}
+	errTargetPingFailed = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.PING_FAILED",
+		Message:    "Target didn't accept the test transaction: %s",
+	}
+	errInitialSyncFailed = appservice.Error{
+		HTTPStatus: http.StatusBadGateway,
+		ErrorCode:  "FI.MAU.SYNCPROXY.INITIAL_SYNC_FAILED",
+		Message:    "Target was saved, but syncing stopped before the first sync completed: %s",
+	}
+	errInitialSyncTimeout = appservice.Error{
+		HTTPStatus: http.StatusGatewayTimeout,
+		ErrorCode:  "FI.MAU.SYNCPROXY.INITIAL_SYNC_TIMEOUT",
+		Message:    "Target was saved, but the first sync didn't complete within %s: %s",
+	}
+	errInvalidQuietHours = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid quiet hours: %s",
+	}
+	errInvalidAddress = appservice.Error{
+		HTTPStatus: http.StatusNotFound,
+		ErrorCode:  "FI.MAU.SYNCPROXY.INVALID_ADDRESS",
+		Message:    "Failed to initialize target: %s",
+	}
+	errInvalidRuntimeConfig = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid runtime config: %s",
+	}
+	errInvalidSynchronousPolicy = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid synchronous policy: %s",
+	}
+	errInvalidSyncBackend = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid sync backend: %s",
+	}
+	errInvalidHomeserverURL = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid homeserver URL: %s",
+	}
+	errInvalidRecipients = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid recipients: %s",
+	}
+	errInvalidDeliveryOptions = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid delivery options: %s",
+	}
+	errInvalidRetryPolicy = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid retry policy: %s",
+	}
+	errInvalidLabels = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid labels: %s",
+	}
+	errInvalidLabelFilter = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "Invalid label filter: %s",
+	}
+	errInvalidRegistrationTarget = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.INVALID_REGISTRATION",
+		Message:    "Failed to derive sync target from registration: %s",
+	}
+	errInvalidOTKCountOptions = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid OTK count options: %s",
+	}
+	errInvalidDeviceListDedup = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "Invalid device list dedup window: %s",
+	}
+	errMasqueradeMissingIdentity = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_BAD_JSON",
+		Message:    "user_id and device_id are required when masquerade_device is set",
+	}
+	errRestartFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "FI.MAU.SYNCPROXY.RESTART_FAILED",
+		Message:    "Failed to restart: %s",
+	}
+	errConfigReloadUnavailable = appservice.Error{
+		HTTPStatus: http.StatusNotImplemented,
+		ErrorCode:  "M_UNRECOGNIZED",
+		Message:    "The config can't be reloaded in this process",
+	}
+	errConfigReloadFailed = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "FI.MAU.SYNCPROXY.CONFIG_RELOAD_FAILED",
+		Message:    "Failed to reload config: %s",
+	}
 )
 
+// syncTokenHandover contains the extra fields of PUT requests from bridges that switch from syncing themselves.
+type syncTokenHandover struct {
+	// NextBatch is the /sync token of the bridge, which the proxy continues from instead of its own token.
+	NextBatch string `json:"next_batch,omitempty"`
+	// SkipBacklog makes a target that has no sync token start from the current position instead of
+	// receiving all to-device events that were sent before it was registered.
+	SkipBacklog bool `json:"skip_backlog,omitempty"`
+}
+
 func startSync(w http.ResponseWriter, r *http.Request) {
-	if !checkAuth(w, r) {
-		return
-	}
 	vars := mux.Vars(r)
 	appserviceID := vars["appserviceID"]
+	deviceKey := vars["deviceID"]
+	profile := requestProfile(r).Name
+	targetID := requestTargetID(r, appserviceID, deviceKey)
+	regTokenHash, ok := checkTargetAuth(w, r, storageAppserviceID(profile, appserviceID), deviceKey)
+	if !ok {
+		return
+	}
 
 	switch r.Method {
 	case http.MethodPut:
+		if !rejectIfDraining(w) {
+			return
+		} else if strings.Contains(appserviceID, profileSeparator) {
+			errInvalidAppserviceID.Write(w)
+			return
+		}
 		var req SyncTarget
-		if !getJSON(w, r, &req) {
+		var handover syncTokenHandover
+		if !getJSON(w, r, &struct {
+			*SyncTarget
+			*syncTokenHandover
+		}{&req, &handover}) {
 			return
 		}
-		log.Debugfln("Received PUT request for appservice %s (user: %s, device: %s, address: %s, proxy: %t)", req.AppserviceID, req.UserID, req.DeviceID, req.Address, req.IsProxy)
+		req.NextBatch = handover.NextBatch
+		req.skipBacklog = handover.SkipBacklog
+		log.Debugfln("Received PUT request %s for target %s (user: %s, device: %s, address: %s, proxy: %t)", requestID(r), targetID, req.UserID, req.DeviceID, req.Address, req.IsProxy)
 		req.AppserviceID = appserviceID
-		target := GetOrSetTarget(appserviceID, &req)
-		changed := true
-		if target == nil {
-			target = &req
-			err := target.Init()
-			if err != nil {
-				target.log.Warnln("Failed to initialize new target:", err)
-				appservice.Error{
-					HTTPStatus: http.StatusNotFound,
-					ErrorCode:  "FI.MAU.SYNCPROXY.INVALID_ADDRESS",
-					Message:    fmt.Sprintf("Failed to initialize target: %v", err),
-				}.Write(w)
-				return
-			}
-		} else if target.BotAccessToken != req.BotAccessToken || target.HSToken != req.HSToken ||
-			target.Address != req.Address || target.UserID != req.UserID || target.DeviceID != req.DeviceID {
-			target.BotAccessToken = req.BotAccessToken
-			target.HSToken = req.HSToken
-			target.Address = req.Address
-			target.UserID = req.UserID
-			target.DeviceID = req.DeviceID
-			if target.client != nil {
-				target.client.AccessToken = target.BotAccessToken
-				target.client.UserID = target.UserID
-				target.client.DeviceID = target.DeviceID
-			}
-		} else {
-			changed = false
-		}
-		if changed {
-			target.log.Debugln("Upserting target for PUT request")
-			err := target.Upsert()
-			if err != nil {
-				target.log.Warnln("Failed to upsert target:", err)
-				errUpsertFailed.Write(w)
+		req.Profile = profile
+		req.DeviceKey = deviceKey
+		if apiErr, ok := req.prepareForPut(); !ok {
+			apiErr.Write(w)
+			return
+		}
+		if !verifyCredentialsBeforeStart(w, r, &req) || !pingBeforeStart(w, r, &req) {
+			return
+		}
+		if len(regTokenHash) > 0 {
+			if !consumeRegistrationToken(w, r, regTokenHash) {
 				return
 			}
+			log.Infofln("Target %s is registering itself with a registration token", targetID)
 		}
-		target.log.Debugln("Starting target for PUT request")
-		go target.Start()
-		appservice.WriteBlankOK(w)
+		putTarget(w, r, &req)
 	case http.MethodDelete:
-		target := GetOrSetTarget(appserviceID, nil)
+		unlock := registry.LockTarget(targetID)
+		defer unlock()
+		target := registry.Get(targetID)
 		if target == nil {
-			log.Debugln("Client requested stopping unknown appservice", appserviceID)
+			log.Debugln("Client requested stopping unknown target", targetID)
 			errTargetNotFound.Write(w)
 			return
+		}
+		purge := r.URL.Query().Get("purge") == "true"
+		if purge && !confirmDestructive(w, r, "purge", targetID) {
+			return
+		}
+		resp := &StopResponse{CanceledSuspension: target.CancelSuspension()}
+		export := r.URL.Query().Get("export") == "true"
+		if purge {
+			purgeTarget(r.Context(), w, target, resp, export)
+			return
+		} else if resp.CanceledSuspension && !target.Active {
+			target.log.Infoln("Canceled suspension after DELETE request")
+			writeStopResponse(w, r, resp)
+			return
 		} else if !target.Active {
-			log.Debugln("Client requested stopping inactive appservice", appserviceID)
+			log.Debugln("Client requested stopping inactive target", targetID)
 			errTargetNotActive.Write(w)
 			return
 		}
-		target.Stop()
+		start := time.Now()
+		resp.WasRunning = target.isRunning()
+		inFlight := target.getInFlight()
+		if inFlight != nil {
+			resp.InFlightTxnID = inFlight.TxnID
+		}
+		stopped := target.Stop(StopReasonOperator)
+		if r.URL.Query().Get("force") == "true" {
+			// Don't wait for the sync loop to wind down, just make sure the in-flight transaction isn't lost.
+			if txnID, err := target.QueueInFlight(); err != nil {
+				target.log.Warnfln("Failed to queue in-flight transaction %s for forced DELETE, waiting for syncing to stop normally: %v", txnID, err)
+			} else {
+				if len(txnID) > 0 {
+					target.log.Debugfln("Queued in-flight transaction %s for forced DELETE", txnID)
+					resp.InFlightTxnID = txnID
+					resp.InFlightQueued = true
+				}
+				target.log.Infoln("Target stop forced after DELETE request")
+				resp.Forced = true
+				resp.setFinalState(target)
+				resp.WindDownMS = time.Since(start).Milliseconds()
+				if export && !exportPendingForStop(w, target, resp) {
+					return
+				}
+				writeStopResponse(w, r, resp)
+				return
+			}
+		}
 		target.log.Debugln("Waiting for syncing to stop")
-		target.wg.Wait()
+		<-stopped
 		target.log.Infoln("Target stopped after DELETE request")
-		w.WriteHeader(http.StatusNoContent)
+		if inFlight != nil {
+			// The sync loop has exited, so the queue status of the transaction won't change anymore.
+			resp.InFlightQueued = inFlight.queued
+		}
+		resp.setFinalState(target)
+		resp.WindDownMS = time.Since(start).Milliseconds()
+		if export && !exportPendingForStop(w, target, resp) {
+			return
+		}
+		writeStopResponse(w, r, resp)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func checkAuth(w http.ResponseWriter, r *http.Request) bool {
-	var token string
+// StopResponse describes what a DELETE request stopped, so that clients can verify that syncing was shut down cleanly.
+type StopResponse struct {
+	WasRunning bool `json:"was_running"`
+	// Forced is true if the request didn't wait for the sync loop to stop (force=true).
+	Forced             bool   `json:"forced"`
+	CanceledSuspension bool   `json:"canceled_suspension"`
+	NextBatch          string `json:"next_batch"`
+	WindDownMS         int64  `json:"wind_down_ms"`
+	// TransactionsSent is the number of transactions delivered since the sync loop was last started.
+	TransactionsSent uint64 `json:"transactions_sent"`
+	// StoppedAt is the unix millisecond timestamp when the sync loop exited. It's not set if the stop was forced
+	// and the sync loop hasn't exited yet.
+	StoppedAt int64 `json:"stopped_at,omitempty"`
+	// InFlightTxnID is the transaction that was being delivered when the request was received.
+	InFlightTxnID string `json:"in_flight_txn_id,omitempty"`
+	// InFlightQueued is true if the in-flight transaction was stored in the pending queue by a forced stop.
+	InFlightQueued bool `json:"in_flight_queued,omitempty"`
+	// Purged is true if the target and all its data were deleted (purge=true).
+	Purged bool `json:"purged,omitempty"`
+	// PendingTransactions is the pending queue of the target after stopping (export=true). When purging,
+	// these transactions were deleted, otherwise they're still delivered when the target is started again.
+	PendingTransactions []ExportedTransaction `json:"pending_transactions,omitempty"`
+	// PendingExportPath is the file where the pending queue was written before purging, if PENDING_EXPORT_DIR is set.
+	PendingExportPath string `json:"pending_export_path,omitempty"`
+}
+
+// setFinalState fills the sync state of a target that was stopped by a DELETE request, so that clients
+// switching away from the proxy can continue from the same position.
+func (resp *StopResponse) setFinalState(target *SyncTarget) {
+	resp.NextBatch = target.NextBatch
+	resp.TransactionsSent = atomic.LoadUint64(&target.sessionTransactions)
+	target.statusLock.RLock()
+	if !target.isRunning() && target.lastStop != nil {
+		resp.StoppedAt = target.lastStop.Timestamp
+	}
+	target.statusLock.RUnlock()
+}
+
+// writeStopResponse finishes a DELETE request that stopped syncing. Clients written before the response had a body
+// expect 204 No Content, so the details are only returned if they're requested with details=true or the request
+// exported the pending queue.
+func writeStopResponse(w http.ResponseWriter, r *http.Request, resp *StopResponse) {
+	query := r.URL.Query()
+	if query.Get("details") == "true" || query.Get("export") == "true" {
+		writeJSON(w, http.StatusOK, resp)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// exportPendingForStop adds the pending queue to the response of a DELETE request with export=true.
+func exportPendingForStop(w http.ResponseWriter, target *SyncTarget, resp *StopResponse) bool {
+	exported, err := target.exportPendingTransactions()
+	if err != nil {
+		target.log.Warnln("Failed to export pending transactions:", err)
+		errPendingExportFailed.Write(w)
+		return false
+	}
+	resp.PendingTransactions = exported
+	return true
+}
+
+// purgeTarget stops syncing if necessary and deletes the target from memory and the database.
+// The pending queue is exported first if requested or if PENDING_EXPORT_DIR is set.
+func purgeTarget(ctx context.Context, w http.ResponseWriter, target *SyncTarget, resp *StopResponse, export bool) {
+	start := time.Now()
+	resp.WasRunning = target.isRunning()
+	<-target.Stop(StopReasonOperator)
+	resp.setFinalState(target)
+	exported, exportPath, err := target.exportBeforePurge()
+	if err != nil {
+		target.log.Warnln("Failed to export pending transactions, not purging target:", err)
+		errPendingExportFailed.Write(w)
+		return
+	}
+	resp.PendingExportPath = exportPath
+	if export {
+		resp.PendingTransactions = exported
+	}
+	if err = target.Purge(ctx); err != nil {
+		target.log.Warnln("Failed to purge target:", err)
+		errPurgeFailed.Write(w)
+		return
+	}
+	target.log.Infoln("Target purged after DELETE request")
+	resp.Purged = true
+	resp.WindDownMS = time.Since(start).Milliseconds()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// prepareForPut fills in the missing fields of a target from a PUT request and validates it.
+// The target must already have the appservice ID, profile and device key set.
+func (req *SyncTarget) prepareForPut() (apiErr appservice.Error, ok bool) {
+	if len(req.DeviceKey) > 0 {
+		if len(req.DeviceID) == 0 {
+			req.DeviceID = id.DeviceID(req.DeviceKey)
+		} else if req.DeviceID != id.DeviceID(req.DeviceKey) {
+			return errDeviceIDMismatch, false
+		}
+	}
+	if req.MasqueradeDevice && (len(req.UserID) == 0 || len(req.DeviceID) == 0) {
+		return errMasqueradeMissingIdentity, false
+	} else if len(req.UserID) == 0 {
+		if err := req.FetchIdentity(); err != nil {
+			log.Debugfln("Failed to fetch identity for %s: %v", req.ID(), err)
+			return formatError(errWhoamiFailed, err), false
+		}
+	}
+	if len(req.Template) > 0 && cfg.Templates[req.Template] == nil {
+		return errUnknownTemplate, false
+	} else if len(req.getAddress()) == 0 {
+		return errMissingAddress, false
+	} else if err := req.SynchronousPolicy.Validate(); err != nil {
+		return formatError(errInvalidSynchronousPolicy, err), false
+	} else if err := req.SyncBackend.Validate(); err != nil {
+		return formatError(errInvalidSyncBackend, err), false
+	} else if err := validateHomeserverURL(req.HomeserverURL); err != nil {
+		return formatError(errInvalidHomeserverURL, err), false
+	} else if err := validateRecipients(req.Recipients); err != nil {
+		return formatError(errInvalidRecipients, err), false
+	} else if err := validateLabels(req.Labels); err != nil {
+		return formatError(errInvalidLabels, err), false
+	} else if req.OTKCountThreshold < 0 || req.OTKCountDelta < 0 {
+		return formatError(errInvalidOTKCountOptions, "otk_count_threshold and otk_count_delta must not be negative"), false
+	} else if req.DeviceListDedupMinutes < 0 {
+		return formatError(errInvalidDeviceListDedup, "device_list_dedup_minutes must not be negative"), false
+	} else if req.QuietHours != nil {
+		if err := req.QuietHours.Parse(); err != nil {
+			return formatError(errInvalidQuietHours, err), false
+		}
+	}
+	if req.Delivery != nil {
+		if err := req.Delivery.Parse(); err != nil {
+			return formatError(errInvalidDeliveryOptions, err), false
+		}
+	}
+	if req.Retry != nil {
+		var err error
+		if req.retryPolicy, err = req.Retry.Parse(); err != nil {
+			return formatError(errInvalidRetryPolicy, err), false
+		}
+	}
+	return apiErr, true
+}
+
+// upsertTarget inserts or updates the given target and (re)starts syncing for it.
+// If req.NextBatch is set, syncing continues from that token.
+func upsertTarget(ctx context.Context, req *SyncTarget) (apiErr appservice.Error, ok bool) {
+	unlock := registry.LockTarget(req.ID())
+	defer unlock()
+	target := registry.Get(req.ID())
+	changed := true
+	isNew := target == nil
+	// restartOnError restarts the sync loop if it was stopped to change the settings and the upsert fails.
+	restartOnError := false
+	if isNew {
+		target = req
+		target.registeredAt = time.Now().UnixNano() / int64(time.Millisecond)
+		err := target.Init()
+		if err != nil {
+			target.log.Warnln("Failed to initialize new target:", err)
+			return formatError(errInvalidAddress, err), false
+		}
+		if nextBatch, ok, err := target.skipInitialBacklog(req); err != nil {
+			return formatError(errSkipBacklogFailed, err), false
+		} else if ok {
+			target.NextBatch = nextBatch
+		}
+	} else if target.Address != req.Address || target.UserID != req.UserID || target.DeviceID != req.DeviceID ||
+		target.Template != req.Template || target.DryRun != req.DryRun || target.AtMostOnce != req.AtMostOnce ||
+		target.quietHoursJSON() != req.quietHoursJSON() || target.labelsJSON() != req.labelsJSON() ||
+		target.recipientsJSON() != req.recipientsJSON() || target.SynchronousPolicy != req.SynchronousPolicy ||
+		target.MaxBufferedBytes != req.MaxBufferedBytes || target.deliveryOptionsJSON() != req.deliveryOptionsJSON() ||
+		target.retryPolicyJSON() != req.retryPolicyJSON() ||
+		target.syncFilterJSON() != req.syncFilterJSON() || target.ForwardPresence != req.ForwardPresence ||
+		target.DropDeviceListLeft != req.DropDeviceListLeft || target.DeviceListDedupMinutes != req.DeviceListDedupMinutes ||
+		target.MasqueradeDevice != req.MasqueradeDevice ||
+		target.OTKCountThreshold != req.OTKCountThreshold || target.OTKCountDelta != req.OTKCountDelta ||
+		target.FullSync != req.FullSync || target.SyncBackend != req.SyncBackend || target.HomeserverURL != req.HomeserverURL {
+		// The sync loop and the delivery clients read the settings without locking,
+		// so the old loop must be stopped before they're changed.
+		<-target.Stop(StopReasonRestart)
+		restartOnError = true
+		target.Address = req.Address
+		target.Template = req.Template
+		target.DryRun = req.DryRun
+		target.AtMostOnce = req.AtMostOnce
+		target.QuietHours = req.QuietHours
+		target.Labels = req.Labels
+		target.Recipients = req.Recipients
+		target.SynchronousPolicy = req.SynchronousPolicy
+		target.MaxBufferedBytes = req.MaxBufferedBytes
+		target.Delivery = req.Delivery
+		target.Retry = req.Retry
+		target.retryPolicy = req.retryPolicy
+		target.Filter = req.Filter
+		target.ForwardPresence = req.ForwardPresence
+		target.DropDeviceListLeft = req.DropDeviceListLeft
+		target.DeviceListDedupMinutes = req.DeviceListDedupMinutes
+		target.MasqueradeDevice = req.MasqueradeDevice
+		target.OTKCountThreshold = req.OTKCountThreshold
+		target.OTKCountDelta = req.OTKCountDelta
+		target.FullSync = req.FullSync
+		target.SyncBackend = req.SyncBackend
+		target.HomeserverURL = req.HomeserverURL
+		target.closeDeliveryClient()
+		target.updateLabelMetric()
+		target.UserID = req.UserID
+		target.DeviceID = req.DeviceID
+		if err := target.UpdateCredentials(req.BotAccessToken, req.HSToken); err != nil {
+			target.log.Warnln("Failed to update credentials:", err)
+			target.startInBackground()
+			return errUpsertFailed, false
+		}
+	} else if target.BotAccessToken != req.BotAccessToken || target.HSToken != req.HSToken {
+		if err := target.UpdateCredentials(req.BotAccessToken, req.HSToken); err != nil {
+			target.log.Warnln("Failed to update credentials:", err)
+			return errUpsertFailed, false
+		} else if err = target.Upsert(ctx); err != nil {
+			target.log.Warnln("Failed to upsert target:", err)
+			return errUpsertFailed, false
+		} else if target.isRunning() && len(req.NextBatch) == 0 {
+			// The running sync loop picks up the new client on its next request, so there's no need to restart it.
+			target.log.Infoln("Updated credentials of running target")
+			if req.syncWaiter != nil {
+				target.addSyncWaiter(req.syncWaiter)
+				target.Poke()
+			}
+			return apiErr, true
+		}
+		changed = false
+	} else {
+		changed = false
+	}
+	if changed {
+		target.log.Debugln("Upserting target for PUT request")
+		err := target.Upsert(ctx)
+		if err != nil {
+			target.log.Warnln("Failed to upsert target:", err)
+			if restartOnError {
+				target.startInBackground()
+			}
+			return errUpsertFailed, false
+		}
+	}
+	if isNew {
+		registry.Add(target)
+	} else if len(req.NextBatch) > 0 {
+		// The old sync loop must be stopped first, so that it can't store its own token after the handed over one.
+		<-target.Stop(StopReasonRestart)
+		target.log.Infoln("Replacing sync token with one handed over in PUT request")
+		target.SetNextBatch(ctx, req.NextBatch)
+	} else if req.skipBacklog && len(target.NextBatch) == 0 {
+		<-target.Stop(StopReasonRestart)
+		if nextBatch, ok, err := target.skipInitialBacklog(req); err != nil {
+			target.startInBackground()
+			return formatError(errSkipBacklogFailed, err), false
+		} else if ok {
+			target.SetNextBatch(ctx, nextBatch)
+		}
+	}
+	if target.CancelSuspension() {
+		target.log.Debugln("Canceled suspension for PUT request")
+	}
+	target.clearPause()
+	target.log.Debugln("Starting target for PUT request")
+	// The instance that handled the PUT request takes over syncing, so that the new settings are used immediately.
+	target.statusLock.Lock()
+	target.leaseTakeover = true
+	target.statusLock.Unlock()
+	if req.syncWaiter != nil {
+		target.addSyncWaiter(req.syncWaiter)
+	}
+	target.startInBackground()
+	return apiErr, true
+}
+
+// putTarget upserts the target of a PUT request. If the request has wait=true,
+// the response is only sent after the first sync request has completed.
+func putTarget(w http.ResponseWriter, r *http.Request, req *SyncTarget) {
+	if timeout, wait, err := parsePutWait(r); err != nil {
+		formatError(errInvalidQueryParam, err.Error()).Write(w)
+	} else if wait {
+		putTargetAndWait(w, r, req, timeout)
+	} else if apiErr, ok := upsertTarget(r.Context(), req); !ok {
+		apiErr.Write(w)
+	} else {
+		appservice.WriteBlankOK(w)
+	}
+}
+
+func getTransaction(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	storageID := storageAppserviceID(requestProfile(r).Name, vars["appserviceID"])
+	entry, err := GetTransactionHistoryEntry(r.Context(), storageID, vars["txnID"])
+	if err != nil {
+		log.Warnfln("Failed to get transaction %s of %s from history: %v", vars["txnID"], storageID, err)
+		errDatabaseQueryFailed.Write(w)
+	} else if entry == nil {
+		errTransactionNotFound.Write(w)
+	} else {
+		entry.AppserviceID = vars["appserviceID"]
+		entry.TraceID = txnTraceID(entry.TxnID)
+		writeJSON(w, http.StatusOK, entry)
+	}
+}
+
+// parsePositiveIntParam parses an optional positive integer query parameter. Missing parameters are returned as zero.
+func parsePositiveIntParam(r *http.Request, name string) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return parsed, nil
+}
+
+// parseHistoryQuery reads the filters of a transaction history query from the query parameters.
+func parseHistoryQuery(r *http.Request) (query HistoryQuery, err error) {
+	params := r.URL.Query()
+	query.Status = TransactionStatus(params.Get("status"))
+	switch query.Status {
+	case "", TransactionStatusPending, TransactionStatusSent, TransactionStatusFailed, TransactionStatusDryRun, TransactionStatusDropped, TransactionStatusDeadLettered:
+	default:
+		return query, fmt.Errorf("unknown status %q", query.Status)
+	}
+	query.EventType = params.Get("event_type")
+	query.Sender = id.UserID(params.Get("sender"))
+	if query.Since, err = parsePositiveIntParam(r, "since"); err != nil {
+		return
+	} else if query.Before, err = parsePositiveIntParam(r, "before"); err != nil {
+		return
+	}
+	limit, err := parsePositiveIntParam(r, "limit")
+	if err != nil {
+		return
+	} else if limit == 0 {
+		query.Limit = defaultHistoryQueryLimit
+	} else if limit > maxHistoryQueryLimit {
+		query.Limit = maxHistoryQueryLimit
+	} else {
+		query.Limit = int(limit)
+	}
+	return
+}
+
+func queryTransactions(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	query, err := parseHistoryQuery(r)
+	if err != nil {
+		formatError(errInvalidQueryParam, err.Error()).Write(w)
+		return
+	}
+	storageID := storageAppserviceID(requestProfile(r).Name, vars["appserviceID"])
+	entries, err := QueryTransactionHistory(r.Context(), storageID, vars["deviceID"], query)
+	if err != nil {
+		log.Warnfln("Failed to query transaction history of %s: %v", TargetID(storageID, vars["deviceID"]), err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	if entries == nil {
+		entries = []*TransactionHistoryEntry{}
+	}
+	for _, entry := range entries {
+		entry.AppserviceID = vars["appserviceID"]
+		entry.TraceID = txnTraceID(entry.TxnID)
+	}
+	resp := map[string]interface{}{
+		"transactions": entries,
+	}
+	if len(entries) == query.Limit {
+		resp["next_before"] = entries[len(entries)-1].CreatedAt
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func requestAccessToken(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		token = r.URL.Query().Get("access_token")
-	} else {
-		token = authHeader[len("Bearer "):]
+		return r.URL.Query().Get("access_token")
+	}
+	return authHeader[len("Bearer "):]
+}
+
+func checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	if !checkManagementAllowed(w, r) {
+		return false
 	}
+	token := requestAccessToken(r)
 	w.Header().Add("Content-Type", "application/json")
 	if len(token) == 0 {
-		appservice.Error{
-			HTTPStatus: http.StatusUnauthorized,
-			ErrorCode:  "M_MISSING_TOKEN",
-			Message:    "Missing authorization header",
-		}.Write(w)
+		errMissingToken.Write(w)
 		return false
 	}
-	if token != cfg.SharedSecret {
-		appservice.Error{
-			HTTPStatus: http.StatusUnauthorized,
-			ErrorCode:  "M_UNKNOWN_TOKEN",
-			Message:    "Unknown authorization token",
-		}.Write(w)
+	if token != requestProfile(r).secret() {
+		log.Warnfln("Request to %s from %s had an invalid access token", r.URL.Path, clientIP(r))
+		errUnknownToken.Write(w)
 		return false
 	}
 	return true
@@ -154,12 +856,14 @@ func checkAuth(w http.ResponseWriter, r *http.Request) bool {
 func getJSON(w http.ResponseWriter, r *http.Request, into interface{}) bool {
 	err := json.NewDecoder(r.Body).Decode(&into)
 	if err != nil {
-		appservice.Error{
-			HTTPStatus: http.StatusBadRequest,
-			ErrorCode:  "M_BAD_JSON",
-			Message:    "Failed to decode request JSON",
-		}.Write(w)
+		errBadJSON.Write(w)
 		return false
 	}
 	return true
 }
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,143 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/appservice"
+)
+
+// BulkTargetRef identifies a target in a bulk request.
+type BulkTargetRef struct {
+	AppserviceID string `json:"appservice_id"`
+	// DeviceKey is the device ID in the path of additional device targets. It's empty for the main target.
+	DeviceKey string `json:"device_key,omitempty"`
+}
+
+// bulkUpsert is a target in a bulk request. It has the same fields as the body of a PUT request.
+type bulkUpsert struct {
+	*SyncTarget
+	DeviceKey string `json:"device_key,omitempty"`
+	syncTokenHandover
+}
+
+type reqBulkTargets struct {
+	Upsert []bulkUpsert    `json:"upsert"`
+	Stop   []BulkTargetRef `json:"stop"`
+}
+
+// BulkTargetResult is the result of a single upsert or stop in a bulk request.
+type BulkTargetResult struct {
+	BulkTargetRef
+	ErrorCode appservice.ErrorCode `json:"errcode,omitempty"`
+	Error     string               `json:"error,omitempty"`
+}
+
+type respBulkTargets struct {
+	Upserted []BulkTargetResult `json:"upserted"`
+	Stopped  []BulkTargetResult `json:"stopped"`
+}
+
+func bulkResult(ref BulkTargetRef, apiErr appservice.Error, ok bool) BulkTargetResult {
+	result := BulkTargetResult{BulkTargetRef: ref}
+	if !ok {
+		result.ErrorCode = apiErr.ErrorCode
+		result.Error = apiErr.Message
+	}
+	return result
+}
+
+// bulkUpsertTarget validates and stores a single target of a bulk request like a PUT request would.
+func bulkUpsertTarget(ctx context.Context, profile string, item bulkUpsert) (appservice.Error, bool) {
+	req := item.SyncTarget
+	if req == nil || len(req.AppserviceID) == 0 || strings.Contains(req.AppserviceID, profileSeparator) {
+		return errInvalidAppserviceID, false
+	}
+	req.Profile = profile
+	req.DeviceKey = item.DeviceKey
+	req.NextBatch = item.syncTokenHandover.NextBatch
+	req.skipBacklog = item.syncTokenHandover.SkipBacklog
+	if apiErr, ok := req.prepareForPut(); !ok {
+		return apiErr, false
+	}
+	return upsertTarget(ctx, req)
+}
+
+// bulkStopTarget stops a single target of a bulk request like a DELETE request would,
+// except that it doesn't wait for the sync loop to exit. The returned channel is closed when it has.
+func bulkStopTarget(targetID string) (<-chan struct{}, appservice.Error, bool) {
+	unlock := registry.LockTarget(targetID)
+	defer unlock()
+	target := registry.Get(targetID)
+	if target == nil {
+		return nil, errTargetNotFound, false
+	}
+	canceledSuspension := target.CancelSuspension()
+	if !target.Active {
+		if canceledSuspension {
+			target.log.Infoln("Canceled suspension after bulk stop request")
+			return closedChan, appservice.Error{}, true
+		}
+		return nil, errTargetNotActive, false
+	}
+	target.log.Infoln("Stopping target after bulk stop request")
+	return target.Stop(StopReasonOperator), appservice.Error{}, true
+}
+
+// bulkTargets upserts and stops many targets in one request, e.g. when a bridge manager restarts.
+// Targets are stopped first, and the response is sent once all of their sync loops have exited.
+func bulkTargets(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	var req reqBulkTargets
+	if !getJSON(w, r, &req) {
+		return
+	} else if len(req.Upsert) > 0 && !rejectIfDraining(w) {
+		return
+	}
+	profile := requestProfile(r).Name
+	log.Debugfln("Received bulk request from %s to upsert %d and stop %d targets", clientIP(r), len(req.Upsert), len(req.Stop))
+	resp := respBulkTargets{
+		Upserted: make([]BulkTargetResult, 0, len(req.Upsert)),
+		Stopped:  make([]BulkTargetResult, 0, len(req.Stop)),
+	}
+	var stopping []<-chan struct{}
+	for _, ref := range req.Stop {
+		stopped, apiErr, ok := bulkStopTarget(TargetID(storageAppserviceID(profile, ref.AppserviceID), ref.DeviceKey))
+		if ok {
+			stopping = append(stopping, stopped)
+		}
+		resp.Stopped = append(resp.Stopped, bulkResult(ref, apiErr, ok))
+	}
+	for _, stopped := range stopping {
+		<-stopped
+	}
+	for _, item := range req.Upsert {
+		ref := BulkTargetRef{DeviceKey: item.DeviceKey}
+		if item.SyncTarget != nil {
+			ref.AppserviceID = item.AppserviceID
+		}
+		apiErr, ok := bulkUpsertTarget(r.Context(), profile, item)
+		resp.Upserted = append(resp.Upserted, bulkResult(ref, apiErr, ok))
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
@@ -0,0 +1,196 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type TargetLabelMode string
+
+const (
+	// TargetLabelID uses the target ID as the value of the target label in metrics.
+	TargetLabelID TargetLabelMode = "id"
+	// TargetLabelHash uses a short hash of the target ID, so that appservice IDs aren't exposed in metrics.
+	TargetLabelHash TargetLabelMode = "hash"
+)
+
+// otherTargetsLabel is the target label value that counters of targets without their own series are added to.
+const otherTargetsLabel = "other"
+
+const targetSeriesRerankInterval = 5 * time.Minute
+
+type MetricsConfig struct {
+	// TargetLabel is the format of the target label in per-target metrics.
+	TargetLabel TargetLabelMode `yaml:"target_label"`
+	// MaxTargets is the number of targets that get their own per-target metric series. Zero means no limit.
+	MaxTargets int `yaml:"max_targets"`
+	// ListenAddress is a comma-separated list of addresses where /metrics, the health checks and the profiler
+	// are served instead of the main listener. Empty means they're served on the main listener.
+	ListenAddress string `yaml:"listen_address"`
+}
+
+func parseTargetLabelMode(mode string) (TargetLabelMode, error) {
+	switch TargetLabelMode(mode) {
+	case "", TargetLabelID:
+		return TargetLabelID, nil
+	case TargetLabelHash:
+		return TargetLabelHash, nil
+	default:
+		return "", fmt.Errorf("unknown target label mode %q", mode)
+	}
+}
+
+// metricTargetLabel returns the value of the target label for the given target ID.
+func metricTargetLabel(targetID string) string {
+	if cfg.Metrics.TargetLabel == TargetLabelHash {
+		hash := sha256.Sum256([]byte(targetID))
+		return hex.EncodeToString(hash[:8])
+	}
+	return targetID
+}
+
+// targetSeriesLimiter decides which targets get their own per-target metric series when the number of
+// series is capped. The slots go to the targets that had the most delivered events in the previous interval.
+type targetSeriesLimiter struct {
+	activity map[string]uint64
+	allowed  map[string]struct{}
+	lock     sync.Mutex
+}
+
+var seriesLimiter = &targetSeriesLimiter{
+	activity: make(map[string]uint64),
+	allowed:  make(map[string]struct{}),
+}
+
+// RecordActivity counts delivered events for the next ranking. Free slots are given out immediately,
+// so that all targets have their own series if there are less of them than the limit.
+func (tsl *targetSeriesLimiter) RecordActivity(targetID string, events int) {
+	if cfg.Metrics.MaxTargets <= 0 {
+		return
+	}
+	tsl.lock.Lock()
+	tsl.activity[targetID] += uint64(events)
+	if _, ok := tsl.allowed[targetID]; !ok && len(tsl.allowed) < cfg.Metrics.MaxTargets {
+		tsl.allowed[targetID] = struct{}{}
+	}
+	tsl.lock.Unlock()
+}
+
+// Label returns the target label for the given target and whether it has its own series.
+// Targets without their own series should be counted under otherTargetsLabel in counters and left out of gauges.
+func (tsl *targetSeriesLimiter) Label(targetID string) (string, bool) {
+	if cfg.Metrics.MaxTargets <= 0 {
+		return metricTargetLabel(targetID), true
+	}
+	tsl.lock.Lock()
+	_, ok := tsl.allowed[targetID]
+	tsl.lock.Unlock()
+	if !ok {
+		return otherTargetsLabel, false
+	}
+	return metricTargetLabel(targetID), true
+}
+
+// Forget drops the target's slot, e.g. when it's deleted.
+func (tsl *targetSeriesLimiter) Forget(targetID string) {
+	tsl.lock.Lock()
+	delete(tsl.allowed, targetID)
+	delete(tsl.activity, targetID)
+	tsl.lock.Unlock()
+}
+
+// Rerank gives the slots to the targets with the most delivered events since the previous ranking
+// and returns the targets that lost their slot.
+func (tsl *targetSeriesLimiter) Rerank() []string {
+	tsl.lock.Lock()
+	defer tsl.lock.Unlock()
+	type rankedTarget struct {
+		id     string
+		events uint64
+	}
+	ranked := make([]rankedTarget, 0, len(tsl.activity))
+	for targetID, events := range tsl.activity {
+		ranked = append(ranked, rankedTarget{targetID, events})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].events > ranked[j].events
+	})
+	allowed := make(map[string]struct{}, cfg.Metrics.MaxTargets)
+	for _, target := range ranked {
+		if len(allowed) >= cfg.Metrics.MaxTargets {
+			break
+		}
+		allowed[target.id] = struct{}{}
+	}
+	// Targets that already had a slot keep it if nobody busier needs it, so quiet periods don't cause churn.
+	for targetID := range tsl.allowed {
+		if len(allowed) >= cfg.Metrics.MaxTargets {
+			break
+		}
+		allowed[targetID] = struct{}{}
+	}
+	var removed []string
+	for targetID := range tsl.allowed {
+		if _, ok := allowed[targetID]; !ok {
+			removed = append(removed, targetID)
+		}
+	}
+	tsl.allowed = allowed
+	tsl.activity = make(map[string]uint64, len(allowed))
+	return removed
+}
+
+// deleteTargetSeries deletes the per-target metric series of the given target.
+func deleteTargetSeries(targetID string) {
+	label := metricTargetLabel(targetID)
+	targetBufferedBytes.DeleteLabelValues(label)
+	targetSyncLag.DeleteLabelValues(label)
+	targetDeliveryLag.DeleteLabelValues(label)
+	targetReachable.DeleteLabelValues(label)
+	targetPingLatency.DeleteLabelValues(label)
+	syncLoopRestarts.DeleteLabelValues(label)
+	for _, window := range latencyWindows {
+		for _, quantile := range latencyQuantiles {
+			targetDeliveryLatency.DeleteLabelValues(label, window.Name, quantile.Name)
+		}
+		sloGoodRatio.DeleteLabelValues(label, window.Name)
+		sloBurnRate.DeleteLabelValues(label, window.Name)
+	}
+	for group := range knownToDeviceTypes {
+		forwardedEvents.DeleteLabelValues(label, group)
+	}
+	forwardedEvents.DeleteLabelValues(label, verificationTypePrefix+"*")
+	forwardedEvents.DeleteLabelValues(label, "other")
+}
+
+// loopRerankTargetSeries periodically moves the per-target series to the busiest targets.
+func loopRerankTargetSeries() {
+	if cfg.Metrics.MaxTargets <= 0 {
+		return
+	}
+	for range time.Tick(targetSeriesRerankInterval) {
+		for _, targetID := range seriesLimiter.Rerank() {
+			deleteTargetSeries(targetID)
+		}
+	}
+}
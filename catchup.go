@@ -0,0 +1,92 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// catchUpMaxBatches is a guardrail against catching up forever if the homeserver keeps returning data.
+// After this many batches, the sync loop switches to long-polling regardless.
+const catchUpMaxBatches = 10000
+
+const catchUpLogInterval = 50
+
+// CatchUpProgress describes the catch-up phase of a target. The homeserver doesn't say how much data is left,
+// so the progress is reported as the amount of data processed so far.
+type CatchUpProgress struct {
+	StartedAt         int64 `json:"started_at"`
+	Batches           int   `json:"batches"`
+	Events            int   `json:"events"`
+	DeviceListChanges int   `json:"device_list_changes"`
+}
+
+func (target *SyncTarget) startCatchUp() {
+	target.statusLock.Lock()
+	target.catchUp = &CatchUpProgress{StartedAt: time.Now().UnixNano() / int64(time.Millisecond)}
+	target.statusLock.Unlock()
+}
+
+// recordCatchUpBatch adds the sync response to the catch-up progress, and returns whether
+// the target should keep catching up. Catching up ends when the homeserver returns an empty response.
+func (target *SyncTarget) recordCatchUpBatch(resp *mautrix.RespSync) bool {
+	target.statusLock.Lock()
+	defer target.statusLock.Unlock()
+	progress := target.catchUp
+	if progress == nil {
+		return false
+	}
+	events := len(resp.ToDevice.Events)
+	deviceListChanges := len(resp.DeviceLists.Changed) + len(resp.DeviceLists.Left)
+	progress.Batches++
+	progress.Events += events
+	progress.DeviceListChanges += deviceListChanges
+	if events == 0 && deviceListChanges == 0 {
+		target.log.Infofln("Caught up after %d batches with %d to-device events and %d device list changes in %s",
+			progress.Batches, progress.Events, progress.DeviceListChanges, progress.elapsed())
+		target.catchUp = nil
+		return false
+	} else if progress.Batches >= catchUpMaxBatches {
+		target.log.Warnfln("Still not caught up after %d batches, switching to long-polling", progress.Batches)
+		target.catchUp = nil
+		return false
+	} else if progress.Batches%catchUpLogInterval == 0 {
+		target.log.Infofln("Catching up: processed %d batches with %d to-device events so far", progress.Batches, progress.Events)
+	}
+	return true
+}
+
+func (target *SyncTarget) stopCatchUp() {
+	target.statusLock.Lock()
+	target.catchUp = nil
+	target.statusLock.Unlock()
+}
+
+func (progress *CatchUpProgress) elapsed() time.Duration {
+	return time.Since(time.Unix(0, progress.StartedAt*int64(time.Millisecond))).Round(time.Millisecond)
+}
+
+// copy returns a copy of the progress that is safe to use without holding the status lock.
+func (progress *CatchUpProgress) copy() *CatchUpProgress {
+	if progress == nil {
+		return nil
+	}
+	copied := *progress
+	return &copied
+}
@@ -0,0 +1,105 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// checkpointedHistoryRetention is how long history entries from before a target's checkpoint are kept.
+// Entries after the checkpoint (or of targets that don't send checkpoints) use the transaction history retention.
+const checkpointedHistoryRetention = 24 * time.Hour
+
+// Checkpoint is the last transaction that the target has confirmed it has processed.
+type Checkpoint struct {
+	TxnID     string `json:"txn_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type reqCheckpoint struct {
+	TxnID string `json:"txn_id"`
+}
+
+// SetCheckpoint stores the checkpoint and removes pending transactions that the target has already processed.
+func (target *SyncTarget) SetCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	target.statusLock.RLock()
+	prev := target.checkpoint
+	target.statusLock.RUnlock()
+	if prev != nil && prev.CreatedAt > checkpoint.CreatedAt {
+		// Checkpoints can't go backwards, the target may have sent them out of order.
+		return nil
+	}
+	count, err := store.SetTargetCheckpoint(ctx, target.storageID(), target.DeviceKey, checkpoint)
+	if err != nil {
+		return err
+	}
+	target.statusLock.Lock()
+	target.checkpoint = checkpoint
+	target.statusLock.Unlock()
+	if count > 0 {
+		target.log.Debugfln("Removed %d already processed transactions from pending queue after checkpoint %s", count, checkpoint.TxnID)
+	}
+	return nil
+}
+
+func pruneCheckpointedHistory() {
+	cutoff := time.Now().Add(-checkpointedHistoryRetention).UnixNano() / int64(time.Millisecond)
+	count, err := store.PruneCheckpointedHistory(context.Background(), cutoff)
+	if err != nil {
+		log.Warnln("Failed to prune checkpointed transaction history:", err)
+	} else if count > 0 {
+		log.Debugfln("Pruned %d checkpointed entries from transaction history", count)
+	}
+}
+
+func putCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	}
+	var req reqCheckpoint
+	if !getJSON(w, r, &req) {
+		return
+	}
+	entry, err := GetTransactionHistoryEntry(r.Context(), target.storageID(), req.TxnID)
+	if err != nil {
+		target.log.Warnfln("Failed to get checkpoint transaction %s from history: %v", req.TxnID, err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	} else if entry == nil || entry.DeviceKey != target.DeviceKey {
+		errTransactionNotFound.Write(w)
+		return
+	}
+	checkpoint := &Checkpoint{TxnID: entry.TxnID, CreatedAt: entry.CreatedAt}
+	if err = target.SetCheckpoint(r.Context(), checkpoint); err != nil {
+		target.log.Warnfln("Failed to store checkpoint %s: %v", req.TxnID, err)
+		errUpsertFailed.Write(w)
+		return
+	}
+	target.log.Debugfln("Target reported checkpoint %s", checkpoint.TxnID)
+	writeJSON(w, http.StatusOK, checkpoint)
+}
@@ -0,0 +1,75 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// splitTransaction splits a transaction into multiple transactions with at most maxEvents events and roughly
+// maxBytes bytes of events each. Zero means no limit. Room events are sent before ephemeral events like in a
+// single transaction, and the device lists, one-time key counts and fallback key types are only included in
+// the last transaction, so targets see them after all the events that came before them in the sync response.
+func splitTransaction(txn *Transaction, maxEvents, maxBytes int) []*Transaction {
+	totalEvents := len(txn.Events) + len(txn.EphemeralEvents)
+	if (maxEvents <= 0 || totalEvents <= maxEvents) && maxBytes <= 0 {
+		return []*Transaction{txn}
+	}
+	chunks := []*Transaction{{}}
+	var count, size int
+	add := func(evt *event.Event, ephemeral bool) {
+		var evtSize int
+		if maxBytes > 0 {
+			data, _ := json.Marshal(evt)
+			evtSize = len(data) + 1
+		}
+		if count > 0 && ((maxEvents > 0 && count >= maxEvents) || (maxBytes > 0 && size+evtSize > maxBytes)) {
+			chunks = append(chunks, &Transaction{})
+			count, size = 0, 0
+		}
+		chunk := chunks[len(chunks)-1]
+		if ephemeral {
+			chunk.EphemeralEvents = append(chunk.EphemeralEvents, evt)
+		} else {
+			chunk.Events = append(chunk.Events, evt)
+		}
+		count++
+		size += evtSize
+	}
+	for _, evt := range txn.Events {
+		add(evt, false)
+	}
+	for _, evt := range txn.EphemeralEvents {
+		add(evt, true)
+	}
+	if len(chunks) == 1 {
+		return []*Transaction{txn}
+	}
+	for _, chunk := range chunks {
+		chunk.MSC2409EphemeralEvents = chunk.EphemeralEvents
+	}
+	last := chunks[len(chunks)-1]
+	last.DeviceLists = txn.DeviceLists
+	last.MSC3202DeviceLists = txn.MSC3202DeviceLists
+	last.DeviceOTKCount = txn.DeviceOTKCount
+	last.MSC3202DeviceOTKCount = txn.MSC3202DeviceOTKCount
+	last.DeviceUnusedFallbackKeyTypes = txn.DeviceUnusedFallbackKeyTypes
+	last.MSC3202DeviceUnusedFallbackKeyTypes = txn.MSC3202DeviceUnusedFallbackKeyTypes
+	return chunks
+}
@@ -0,0 +1,64 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// errCircuitOpen stops the sync loop of a target whose transactions have been failing for too long.
+var errCircuitOpen = errors.New("circuit breaker opened after persistent delivery failures")
+
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failed delivery attempts after which syncing is stopped.
+	Failures int `yaml:"failures"`
+	// Window is how long the delivery must have been failing in addition to the number of failures.
+	// If only one of Failures and Window is set, it's enough alone, and if neither is set, the breaker is disabled.
+	Window time.Duration `yaml:"window"`
+	// Cooldown is how long to wait before syncing is resumed automatically. Zero leaves the target stopped until it's PUT again.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// shouldOpenCircuit checks whether delivery has failed enough times over a long enough time to give up.
+func shouldOpenCircuit(failures int, failingSince time.Time) bool {
+	return (cfg.CircuitBreaker.Failures > 0 || cfg.CircuitBreaker.Window > 0) &&
+		failures >= cfg.CircuitBreaker.Failures && time.Since(failingSince) >= cfg.CircuitBreaker.Window
+}
+
+// openCircuit is called after the sync loop was stopped by the circuit breaker. If a cooldown is configured,
+// the target is suspended so that syncing is resumed automatically afterwards, also across restarts.
+func (target *SyncTarget) openCircuit(syncLog maulogger.Logger) {
+	circuitBreakerTrips.Inc()
+	if cfg.CircuitBreaker.Cooldown <= 0 {
+		syncLog.Warnln("Circuit breaker opened, syncing won't be resumed until the target is PUT again")
+		return
+	}
+	until := time.Now().Add(cfg.CircuitBreaker.Cooldown).UnixNano() / int64(time.Millisecond)
+	if err := target.setSuspendedUntil(until); err != nil {
+		syncLog.Warnln("Failed to store circuit breaker cooldown in database:", err)
+	}
+	target.scheduleResume()
+	syncLog.Warnfln("Circuit breaker opened, retrying in %v", cfg.CircuitBreaker.Cooldown)
+}
+
+func circuitOpenError(attempts int, failingSince time.Time, lastErr error) error {
+	return fmt.Errorf("%w: %d attempts over %v, last error: %v", errCircuitOpen, attempts, time.Since(failingSince).Round(time.Second), lastErr)
+}
@@ -0,0 +1,208 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// TrustedProxyList is a list of IP ranges. In YAML, it's a list of IP addresses and CIDR ranges.
+// Despite the name, it's also used for other lists of IP ranges.
+type TrustedProxyList []*net.IPNet
+
+func (tpl *TrustedProxyList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ranges []string
+	if err := unmarshal(&ranges); err != nil {
+		return err
+	}
+	nets, err := parseTrustedProxies(strings.Join(ranges, ","))
+	if err != nil {
+		return err
+	}
+	*tpl = nets
+	return nil
+}
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(val string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		if !strings.ContainsRune(part, '/') {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// TrustedProxyHeader is the header that trusted proxies put the client address in.
+type TrustedProxyHeader string
+
+const (
+	TrustedProxyHeaderXForwardedFor TrustedProxyHeader = "x-forwarded-for"
+	TrustedProxyHeaderForwarded     TrustedProxyHeader = "forwarded"
+)
+
+func parseTrustedProxyHeader(val string) (TrustedProxyHeader, error) {
+	switch header := TrustedProxyHeader(strings.ToLower(val)); header {
+	case "", TrustedProxyHeaderXForwardedFor:
+		return TrustedProxyHeaderXForwardedFor, nil
+	case TrustedProxyHeaderForwarded:
+		return header, nil
+	default:
+		return "", fmt.Errorf("unknown trusted proxy header %q (expected x-forwarded-for or forwarded)", val)
+	}
+}
+
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	return ipInRanges(ip, cfg.TrustedProxies)
+}
+
+// checkManagementAllowed checks that the client IP of a management API request is in MANAGEMENT_ALLOWED_CIDRS.
+// Requests over a Unix socket don't have an IP address and are always allowed, as the socket mode restricts them.
+func checkManagementAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if len(cfg.ManagementAllowedCIDRs) == 0 || parseHostIP(r.RemoteAddr) == nil {
+		return true
+	}
+	ip := clientIP(r)
+	if ipInRanges(net.ParseIP(ip), cfg.ManagementAllowedCIDRs) {
+		return true
+	}
+	log.Warnfln("Rejected request to %s from %s, which isn't in the allowed management networks", r.URL.Path, ip)
+	w.Header().Add("Content-Type", "application/json")
+	errAddressNotAllowed.Write(w)
+	return false
+}
+
+// parseHostIP parses an IP address that may have a port and IPv6 brackets around it.
+func parseHostIP(addr string) net.IP {
+	addr = strings.Trim(strings.TrimSpace(addr), `"`)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// forwardedChain returns the client addresses in the configured forwarding header, in the order the proxies
+// appended them. Only one header is ever read: proxies usually pass through the header they don't write to
+// unchanged, so the client could put any address in it.
+func forwardedChain(r *http.Request) []string {
+	var chain []string
+	if cfg.TrustedProxyHeader == TrustedProxyHeaderForwarded {
+		for _, header := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(header, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+						chain = append(chain, pair[4:])
+					}
+				}
+			}
+		}
+		return chain
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		chain = append(chain, strings.Split(header, ",")...)
+	}
+	return chain
+}
+
+// clientIP returns the address of the client that made the request. If the direct peer is a trusted proxy,
+// the forwarding headers are walked from the right, and the first address that isn't a trusted proxy is used.
+// Forwarding headers from untrusted peers are ignored, as anyone could set them.
+func clientIP(r *http.Request) string {
+	remoteIP := parseHostIP(r.RemoteAddr)
+	if remoteIP == nil {
+		return r.RemoteAddr
+	} else if !isTrustedProxy(remoteIP) {
+		return remoteIP.String()
+	}
+	chain := forwardedChain(r)
+	ip := remoteIP
+	for i := len(chain) - 1; i >= 0; i-- {
+		hopIP := parseHostIP(chain[i])
+		if hopIP == nil {
+			// Obfuscated or unknown identifiers can't be checked, so stop at the last known address.
+			break
+		}
+		ip = hopIP
+		if !isTrustedProxy(hopIP) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+var accessLog = log.Sub("HTTP")
+
+// accessLogMiddleware logs every request along with the real client IP.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		id := requestID(r)
+		accessLog.Subm("", logFields{"request_id": id}).
+			Debugfln("%s %s %s -> %d in %s (request ID: %s)", clientIP(r), r.Method, r.URL.Path, recorder.status, time.Since(start), id)
+	})
+}
@@ -0,0 +1,106 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withClientIPConfig sets the trusted proxy config for the duration of the test.
+func withClientIPConfig(t *testing.T, trustedProxies, allowedCIDRs string, header TrustedProxyHeader) {
+	t.Helper()
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+	var err error
+	if cfg.TrustedProxies, err = parseTrustedProxies(trustedProxies); err != nil {
+		t.Fatal(err)
+	} else if cfg.ManagementAllowedCIDRs, err = parseTrustedProxies(allowedCIDRs); err != nil {
+		t.Fatal(err)
+	} else if cfg.TrustedProxyHeader, err = parseTrustedProxyHeader(string(header)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newClientIPRequest(remoteAddr string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/fi.mau.syncproxy/targets", nil)
+	r.RemoteAddr = remoteAddr
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+var clientIPTests = []struct {
+	name       string
+	header     TrustedProxyHeader
+	remoteAddr string
+	headers    map[string]string
+	expected   string
+}{
+	{"Direct", "", "192.0.2.1:1234", nil, "192.0.2.1"},
+	{"UntrustedPeerWithXFF", "", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.5"}, "192.0.2.1"},
+	{"TrustedProxyXFF", "", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "192.0.2.1"},
+	{"TrustedProxyChain", "", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.5, 192.0.2.1, 10.0.0.2"}, "192.0.2.1"},
+	{"SpoofedForwardedWithXFF", "", "10.0.0.1:1234", map[string]string{"Forwarded": "for=10.0.0.5", "X-Forwarded-For": "192.0.2.1"}, "192.0.2.1"},
+	{"SpoofedForwardedOnly", "", "10.0.0.1:1234", map[string]string{"Forwarded": "for=10.0.0.5"}, "10.0.0.1"},
+	{"TrustedProxyForwarded", TrustedProxyHeaderForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711";proto=https`}, "2001:db8::1"},
+	{"SpoofedXFFWithForwarded", TrustedProxyHeaderForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": "for=192.0.2.1", "X-Forwarded-For": "10.0.0.5"}, "192.0.2.1"},
+	{"UnknownForwardedIdentifier", TrustedProxyHeaderForwarded, "10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range clientIPTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			withClientIPConfig(t, "10.0.0.0/8", "", tc.header)
+			if ip := clientIP(newClientIPRequest(tc.remoteAddr, tc.headers)); ip != tc.expected {
+				t.Errorf("Expected client IP %s, got %s", tc.expected, ip)
+			}
+		})
+	}
+}
+
+func TestCheckManagementAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		allowed    bool
+	}{
+		{"AllowedDirect", "10.0.0.5:1234", nil, true},
+		{"RejectedDirect", "192.0.2.1:1234", nil, false},
+		{"AllowedThroughProxy", "10.1.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.5"}, true},
+		{"RejectedThroughProxy", "10.1.0.1:1234", map[string]string{"X-Forwarded-For": "192.0.2.1"}, false},
+		{"SpoofedForwarded", "10.1.0.1:1234", map[string]string{"Forwarded": "for=10.0.0.5", "X-Forwarded-For": "192.0.2.1"}, false},
+		{"SpoofedXFFFromUntrustedPeer", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.5"}, false},
+		{"UnixSocket", "@", nil, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			withClientIPConfig(t, "10.1.0.0/16", "10.0.0.0/16", "")
+			w := httptest.NewRecorder()
+			if allowed := checkManagementAllowed(w, newClientIPRequest(tc.remoteAddr, tc.headers)); allowed != tc.allowed {
+				t.Errorf("Expected allowed=%t, got %t", tc.allowed, allowed)
+			} else if !allowed && w.Code != http.StatusForbidden {
+				t.Errorf("Expected HTTP 403 for rejected request, got %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "maunium.net/go/maulogger/v2"
+
+	syncproxy "go.mau.fi/mautrix-syncproxy"
+)
+
+var configPath = flag.String("config", "env", "Path to a YAML config file, or \"env\" to only use environment variables. Environment variables override values from the file.")
+var printVersion = flag.Bool("version", false, "Print the version and exit.")
+
+func main() {
+	log.DefaultLogger.TimeFormat = "Jan _2, 2006 15:04:05"
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(syncproxy.VersionString())
+		return
+	}
+	config, err := syncproxy.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln("Failed to read config:", err)
+		os.Exit(2)
+	} else if flag.Arg(0) == "healthcheck" {
+		healthcheck(config)
+		return
+	} else if flag.Arg(0) == "import-registration" {
+		importRegistrations(config, flag.Args()[1:])
+		return
+	} else if len(config.ListenAddress) == 0 {
+		log.Fatalln("Listen address is not set (LISTEN_ADDRESS or listen_address)")
+		os.Exit(2)
+	}
+	proxy, err := syncproxy.New(config)
+	if err != nil {
+		log.Fatalln("Invalid config:", err)
+		os.Exit(2)
+	}
+	proxy.ConfigLoader = func() (syncproxy.Config, error) {
+		return syncproxy.LoadConfig(*configPath)
+	}
+	if err = proxy.Start(); err != nil {
+		log.Fatalln("Failed to start:", err)
+		os.Exit(3)
+	}
+
+	waitForShutdown(proxy)
+	proxy.Stop()
+}
+
+// waitForShutdown waits for SIGINT, SIGTERM or a restart and reloads the config on SIGHUP.
+func waitForShutdown(proxy *syncproxy.Proxy) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-c:
+			if sig != syscall.SIGHUP {
+				return
+			}
+			changes, err := proxy.Reload()
+			if err != nil {
+				log.Errorln("Failed to reload config:", err)
+			} else if len(changes) == 0 {
+				log.Infoln("Reloaded config, nothing changed")
+			}
+			for _, change := range changes {
+				log.Infoln("Config reloaded:", change)
+			}
+		case <-proxy.Restarted():
+			return
+		case err := <-proxy.ListenErrors():
+			log.Fatalln(err)
+			os.Exit(6)
+		}
+	}
+}
+
+// healthcheck checks the /health endpoint of the proxy running with the same config and exits with status 1 if it fails.
+func healthcheck(config syncproxy.Config) {
+	if err := syncproxy.HealthCheck(config); err != nil {
+		fmt.Fprintln(os.Stderr, "Health check failed:", err)
+		os.Exit(1)
+	}
+}
+
+// importRegistrations uploads appservice registration files to the proxy running with the same config
+// and exits with status 1 if any of them fail.
+func importRegistrations(config syncproxy.Config, paths []string) {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: mautrix-syncproxy import-registration <registration.yaml>...")
+		os.Exit(2)
+	}
+	uploaded, errs := syncproxy.UploadRegistrationFiles(config, paths)
+	for _, appserviceID := range uploaded {
+		fmt.Println("Imported", appserviceID)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "Failed to import", err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,480 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the proxy. Use DefaultConfig or LoadConfig to get one with the default values filled in.
+type Config struct {
+	// ListenAddress is a comma-separated list of addresses, all of which serve the same endpoints.
+	ListenAddress string `yaml:"listen_address"`
+	// ListenSocketMode is the octal permission mode of the socket when listening on a Unix socket.
+	ListenSocketMode  string    `yaml:"listen_socket_mode"`
+	TLS               TLSConfig `yaml:"tls"`
+	BasePath          string    `yaml:"base_path"`
+	DatabaseURL       string    `yaml:"database_url"`
+	HomeserverURL     string    `yaml:"homeserver_url"`
+	SharedSecret      string    `yaml:"shared_secret"`
+	ExpectSynchronous bool      `yaml:"expect_synchronous"`
+	DryRunCaptureDir  string    `yaml:"dry_run_capture_dir"`
+	PendingExportDir  string    `yaml:"pending_export_dir"`
+	Debug             bool      `yaml:"debug"`
+	LogFormat         LogFormat `yaml:"log_format"`
+	// LogFile configures writing logs to a rotated file in addition to stdout.
+	LogFile LogFileConfig `yaml:"log_file"`
+	// InstanceID identifies this proxy in transactions, e.g. when multiple instances deliver to the same bridge.
+	InstanceID string `yaml:"instance_id"`
+	// AllowNewerSchema allows starting even if the database schema is newer than this build supports.
+	AllowNewerSchema bool `yaml:"allow_newer_schema"`
+	// StoreAndForward makes every transaction go through the pending queue in the database before it's delivered.
+	StoreAndForward bool `yaml:"store_and_forward"`
+	// TokenEncryptionKey is a base64-encoded AES-256 key for encrypting the tokens of targets in the database.
+	TokenEncryptionKey string `yaml:"token_encryption_key"`
+	// SentryDSN enables reporting sync panics, persistent delivery failures and database errors to Sentry.
+	SentryDSN string `yaml:"sentry_dsn"`
+	// EnablePprof serves the Go profiler endpoints under /debug/pprof/ to requests with the shared secret.
+	EnablePprof bool `yaml:"enable_pprof"`
+	// EnableDashboard serves the admin web dashboard under /admin.
+	EnableDashboard bool `yaml:"enable_dashboard"`
+	// ShutdownTimeout is how long to wait for sync loops to stop when shutting down.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// TransactionHistoryRetention is how long the metadata of sent transactions is kept.
+	TransactionHistoryRetention time.Duration `yaml:"transaction_history_retention"`
+
+	ToDeviceDedupWindow    time.Duration      `yaml:"to_device_dedup_window"`
+	StartupProbeTimeout    time.Duration      `yaml:"startup_probe_timeout"`
+	KeyRequestRateLimit    int                `yaml:"key_request_rate_limit"`
+	DeadLetterAttempts     int                `yaml:"dead_letter_attempts"`
+	TargetCacheSize        int                `yaml:"target_cache_size"`
+	MaxTargetBufferedBytes int64              `yaml:"max_target_buffered_bytes"`
+	MaxTransactionEvents   int                `yaml:"max_transaction_events"`
+	MaxTransactionBytes    int                `yaml:"max_transaction_bytes"`
+	MetricLabels           []string           `yaml:"metric_labels"`
+	TrustedProxies         TrustedProxyList   `yaml:"trusted_proxies"`
+	TrustedProxyHeader     TrustedProxyHeader `yaml:"trusted_proxy_header"`
+	ManagementAllowedCIDRs TrustedProxyList   `yaml:"management_allowed_cidrs"`
+	// HSTokenAuth lets bridges manage their own targets with the hs_token of the target instead of the shared secret.
+	HSTokenAuth bool `yaml:"hs_token_auth"`
+	// RegistrationFiles are paths or glob patterns of appservice registration files to import targets from on startup.
+	RegistrationFiles []string `yaml:"registration_files"`
+
+	SLO             SLOConfig             `yaml:"slo"`
+	CatchUp         CatchUpConfig         `yaml:"catch_up"`
+	SyncStartPacing SyncStartPacingConfig `yaml:"sync_start_pacing"`
+	RecentErrors    RecentErrorsConfig    `yaml:"recent_errors"`
+	Watchdog        WatchdogConfig        `yaml:"watchdog"`
+	Metrics         MetricsConfig         `yaml:"metrics"`
+	// StaleRegistrations configures the sweep for targets that were registered but have never synced.
+	StaleRegistrations StaleRegistrationConfig `yaml:"stale_registrations"`
+	// Webhook configures notifications about target lifecycle events.
+	Webhook WebhookConfig `yaml:"webhook"`
+	// CircuitBreaker stops syncing for targets whose transactions keep failing.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// Leases configures coordination between instances that share a database.
+	Leases LeaseConfig `yaml:"leases"`
+	// Proxies configures the outbound proxies for homeserver and target connections.
+	Proxies ProxyConfig `yaml:"proxies"`
+	// DeliveryClient configures the HTTP clients used to send transactions to targets.
+	DeliveryClient DeliveryClientConfig `yaml:"delivery_client"`
+	// ConsistencyCheck configures the periodic comparison of in-memory target state with the database.
+	ConsistencyCheck ConsistencyCheckConfig `yaml:"consistency_check"`
+	// Reachability configures the periodic pings of active targets.
+	Reachability ReachabilityConfig `yaml:"reachability"`
+	// HomeserverQuirks overrides the detected flavor and workarounds of all homeservers.
+	HomeserverQuirks HomeserverQuirksConfig `yaml:"homeserver_quirks"`
+
+	DatabaseOpts DatabaseOpts `yaml:"database_opts"`
+
+	Templates map[string]*TargetTemplate `yaml:"templates"`
+	Profiles  []*Profile                 `yaml:"profiles"`
+}
+
+type SLOConfig struct {
+	LatencyThreshold time.Duration `yaml:"latency_threshold"`
+	Objective        float64       `yaml:"objective"`
+}
+
+type SyncStartPacingConfig struct {
+	// Rate is the number of sync loop starts per second per homeserver. Zero disables pacing.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Jitter is the maximum random delay before starting each target that was active before a restart.
+	Jitter time.Duration `yaml:"jitter"`
+}
+
+type CatchUpConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MinInterval time.Duration `yaml:"min_interval"`
+}
+
+type WatchdogConfig struct {
+	// StallTimeout is how long a sync loop can go without activity before it's considered stuck. Zero disables the watchdog.
+	StallTimeout time.Duration `yaml:"stall_timeout"`
+	ExitOnStall  bool          `yaml:"exit_on_stall"`
+	// LiveDatabaseTimeout is how long the database can be unreachable before the /live endpoint fails. Zero disables the check.
+	LiveDatabaseTimeout time.Duration `yaml:"live_database_timeout"`
+}
+
+type RecentErrorsConfig struct {
+	Limit   int  `yaml:"limit"`
+	Persist bool `yaml:"persist"`
+}
+
+// configEnv reads config overrides from environment variables.
+// The get* methods return the value of the environment variable, or defVal if it's unset or empty.
+// The defaults are the values from the config file, so that environment variables act as overrides.
+type configEnv struct {
+	// err is the first invalid value that was encountered.
+	err error
+}
+
+func (env *configEnv) fail(key string, err error) {
+	if env.err == nil {
+		env.err = fmt.Errorf("invalid %s: %w", key, err)
+	}
+}
+
+// getString also reads the value from the file in <key>_FILE, so that secrets can be mounted
+// as files (e.g. Docker or Kubernetes secrets) instead of being in the process environment.
+func (env *configEnv) getString(key, defVal string) string {
+	val := os.Getenv(key)
+	if path := os.Getenv(key + "_FILE"); len(path) > 0 {
+		if len(val) > 0 {
+			env.fail(key, fmt.Errorf("both %s and %s_FILE are set", key, key))
+			return defVal
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			env.fail(key+"_FILE", err)
+			return defVal
+		}
+		val = strings.TrimRight(string(data), "\r\n")
+	}
+	if len(val) > 0 {
+		return val
+	}
+	return defVal
+}
+
+func (env *configEnv) getInt(key string, defVal int) int {
+	strVal, ok := os.LookupEnv(key)
+	if !ok {
+		return defVal
+	}
+	val, err := strconv.Atoi(strVal)
+	if err != nil {
+		return defVal
+	}
+	return val
+}
+
+// getBool treats values that aren't valid booleans (e.g. "yes") as true,
+// since any non-empty value used to enable boolean options.
+func (env *configEnv) getBool(key string, defVal bool) bool {
+	strVal := os.Getenv(key)
+	if len(strVal) == 0 {
+		return defVal
+	}
+	val, err := strconv.ParseBool(strVal)
+	if err != nil {
+		return true
+	}
+	return val
+}
+
+func (env *configEnv) getDuration(key string, defVal time.Duration) time.Duration {
+	strVal := os.Getenv(key)
+	if len(strVal) == 0 {
+		return defVal
+	}
+	val, err := time.ParseDuration(strVal)
+	if err != nil {
+		env.fail(key, err)
+		return defVal
+	}
+	return val
+}
+
+func (env *configEnv) getFloat(key string, defVal float64) float64 {
+	strVal := os.Getenv(key)
+	if len(strVal) == 0 {
+		return defVal
+	}
+	val, err := strconv.ParseFloat(strVal, 64)
+	if err != nil {
+		env.fail(key, err)
+		return defVal
+	}
+	return val
+}
+
+// normalizeBasePath makes sure the base path starts with a slash and doesn't end with one.
+func normalizeBasePath(basePath string) string {
+	basePath = strings.TrimRight(basePath, "/")
+	if len(basePath) > 0 && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return basePath
+}
+
+// DefaultConfig returns a config where the options whose default value isn't the zero value are set.
+// The required options (database URL, homeserver URL and shared secret) still need to be filled in.
+func DefaultConfig() Config {
+	var config Config
+	config.DatabaseOpts.MaxOpenConns = 4
+	config.DatabaseOpts.MaxIdleConns = 2
+	config.DatabaseOpts.SlowQueryThreshold = 1 * time.Second
+	config.DatabaseOpts.StartupTimeout = 1 * time.Minute
+	config.DatabaseOpts.QueryTimeout = 30 * time.Second
+	config.RecentErrors.Limit = 50
+	config.LogFile.MaxSize = 100
+	config.LogFile.MaxBackups = 10
+	config.ListenSocketMode = "0660"
+	config.SyncStartPacing.Burst = 1
+	config.Leases.Duration = defaultLeaseDuration
+	config.CatchUp.MinInterval = 250 * time.Millisecond
+	config.SLO.LatencyThreshold = 5 * time.Second
+	config.SLO.Objective = 0.99
+	config.ShutdownTimeout = defaultShutdownTimeout
+	config.TransactionHistoryRetention = defaultTransactionHistoryRetention
+	config.Watchdog.StallTimeout = 10 * time.Minute
+	config.Watchdog.LiveDatabaseTimeout = 5 * time.Minute
+	config.Metrics.TargetLabel = TargetLabelID
+	config.DeliveryClient.DialTimeout = 30 * time.Second
+	config.DeliveryClient.KeepAlive = 30 * time.Second
+	config.DeliveryClient.TLSHandshakeTimeout = 10 * time.Second
+	config.DeliveryClient.IdleConnTimeout = 90 * time.Second
+	config.DeliveryClient.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	return config
+}
+
+// loadConfigFile reads the config file on top of the given config. Unknown keys are rejected to catch typos.
+func loadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, config)
+}
+
+// LoadConfig reads the YAML config file at path on top of the defaults, and then applies the overrides
+// from environment variables. If path is empty or "env", only environment variables are used.
+// The returned config isn't validated yet, that's done by New.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if len(path) > 0 && path != "env" {
+		if err := loadConfigFile(path, &config); err != nil {
+			return config, fmt.Errorf("failed to load config file: %w", err)
+		}
+	}
+
+	var env configEnv
+	config.ListenAddress = env.getString("LISTEN_ADDRESS", config.ListenAddress)
+	config.ListenSocketMode = env.getString("LISTEN_SOCKET_MODE", config.ListenSocketMode)
+	config.TLS.Cert = env.getString("TLS_CERT", config.TLS.Cert)
+	config.TLS.Key = env.getString("TLS_KEY", config.TLS.Key)
+	config.BasePath = env.getString("BASE_PATH", config.BasePath)
+	config.DatabaseURL = env.getString("DATABASE_URL", config.DatabaseURL)
+	config.DatabaseOpts.MaxOpenConns = env.getInt("DATABASE_MAX_OPEN_CONNS", config.DatabaseOpts.MaxOpenConns)
+	config.DatabaseOpts.MaxIdleConns = env.getInt("DATABASE_MAX_IDLE_CONNS", config.DatabaseOpts.MaxIdleConns)
+	config.DatabaseOpts.SlowQueryThreshold = env.getDuration("DATABASE_SLOW_QUERY_THRESHOLD", config.DatabaseOpts.SlowQueryThreshold)
+	config.DatabaseOpts.StartupTimeout = env.getDuration("DATABASE_STARTUP_TIMEOUT", config.DatabaseOpts.StartupTimeout)
+	config.DatabaseOpts.QueryTimeout = env.getDuration("DATABASE_QUERY_TIMEOUT", config.DatabaseOpts.QueryTimeout)
+	config.HomeserverURL = env.getString("HOMESERVER_URL", config.HomeserverURL)
+	config.SharedSecret = env.getString("SHARED_SECRET", config.SharedSecret)
+	config.ExpectSynchronous = env.getBool("EXPECT_SYNCHRONOUS", config.ExpectSynchronous)
+	config.DryRunCaptureDir = env.getString("DRY_RUN_CAPTURE_DIR", config.DryRunCaptureDir)
+	config.PendingExportDir = env.getString("PENDING_EXPORT_DIR", config.PendingExportDir)
+	config.StoreAndForward = env.getBool("STORE_AND_FORWARD", config.StoreAndForward)
+	config.TokenEncryptionKey = env.getString("TOKEN_ENCRYPTION_KEY", config.TokenEncryptionKey)
+	config.SentryDSN = env.getString("SENTRY_DSN", config.SentryDSN)
+	config.Webhook.URL = env.getString("WEBHOOK_URL", config.Webhook.URL)
+	config.Webhook.Secret = env.getString("WEBHOOK_SECRET", config.Webhook.Secret)
+	config.Webhook.FailingAfter = env.getDuration("WEBHOOK_FAILING_AFTER", config.Webhook.FailingAfter)
+	config.AllowNewerSchema = env.getBool("ALLOW_NEWER_DB_SCHEMA", config.AllowNewerSchema)
+	config.InstanceID = env.getString("INSTANCE_ID", config.InstanceID)
+	config.Debug = env.getBool("DEBUG", config.Debug)
+	config.EnablePprof = env.getBool("ENABLE_PPROF", config.EnablePprof)
+	config.EnableDashboard = env.getBool("ENABLE_DASHBOARD", config.EnableDashboard)
+	config.HSTokenAuth = env.getBool("HS_TOKEN_AUTH", config.HSTokenAuth)
+	config.LogFormat = LogFormat(env.getString("LOG_FORMAT", string(config.LogFormat)))
+	config.LogFile.Path = env.getString("LOG_FILE_PATH", config.LogFile.Path)
+	config.LogFile.MaxSize = env.getInt("LOG_FILE_MAX_SIZE", config.LogFile.MaxSize)
+	config.LogFile.RotateInterval = env.getDuration("LOG_FILE_ROTATE_INTERVAL", config.LogFile.RotateInterval)
+	config.LogFile.MaxBackups = env.getInt("LOG_FILE_MAX_BACKUPS", config.LogFile.MaxBackups)
+	config.LogFile.MaxAge = env.getDuration("LOG_FILE_MAX_AGE", config.LogFile.MaxAge)
+	config.ToDeviceDedupWindow = env.getDuration("TO_DEVICE_DEDUP_WINDOW", config.ToDeviceDedupWindow)
+	config.StartupProbeTimeout = env.getDuration("STARTUP_PROBE_TIMEOUT", config.StartupProbeTimeout)
+	config.ShutdownTimeout = env.getDuration("SHUTDOWN_TIMEOUT", config.ShutdownTimeout)
+	config.TransactionHistoryRetention = env.getDuration("TRANSACTION_HISTORY_RETENTION", config.TransactionHistoryRetention)
+	config.KeyRequestRateLimit = env.getInt("KEY_REQUEST_RATE_LIMIT", config.KeyRequestRateLimit)
+	config.DeadLetterAttempts = env.getInt("DEAD_LETTER_ATTEMPTS", config.DeadLetterAttempts)
+	config.TargetCacheSize = env.getInt("TARGET_CACHE_SIZE", config.TargetCacheSize)
+	config.MaxTargetBufferedBytes = int64(env.getInt("MAX_TARGET_BUFFERED_BYTES", int(config.MaxTargetBufferedBytes)))
+	config.MaxTransactionEvents = env.getInt("MAX_TRANSACTION_EVENTS", config.MaxTransactionEvents)
+	config.MaxTransactionBytes = env.getInt("MAX_TRANSACTION_BYTES", config.MaxTransactionBytes)
+	if metricLabels := os.Getenv("METRIC_LABELS"); len(metricLabels) > 0 {
+		config.MetricLabels = strings.Split(metricLabels, ",")
+	}
+	if registrationFiles := os.Getenv("REGISTRATION_FILES"); len(registrationFiles) > 0 {
+		config.RegistrationFiles = strings.Split(registrationFiles, ",")
+	}
+	if trustedProxies := os.Getenv("TRUSTED_PROXIES"); len(trustedProxies) > 0 {
+		var err error
+		if config.TrustedProxies, err = parseTrustedProxies(trustedProxies); err != nil {
+			env.fail("TRUSTED_PROXIES", err)
+		}
+	}
+	config.TrustedProxyHeader = TrustedProxyHeader(env.getString("TRUSTED_PROXY_HEADER", string(config.TrustedProxyHeader)))
+	if allowedCIDRs := os.Getenv("MANAGEMENT_ALLOWED_CIDRS"); len(allowedCIDRs) > 0 {
+		var err error
+		if config.ManagementAllowedCIDRs, err = parseTrustedProxies(allowedCIDRs); err != nil {
+			env.fail("MANAGEMENT_ALLOWED_CIDRS", err)
+		}
+	}
+	config.RecentErrors.Limit = env.getInt("RECENT_ERRORS_LIMIT", config.RecentErrors.Limit)
+	config.RecentErrors.Persist = env.getBool("PERSIST_RECENT_ERRORS", config.RecentErrors.Persist)
+	config.SyncStartPacing.Rate = env.getFloat("SYNC_START_RATE", config.SyncStartPacing.Rate)
+	config.SyncStartPacing.Burst = env.getInt("SYNC_START_BURST", config.SyncStartPacing.Burst)
+	config.SyncStartPacing.Jitter = env.getDuration("SYNC_START_JITTER", config.SyncStartPacing.Jitter)
+	config.CatchUp.Enabled = env.getBool("CATCH_UP_SYNC", config.CatchUp.Enabled)
+	config.CatchUp.MinInterval = env.getDuration("CATCH_UP_MIN_INTERVAL", config.CatchUp.MinInterval)
+	config.SLO.LatencyThreshold = env.getDuration("SLO_LATENCY_THRESHOLD", config.SLO.LatencyThreshold)
+	config.SLO.Objective = env.getFloat("SLO_OBJECTIVE", config.SLO.Objective)
+	config.Watchdog.StallTimeout = env.getDuration("WATCHDOG_STALL_TIMEOUT", config.Watchdog.StallTimeout)
+	config.Watchdog.ExitOnStall = env.getBool("WATCHDOG_EXIT_ON_STALL", config.Watchdog.ExitOnStall)
+	config.Watchdog.LiveDatabaseTimeout = env.getDuration("WATCHDOG_LIVE_DB_TIMEOUT", config.Watchdog.LiveDatabaseTimeout)
+	config.Metrics.TargetLabel = TargetLabelMode(env.getString("METRICS_TARGET_LABEL", string(config.Metrics.TargetLabel)))
+	config.Metrics.MaxTargets = env.getInt("METRICS_MAX_TARGETS", config.Metrics.MaxTargets)
+	config.Metrics.ListenAddress = env.getString("METRICS_LISTEN_ADDRESS", config.Metrics.ListenAddress)
+	config.StaleRegistrations.MaxAge = env.getDuration("STALE_REGISTRATION_MAX_AGE", config.StaleRegistrations.MaxAge)
+	config.StaleRegistrations.Delete = env.getBool("DELETE_STALE_REGISTRATIONS", config.StaleRegistrations.Delete)
+	config.Leases.Enabled = env.getBool("TARGET_LEASES", config.Leases.Enabled)
+	config.Leases.Duration = env.getDuration("TARGET_LEASE_DURATION", config.Leases.Duration)
+	config.CircuitBreaker.Failures = env.getInt("CIRCUIT_BREAKER_FAILURES", config.CircuitBreaker.Failures)
+	config.CircuitBreaker.Window = env.getDuration("CIRCUIT_BREAKER_WINDOW", config.CircuitBreaker.Window)
+	config.CircuitBreaker.Cooldown = env.getDuration("CIRCUIT_BREAKER_COOLDOWN", config.CircuitBreaker.Cooldown)
+	config.Proxies.Homeserver = env.getString("HOMESERVER_PROXY", config.Proxies.Homeserver)
+	config.Proxies.Delivery = env.getString("DELIVERY_PROXY", config.Proxies.Delivery)
+	config.DeliveryClient.Timeout = env.getDuration("DELIVERY_TIMEOUT", config.DeliveryClient.Timeout)
+	config.DeliveryClient.DialTimeout = env.getDuration("DELIVERY_DIAL_TIMEOUT", config.DeliveryClient.DialTimeout)
+	config.DeliveryClient.TLSHandshakeTimeout = env.getDuration("DELIVERY_TLS_HANDSHAKE_TIMEOUT", config.DeliveryClient.TLSHandshakeTimeout)
+	config.DeliveryClient.ResponseHeaderTimeout = env.getDuration("DELIVERY_RESPONSE_HEADER_TIMEOUT", config.DeliveryClient.ResponseHeaderTimeout)
+	config.DeliveryClient.IdleConnTimeout = env.getDuration("DELIVERY_IDLE_CONN_TIMEOUT", config.DeliveryClient.IdleConnTimeout)
+	config.DeliveryClient.KeepAlive = env.getDuration("DELIVERY_KEEP_ALIVE", config.DeliveryClient.KeepAlive)
+	config.DeliveryClient.ClientCert = env.getString("DELIVERY_CLIENT_CERT", config.DeliveryClient.ClientCert)
+	config.DeliveryClient.ClientKey = env.getString("DELIVERY_CLIENT_KEY", config.DeliveryClient.ClientKey)
+	config.DeliveryClient.MaxIdleConnsPerHost = env.getInt("DELIVERY_MAX_IDLE_CONNS_PER_HOST", config.DeliveryClient.MaxIdleConnsPerHost)
+	config.ConsistencyCheck.Interval = env.getDuration("CONSISTENCY_CHECK_INTERVAL", config.ConsistencyCheck.Interval)
+	config.ConsistencyCheck.Heal = env.getBool("CONSISTENCY_CHECK_HEAL", config.ConsistencyCheck.Heal)
+	config.Reachability.Interval = env.getDuration("REACHABILITY_CHECK_INTERVAL", config.Reachability.Interval)
+	config.Reachability.PauseAfter = env.getDuration("REACHABILITY_PAUSE_AFTER", config.Reachability.PauseAfter)
+	config.HomeserverQuirks.Flavor = HomeserverFlavor(env.getString("HOMESERVER_FLAVOR", string(config.HomeserverQuirks.Flavor)))
+	if quirks, ok := os.LookupEnv("HOMESERVER_QUIRKS"); ok {
+		var err error
+		if config.HomeserverQuirks.Quirks, err = parseHomeserverQuirks(quirks); err != nil {
+			env.fail("HOMESERVER_QUIRKS", err)
+		}
+	}
+	if profileNames := os.Getenv("PROFILES"); len(profileNames) > 0 {
+		config.Profiles = readProfiles(&env, profileNames)
+	}
+	if templatesFile := os.Getenv("TEMPLATES_FILE"); len(templatesFile) > 0 {
+		var err error
+		if config.Templates, err = loadTemplates(templatesFile); err != nil {
+			env.fail("TEMPLATES_FILE", err)
+		}
+	}
+	return config, env.err
+}
+
+// applyConfig validates the global config, normalizes it in place and sets up the state derived from it.
+func applyConfig() error {
+	var err error
+	cfg.BasePath = normalizeBasePath(cfg.BasePath)
+	if len(cfg.InstanceID) == 0 {
+		cfg.InstanceID, _ = os.Hostname()
+	}
+	if cfg.SyncStartPacing.Burst < 1 {
+		cfg.SyncStartPacing.Burst = 1
+	}
+	if tokenCipher, err = parseTokenEncryptionKey(cfg.TokenEncryptionKey); err != nil {
+		return fmt.Errorf("invalid token encryption key: %w", err)
+	} else if sentry, err = parseSentryDSN(cfg.SentryDSN); err != nil {
+		return fmt.Errorf("invalid Sentry DSN: %w", err)
+	} else if webhook, err = newWebhookNotifier(cfg.Webhook); err != nil {
+		return fmt.Errorf("invalid webhook config: %w", err)
+	} else if cfg.LogFormat, err = parseLogFormat(string(cfg.LogFormat)); err != nil {
+		return fmt.Errorf("invalid log format: %w", err)
+	} else if cfg.TrustedProxyHeader, err = parseTrustedProxyHeader(string(cfg.TrustedProxyHeader)); err != nil {
+		return fmt.Errorf("invalid trusted proxy header: %w", err)
+	} else if cfg.LogFile.MaxSize < 0 || cfg.LogFile.RotateInterval < 0 || cfg.LogFile.MaxBackups < 0 || cfg.LogFile.MaxAge < 0 {
+		return fmt.Errorf("invalid log file rotation settings: must be non-negative")
+	} else if cfg.Metrics.TargetLabel, err = parseTargetLabelMode(string(cfg.Metrics.TargetLabel)); err != nil {
+		return fmt.Errorf("invalid metrics target label: %w", err)
+	} else if homeserverProxy, err = parseProxy(cfg.Proxies.Homeserver); err != nil {
+		return fmt.Errorf("invalid homeserver proxy: %w", err)
+	} else if deliveryProxy, err = parseProxy(cfg.Proxies.Delivery); err != nil {
+		return fmt.Errorf("invalid delivery proxy: %w", err)
+	} else if cfg.SyncStartPacing.Rate < 0 {
+		return fmt.Errorf("invalid sync start rate: must be a non-negative number")
+	} else if cfg.MaxTransactionEvents < 0 || cfg.MaxTransactionBytes < 0 {
+		return fmt.Errorf("invalid transaction size limit: must be a non-negative number")
+	} else if cfg.Reachability.Interval < 0 || cfg.Reachability.PauseAfter < 0 {
+		return fmt.Errorf("invalid reachability check settings: must be non-negative")
+	} else if cfg.SLO.Objective <= 0 || cfg.SLO.Objective >= 1 {
+		return fmt.Errorf("invalid SLO objective: must be a number between 0 and 1")
+	} else if cfg.Leases.Duration < 3*time.Second {
+		return fmt.Errorf("invalid target lease duration: must be at least 3 seconds")
+	} else if (len(cfg.DeliveryClient.ClientCert) > 0) != (len(cfg.DeliveryClient.ClientKey) > 0) {
+		return fmt.Errorf("both the delivery client certificate and key must be set to use a client certificate")
+	} else if cfg.DeliveryClient.MaxIdleConnsPerHost < 1 || cfg.DeliveryClient.MaxIdleConnsPerHost > maxDeliveryIdleConns {
+		return fmt.Errorf("invalid delivery client max idle connections per host: must be between 1 and %d", maxDeliveryIdleConns)
+	} else if err = validateHomeserverQuirks(cfg.HomeserverQuirks.Quirks); err != nil {
+		return fmt.Errorf("invalid homeserver quirks: %w", err)
+	} else if err = validateProfiles(cfg.Profiles); err != nil {
+		return fmt.Errorf("invalid profile configuration: %w", err)
+	} else if err = validateTemplates(cfg.Templates); err != nil {
+		return fmt.Errorf("invalid target templates: %w", err)
+	} else if _, err = parseSocketMode(cfg.ListenSocketMode); err != nil {
+		return fmt.Errorf("invalid listen socket mode: %w", err)
+	} else if cfg.TLS.Enabled() && (len(cfg.TLS.Cert) == 0 || len(cfg.TLS.Key) == 0) {
+		return fmt.Errorf("both the TLS certificate and key must be set to enable TLS")
+	} else if len(cfg.HomeserverURL) == 0 {
+		return fmt.Errorf("homeserver URL is not set (HOMESERVER_URL or homeserver_url)")
+	} else if len(cfg.SharedSecret) == 0 {
+		return fmt.Errorf("shared secret is not set (SHARED_SECRET or shared_secret)")
+	}
+	if len(cfg.HomeserverQuirks.Flavor) > 0 {
+		if cfg.HomeserverQuirks.Flavor, err = parseHomeserverFlavor(string(cfg.HomeserverQuirks.Flavor)); err != nil {
+			return fmt.Errorf("invalid homeserver flavor: %w", err)
+		}
+	}
+	defaultProfile.HomeserverURL = cfg.HomeserverURL
+	defaultProfile.SharedSecret = cfg.SharedSecret
+	defaultProfile.BasePath = cfg.BasePath
+	return nil
+}
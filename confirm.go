@@ -0,0 +1,83 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Destructive operations need a confirmation token, which is returned by the same request with dry_run=true.
+// The token is an HMAC of the operation, its scope and the expiry time keyed with the shared secret of the
+// profile, so it works on every instance of the proxy and can't be reused for a different target or operation.
+
+const confirmationLifetime = 5 * time.Minute
+
+// ConfirmationResponse is returned by dry runs of destructive operations.
+type ConfirmationResponse struct {
+	Operation         string `json:"operation"`
+	ConfirmationToken string `json:"confirmation_token"`
+	ExpiresAt         int64  `json:"expires_at"`
+}
+
+func createConfirmationToken(secret, operation, scope string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%s\x00%s\x00%d", operation, scope, expiresAt)
+	return fmt.Sprintf("%d.%s", expiresAt, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func checkConfirmationToken(secret, operation, scope, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || expiresAt < time.Now().UnixNano()/int64(time.Millisecond) {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(createConfirmationToken(secret, operation, scope, expiresAt)))
+}
+
+// confirmDestructive checks the confirmation token in the confirm query parameter of a destructive request.
+// If the request is a dry run (dry_run=true), a new confirmation token is returned instead. The caller may
+// only proceed if this returns true.
+func confirmDestructive(w http.ResponseWriter, r *http.Request, operation, scope string) bool {
+	secret := requestProfile(r).secret()
+	query := r.URL.Query()
+	if query.Get("dry_run") == "true" {
+		expiresAt := time.Now().Add(confirmationLifetime).UnixNano() / int64(time.Millisecond)
+		writeJSON(w, http.StatusOK, &ConfirmationResponse{
+			Operation:         operation,
+			ConfirmationToken: createConfirmationToken(secret, operation, scope, expiresAt),
+			ExpiresAt:         expiresAt,
+		})
+		return false
+	} else if token := query.Get("confirm"); len(token) == 0 {
+		formatError(errConfirmationRequired, operation).Write(w)
+		return false
+	} else if !checkConfirmationToken(secret, operation, scope, token) {
+		errInvalidConfirmation.Write(w)
+		return false
+	}
+	return true
+}
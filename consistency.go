@@ -0,0 +1,146 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+type ConsistencyCheckConfig struct {
+	// Interval is how often the in-memory state of loaded targets is compared with the database. Zero disables the check.
+	Interval time.Duration `yaml:"interval"`
+	// Heal makes the check write the in-memory state to the database when they differ.
+	Heal bool `yaml:"heal"`
+}
+
+// stateSnapshot is the part of the target state that's compared with the database.
+type stateSnapshot struct {
+	active         bool
+	nextBatch      string
+	botAccessToken string
+	hsToken        string
+}
+
+func (target *SyncTarget) stateSnapshot() stateSnapshot {
+	var snapshot stateSnapshot
+	snapshot.active = target.Active
+	target.statusLock.RLock()
+	snapshot.nextBatch = target.NextBatch
+	target.statusLock.RUnlock()
+	target.credsLock.RLock()
+	snapshot.botAccessToken = target.BotAccessToken
+	snapshot.hsToken = target.HSToken
+	target.credsLock.RUnlock()
+	return snapshot
+}
+
+// checkTargetConsistency compares the in-memory state of the target with the database and returns the number of
+// differences. Columns with a deferred write are skipped, since they're expected to differ until the write is flushed.
+func checkTargetConsistency(target *SyncTarget) (int, error) {
+	unlock := registry.LockTarget(target.ID())
+	defer unlock()
+	if registry.GetLoaded(target.ID()) != target {
+		// The target was purged or replaced after the snapshot was taken.
+		return 0, nil
+	} else if !target.holdsLease() {
+		// Another instance is syncing the target, so the in-memory state of this instance is expected to be outdated.
+		return 0, nil
+	}
+	// The sync loop may update the state while the database is being read, so the state is read on both sides of
+	// the query and only fields that didn't change in the meantime are compared.
+	before := target.stateSnapshot()
+	dbTarget, err := store.GetTarget(context.Background(), target.storageID(), target.DeviceKey)
+	if err != nil {
+		return 0, err
+	}
+	after := target.stateSnapshot()
+	if dbTarget == nil {
+		target.log.Warnln("Consistency check: target is loaded in memory, but it doesn't exist in the database")
+		return 1, nil
+	}
+	targetID := target.ID()
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	divergences := 0
+	if before.active == after.active && after.active != dbTarget.Active && !deferredWrites.IsQueued(targetID, "active") {
+		divergences++
+		target.log.Warnfln("Consistency check: target is active=%t in memory, but active=%t in the database (running: %t)", after.active, dbTarget.Active, target.isRunning())
+		if cfg.ConsistencyCheck.Heal {
+			active := after.active
+			deferredWrites.Exec(context.Background(), target, "active", func(ctx context.Context) error {
+				return store.SetTargetActive(ctx, appserviceID, deviceKey, active)
+			})
+		}
+	}
+	if before.nextBatch == after.nextBatch && after.nextBatch != dbTarget.NextBatch && !deferredWrites.IsQueued(targetID, "next_batch") {
+		divergences++
+		target.log.Warnfln("Consistency check: next batch token is %q in memory, but %q in the database", after.nextBatch, dbTarget.NextBatch)
+		if cfg.ConsistencyCheck.Heal {
+			nextBatch := after.nextBatch
+			deferredWrites.Exec(context.Background(), target, "next_batch", func(ctx context.Context) error {
+				return store.SetTargetNextBatch(ctx, appserviceID, deviceKey, nextBatch)
+			})
+		}
+	}
+	if before.botAccessToken == after.botAccessToken && before.hsToken == after.hsToken &&
+		(after.botAccessToken != dbTarget.BotAccessToken || after.hsToken != dbTarget.HSToken) &&
+		!deferredWrites.IsQueued(targetID, "credentials") {
+		divergences++
+		target.log.Warnln("Consistency check: tokens in memory don't match the database")
+		if cfg.ConsistencyCheck.Heal {
+			botAccessToken, hsToken := after.botAccessToken, after.hsToken
+			deferredWrites.Exec(context.Background(), target, "credentials", func(ctx context.Context) error {
+				return store.SetTargetCredentials(ctx, appserviceID, deviceKey, botAccessToken, hsToken)
+			})
+		}
+	}
+	return divergences, nil
+}
+
+// checkConsistency compares every loaded target with the database and returns the total number of differences.
+func checkConsistency() int {
+	divergences := 0
+	for _, target := range registry.Snapshot() {
+		count, err := checkTargetConsistency(target)
+		if err != nil {
+			target.log.Warnln("Consistency check failed to read target from database:", err)
+			continue
+		}
+		divergences += count
+	}
+	return divergences
+}
+
+func loopCheckConsistency() {
+	if cfg.ConsistencyCheck.Interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(cfg.ConsistencyCheck.Interval)
+		divergences := checkConsistency()
+		stateDivergences.Set(float64(divergences))
+		if divergences > 0 {
+			healed := ""
+			if cfg.ConsistencyCheck.Heal {
+				healed = ", wrote the in-memory state to the database"
+			}
+			log.Warnfln("Consistency check found %d differences between memory and the database%s", divergences, healed)
+		}
+	}
+}
@@ -14,13 +14,16 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package syncproxy
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/mattn/go-sqlite3"
@@ -31,6 +34,25 @@ import (
 type Database struct {
 	conn   *sql.DB
 	scheme string
+	// snapshotter is set for in-memory SQLite databases that are persisted with snapshots.
+	snapshotter *sqliteSnapshotter
+	// queryTimeout limits how long the query methods of Database wait for the database.
+	queryTimeout time.Duration
+
+	schema     SchemaInfo
+	schemaLock sync.RWMutex
+}
+
+// SchemaInfo describes the database schema version and the last migration that was applied to it.
+type SchemaInfo struct {
+	Version int `json:"schema_version"`
+	// CompatVersion is the oldest schema version that the code must support to use the database.
+	CompatVersion    int `json:"compat_schema_version"`
+	SupportedVersion int `json:"supported_schema_version"`
+	// LastMigrationAt and LastMigrationDuration are in milliseconds. They're only known for
+	// migrations that were applied after migration timing was added.
+	LastMigrationAt       int64 `json:"last_migration_at,omitempty"`
+	LastMigrationDuration int64 `json:"last_migration_duration_ms,omitempty"`
 }
 
 var knownSchemes = map[string]string{
@@ -44,10 +66,25 @@ var knownSchemes = map[string]string{
 type DatabaseOpts struct {
 	MaxOpenConns int `yaml:"max_open_conns"`
 	MaxIdleConns int `yaml:"max_idle_conns"`
+	// SlowQueryThreshold is how long a store operation can take before it's logged as slow. Zero disables the logging.
+	SlowQueryThreshold time.Duration `yaml:"slow_query_threshold"`
+	// StartupTimeout is how long to wait for the database to become reachable on startup.
+	StartupTimeout time.Duration `yaml:"startup_timeout"`
+	// QueryTimeout is how long a single query or transaction can take before it's canceled. Zero disables the timeout.
+	QueryTimeout time.Duration `yaml:"query_timeout"`
 }
 
 // Connect creates a new pgx connection pool.
 func Connect(dbURL string, opts DatabaseOpts) (*Database, error) {
+	if isMemory, snapshotter, err := parseMemorySQLiteURL(dbURL); err != nil {
+		return nil, err
+	} else if isMemory {
+		memDB, err := connectMemorySQLite(snapshotter)
+		if memDB != nil {
+			memDB.queryTimeout = opts.QueryTimeout
+		}
+		return memDB, err
+	}
 	var localDB Database
 	parsedURL, err := url.Parse(dbURL)
 	if err != nil {
@@ -63,79 +100,93 @@ func Connect(dbURL string, opts DatabaseOpts) (*Database, error) {
 		if len(newDBURL) == 0 {
 			return nil, fmt.Errorf("invalid database URL '%s', missing a slash?", dbURL)
 		}
-		dbURL = newDBURL
+		dbURL = sqliteDSN(newDBURL, parsedURL.Query())
 	}
 	localDB.conn, err = sql.Open(localDB.scheme, dbURL)
+	localDB.queryTimeout = opts.QueryTimeout
 	localDB.conn.SetMaxOpenConns(opts.MaxOpenConns)
 	localDB.conn.SetMaxIdleConns(opts.MaxIdleConns)
 	return &localDB, err
 }
 
-type Upgrade struct {
-	Message string
-	Func    func(conn *sql.Tx) error
+// defaultSQLiteOptions are the go-sqlite3 connection options used for SQLite files unless the database URL
+// overrides them. WAL mode and a busy timeout stop concurrent sync token writes of different targets from
+// failing with "database is locked", and immediate transactions take the write lock up front instead of
+// failing when a read transaction is upgraded.
+var defaultSQLiteOptions = map[string]string{
+	"_journal_mode": "WAL",
+	"_synchronous":  "NORMAL",
+	"_busy_timeout": "5000",
+	"_txlock":       "immediate",
 }
 
-var upgrades = []Upgrade{{
-	"Initial version",
-	func(conn *sql.Tx) error {
-		_, err := conn.Exec(`
-			CREATE TABLE targets (
-				appservice_id    TEXT    PRIMARY KEY,
-				bot_access_token TEXT    NOT NULL,
-				hs_token         TEXT    NOT NULL,
-				address          TEXT    NOT NULL,
-				user_id          TEXT    NOT NULL,
-				device_id        TEXT    NOT NULL,
-				is_proxy         BOOLEAN NOT NULL,
-				next_batch       TEXT    NOT NULL,
-				active           BOOLEAN DEFAULT false
-			);
-		`)
-		return err
-	},
-}}
-
-func setVersion(conn *sql.Tx, version int) error {
-	_, err := conn.Exec("DELETE FROM version")
-	if err != nil {
-		return fmt.Errorf("failed to delete current version row: %w", err)
+// sqliteDSN adds the default SQLite options and the ones in the query string of the database URL to the path.
+func sqliteDSN(path string, query url.Values) string {
+	for key, value := range defaultSQLiteOptions {
+		if _, ok := query[key]; !ok {
+			query.Set(key, value)
+		}
 	}
-	_, err = conn.Exec("INSERT INTO version VALUES ($1)", version)
-	if err != nil {
-		return fmt.Errorf("failed to insert new version row: %w", err)
+	return path + "?" + query.Encode()
+}
+
+const maxDatabaseStartupRetry = 30 * time.Second
+
+// WaitForConnection pings the database until it answers or the timeout is reached, so that the proxy can be
+// started at the same time as the database instead of failing immediately. After startup, the connection pool
+// reconnects by itself.
+func (db *Database) WaitForConnection(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	retryIn := 1 * time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := db.conn.PingContext(ctx)
+		cancel()
+		if err == nil || time.Now().Add(retryIn).After(deadline) {
+			return err
+		}
+		log.Warnfln("Database isn't reachable yet: %v. Retrying in %v", err, retryIn)
+		time.Sleep(retryIn)
+		retryIn *= 2
+		if retryIn > maxDatabaseStartupRetry {
+			retryIn = maxDatabaseStartupRetry
+		}
 	}
-	return nil
 }
 
-// Upgrade updates the database schema to the latest version.
-func (db *Database) Upgrade() error {
-	_, err := db.conn.Exec("CREATE TABLE IF NOT EXISTS version (version INTEGER PRIMARY KEY)")
+// SchemaVersion returns the current schema version stored in the database.
+func (db *Database) SchemaVersion() (version int, err error) {
+	err = db.QueryRow("SELECT version FROM version").Scan(&version)
+	return
+}
+
+// Schema returns the schema information that was loaded when the database was upgraded.
+func (db *Database) Schema() SchemaInfo {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.schema
+}
+
+func (db *Database) loadSchemaInfo() error {
+	info := SchemaInfo{SupportedVersion: len(migrations)}
+	var err error
+	info.Version, info.CompatVersion, err = db.getVersion()
 	if err != nil {
-		return fmt.Errorf("failed to ensure version table exists: %w", err)
+		return fmt.Errorf("failed to get current database schema version: %w", err)
 	}
-	var version int
-	err = db.conn.QueryRow("SELECT version FROM version").Scan(&version)
+	err = db.QueryRow("SELECT applied_at, duration_ms FROM schema_migrations ORDER BY version DESC LIMIT 1").
+		Scan(&info.LastMigrationAt, &info.LastMigrationDuration)
 	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("failed to get current database schema version: %w", err)
+		return fmt.Errorf("failed to get last migration: %w", err)
 	}
-
-	if len(upgrades) > version {
-		for index, upgrade := range upgrades[version:] {
-			newVersion := version + index + 1
-			log.Infofln("Updating database schema to v%d: %s", newVersion, upgrade.Message)
-			var tx *sql.Tx
-			if tx, err = db.conn.Begin(); err != nil {
-				return fmt.Errorf("failed to begin transaction to upgrade database schema to v%d: %w", newVersion, err)
-			} else if err = upgrade.Func(tx); err != nil {
-				return fmt.Errorf("failed to upgrade database schema to v%d: %w", newVersion, err)
-			} else if err = setVersion(tx, newVersion); err != nil {
-				return fmt.Errorf("failed to store new version v%d in database: %w", newVersion, err)
-			} else if err = tx.Commit(); err != nil {
-				return fmt.Errorf("failed to commit upgrade of database schema to v%d: %w", newVersion, err)
-			}
-		}
-		log.Infofln("Database schema update to v%d", len(upgrades))
+	db.schemaLock.Lock()
+	db.schema = info
+	db.schemaLock.Unlock()
+	dbSchemaVersion.Set(float64(info.Version))
+	dbSupportedSchemaVersion.Set(float64(info.SupportedVersion))
+	if info.LastMigrationAt > 0 {
+		dbLastMigrationTimestamp.Set(float64(info.LastMigrationAt) / 1000)
+		dbLastMigrationDuration.Set(float64(info.LastMigrationDuration) / 1000)
 	}
 	return nil
 }
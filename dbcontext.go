@@ -0,0 +1,168 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// The methods below are like the ones of sql.DB, but every query is limited by the configured query timeout,
+// so a database that stops responding fails the query instead of blocking the caller forever. The versions
+// without a context use context.Background() as the parent.
+
+// withQueryTimeout returns a context that expires after the query timeout. The returned function must be
+// called once the query and its result are no longer used.
+func (db *Database) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+var numberedPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// rebind converts the $1-style placeholders in queries to ?1 for SQLite. SQLite treats $1 as a named parameter and
+// numbers named parameters in the order they appear, so "UPDATE targets SET active=$3 WHERE appservice_id=$1"
+// would bind the arguments in the wrong order, while ?NNN parameters are bound by their number.
+func (db *Database) rebind(query string) string {
+	if db.scheme != "sqlite3" {
+		return query
+	}
+	return numberedPlaceholder.ReplaceAllString(query, "?$1")
+}
+
+// outcomeContext returns ctx, or a background context if ctx is already canceled. It's used for writes that record
+// the outcome of an operation, which must be stored even if the operation was interrupted by canceling ctx.
+func outcomeContext(ctx context.Context) context.Context {
+	if ctx.Err() != nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// wrapTimeout makes errors caused by the query timeout say so, as the driver only returns the context error.
+func (db *Database) wrapTimeout(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("database query timed out after %v: %w", db.queryTimeout, err)
+	}
+	return err
+}
+
+func (db *Database) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+	res, err := db.conn.ExecContext(ctx, db.rebind(query), args...)
+	return res, db.wrapTimeout(ctx, err)
+}
+
+func (db *Database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// dbRows is a result set whose query timeout is released when it's closed.
+type dbRows struct {
+	*sql.Rows
+	ctx    context.Context
+	db     *Database
+	cancel context.CancelFunc
+}
+
+func (rows *dbRows) Close() error {
+	err := rows.Rows.Close()
+	rows.cancel()
+	return err
+}
+
+func (rows *dbRows) Err() error {
+	return rows.db.wrapTimeout(rows.ctx, rows.Rows.Err())
+}
+
+func (db *Database) QueryContext(ctx context.Context, query string, args ...interface{}) (*dbRows, error) {
+	ctx, cancel := db.withQueryTimeout(ctx)
+	rows, err := db.conn.QueryContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		cancel()
+		return nil, db.wrapTimeout(ctx, err)
+	}
+	return &dbRows{Rows: rows, ctx: ctx, db: db, cancel: cancel}, nil
+}
+
+func (db *Database) Query(query string, args ...interface{}) (*dbRows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// dbRow is a single row whose query timeout is released when it's scanned.
+type dbRow struct {
+	row    *sql.Row
+	ctx    context.Context
+	db     *Database
+	cancel context.CancelFunc
+}
+
+func (row *dbRow) Scan(dest ...interface{}) error {
+	defer row.cancel()
+	return row.db.wrapTimeout(row.ctx, row.row.Scan(dest...))
+}
+
+func (db *Database) QueryRowContext(ctx context.Context, query string, args ...interface{}) *dbRow {
+	ctx, cancel := db.withQueryTimeout(ctx)
+	return &dbRow{row: db.conn.QueryRowContext(ctx, db.rebind(query), args...), ctx: ctx, db: db, cancel: cancel}
+}
+
+func (db *Database) QueryRow(query string, args ...interface{}) *dbRow {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+// dbTx is a transaction whose queries all share one query timeout, which is released when it's committed or
+// rolled back. The database rolls the transaction back by itself if the timeout is reached.
+type dbTx struct {
+	*sql.Tx
+	db     *Database
+	cancel context.CancelFunc
+}
+
+func (tx *dbTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.rebind(query), args...)
+}
+
+func (tx *dbTx) Commit() error {
+	defer tx.cancel()
+	return tx.Tx.Commit()
+}
+
+func (tx *dbTx) Rollback() error {
+	defer tx.cancel()
+	return tx.Tx.Rollback()
+}
+
+func (db *Database) BeginTx(ctx context.Context) (*dbTx, error) {
+	ctx, cancel := db.withQueryTimeout(ctx)
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+		return nil, db.wrapTimeout(ctx, err)
+	}
+	return &dbTx{Tx: tx, db: db, cancel: cancel}, nil
+}
+
+func (db *Database) Begin() (*dbTx, error) {
+	return db.BeginTx(context.Background())
+}
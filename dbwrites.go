@@ -0,0 +1,178 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const initialDeferredWriteRetry = 1 * time.Second
+const maxDeferredWriteRetry = 60 * time.Second
+
+type deferredWriteKey struct {
+	targetID string
+	column   string
+}
+
+type deferredWrite struct {
+	write func(ctx context.Context) error
+	// generation is used to check that the write wasn't replaced with a newer one while it was being flushed.
+	generation uint64
+}
+
+// deferredWriteKeyLock serializes the writes of a single key. It's removed from the queue when nobody is holding it.
+type deferredWriteKeyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// deferredWriteQueue holds state writes that failed because the database was unavailable.
+// Only the latest write for each target and column is kept, and the writes are retried with backoff until they succeed.
+//
+// lock only protects the maps and is never held while writing to the database, so that a slow database doesn't
+// make the sync loops of all targets wait for each other. Writes of the same key are serialized with keyLocks
+// instead, so that an older value can't be written after a newer one.
+type deferredWriteQueue struct {
+	writes     map[deferredWriteKey]*deferredWrite
+	keyLocks   map[deferredWriteKey]*deferredWriteKeyLock
+	generation uint64
+	lock       sync.Mutex
+	wake       chan struct{}
+}
+
+var deferredWrites = &deferredWriteQueue{
+	writes:   make(map[deferredWriteKey]*deferredWrite),
+	keyLocks: make(map[deferredWriteKey]*deferredWriteKeyLock),
+	wake:     make(chan struct{}, 1),
+}
+
+// lockKey locks the given key and returns a function to unlock it. The caller must not hold dwq.lock.
+func (dwq *deferredWriteQueue) lockKey(key deferredWriteKey) (unlock func()) {
+	dwq.lock.Lock()
+	keyLock, ok := dwq.keyLocks[key]
+	if !ok {
+		keyLock = &deferredWriteKeyLock{}
+		dwq.keyLocks[key] = keyLock
+	}
+	keyLock.refs++
+	dwq.lock.Unlock()
+	keyLock.Lock()
+	return func() {
+		keyLock.Unlock()
+		dwq.lock.Lock()
+		keyLock.refs--
+		if keyLock.refs == 0 {
+			delete(dwq.keyLocks, key)
+		}
+		dwq.lock.Unlock()
+	}
+}
+
+func (dwq *deferredWriteQueue) queue(key deferredWriteKey, write func(ctx context.Context) error) {
+	dwq.generation++
+	dwq.writes[key] = &deferredWrite{write: write, generation: dwq.generation}
+	deferredDBWrites.Set(float64(len(dwq.writes)))
+	select {
+	case dwq.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Exec runs the write with the given context, or queues it if it fails. If there's already a queued write for the
+// same key, the new write replaces it without touching the database, so that an older value can't overwrite a newer
+// one. Queued writes are retried without the caller's context, as it's usually done by the time they're retried.
+func (dwq *deferredWriteQueue) Exec(ctx context.Context, target *SyncTarget, column string, write func(ctx context.Context) error) {
+	key := deferredWriteKey{targetID: target.ID(), column: column}
+	unlockKey := dwq.lockKey(key)
+	defer unlockKey()
+	dwq.lock.Lock()
+	_, alreadyQueued := dwq.writes[key]
+	if alreadyQueued {
+		dwq.queue(key, write)
+	}
+	dwq.lock.Unlock()
+	if alreadyQueued {
+		return
+	}
+	if err := write(ctx); err != nil {
+		target.log.Warnfln("Failed to store %s in database, will retry in the background: %v", column, err)
+		target.reportError("Failed to store target state in database", err, map[string]interface{}{"column": column})
+		dwq.lock.Lock()
+		dwq.queue(key, write)
+		dwq.lock.Unlock()
+	}
+}
+
+// IsQueued returns whether there's a queued write for the given target and column.
+func (dwq *deferredWriteQueue) IsQueued(targetID, column string) bool {
+	dwq.lock.Lock()
+	defer dwq.lock.Unlock()
+	_, ok := dwq.writes[deferredWriteKey{targetID: targetID, column: column}]
+	return ok
+}
+
+// Flush tries to run all queued writes once and returns the number of writes that are still queued.
+// The lock isn't held while writing, so sync loops aren't blocked by a slow database.
+func (dwq *deferredWriteQueue) Flush() int {
+	dwq.lock.Lock()
+	snapshot := make(map[deferredWriteKey]*deferredWrite, len(dwq.writes))
+	for key, write := range dwq.writes {
+		snapshot[key] = write
+	}
+	dwq.lock.Unlock()
+	flushed := make(map[deferredWriteKey]uint64, len(snapshot))
+	for key, write := range snapshot {
+		if err := write.write(context.Background()); err != nil {
+			log.Debugfln("Failed to flush deferred write of %s for %s: %v", key.column, key.targetID, err)
+			continue
+		}
+		flushed[key] = write.generation
+	}
+	dwq.lock.Lock()
+	defer dwq.lock.Unlock()
+	for key, generation := range flushed {
+		if current, ok := dwq.writes[key]; ok && current.generation == generation {
+			delete(dwq.writes, key)
+		}
+	}
+	deferredDBWrites.Set(float64(len(dwq.writes)))
+	return len(dwq.writes)
+}
+
+// Loop flushes queued writes with exponential backoff while there are any.
+func (dwq *deferredWriteQueue) Loop() {
+	for range dwq.wake {
+		retryIn := initialDeferredWriteRetry
+		for {
+			time.Sleep(retryIn)
+			remaining := dwq.Flush()
+			if remaining == 0 {
+				log.Infoln("Flushed all deferred database writes")
+				break
+			}
+			log.Warnfln("%d database writes are still deferred, retrying in %v", remaining, retryIn)
+			retryIn *= 2
+			if retryIn > maxDeferredWriteRetry {
+				retryIn = maxDeferredWriteRetry
+			}
+		}
+	}
+}
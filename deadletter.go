@@ -0,0 +1,236 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// deadLetter stores a transaction that won't be delivered anymore in the dead letter table.
+// If storeData is false, only the metadata is stored and the transaction itself is dropped.
+func (target *SyncTarget) deadLetter(txnID string, meta txnMetadata, txn *Transaction, reason error, storeData bool) error {
+	letter := StoredDeadLetter{
+		TxnID:        txnID,
+		Reason:       reason.Error(),
+		CreatedAt:    time.Now().UnixNano() / int64(time.Millisecond),
+		TxnCreatedAt: meta.CreatedAt,
+		Sequence:     meta.Sequence,
+	}
+	if storeData {
+		var err error
+		letter.Data, err = json.Marshal(txn)
+		if err != nil {
+			return fmt.Errorf("failed to marshal transaction: %w", err)
+		}
+	}
+	err := store.InsertDeadLetter(context.Background(), target.storageID(), target.DeviceKey, letter)
+	if err == nil {
+		deadLetteredTransactions.WithLabelValues(string(classifyDeliveryError(reason))).Inc()
+	}
+	return err
+}
+
+// DeadLetter is a transaction in the dead letter table. The payload itself isn't returned by the API,
+// only the type and sender of its to-device events like in the transaction history.
+type DeadLetter struct {
+	TxnID  string `json:"txn_id"`
+	Reason string `json:"reason"`
+	// CreatedAt is when the transaction was dead-lettered, TxnCreatedAt is when it was created from a /sync response.
+	CreatedAt    int64  `json:"created_at"`
+	TxnCreatedAt int64  `json:"txn_created_at,omitempty"`
+	Sequence     uint64 `json:"sequence,omitempty"`
+	// Replayable is false if only the metadata of the transaction was stored, e.g. for at-most-once targets.
+	Replayable bool           `json:"replayable"`
+	Events     []HistoryEvent `json:"events,omitempty"`
+
+	data []byte
+}
+
+// loadDeadLetters returns the transactions of a target that were dead-lettered before the given timestamp, newest first.
+// Zero values for before and limit disable the respective filter.
+func loadDeadLetters(ctx context.Context, appserviceID, deviceKey string, before int64, limit int) ([]*DeadLetter, error) {
+	stored, err := store.GetDeadLetters(ctx, appserviceID, deviceKey, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, len(stored))
+	for i, storedLetter := range stored {
+		letter := &DeadLetter{
+			TxnID:        storedLetter.TxnID,
+			Reason:       storedLetter.Reason,
+			CreatedAt:    storedLetter.CreatedAt,
+			TxnCreatedAt: storedLetter.TxnCreatedAt,
+			Sequence:     storedLetter.Sequence,
+		}
+		if storedLetter.Data != nil {
+			var txn Transaction
+			if err = json.Unmarshal(storedLetter.Data, &txn); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal dead-lettered transaction %s: %w", letter.TxnID, err)
+			}
+			letter.Replayable = true
+			letter.data = storedLetter.Data
+			letter.Events = newHistoryEntry("", "", letter.TxnID, &txn).Events
+		}
+		letters[i] = letter
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters moves dead-lettered transactions of the target back to the pending queue and returns their IDs.
+// If txnIDs is empty, every transaction with a stored payload is replayed. A running sync loop delivers them
+// before its next /sync request, otherwise they're delivered when the target is started.
+func (target *SyncTarget) ReplayDeadLetters(txnIDs []string) ([]string, error) {
+	letters, err := loadDeadLetters(context.Background(), target.storageID(), target.DeviceKey, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	requested := make(map[string]bool, len(txnIDs))
+	for _, txnID := range txnIDs {
+		requested[txnID] = true
+	}
+	replayed := []string{}
+	for _, letter := range letters {
+		if !letter.Replayable || (len(requested) > 0 && !requested[letter.TxnID]) {
+			continue
+		}
+		createdAt := letter.TxnCreatedAt
+		if createdAt == 0 {
+			// Transactions dead-lettered before the creation time was stored
+			createdAt = letter.CreatedAt
+		}
+		err = store.QueueTransaction(context.Background(), target.storageID(), target.DeviceKey, QueuedTransaction{
+			TxnID:     letter.TxnID,
+			Sequence:  letter.Sequence,
+			Data:      letter.data,
+			CreatedAt: createdAt,
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("failed to queue transaction %s: %w", letter.TxnID, err)
+		}
+		// The transaction is in the pending queue now, so failing to delete it here only means it may be replayed twice.
+		if err = store.DeleteDeadLetter(context.Background(), letter.TxnID); err != nil {
+			target.log.Warnfln("Failed to delete replayed transaction %s from dead letter table: %v", letter.TxnID, err)
+		}
+		replayed = append(replayed, letter.TxnID)
+	}
+	if len(replayed) > 0 {
+		atomic.StoreInt32(&target.replayQueued, 1)
+		target.Poke()
+	}
+	return replayed, nil
+}
+
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	before, err := parsePositiveIntParam(r, "before")
+	if err != nil {
+		formatError(errInvalidQueryParam, err.Error()).Write(w)
+		return
+	}
+	limit, err := parsePositiveIntParam(r, "limit")
+	if err != nil {
+		formatError(errInvalidQueryParam, err.Error()).Write(w)
+		return
+	} else if limit == 0 {
+		limit = defaultHistoryQueryLimit
+	} else if limit > maxHistoryQueryLimit {
+		limit = maxHistoryQueryLimit
+	}
+	storageID := storageAppserviceID(requestProfile(r).Name, vars["appserviceID"])
+	letters, err := loadDeadLetters(r.Context(), storageID, vars["deviceID"], before, int(limit))
+	if err != nil {
+		log.Warnfln("Failed to get dead letters of %s: %v", TargetID(storageID, vars["deviceID"]), err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	resp := map[string]interface{}{
+		"dead_letters": letters,
+	}
+	if len(letters) == int(limit) {
+		resp["next_before"] = letters[len(letters)-1].CreatedAt
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type reqReplayDeadLetters struct {
+	// TxnIDs are the transactions to replay. If empty, all replayable transactions of the target are replayed.
+	TxnIDs []string `json:"txn_ids"`
+}
+
+func replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	var req reqReplayDeadLetters
+	if !getJSON(w, r, &req) {
+		return
+	}
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	}
+	replayed, err := target.ReplayDeadLetters(req.TxnIDs)
+	if err != nil {
+		target.log.Warnln("Failed to replay dead letters:", err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	target.log.Infofln("Replaying %d dead-lettered transactions", len(replayed))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"replayed": replayed,
+	})
+}
+
+// addDroppedTransaction remembers a dropped transaction ID, so that the target can be told about it
+// in the next transaction that is delivered successfully.
+func (target *SyncTarget) addDroppedTransaction(txnID string) {
+	target.droppedLock.Lock()
+	target.droppedTxns = append(target.droppedTxns, txnID)
+	target.droppedLock.Unlock()
+}
+
+func (target *SyncTarget) getDroppedTransactions() []string {
+	target.droppedLock.Lock()
+	defer target.droppedLock.Unlock()
+	if len(target.droppedTxns) == 0 {
+		return nil
+	}
+	return append([]string{}, target.droppedTxns...)
+}
+
+// clearDroppedTransactions removes the first n dropped transaction IDs after they've been delivered to the target.
+func (target *SyncTarget) clearDroppedTransactions(n int) {
+	if n == 0 {
+		return
+	}
+	target.droppedLock.Lock()
+	target.droppedTxns = target.droppedTxns[n:]
+	target.droppedLock.Unlock()
+}
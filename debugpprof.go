@@ -0,0 +1,50 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// requireSharedSecret wraps a handler so that it's only served to requests with the shared secret.
+func requireSharedSecret(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkAuth(w, r) {
+			return
+		}
+		// checkAuth sets a JSON content type for errors, the profile handlers set their own.
+		w.Header().Del("Content-Type")
+		next.ServeHTTP(w, r)
+	}
+}
+
+// registerPprofRoutes adds the net/http/pprof handlers under /debug/pprof/. They're only registered
+// if enabled in the config, as profiles can reveal e.g. tokens in goroutine stacks and command line flags.
+func registerPprofRoutes(router *mux.Router, basePath string) {
+	// The index page finds the profile name by removing /debug/pprof/ from the path, so the base path has to go first.
+	router.Handle("/debug/pprof/", requireSharedSecret(http.StripPrefix(basePath, http.HandlerFunc(pprof.Index))))
+	router.Handle("/debug/pprof/cmdline", requireSharedSecret(http.HandlerFunc(pprof.Cmdline)))
+	router.Handle("/debug/pprof/profile", requireSharedSecret(http.HandlerFunc(pprof.Profile)))
+	router.Handle("/debug/pprof/symbol", requireSharedSecret(http.HandlerFunc(pprof.Symbol)))
+	router.Handle("/debug/pprof/trace", requireSharedSecret(http.HandlerFunc(pprof.Trace)))
+	router.Handle("/debug/pprof/{name}", requireSharedSecret(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pprof.Handler(mux.Vars(r)["name"]).ServeHTTP(w, r)
+	})))
+}
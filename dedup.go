@@ -0,0 +1,152 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type eventHash [sha256.Size]byte
+
+func hashToDeviceEvent(evt *event.Event) eventHash {
+	content := []byte(evt.Content.VeryRaw)
+	if len(content) == 0 {
+		content, _ = json.Marshal(&evt.Content)
+	}
+	hasher := sha256.New()
+	hasher.Write([]byte(evt.Sender))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(evt.Type.Type))
+	hasher.Write([]byte{0})
+	hasher.Write(content)
+	var hash eventHash
+	copy(hash[:], hasher.Sum(nil))
+	return hash
+}
+
+// toDeviceDeduplicator remembers the hashes of to-device events that have been delivered to a target,
+// so that the same event isn't delivered twice within the dedup window.
+type toDeviceDeduplicator struct {
+	delivered map[eventHash]time.Time
+	lock      sync.Mutex
+}
+
+func (dedup *toDeviceDeduplicator) prune(now time.Time) {
+	for hash, deliveredAt := range dedup.delivered {
+		if now.Sub(deliveredAt) > cfg.ToDeviceDedupWindow {
+			delete(dedup.delivered, hash)
+		}
+	}
+}
+
+// Filter returns the events that haven't been delivered within the dedup window.
+func (dedup *toDeviceDeduplicator) Filter(evts []*event.Event) []*event.Event {
+	if cfg.ToDeviceDedupWindow <= 0 || len(evts) == 0 {
+		return evts
+	}
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	dedup.prune(time.Now())
+	filtered := evts[:0]
+	for _, evt := range evts {
+		if _, alreadyDelivered := dedup.delivered[hashToDeviceEvent(evt)]; alreadyDelivered {
+			deduplicatedEvents.WithLabelValues(evt.Type.Type).Inc()
+		} else {
+			filtered = append(filtered, evt)
+		}
+	}
+	return filtered
+}
+
+// MarkDelivered records the given events as delivered.
+func (dedup *toDeviceDeduplicator) MarkDelivered(evts []*event.Event) {
+	if cfg.ToDeviceDedupWindow <= 0 || len(evts) == 0 {
+		return
+	}
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	if dedup.delivered == nil {
+		dedup.delivered = make(map[eventHash]time.Time)
+	}
+	now := time.Now()
+	for _, evt := range evts {
+		dedup.delivered[hashToDeviceEvent(evt)] = now
+	}
+}
+
+// deviceListDeduplicator remembers which users' device list changes have been delivered to a target,
+// so that changes that are repeated in consecutive syncs aren't delivered again within the dedup window.
+type deviceListDeduplicator struct {
+	delivered map[id.UserID]time.Time
+	lock      sync.Mutex
+}
+
+// deviceListDedupWindow returns the device list dedup window of the target, or zero if it's disabled.
+func (target *SyncTarget) deviceListDedupWindow() time.Duration {
+	return time.Duration(target.DeviceListDedupMinutes) * time.Minute
+}
+
+// Filter removes users whose change was delivered within the window from the changed list.
+// Users who left are always kept, and they're forgotten so that their next change is delivered.
+func (dedup *deviceListDeduplicator) Filter(lists *mautrix.DeviceLists, window time.Duration) {
+	if window <= 0 || (len(lists.Changed) == 0 && len(lists.Left) == 0) {
+		return
+	}
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	now := time.Now()
+	for userID, deliveredAt := range dedup.delivered {
+		if now.Sub(deliveredAt) > window {
+			delete(dedup.delivered, userID)
+		}
+	}
+	for _, userID := range lists.Left {
+		delete(dedup.delivered, userID)
+	}
+	filtered := lists.Changed[:0]
+	for _, userID := range lists.Changed {
+		if _, alreadyDelivered := dedup.delivered[userID]; alreadyDelivered {
+			deduplicatedDeviceListUsers.Inc()
+		} else {
+			filtered = append(filtered, userID)
+		}
+	}
+	lists.Changed = filtered
+}
+
+// MarkDelivered records the changed users in the given device lists as delivered.
+func (dedup *deviceListDeduplicator) MarkDelivered(lists *mautrix.DeviceLists, window time.Duration) {
+	if window <= 0 || lists == nil || len(lists.Changed) == 0 {
+		return
+	}
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	if dedup.delivered == nil {
+		dedup.delivered = make(map[id.UserID]time.Time)
+	}
+	now := time.Now()
+	for _, userID := range lists.Changed {
+		dedup.delivered[userID] = now
+	}
+}
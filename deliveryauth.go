@@ -0,0 +1,167 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DeliveryAuthType string
+
+const (
+	// DeliveryAuthCloudflareAccess sends a Cloudflare Access service token in the CF-Access-Client-Id/Secret headers.
+	DeliveryAuthCloudflareAccess DeliveryAuthType = "cloudflare_access"
+	// DeliveryAuthGCPIAP sends a Google-signed identity token for Identity-Aware Proxy in the Proxy-Authorization
+	// header, since the Authorization header contains the hs_token. The token is fetched from the GCE metadata server.
+	DeliveryAuthGCPIAP DeliveryAuthType = "gcp_iap"
+)
+
+// DeliveryAuth contains credentials for a zero-trust proxy in front of the target.
+type DeliveryAuth struct {
+	Type DeliveryAuthType `json:"type"`
+	// ClientID and ClientSecret are the Cloudflare Access service token.
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// Audience is the OAuth client ID of the IAP-protected resource.
+	Audience string `json:"audience,omitempty"`
+}
+
+func (auth *DeliveryAuth) Validate() error {
+	switch auth.Type {
+	case DeliveryAuthCloudflareAccess:
+		if len(auth.ClientID) == 0 || len(auth.ClientSecret) == 0 {
+			return fmt.Errorf("client_id and client_secret are required for cloudflare_access auth")
+		}
+	case DeliveryAuthGCPIAP:
+		if len(auth.Audience) == 0 {
+			return fmt.Errorf("audience is required for gcp_iap auth")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", auth.Type)
+	}
+	return nil
+}
+
+// gcpMetadataIdentityURL is the GCE metadata server endpoint for fetching identity tokens of the instance's service account.
+var gcpMetadataIdentityURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+
+// identityTokenRefreshMargin is how long before expiry cached identity tokens are replaced.
+const identityTokenRefreshMargin = 5 * time.Minute
+
+type cachedIdentityToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// identityTokens caches identity tokens by audience, so that targets behind the same IAP resource share a token.
+var identityTokens = make(map[string]cachedIdentityToken)
+var identityTokensLock sync.Mutex
+
+var metadataHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func getIdentityToken(audience string) (string, error) {
+	identityTokensLock.Lock()
+	defer identityTokensLock.Unlock()
+	cached, ok := identityTokens[audience]
+	if ok && time.Until(cached.expiresAt) > identityTokenRefreshMargin {
+		return cached.token, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataIdentityURL+"?format=full&audience="+url.QueryEscape(audience), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := metadataHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request identity token from metadata server: %w", err)
+	}
+	defer closeBody(resp.Body)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read identity token: %w", err)
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	token := strings.TrimSpace(string(data))
+	expiresAt, err := jwtExpiry(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse identity token: %w", err)
+	}
+	identityTokens[audience] = cachedIdentityToken{token: token, expiresAt: expiresAt}
+	return token, nil
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it. The token comes straight from
+// the metadata server and is only passed on, so the expiry is only needed for caching.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token doesn't have three parts")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Expiry int64 `json:"exp"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	} else if claims.Expiry == 0 {
+		return time.Time{}, fmt.Errorf("token doesn't have an expiry")
+	}
+	return time.Unix(claims.Expiry, 0), nil
+}
+
+// authTransport adds the zero-trust proxy credentials of the target to every request.
+type authTransport struct {
+	auth *DeliveryAuth
+	next http.RoundTripper
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	if err := at.auth.setHeaders(req.Header); err != nil {
+		return nil, err
+	}
+	return at.next.RoundTrip(req)
+}
+
+// setHeaders adds the credentials to the given request headers.
+func (auth *DeliveryAuth) setHeaders(header http.Header) error {
+	switch auth.Type {
+	case DeliveryAuthCloudflareAccess:
+		header.Set("CF-Access-Client-Id", auth.ClientID)
+		header.Set("CF-Access-Client-Secret", auth.ClientSecret)
+	case DeliveryAuthGCPIAP:
+		token, err := getIdentityToken(auth.Audience)
+		if err != nil {
+			return err
+		}
+		header.Set("Proxy-Authorization", "Bearer "+token)
+	}
+	return nil
+}
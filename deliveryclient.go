@@ -0,0 +1,339 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxDeliveryIdleConns = 100
+
+// DeliveryClientConfig contains the defaults for the HTTP clients used to send transactions and probes to targets.
+// Zero durations mean no timeout.
+type DeliveryClientConfig struct {
+	// Timeout is the maximum duration of a whole request, including reading the response body.
+	Timeout               time.Duration `yaml:"timeout"`
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	// IdleConnTimeout is how long idle connections are kept open before they're closed.
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+	// KeepAlive is the interval of TCP keep-alive probes. Negative values disable keep-alives.
+	KeepAlive           time.Duration `yaml:"keep_alive"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	// ClientCert and ClientKey are paths to a certificate that is presented to targets that request one (mutual TLS).
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+}
+
+// deliveryClientCert is the client certificate from DELIVERY_CLIENT_CERT and DELIVERY_CLIENT_KEY, or nil if not configured.
+var deliveryClientCert *certReloader
+
+// DeliveryOptions are per-target settings for sending transactions and probes to the target.
+type DeliveryOptions struct {
+	// Timeout is the maximum duration of a single request to the target, e.g. "30s". Empty means no timeout.
+	Timeout string `json:"timeout,omitempty"`
+	// MaxIdleConns is the number of idle connections to keep open to each address of the target.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// AppserviceIDParam is the name of the query parameter that contains the appservice ID in transaction URLs.
+	// If unset, "appservice_id" is used, and an empty string omits the parameter entirely.
+	AppserviceIDParam *string `json:"appservice_id_param,omitempty"`
+	// PinnedSPKI is a list of base64-encoded SHA-256 hashes of certificate public keys (SubjectPublicKeyInfo).
+	// If set, transactions are only sent over HTTPS to servers whose certificate chain contains one of the keys.
+	PinnedSPKI []string `json:"pinned_spki,omitempty"`
+	// TransactionPath and ErrorPath replace the default paths of transactions and error notifications.
+	// {txn_id} is replaced with the transaction ID and {appservice_id} with the appservice ID.
+	TransactionPath string `json:"transaction_path,omitempty"`
+	ErrorPath       string `json:"error_path,omitempty"`
+	// Auth contains credentials for a zero-trust proxy (e.g. Cloudflare Access or IAP) in front of the target.
+	Auth *DeliveryAuth `json:"auth,omitempty"`
+	// TLS contains custom TLS settings, e.g. for targets with self-signed certificates.
+	TLS *DeliveryTLSOptions `json:"tls,omitempty"`
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout override the proxy-wide delivery client timeouts.
+	DialTimeout           string `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   string `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout string `json:"response_header_timeout,omitempty"`
+
+	timeout               time.Duration
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	pins                  map[[sha256.Size]byte]struct{}
+}
+
+// DeliveryTLSOptions are per-target TLS settings for HTTPS and wss:// delivery.
+type DeliveryTLSOptions struct {
+	// CACertificates is a PEM bundle of CA certificates that are trusted instead of the system roots.
+	CACertificates string `json:"ca_certificates,omitempty"`
+	// ServerName overrides the host name that is sent in SNI and that the certificate is verified against.
+	ServerName string `json:"server_name,omitempty"`
+	// InsecureSkipVerify disables certificate verification. Pinned keys are still checked if set.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// ClientCertificate and ClientKey are a PEM certificate and key for mutual TLS, which replace the proxy-wide certificate.
+	ClientCertificate string `json:"client_certificate,omitempty"`
+	ClientKey         string `json:"client_key,omitempty"`
+
+	roots      *x509.CertPool
+	clientCert *tls.Certificate
+}
+
+// Parse validates the options and parses the CA bundle.
+func (opts *DeliveryTLSOptions) Parse() error {
+	opts.roots = nil
+	if len(opts.CACertificates) > 0 {
+		opts.roots = x509.NewCertPool()
+		if !opts.roots.AppendCertsFromPEM([]byte(opts.CACertificates)) {
+			return fmt.Errorf("tls.ca_certificates doesn't contain any PEM certificates")
+		}
+	}
+	opts.clientCert = nil
+	if len(opts.ClientCertificate) > 0 || len(opts.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair([]byte(opts.ClientCertificate), []byte(opts.ClientKey))
+		if err != nil {
+			return fmt.Errorf("invalid tls.client_certificate or tls.client_key: %w", err)
+		}
+		opts.clientCert = &cert
+	}
+	return nil
+}
+
+const defaultAppserviceIDParam = "appservice_id"
+
+// appserviceIDParam returns the query parameter name for the appservice ID, or an empty string if it should be omitted.
+func (opts *DeliveryOptions) appserviceIDParam() string {
+	if opts == nil || opts.AppserviceIDParam == nil {
+		return defaultAppserviceIDParam
+	}
+	return *opts.AppserviceIDParam
+}
+
+// Parse validates the options and parses the timeout.
+func (opts *DeliveryOptions) Parse() (err error) {
+	if opts.timeout, err = parseOptionalDuration("timeout", opts.Timeout); err != nil {
+		return
+	} else if opts.dialTimeout, err = parseOptionalDuration("dial_timeout", opts.DialTimeout); err != nil {
+		return
+	} else if opts.tlsHandshakeTimeout, err = parseOptionalDuration("tls_handshake_timeout", opts.TLSHandshakeTimeout); err != nil {
+		return
+	} else if opts.responseHeaderTimeout, err = parseOptionalDuration("response_header_timeout", opts.ResponseHeaderTimeout); err != nil {
+		return
+	} else if opts.MaxIdleConns < 0 || opts.MaxIdleConns > maxDeliveryIdleConns {
+		return fmt.Errorf("max_idle_conns must be between 0 and %d", maxDeliveryIdleConns)
+	} else if opts.AppserviceIDParam != nil && strings.ContainsAny(*opts.AppserviceIDParam, "&=#?") {
+		return fmt.Errorf("appservice_id_param can't contain &, =, # or ?")
+	} else if err = validateTxnPathTemplate("transaction_path", opts.TransactionPath); err != nil {
+		return err
+	} else if err = validateTxnPathTemplate("error_path", opts.ErrorPath); err != nil {
+		return err
+	} else if opts.Auth != nil {
+		if err = opts.Auth.Validate(); err != nil {
+			return err
+		}
+	}
+	if opts.TLS != nil {
+		if err = opts.TLS.Parse(); err != nil {
+			return err
+		}
+	}
+	opts.pins = nil
+	for _, pin := range opts.PinnedSPKI {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("pinned_spki entry %q is not a base64-encoded SHA-256 hash", pin)
+		}
+		if opts.pins == nil {
+			opts.pins = make(map[[sha256.Size]byte]struct{}, len(opts.PinnedSPKI))
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		opts.pins[key] = struct{}{}
+	}
+	return nil
+}
+
+var errSPKIPinMismatch = errors.New("server certificate doesn't match any pinned public key")
+var errPinnedNotHTTPS = errors.New("refusing to send request to pinned target over plain HTTP")
+
+// verifyPins checks that the certificate chain presented by the server contains a pinned public key.
+func (opts *DeliveryOptions) verifyPins(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		if _, ok := opts.pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+			return nil
+		}
+	}
+	return errSPKIPinMismatch
+}
+
+// tlsConfig returns the TLS config for connections to the target, or nil if the defaults should be used.
+// The normal certificate verification still applies unless it's explicitly disabled, and the pin is checked in addition to it.
+func (opts *DeliveryOptions) tlsConfig() *tls.Config {
+	hasOpts := opts != nil && (len(opts.pins) > 0 || opts.TLS != nil)
+	if !hasOpts && deliveryClientCert == nil {
+		return nil
+	}
+	tlsConfig := &tls.Config{}
+	if deliveryClientCert != nil {
+		tlsConfig.GetClientCertificate = deliveryClientCert.GetClientCertificate
+	}
+	if !hasOpts {
+		return tlsConfig
+	}
+	if len(opts.pins) > 0 {
+		tlsConfig.VerifyConnection = opts.verifyPins
+	}
+	if opts.TLS != nil {
+		tlsConfig.RootCAs = opts.TLS.roots
+		tlsConfig.ServerName = opts.TLS.ServerName
+		tlsConfig.InsecureSkipVerify = opts.TLS.InsecureSkipVerify
+		if opts.TLS.clientCert != nil {
+			clientCert := opts.TLS.clientCert
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return clientCert, nil
+			}
+		}
+	}
+	return tlsConfig
+}
+
+// httpsOnlyTransport rejects requests that aren't HTTPS, so that the hs_token of targets
+// with pinned keys is never sent in plain text.
+type httpsOnlyTransport struct {
+	*http.Transport
+}
+
+func (hot httpsOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, errPinnedNotHTTPS
+	}
+	return hot.Transport.RoundTrip(req)
+}
+
+func (target *SyncTarget) deliveryOptionsJSON() string {
+	if target.Delivery == nil {
+		return ""
+	}
+	data, _ := json.Marshal(target.Delivery)
+	return string(data)
+}
+
+func parseDeliveryOptionsJSON(data string) (*DeliveryOptions, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var opts DeliveryOptions
+	if err := json.Unmarshal([]byte(data), &opts); err != nil {
+		return nil, err
+	}
+	return &opts, opts.Parse()
+}
+
+// overrideDuration returns the per-target value if it's set, and the proxy-wide value otherwise.
+func overrideDuration(proxyWide, perTarget time.Duration) time.Duration {
+	if perTarget > 0 {
+		return perTarget
+	}
+	return proxyWide
+}
+
+// getDeliveryClientConfig returns the proxy-wide delivery client settings and proxy, which can change when the config is reloaded.
+func getDeliveryClientConfig() (DeliveryClientConfig, proxyFunc) {
+	runtimeLock.RLock()
+	defer runtimeLock.RUnlock()
+	return cfg.DeliveryClient, deliveryProxy
+}
+
+// deliveryDialer returns the dialer for TCP connections to the target, which is shared by HTTP and websocket delivery.
+func deliveryDialer(clientCfg DeliveryClientConfig, opts *DeliveryOptions) *net.Dialer {
+	dialTimeout := clientCfg.DialTimeout
+	if opts != nil {
+		dialTimeout = overrideDuration(dialTimeout, opts.dialTimeout)
+	}
+	return &net.Dialer{Timeout: dialTimeout, KeepAlive: clientCfg.KeepAlive}
+}
+
+func newDeliveryClient(opts *DeliveryOptions) *http.Client {
+	clientCfg, proxy := getDeliveryClientConfig()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = deliveryDialer(clientCfg, opts).DialContext
+	transport.TLSHandshakeTimeout = clientCfg.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = clientCfg.ResponseHeaderTimeout
+	transport.IdleConnTimeout = clientCfg.IdleConnTimeout
+	transport.MaxIdleConnsPerHost = clientCfg.MaxIdleConnsPerHost
+	transport.TLSClientConfig = opts.tlsConfig()
+	var next http.RoundTripper = transport
+	client := &http.Client{Timeout: clientCfg.Timeout}
+	if opts != nil {
+		client.Timeout = overrideDuration(client.Timeout, opts.timeout)
+		transport.TLSHandshakeTimeout = overrideDuration(transport.TLSHandshakeTimeout, opts.tlsHandshakeTimeout)
+		transport.ResponseHeaderTimeout = overrideDuration(transport.ResponseHeaderTimeout, opts.responseHeaderTimeout)
+		if opts.MaxIdleConns > 0 {
+			transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+		}
+		if len(opts.pins) > 0 {
+			next = httpsOnlyTransport{transport}
+		}
+		if opts.Auth != nil {
+			next = &authTransport{auth: opts.Auth, next: next}
+		}
+	}
+	client.Transport = &tracingTransport{client: httpClientTarget, next: next}
+	return client
+}
+
+// getDeliveryClient returns the HTTP client of the target, creating it if necessary. Each target has its own
+// connection pool, so that a slow or misbehaving target can't use up connections meant for other targets.
+func (target *SyncTarget) getDeliveryClient() *http.Client {
+	target.credsLock.Lock()
+	defer target.credsLock.Unlock()
+	if target.deliveryClient == nil {
+		target.deliveryClient = newDeliveryClient(target.Delivery)
+	}
+	return target.deliveryClient
+}
+
+func init() {
+	registry.Subscribe(func(evt TargetEvent) {
+		if evt.Type == TargetRemoved {
+			evt.Target.closeDeliveryClient()
+		}
+	})
+}
+
+// closeDeliveryClient drops the HTTP client of the target and closes its idle connections.
+// Requests that are already in progress finish normally, and the next request creates a new client.
+// Websockets are closed immediately, so transactions waiting on them fail and are retried over a new connection.
+func (target *SyncTarget) closeDeliveryClient() {
+	target.credsLock.Lock()
+	client := target.deliveryClient
+	target.deliveryClient = nil
+	target.closeDeliveryWebsockets()
+	target.credsLock.Unlock()
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,139 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const drainInFlightPollInterval = 100 * time.Millisecond
+
+// DrainStatus is the response of the drain endpoints.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	// Complete is true once every sync loop has stopped and the state has been written to the database.
+	Complete    bool  `json:"complete"`
+	StartedAt   int64 `json:"started_at,omitempty"`
+	CompletedAt int64 `json:"completed_at,omitempty"`
+	// Running is the number of sync loops that haven't stopped yet.
+	Running int `json:"running"`
+	// UnflushedWrites is the number of database writes that couldn't be flushed after the sync loops stopped.
+	UnflushedWrites int `json:"unflushed_writes,omitempty"`
+}
+
+// drainState tracks drain mode, where the proxy stops accepting new targets and stops syncing
+// so that it can be upgraded or shut down without losing anything. Draining can't be canceled,
+// the process is expected to be restarted afterwards.
+type drainState struct {
+	status DrainStatus
+	lock   sync.RWMutex
+}
+
+var drain drainState
+
+func (ds *drainState) IsDraining() bool {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+	return ds.status.Draining
+}
+
+func (ds *drainState) Status() DrainStatus {
+	ds.lock.RLock()
+	status := ds.status
+	ds.lock.RUnlock()
+	if !status.Complete {
+		for _, target := range registry.Snapshot() {
+			if target.isRunning() {
+				status.Running++
+			}
+		}
+	}
+	return status
+}
+
+// Start enables drain mode and drains in the background. Returns false if draining was already started.
+func (ds *drainState) Start() bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.status.Draining {
+		return false
+	}
+	ds.status.Draining = true
+	ds.status.StartedAt = nowMillis()
+	go ds.run()
+	return true
+}
+
+// run waits for in-flight transactions to be delivered, then stops every sync loop and flushes the database writes.
+// Transactions that aren't delivered within the shutdown timeout are stored in the pending queue when their loop is stopped.
+func (ds *drainState) run() {
+	log.Infoln("Draining: waiting for in-flight transactions to be delivered")
+	deadline := time.Now().Add(cfg.ShutdownTimeout)
+	for _, target := range registry.Snapshot() {
+		for target.isRunning() && target.getInFlight() != nil && time.Now().Before(deadline) {
+			time.Sleep(drainInFlightPollInterval)
+		}
+	}
+	handOffInFlight()
+	if remaining := stopAllTargets(time.Until(deadline)); remaining > 0 {
+		log.Warnfln("Draining: %d sync loops didn't stop in time, their in-flight transactions were already handed off", remaining)
+	}
+	recordShutdown()
+	unflushed := deferredWrites.Flush()
+	if unflushed > 0 {
+		log.Warnfln("Draining: %d deferred database writes couldn't be flushed", unflushed)
+	}
+	releaseLeases()
+	ds.lock.Lock()
+	ds.status.Complete = true
+	ds.status.CompletedAt = nowMillis()
+	ds.status.UnflushedWrites = unflushed
+	ds.lock.Unlock()
+	log.Infoln("Draining complete")
+}
+
+// rejectIfDraining writes an error and returns false if the proxy is draining.
+func rejectIfDraining(w http.ResponseWriter) bool {
+	if drain.IsDraining() {
+		errDraining.Write(w)
+		return false
+	}
+	return true
+}
+
+func getDrain(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, drain.Status())
+}
+
+func postDrain(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	if drain.Start() {
+		log.Infofln("Drain mode enabled by %s", clientIP(r))
+		writeJSON(w, http.StatusAccepted, drain.Status())
+	} else {
+		writeJSON(w, http.StatusOK, drain.Status())
+	}
+}
@@ -0,0 +1,44 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// captureDryRunTransaction is called instead of actually sending the transaction when the target is in dry run mode.
+// The transaction is logged, and if DRY_RUN_CAPTURE_DIR is set, the request body is also written to disk.
+func (target *SyncTarget) captureDryRunTransaction(txnLog maulogger.Logger, txnID, txnURL string, body []byte) error {
+	txnLog.Infofln("Dry run: not sending transaction %s (%d bytes) to %s", txnID, len(body), txnURL)
+	if len(cfg.DryRunCaptureDir) == 0 {
+		return nil
+	}
+	dir := filepath.Join(cfg.DryRunCaptureDir, filepath.Clean("/" + target.ID())[1:])
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create dry run capture directory: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s.json", txnID))
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		return fmt.Errorf("failed to write dry run capture: %w", err)
+	}
+	txnLog.Debugfln("Wrote dry run capture of transaction %s to %s", txnID, path)
+	return nil
+}
@@ -0,0 +1,125 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// formatError fills the parameters of an error message template.
+func formatError(err appservice.Error, args ...interface{}) appservice.Error {
+	for i, arg := range args {
+		if argErr, ok := arg.(error); ok {
+			args[i] = argErr.Error()
+		}
+	}
+	err.Message = fmt.Sprintf(err.Message, args...)
+	return err
+}
+
+type ErrorCatalogEntry struct {
+	// ID is a stable identifier for the error. Unlike errcode, it's unique for each error.
+	ID         string   `json:"id"`
+	ErrorCode  string   `json:"errcode"`
+	HTTPStatus int      `json:"http_status"`
+	Message    string   `json:"message"`
+	Parameters []string `json:"parameters,omitempty"`
+}
+
+func catalogEntry(id string, err appservice.Error, params ...string) ErrorCatalogEntry {
+	message := err.Message
+	for _, param := range params {
+		message = strings.Replace(message, "%s", fmt.Sprintf("{%s}", param), 1)
+	}
+	return ErrorCatalogEntry{
+		ID:         id,
+		ErrorCode:  string(err.ErrorCode),
+		HTTPStatus: err.HTTPStatus,
+		Message:    message,
+		Parameters: params,
+	}
+}
+
+// errorCatalog contains every error that the API can return.
+// Message parameters are shown as {name} in the catalog.
+var errorCatalog = []ErrorCatalogEntry{
+	catalogEntry("missing_token", errMissingToken),
+	catalogEntry("unknown_token", errUnknownToken),
+	catalogEntry("address_not_allowed", errAddressNotAllowed),
+	catalogEntry("bad_json", errBadJSON),
+	catalogEntry("target_not_found", errTargetNotFound),
+	catalogEntry("target_not_active", errTargetNotActive),
+	catalogEntry("target_not_paused", errTargetNotPaused),
+	catalogEntry("upsert_failed", errUpsertFailed),
+	catalogEntry("purge_failed", errPurgeFailed),
+	catalogEntry("pending_export_failed", errPendingExportFailed),
+	catalogEntry("invalid_confirmation", errInvalidConfirmation),
+	catalogEntry("device_id_mismatch", errDeviceIDMismatch),
+	catalogEntry("appservice_id_mismatch", errAppserviceIDMismatch),
+	catalogEntry("invalid_appservice_id", errInvalidAppserviceID),
+	catalogEntry("registration_invalid", errRegistrationInvalid),
+	catalogEntry("unknown_template", errUnknownTemplate),
+	catalogEntry("missing_address", errMissingAddress),
+	catalogEntry("missing_tokens", errMissingTokens),
+	catalogEntry("invalid_suspend_duration", errInvalidSuspendDuration),
+	catalogEntry("invalid_token_lifetime", errInvalidTokenLifetime),
+	catalogEntry("transaction_not_found", errTransactionNotFound),
+	catalogEntry("invalid_query_param", errInvalidQueryParam, "error"),
+	catalogEntry("database_query_failed", errDatabaseQueryFailed),
+	catalogEntry("support_bundle_failed", errSupportBundleFailed),
+	catalogEntry("draining", errDraining),
+	catalogEntry("whoami_failed", errWhoamiFailed, "error"),
+	catalogEntry("verify_credentials_failed", errVerifyCredentialsFailed, "error"),
+	catalogEntry("credentials_user_mismatch", errCredentialsUserMismatch, "actual_user_id", "expected_user_id"),
+	catalogEntry("credentials_device_mismatch", errCredentialsDeviceMismatch, "actual_device_id", "expected_device_id"),
+	catalogEntry("confirmation_required", errConfirmationRequired, "operation"),
+	catalogEntry("token_validation_failed", errTokenValidationFailed, "error"),
+	catalogEntry("ping_failed", errTargetPingFailed, "error"),
+	catalogEntry("initial_sync_failed", errInitialSyncFailed, "error"),
+	catalogEntry("initial_sync_timeout", errInitialSyncTimeout, "timeout", "error"),
+	catalogEntry("invalid_next_batch_reset", errInvalidNextBatchReset),
+	catalogEntry("next_batch_reset_failed", errNextBatchResetFailed, "error"),
+	catalogEntry("skip_backlog_failed", errSkipBacklogFailed, "error"),
+	catalogEntry("invalid_quiet_hours", errInvalidQuietHours, "error"),
+	catalogEntry("invalid_address", errInvalidAddress, "error"),
+	catalogEntry("invalid_registration_target", errInvalidRegistrationTarget, "error"),
+	catalogEntry("invalid_runtime_config", errInvalidRuntimeConfig, "error"),
+	catalogEntry("invalid_synchronous_policy", errInvalidSynchronousPolicy, "error"),
+	catalogEntry("invalid_sync_backend", errInvalidSyncBackend, "error"),
+	catalogEntry("invalid_homeserver_url", errInvalidHomeserverURL, "error"),
+	catalogEntry("invalid_recipients", errInvalidRecipients, "error"),
+	catalogEntry("invalid_labels", errInvalidLabels, "error"),
+	catalogEntry("invalid_delivery_options", errInvalidDeliveryOptions, "error"),
+	catalogEntry("invalid_retry_policy", errInvalidRetryPolicy, "error"),
+	catalogEntry("invalid_label_filter", errInvalidLabelFilter, "error"),
+	catalogEntry("invalid_otk_count_options", errInvalidOTKCountOptions, "error"),
+	catalogEntry("invalid_device_list_dedup", errInvalidDeviceListDedup, "error"),
+	catalogEntry("masquerade_missing_identity", errMasqueradeMissingIdentity),
+	catalogEntry("config_reload_unavailable", errConfigReloadUnavailable),
+	catalogEntry("config_reload_failed", errConfigReloadFailed, "error"),
+	catalogEntry("restart_failed", errRestartFailed, "error"),
+}
+
+func getErrorCatalog(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errors": errorCatalog,
+	})
+}
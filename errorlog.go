@@ -0,0 +1,120 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// ErrorSource describes which part of the proxy an error in the recent errors log came from.
+type ErrorSource string
+
+const (
+	ErrorSourceSync     ErrorSource = "sync"
+	ErrorSourceDelivery ErrorSource = "delivery"
+	ErrorSourceStop     ErrorSource = "stop"
+)
+
+type TargetError struct {
+	Timestamp int64       `json:"timestamp"`
+	Source    ErrorSource `json:"source"`
+	Category  string      `json:"category"`
+	Message   string      `json:"message"`
+}
+
+// errorRing is a fixed-size ring buffer of the most recent errors of a target.
+type errorRing struct {
+	entries []TargetError
+	next    int
+	lock    sync.Mutex
+}
+
+func (ring *errorRing) Add(entry TargetError) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	if len(ring.entries) < cfg.RecentErrors.Limit {
+		ring.entries = append(ring.entries, entry)
+	} else {
+		ring.entries[ring.next] = entry
+	}
+	ring.next = (ring.next + 1) % cfg.RecentErrors.Limit
+}
+
+// List returns the errors in the ring, newest first.
+func (ring *errorRing) List() []TargetError {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	list := make([]TargetError, len(ring.entries))
+	for i := range list {
+		list[i] = ring.entries[(ring.next-1-i+2*len(ring.entries))%len(ring.entries)]
+	}
+	return list
+}
+
+func (target *SyncTarget) recordError(source ErrorSource, category string, err error) {
+	if cfg.RecentErrors.Limit <= 0 {
+		return
+	}
+	entry := TargetError{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Source:    source,
+		Category:  category,
+		Message:   err.Error(),
+	}
+	target.recentErrors.Add(entry)
+	if cfg.RecentErrors.Persist {
+		if dbErr := store.InsertTargetError(context.Background(), target.storageID(), target.DeviceKey, entry, cfg.RecentErrors.Limit); dbErr != nil {
+			log.Warnfln("Failed to store error of %s in database: %v", target.ID(), dbErr)
+		}
+	}
+}
+
+// RecentErrors returns the most recent errors of the target, newest first.
+// If errors are persisted, the store is used so that errors from before a restart are included.
+func (target *SyncTarget) RecentErrors() ([]TargetError, error) {
+	if cfg.RecentErrors.Persist {
+		return store.GetTargetErrors(context.Background(), target.storageID(), target.DeviceKey, cfg.RecentErrors.Limit)
+	}
+	return target.recentErrors.List(), nil
+}
+
+func getRecentErrors(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	}
+	errs, err := target.RecentErrors()
+	if err != nil {
+		log.Warnfln("Failed to get recent errors of %s: %v", target.ID(), err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errors": errs,
+	})
+}
@@ -0,0 +1,90 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// knownToDeviceTypes are the to-device event types that are counted separately.
+// Other types are counted as "other" to keep the number of metric series bounded.
+var knownToDeviceTypes = map[string]struct{}{
+	event.ToDeviceEncrypted.Type:                {},
+	event.ToDeviceRoomKey.Type:                  {},
+	event.ToDeviceRoomKeyRequest.Type:           {},
+	event.ToDeviceForwardedRoomKey.Type:         {},
+	event.ToDeviceRoomKeyWithheld.Type:          {},
+	event.ToDeviceOrgMatrixRoomKeyWithheld.Type: {},
+	"m.secret.request":                          {},
+	"m.secret.send":                             {},
+	"m.dummy":                                   {},
+	selfTestEventType.Type:                      {},
+}
+
+const verificationTypePrefix = "m.key.verification."
+
+// eventTypeGroup returns the name that the given event type is counted under.
+func eventTypeGroup(evtType string) string {
+	if strings.HasPrefix(evtType, verificationTypePrefix) {
+		return verificationTypePrefix + "*"
+	} else if _, ok := knownToDeviceTypes[evtType]; ok {
+		return evtType
+	}
+	return "other"
+}
+
+// eventTypeCounter counts the to-device events delivered to a target by event type.
+type eventTypeCounter struct {
+	counts map[string]uint64
+	lock   sync.Mutex
+}
+
+// Count records the given events as delivered to the target.
+func (etc *eventTypeCounter) Count(targetID string, evts []*event.Event) {
+	if len(evts) == 0 {
+		return
+	}
+	etc.lock.Lock()
+	defer etc.lock.Unlock()
+	if etc.counts == nil {
+		etc.counts = make(map[string]uint64)
+	}
+	seriesLimiter.RecordActivity(targetID, len(evts))
+	label, _ := seriesLimiter.Label(targetID)
+	for _, evt := range evts {
+		group := eventTypeGroup(evt.Type.Type)
+		etc.counts[group]++
+		forwardedEvents.WithLabelValues(label, group).Inc()
+	}
+}
+
+// Snapshot returns a copy of the counts since the target was loaded, or nil if nothing has been delivered.
+func (etc *eventTypeCounter) Snapshot() map[string]uint64 {
+	etc.lock.Lock()
+	defer etc.lock.Unlock()
+	if len(etc.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]uint64, len(etc.counts))
+	for group, count := range etc.counts {
+		counts[group] = count
+	}
+	return counts
+}
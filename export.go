@@ -0,0 +1,90 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ExportedTransaction is an undelivered transaction from the pending queue of a target,
+// returned or written to disk so that the data (e.g. room keys) can be imported manually.
+type ExportedTransaction struct {
+	TxnID       string          `json:"txn_id"`
+	Sequence    uint64          `json:"sequence,omitempty"`
+	CreatedAt   int64           `json:"created_at"`
+	Transaction json.RawMessage `json:"transaction"`
+}
+
+// exportPendingTransactions returns the whole pending queue of the target without removing anything.
+func (target *SyncTarget) exportPendingTransactions() ([]ExportedTransaction, error) {
+	queued, err := store.GetQueuedTransactions(context.Background(), target.storageID(), target.DeviceKey, PendingCursor{}, 0)
+	if err != nil {
+		return nil, err
+	}
+	exported := make([]ExportedTransaction, len(queued))
+	for i, item := range queued {
+		exported[i] = ExportedTransaction{
+			TxnID:       item.TxnID,
+			Sequence:    item.Sequence,
+			CreatedAt:   item.CreatedAt,
+			Transaction: item.Data,
+		}
+	}
+	return exported, nil
+}
+
+// writePendingExport writes the exported transactions to PENDING_EXPORT_DIR and returns the path of the file.
+// Nothing is written if the directory isn't configured or there are no transactions.
+func (target *SyncTarget) writePendingExport(exported []ExportedTransaction) (string, error) {
+	if len(cfg.PendingExportDir) == 0 || len(exported) == 0 {
+		return "", nil
+	}
+	dir := filepath.Join(cfg.PendingExportDir, filepath.Clean("/" + target.ID())[1:])
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create pending export directory: %w", err)
+	}
+	data, err := json.Marshal(exported)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal pending transactions: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", time.Now().UnixNano()/int64(time.Millisecond)))
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write pending export: %w", err)
+	}
+	return path, nil
+}
+
+// exportBeforePurge loads the pending queue of a stopped target and writes it to PENDING_EXPORT_DIR
+// if configured. Purging must be aborted if this fails, as the transactions would be lost otherwise.
+func (target *SyncTarget) exportBeforePurge() ([]ExportedTransaction, string, error) {
+	exported, err := target.exportPendingTransactions()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load pending transactions: %w", err)
+	}
+	path, err := target.writePendingExport(exported)
+	if err != nil {
+		return nil, "", err
+	} else if len(path) > 0 {
+		target.log.Infofln("Wrote %d undelivered transactions to %s before purging", len(exported), path)
+	}
+	return exported, path, nil
+}
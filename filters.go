@@ -0,0 +1,122 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+)
+
+// Sync filters are uploaded once per bot account and filter content, and the filter IDs are stored so that
+// they can be reused when the target restarts or is registered again. The client-server API has no way to
+// delete filters, so reusing them is the only way to keep them from piling up on the homeserver. Filters of
+// accounts that no longer have any targets are counted as orphaned and reused if the account comes back.
+
+func hashFilter(filter *mautrix.Filter) (string, error) {
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// updateOrphanedFilterMetric counts stored filters whose account doesn't have any targets.
+func updateOrphanedFilterMetric() {
+	count, err := store.CountOrphanedFilters(context.Background())
+	if err != nil {
+		log.Warnln("Failed to count orphaned sync filters:", err)
+		return
+	}
+	orphanedFilters.Set(float64(count))
+}
+
+// uploadFilter returns the ID of the given filter for the target's account, uploading it only if
+// the same filter hasn't been uploaded before.
+func (target *SyncTarget) uploadFilter(filter *mautrix.Filter) (string, error) {
+	hash, err := hashFilter(filter)
+	if err != nil {
+		return "", err
+	}
+	if filterID, err := store.GetFilterID(context.Background(), target.UserID, hash); err != nil {
+		target.log.Warnln("Failed to get stored filter ID, uploading a new filter:", err)
+	} else if len(filterID) > 0 {
+		target.log.Debugln("Reusing previously uploaded filter", filterID)
+		return filterID, nil
+	}
+	resp, err := target.getClient().CreateFilter(filter)
+	if err != nil {
+		return "", err
+	}
+	syncFiltersCreated.Inc()
+	createdAt := time.Now().UnixNano() / int64(time.Millisecond)
+	if err = store.SetFilterID(context.Background(), target.UserID, hash, resp.FilterID, createdAt); err != nil {
+		target.log.Warnln("Failed to store uploaded filter ID:", err)
+	}
+	return resp.FilterID, nil
+}
+
+// isUnknownFilterError checks whether a sync error means that the homeserver doesn't know the filter ID,
+// e.g. because it was purged from the homeserver's database.
+func isUnknownFilterError(err error) bool {
+	if errors.Is(err, mautrix.MNotFound) {
+		return true
+	}
+	var httpErr mautrix.HTTPError
+	return errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_INVALID_PARAM" &&
+		strings.Contains(strings.ToLower(httpErr.RespError.Err), "filter")
+}
+
+// recreateSyncFilter forgets the stored ID of the target's filter and uploads it again.
+func (target *SyncTarget) recreateSyncFilter(hsInfo *HomeserverInfo) (string, error) {
+	hash, err := hashFilter(target.getSyncFilter())
+	if err != nil {
+		return "", err
+	} else if err = store.DeleteFilterID(context.Background(), target.UserID, hash); err != nil {
+		return "", fmt.Errorf("failed to delete stored filter ID: %w", err)
+	}
+	return target.createSyncFilter(hsInfo)
+}
+
+func (target *SyncTarget) syncFilterJSON() string {
+	if target.Filter == nil {
+		return ""
+	}
+	data, _ := json.Marshal(target.Filter)
+	return string(data)
+}
+
+func parseSyncFilterJSON(data string) (*mautrix.Filter, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var filter mautrix.Filter
+	if err := json.Unmarshal([]byte(data), &filter); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
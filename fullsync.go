@@ -0,0 +1,83 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// fullSyncFilter is the default filter of targets in full sync mode. It includes everything except presence,
+// which is controlled by the forward_presence option.
+var fullSyncFilter = &mautrix.Filter{
+	Presence: nothing,
+}
+
+// stripRoomData removes the room events and account data from a sync response,
+// so that targets that aren't in full sync mode only get them if they ask for them.
+func stripRoomData(resp *mautrix.RespSync) {
+	resp.AccountData.Events = nil
+	for roomID, room := range resp.Rooms.Join {
+		room.State.Events = nil
+		room.Timeline.Events = nil
+		room.AccountData.Events = nil
+		resp.Rooms.Join[roomID] = room
+	}
+	resp.Rooms.Invite = nil
+	resp.Rooms.Leave = nil
+}
+
+// hasRoomData checks if the sync response has any room events, room ephemeral events or account data.
+func hasRoomData(resp *mautrix.RespSync) bool {
+	if len(resp.AccountData.Events) > 0 || len(resp.Rooms.Invite) > 0 || len(resp.Rooms.Leave) > 0 {
+		return true
+	}
+	for _, room := range resp.Rooms.Join {
+		if len(room.Ephemeral.Events) > 0 || len(room.State.Events) > 0 || len(room.Timeline.Events) > 0 || len(room.AccountData.Events) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func appendRoomEvents(events []*event.Event, roomID id.RoomID, roomEvents []*event.Event) []*event.Event {
+	for _, evt := range roomEvents {
+		evt.RoomID = roomID
+		events = append(events, evt)
+	}
+	return events
+}
+
+// addRoomData converts the room events in a sync response into the events of an appservice transaction.
+// State events from the state section come before the timeline like in the sync response. Account data
+// has no equivalent in transactions, so it's sent as ephemeral events, with room_id set for room account data.
+func addRoomData(resp *mautrix.RespSync, txn *Transaction) {
+	for roomID, room := range resp.Rooms.Join {
+		txn.Events = appendRoomEvents(txn.Events, roomID, room.State.Events)
+		txn.Events = appendRoomEvents(txn.Events, roomID, room.Timeline.Events)
+		txn.EphemeralEvents = appendRoomEvents(txn.EphemeralEvents, roomID, room.AccountData.Events)
+	}
+	for roomID, room := range resp.Rooms.Invite {
+		txn.Events = appendRoomEvents(txn.Events, roomID, room.State.Events)
+	}
+	for roomID, room := range resp.Rooms.Leave {
+		txn.Events = appendRoomEvents(txn.Events, roomID, room.State.Events)
+		txn.Events = appendRoomEvents(txn.Events, roomID, room.Timeline.Events)
+	}
+	txn.EphemeralEvents = append(txn.EphemeralEvents, resp.AccountData.Events...)
+}
@@ -4,9 +4,11 @@ go 1.16
 
 require (
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/prometheus/client_golang v1.11.0
+	gopkg.in/yaml.v2 v2.3.0
 	maunium.net/go/maulogger/v2 v2.3.0
 	maunium.net/go/mautrix v0.9.22
 )
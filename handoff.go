@@ -0,0 +1,46 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	log "maunium.net/go/maulogger/v2"
+)
+
+// handOffInFlight stores the in-flight transaction of every target in the pending queue during a planned shutdown.
+// The database is the handoff channel: whichever process starts the targets next delivers the pending queue
+// before syncing, so the transactions don't have to wait for the sync token to be replayed.
+func handOffInFlight() {
+	var running []*SyncTarget
+	for _, target := range registry.Snapshot() {
+		if target.isRunning() {
+			running = append(running, target)
+		}
+	}
+	handedOff := 0
+	for _, target := range running {
+		txnID, err := target.QueueInFlight()
+		if err != nil {
+			target.log.Warnfln("Failed to hand off in-flight transaction %s: %v", txnID, err)
+		} else if len(txnID) > 0 {
+			target.log.Debugfln("Stored in-flight transaction %s in pending queue for handoff", txnID)
+			handedOff++
+		}
+	}
+	if handedOff > 0 {
+		log.Infofln("Handed off %d in-flight transactions through the pending queue", handedOff)
+	}
+}
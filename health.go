@@ -0,0 +1,220 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// HealthResponse is the response of the /health, /live and /ready endpoints.
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Checks contains the result of each dependency check, "ok" or an error message.
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// dbFailingSince is the unix nanosecond timestamp of the first failed database check since the last successful one.
+var dbFailingSince int64
+
+// checkDatabase pings the database and keeps track of how long it has been failing.
+func checkDatabase(ctx context.Context) (failingFor time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	err = db.conn.PingContext(ctx)
+	now := time.Now().UnixNano()
+	if err == nil {
+		atomic.StoreInt64(&dbFailingSince, 0)
+		return 0, nil
+	}
+	atomic.CompareAndSwapInt64(&dbFailingSince, 0, now)
+	return time.Duration(now - atomic.LoadInt64(&dbFailingSince)), err
+}
+
+const databaseCheckInterval = 30 * time.Second
+
+// loopCheckDatabase periodically pings the database, so that lost and restored connections are logged and
+// visible in the syncproxy_db_up metric even when there are no requests to the health endpoints.
+func loopCheckDatabase() {
+	databaseUp.Set(1)
+	var lostAt time.Time
+	for now := range time.Tick(databaseCheckInterval) {
+		_, err := checkDatabase(context.Background())
+		if err != nil {
+			databaseUp.Set(0)
+			if lostAt.IsZero() {
+				log.Errorln("Database connection lost:", err)
+				lostAt = now
+			}
+		} else {
+			databaseUp.Set(1)
+			if !lostAt.IsZero() {
+				log.Infofln("Database connection restored after %v", now.Sub(lostAt).Round(time.Second))
+				lostAt = time.Time{}
+			}
+		}
+	}
+}
+
+// checkHomeserver checks that the homeserver answers the client-server API version endpoint.
+func checkHomeserver(ctx context.Context, homeserverURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, homeserverURL+"/_matrix/client/versions", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := homeserverHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]string, healthy bool) {
+	if healthy {
+		writeJSON(w, http.StatusOK, &HealthResponse{Status: "ok", Checks: checks})
+	} else {
+		writeJSON(w, http.StatusServiceUnavailable, &HealthResponse{Status: "unavailable", Checks: checks})
+	}
+}
+
+// getHealth only tells that the process is up and serving requests.
+func getHealth(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, nil, true)
+}
+
+// getLive fails if the database has been unreachable for longer than the configured timeout,
+// so that e.g. Kubernetes restarts the process instead of it failing every request.
+func getLive(w http.ResponseWriter, r *http.Request) {
+	if cfg.Watchdog.LiveDatabaseTimeout <= 0 || db == nil {
+		writeHealth(w, nil, true)
+		return
+	}
+	failingFor, err := checkDatabase(r.Context())
+	if err == nil {
+		writeHealth(w, map[string]string{"database": "ok"}, true)
+	} else {
+		failing := fmt.Sprintf("failing for %v: %v", failingFor.Round(time.Second), err)
+		writeHealth(w, map[string]string{"database": failing}, failingFor < cfg.Watchdog.LiveDatabaseTimeout)
+	}
+}
+
+// getReady fails if the proxy is draining or if the database or the homeserver of any profile isn't reachable.
+func getReady(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	healthy := true
+	if drain.IsDraining() {
+		checks["drain"] = "draining"
+		healthy = false
+	}
+	// Proxies embedded with a custom store may not have a database.
+	if db != nil {
+		if _, err := checkDatabase(r.Context()); err != nil {
+			checks["database"] = err.Error()
+			healthy = false
+		} else {
+			checks["database"] = "ok"
+		}
+	}
+	for _, profile := range append([]*Profile{defaultProfile}, cfg.Profiles...) {
+		name := "homeserver"
+		if len(profile.Name) > 0 {
+			name = fmt.Sprintf("homeserver:%s", profile.Name)
+		}
+		if err := checkHomeserver(r.Context(), profile.homeserver()); err != nil {
+			checks[name] = err.Error()
+			healthy = false
+		} else {
+			checks[name] = "ok"
+		}
+	}
+	writeHealth(w, checks, healthy)
+}
+
+// localURL returns the URL of the given path on the first listen address of the config, and the Unix socket
+// path if the address is a socket. Wildcard addresses are replaced with the loopback address.
+func localURL(config Config, path string) (fullURL, socketPath string, err error) {
+	address := strings.TrimSpace(strings.Split(config.ListenAddress, ",")[0])
+	path = normalizeBasePath(config.BasePath) + path
+	if len(address) == 0 {
+		return "", "", fmt.Errorf("listen address is not set")
+	} else if strings.HasPrefix(address, unixSocketPrefix) {
+		return "http://localhost" + path, strings.TrimPrefix(address, unixSocketPrefix), nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified() && ip.To4() != nil) {
+		host = "127.0.0.1"
+	} else if ip != nil && ip.IsUnspecified() {
+		host = "::1"
+	}
+	scheme := "http"
+	if config.TLS.Enabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, port), path), "", nil
+}
+
+// localClient returns a HTTP client for requests to a proxy running locally, see localURL.
+func localClient(socketPath string, timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		// The certificate is for the public name of the proxy, not the loopback address.
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	if len(socketPath) > 0 {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// HealthCheck requests the /health endpoint of a proxy running locally with the given config,
+// so that container images can check the health without shipping curl or wget.
+func HealthCheck(config Config) error {
+	healthURL, socketPath, err := localURL(config, "/health")
+	if err != nil {
+		return err
+	}
+	resp, err := localClient(socketPath, healthCheckTimeout).Get(healthURL)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", healthURL, resp.StatusCode)
+	}
+	return nil
+}
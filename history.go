@@ -0,0 +1,220 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const defaultTransactionHistoryRetention = 7 * 24 * time.Hour
+const transactionHistoryPruneInterval = 1 * time.Hour
+
+type TransactionStatus string
+
+const (
+	TransactionStatusPending TransactionStatus = "pending"
+	TransactionStatusSent    TransactionStatus = "sent"
+	TransactionStatusFailed  TransactionStatus = "failed"
+	TransactionStatusDryRun  TransactionStatus = "dry-run"
+	TransactionStatusDropped TransactionStatus = "dropped"
+	// TransactionStatusDeadLettered means the target kept rejecting the transaction and it was moved to the dead letter table.
+	TransactionStatusDeadLettered TransactionStatus = "dead-lettered"
+)
+
+// HistoryEvent is the non-sensitive part of a to-device event that is stored in the transaction history.
+type HistoryEvent struct {
+	Type   string    `json:"type"`
+	Sender id.UserID `json:"sender"`
+}
+
+type TransactionHistoryEntry struct {
+	TxnID string `json:"txn_id"`
+	// TraceID is the trace ID in the traceparent header of the transaction. It's derived from the ID, not stored.
+	TraceID      string            `json:"trace_id,omitempty"`
+	AppserviceID string            `json:"appservice_id"`
+	DeviceKey    string            `json:"device_key,omitempty"`
+	Status       TransactionStatus `json:"status"`
+	Attempts     int               `json:"attempts"`
+	CreatedAt    int64             `json:"created_at"`
+	SentAt       int64             `json:"sent_at,omitempty"`
+
+	// SentTo is the delivery status of each recipient, only set for targets with additional recipients.
+	SentTo map[string]SendStatus `json:"sent_to,omitempty"`
+
+	Events            []HistoryEvent `json:"events"`
+	DeviceListChanged int            `json:"device_list_changed"`
+	DeviceListLeft    int            `json:"device_list_left"`
+	OTKCount          bool           `json:"otk_count"`
+}
+
+func newHistoryEntry(appserviceID, deviceKey, txnID string, txn *Transaction) *TransactionHistoryEntry {
+	entry := &TransactionHistoryEntry{
+		TxnID:        txnID,
+		AppserviceID: appserviceID,
+		DeviceKey:    deviceKey,
+		Status:       TransactionStatusPending,
+		CreatedAt:    time.Now().UnixNano() / int64(time.Millisecond),
+		Events:       make([]HistoryEvent, len(txn.EphemeralEvents)),
+		OTKCount:     len(txn.DeviceOTKCount) > 0,
+	}
+	for i, evt := range txn.EphemeralEvents {
+		entry.Events[i] = HistoryEvent{Type: evt.Type.Type, Sender: evt.Sender}
+	}
+	if txn.DeviceLists != nil {
+		entry.DeviceListChanged = len(txn.DeviceLists.Changed)
+		entry.DeviceListLeft = len(txn.DeviceLists.Left)
+	}
+	return entry
+}
+
+func (entry *TransactionHistoryEntry) Insert(ctx context.Context) error {
+	return store.InsertHistoryEntry(ctx, entry)
+}
+
+func (entry *TransactionHistoryEntry) SetStatus(ctx context.Context, status TransactionStatus, attempts int) error {
+	entry.Status = status
+	entry.Attempts = attempts
+	if status == TransactionStatusSent {
+		entry.SentAt = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return store.UpdateHistoryEntry(ctx, entry)
+}
+
+func GetTransactionHistoryEntry(ctx context.Context, appserviceID, txnID string) (*TransactionHistoryEntry, error) {
+	return store.GetHistoryEntry(ctx, appserviceID, txnID)
+}
+
+const defaultHistoryQueryLimit = 50
+const maxHistoryQueryLimit = 500
+
+// HistoryQuery filters the transaction history of a target. Zero values match everything.
+type HistoryQuery struct {
+	Status TransactionStatus
+	// EventType and Sender match transactions that have a to-device event with the given type and sender.
+	EventType string
+	Sender    id.UserID
+	// Since and Before are unix millisecond creation timestamps. Since is inclusive and Before is exclusive.
+	Since  int64
+	Before int64
+	Limit  int
+}
+
+// Matches checks whether the entry matches the query, ignoring the limit.
+func (query *HistoryQuery) Matches(entry *TransactionHistoryEntry) bool {
+	if (len(query.Status) > 0 && entry.Status != query.Status) ||
+		(query.Since > 0 && entry.CreatedAt < query.Since) ||
+		(query.Before > 0 && entry.CreatedAt >= query.Before) {
+		return false
+	} else if len(query.EventType) == 0 && len(query.Sender) == 0 {
+		return true
+	}
+	for _, evt := range entry.Events {
+		if (len(query.EventType) == 0 || evt.Type == query.EventType) && (len(query.Sender) == 0 || evt.Sender == query.Sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventPattern returns a LIKE pattern that matches the JSON-encoded event list of entries with a matching event,
+// or an empty string if the query doesn't filter by events. It relies on the field order of HistoryEvent.
+func (query *HistoryQuery) eventPattern() string {
+	var pattern string
+	if len(query.EventType) > 0 {
+		eventType, _ := json.Marshal(query.EventType)
+		pattern = `{"type":` + string(eventType) + `,`
+	}
+	if len(query.Sender) > 0 {
+		sender, _ := json.Marshal(query.Sender)
+		if len(pattern) > 0 {
+			pattern += `"sender":` + string(sender) + `}`
+		} else {
+			pattern = `,"sender":` + string(sender) + `}`
+		}
+	}
+	if len(pattern) == 0 {
+		return ""
+	}
+	return "%" + likeEscaper.Replace(pattern) + "%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// QueryTransactionHistory returns the history entries of the target that match the query, newest first.
+func QueryTransactionHistory(ctx context.Context, appserviceID, deviceKey string, query HistoryQuery) ([]*TransactionHistoryEntry, error) {
+	return store.QueryHistory(ctx, appserviceID, deviceKey, query)
+}
+
+const transactionSummaryLimit = 100
+
+// TransactionSummary is an aggregate of the non-sensitive metadata of a target's recent transactions.
+type TransactionSummary struct {
+	Transactions      int                       `json:"transactions"`
+	Since             int64                     `json:"since,omitempty"`
+	Statuses          map[TransactionStatus]int `json:"statuses"`
+	EventTypes        map[string]int            `json:"event_types"`
+	DeviceListChanged int                       `json:"device_list_changed"`
+	DeviceListLeft    int                       `json:"device_list_left"`
+	OTKCounts         int                       `json:"otk_counts"`
+}
+
+// SummarizeRecentTransactions aggregates the last transactionSummaryLimit transactions of the target from the history.
+func (target *SyncTarget) SummarizeRecentTransactions() (*TransactionSummary, error) {
+	entries, err := store.GetRecentHistory(context.Background(), target.storageID(), target.DeviceKey, transactionSummaryLimit)
+	if err != nil {
+		return nil, err
+	}
+	summary := &TransactionSummary{
+		Statuses:   make(map[TransactionStatus]int),
+		EventTypes: make(map[string]int),
+	}
+	for _, entry := range entries {
+		summary.Transactions++
+		summary.Since = entry.CreatedAt
+		summary.Statuses[entry.Status]++
+		for _, evt := range entry.Events {
+			summary.EventTypes[evt.Type]++
+		}
+		summary.DeviceListChanged += entry.DeviceListChanged
+		summary.DeviceListLeft += entry.DeviceListLeft
+		if entry.OTKCount {
+			summary.OTKCounts++
+		}
+	}
+	return summary, nil
+}
+
+func pruneTransactionHistory() {
+	for {
+		cutoff := time.Now().Add(-cfg.TransactionHistoryRetention).UnixNano() / int64(time.Millisecond)
+		count, err := store.PruneHistory(context.Background(), cutoff)
+		if err != nil {
+			log.Warnln("Failed to prune transaction history:", err)
+		} else if count > 0 {
+			log.Debugfln("Pruned %d old entries from transaction history", count)
+		}
+		pruneCheckpointedHistory()
+		time.Sleep(transactionHistoryPruneInterval)
+	}
+}
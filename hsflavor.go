@@ -0,0 +1,263 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type HomeserverFlavor string
+
+const (
+	FlavorUnknown  HomeserverFlavor = ""
+	FlavorSynapse  HomeserverFlavor = "synapse"
+	FlavorConduit  HomeserverFlavor = "conduit"
+	FlavorDendrite HomeserverFlavor = "dendrite"
+	FlavorGeneric  HomeserverFlavor = "generic"
+)
+
+// HomeserverQuirk is a workaround for a homeserver that differs from Synapse in a way that affects syncing.
+type HomeserverQuirk string
+
+const (
+	// QuirkOmittedOTKCount treats a missing device_one_time_keys_count as unchanged instead of zero,
+	// for servers that leave it out of incremental syncs. Otherwise targets would be told to upload new keys.
+	QuirkOmittedOTKCount HomeserverQuirk = "omitted_otk_count"
+	// QuirkInlineFilter sends the sync filter as JSON in the filter parameter instead of uploading it first,
+	// for servers that don't support the filter upload endpoint.
+	QuirkInlineFilter HomeserverQuirk = "inline_filter"
+)
+
+var knownQuirks = map[HomeserverQuirk]struct{}{
+	QuirkOmittedOTKCount: {},
+	QuirkInlineFilter:    {},
+}
+
+// defaultQuirks are the workarounds enabled for each detected flavor. Servers that can't be identified
+// get the tolerant ones, since they're harmless on servers that don't need them.
+var defaultQuirks = map[HomeserverFlavor][]HomeserverQuirk{
+	FlavorSynapse:  nil,
+	FlavorConduit:  {QuirkOmittedOTKCount},
+	FlavorDendrite: {QuirkOmittedOTKCount},
+	FlavorGeneric:  {QuirkOmittedOTKCount},
+}
+
+type HomeserverQuirksConfig struct {
+	// Flavor overrides the detected homeserver flavor.
+	Flavor HomeserverFlavor `yaml:"flavor"`
+	// Quirks overrides the workarounds of the flavor if set.
+	Quirks []HomeserverQuirk `yaml:"quirks"`
+}
+
+func parseHomeserverFlavor(val string) (HomeserverFlavor, error) {
+	flavor := HomeserverFlavor(strings.ToLower(val))
+	if _, ok := defaultQuirks[flavor]; !ok {
+		return "", fmt.Errorf("unknown homeserver flavor %q", val)
+	}
+	return flavor, nil
+}
+
+func validateHomeserverQuirks(quirks []HomeserverQuirk) error {
+	for _, quirk := range quirks {
+		if _, ok := knownQuirks[quirk]; !ok {
+			return fmt.Errorf("unknown homeserver quirk %q", quirk)
+		}
+	}
+	return nil
+}
+
+// parseHomeserverQuirks parses a comma-separated list of quirks. An empty string disables all quirks.
+func parseHomeserverQuirks(val string) ([]HomeserverQuirk, error) {
+	quirks := []HomeserverQuirk{}
+	for _, part := range strings.Split(val, ",") {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			quirks = append(quirks, HomeserverQuirk(part))
+		}
+	}
+	return quirks, validateHomeserverQuirks(quirks)
+}
+
+// HomeserverInfo is what was detected about a homeserver when the first sync loop using it started.
+type HomeserverInfo struct {
+	Flavor  HomeserverFlavor  `json:"flavor"`
+	Version string            `json:"version,omitempty"`
+	Quirks  []HomeserverQuirk `json:"quirks,omitempty"`
+	// SlidingSync is true if the server advertises support for simplified sliding sync (MSC4186).
+	SlidingSync bool `json:"sliding_sync,omitempty"`
+}
+
+func (info *HomeserverInfo) Has(quirk HomeserverQuirk) bool {
+	for _, enabled := range info.Quirks {
+		if enabled == quirk {
+			return true
+		}
+	}
+	return false
+}
+
+var homeservers = make(map[string]*HomeserverInfo)
+var homeserversLock sync.Mutex
+
+type respServerVersion struct {
+	Server struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"server"`
+}
+
+// detectFlavor identifies the homeserver implementation. /versions confirms that the server speaks the
+// client-server API, and the federation version endpoint (which is often served on the same listener)
+// tells the implementation name. If the latter isn't available, the server is treated as generic.
+func detectFlavor(client *mautrix.Client) (*HomeserverInfo, error) {
+	versions, err := client.Versions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get supported versions: %w", err)
+	}
+	info := &HomeserverInfo{Flavor: FlavorGeneric, SlidingSync: versions.UnstableFeatures[slidingSyncFeature]}
+	resp, err := homeserverHTTPClient.Get(client.BuildBaseURL("_matrix", "federation", "v1", "version"))
+	if err != nil {
+		return info, nil
+	}
+	defer closeBody(resp.Body)
+	var version respServerVersion
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&version) != nil {
+		return info, nil
+	}
+	info.Version = version.Server.Version
+	switch name := strings.ToLower(version.Server.Name); {
+	case strings.Contains(name, "synapse"):
+		info.Flavor = FlavorSynapse
+	case strings.Contains(name, "conduit"):
+		info.Flavor = FlavorConduit
+	case strings.Contains(name, "dendrite"):
+		info.Flavor = FlavorDendrite
+	}
+	return info, nil
+}
+
+// getHomeserverInfo returns the detected flavor and enabled workarounds of the target's homeserver.
+// Detection is done once per homeserver URL, and failed detections are retried by the next sync loop.
+func (target *SyncTarget) getHomeserverInfo() *HomeserverInfo {
+	hsURL := target.homeserverURL()
+	homeserversLock.Lock()
+	defer homeserversLock.Unlock()
+	if info, ok := homeservers[hsURL]; ok {
+		return info
+	}
+	info := &HomeserverInfo{Flavor: cfg.HomeserverQuirks.Flavor}
+	cache := true
+	if info.Flavor == FlavorUnknown {
+		detected, err := detectFlavor(target.getClient())
+		if err != nil {
+			target.log.Warnln("Failed to detect homeserver flavor:", err)
+			info.Flavor = FlavorGeneric
+			cache = false
+		} else {
+			info = detected
+		}
+	}
+	if cfg.HomeserverQuirks.Quirks != nil {
+		info.Quirks = cfg.HomeserverQuirks.Quirks
+	} else {
+		info.Quirks = defaultQuirks[info.Flavor]
+	}
+	if cache {
+		homeservers[hsURL] = info
+	}
+	log.Infofln("Homeserver %s is %s %s, enabled quirks: %v", hsURL, info.Flavor, info.Version, info.Quirks)
+	return info
+}
+
+// tolerantRespSync notices fields that are missing from the sync response instead of treating them as zero.
+// The outer field shadows the one in the embedded struct when decoding.
+type tolerantRespSync struct {
+	mautrix.RespSync
+	DeviceOTKCount *mautrix.OTKCount `json:"device_one_time_keys_count"`
+	// The fallback key types (MSC2732) aren't in mautrix's RespSync yet.
+	FallbackKeyTypes         []id.KeyAlgorithm `json:"device_unused_fallback_key_types"`
+	UnstableFallbackKeyTypes []id.KeyAlgorithm `json:"org.matrix.msc2732.device_unused_fallback_key_types"`
+}
+
+// syncExtras contains information from the sync response that doesn't fit in mautrix's RespSync.
+type syncExtras struct {
+	// OTKCountKnown is false if the server omitted the OTK count and the omitted OTK count quirk is enabled,
+	// in which case the count in the response shouldn't be used.
+	OTKCountKnown bool
+	// FallbackKeyTypes is the list of unused fallback key algorithms, or nil if the server didn't include it.
+	FallbackKeyTypes []id.KeyAlgorithm
+	// Sliding is the position to store after the response is handled, if the sliding sync backend was used.
+	Sliding *SlidingSyncPosition
+}
+
+// createSyncFilter returns the filter to pass in sync requests, which is either an uploaded filter ID or inline JSON.
+func (target *SyncTarget) createSyncFilter(hsInfo *HomeserverInfo) (string, error) {
+	if hsInfo.Has(QuirkInlineFilter) {
+		data, err := json.Marshal(target.getSyncFilter())
+		return string(data), err
+	}
+	return target.uploadFilter(target.getSyncFilter())
+}
+
+// syncRequest is like mautrix's SyncRequest, but applies the workarounds of the homeserver.
+func (target *SyncTarget) syncRequest(ctx context.Context, hsInfo *HomeserverInfo, timeout int, filter string) (*mautrix.RespSync, syncExtras, error) {
+	client := target.getClient()
+	query := map[string]string{
+		"timeout": strconv.Itoa(timeout),
+		"filter":  filter,
+	}
+	// Targets that forward presence presumably care about presence, so the bot is left online for them.
+	if !target.ForwardPresence {
+		query["set_presence"] = string(event.PresenceOffline)
+	}
+	if len(target.NextBatch) > 0 {
+		query["since"] = target.NextBatch
+	}
+	var resp tolerantRespSync
+	_, err := client.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          client.BuildURLWithQuery(mautrix.URLPath{"sync"}, query),
+		ResponseJSON: &resp,
+		Context:      ctx,
+		// Retries are handled by the sync loop.
+		MaxAttempts: 1,
+	})
+	if err != nil {
+		return nil, syncExtras{}, err
+	}
+	extras := syncExtras{OTKCountKnown: true, FallbackKeyTypes: resp.FallbackKeyTypes}
+	if extras.FallbackKeyTypes == nil {
+		extras.FallbackKeyTypes = resp.UnstableFallbackKeyTypes
+	}
+	if resp.DeviceOTKCount != nil {
+		resp.RespSync.DeviceOTKCount = *resp.DeviceOTKCount
+	} else if hsInfo.Has(QuirkOmittedOTKCount) {
+		extras.OTKCountKnown = false
+	}
+	return &resp.RespSync, extras, nil
+}
@@ -0,0 +1,97 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	httpClientHomeserver = "homeserver"
+	httpClientTarget     = "target"
+)
+
+// homeserverClientTimeout is the same timeout that mautrix uses for its default client.
+const homeserverClientTimeout = 180 * time.Second
+
+// tracingTransport records connection reuse and handshake timings of outgoing requests in metrics,
+// so that network problems can be told apart from slow or failing servers.
+type tracingTransport struct {
+	client string
+	next   http.RoundTripper
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			httpConnections.WithLabelValues(tt.client, strconv.FormatBool(info.Reused)).Inc()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			httpDNSDuration.WithLabelValues(tt.client).Observe(time.Since(dnsStart).Seconds())
+		},
+		ConnectStart: func(_, _ string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				httpConnectDuration.WithLabelValues(tt.client).Observe(time.Since(connectStart).Seconds())
+			}
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				httpTLSHandshakeDuration.WithLabelValues(tt.client).Observe(time.Since(tlsStart).Seconds())
+			}
+		},
+	}
+	return tt.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// CloseIdleConnections allows http.Client.CloseIdleConnections to reach the wrapped transport.
+func (tt *tracingTransport) CloseIdleConnections() {
+	if closer, ok := tt.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+var homeserverHTTPClient = &http.Client{
+	Timeout:   homeserverClientTimeout,
+	Transport: &tracingTransport{client: httpClientHomeserver, next: newHomeserverTransport()},
+}
+
+// newHomeserverClient creates a mautrix client that uses the instrumented HTTP client.
+func newHomeserverClient(homeserverURL string, userID id.UserID, accessToken string) (*mautrix.Client, error) {
+	client, err := mautrix.NewClient(homeserverURL, userID, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	client.Client = homeserverHTTPClient
+	return client, nil
+}
@@ -0,0 +1,109 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const keyRequestWindow = time.Minute
+
+type keyRequestDeviceWindow struct {
+	start    time.Time
+	count    int
+	storming bool
+	seen     map[string]struct{}
+}
+
+// keyRequestLimiter counts room key requests per requesting device. Once a device sends more than
+// the configured number of requests within a minute, only the first request for each session is
+// delivered for the rest of the minute, and repeated requests are dropped.
+type keyRequestLimiter struct {
+	devices map[string]*keyRequestDeviceWindow
+	lock    sync.Mutex
+}
+
+func keyRequestKeys(evt *event.Event) (device, request string) {
+	action, _ := evt.Content.Raw["action"].(string)
+	deviceID, _ := evt.Content.Raw["requesting_device_id"].(string)
+	device = fmt.Sprintf("%s|%s", evt.Sender, deviceID)
+	if body, ok := evt.Content.Raw["body"].(map[string]interface{}); ok {
+		sessionID, _ := body["session_id"].(string)
+		request = fmt.Sprintf("%s|%s", action, sessionID)
+	} else {
+		requestID, _ := evt.Content.Raw["request_id"].(string)
+		request = fmt.Sprintf("%s|%s", action, requestID)
+	}
+	return
+}
+
+func (krl *keyRequestLimiter) prune(now time.Time) {
+	for device, window := range krl.devices {
+		if now.Sub(window.start) > keyRequestWindow {
+			delete(krl.devices, device)
+		}
+	}
+}
+
+// Filter drops repeated key requests from devices that have exceeded the rate limit.
+func (krl *keyRequestLimiter) Filter(target *SyncTarget, evts []*event.Event) []*event.Event {
+	limit := getKeyRequestRateLimit()
+	if limit <= 0 || len(evts) == 0 {
+		return evts
+	}
+	krl.lock.Lock()
+	defer krl.lock.Unlock()
+	now := time.Now()
+	krl.prune(now)
+	if krl.devices == nil {
+		krl.devices = make(map[string]*keyRequestDeviceWindow)
+	}
+	filtered := evts[:0]
+	for _, evt := range evts {
+		if evt.Type != event.ToDeviceRoomKeyRequest {
+			filtered = append(filtered, evt)
+			continue
+		}
+		deviceKey, requestKey := keyRequestKeys(evt)
+		window, ok := krl.devices[deviceKey]
+		if !ok {
+			window = &keyRequestDeviceWindow{start: now, seen: make(map[string]struct{})}
+			krl.devices[deviceKey] = window
+		}
+		window.count++
+		_, alreadySeen := window.seen[requestKey]
+		window.seen[requestKey] = struct{}{}
+		if window.count <= limit {
+			filtered = append(filtered, evt)
+			continue
+		} else if !window.storming {
+			window.storming = true
+			keyRequestStorms.Inc()
+			target.log.Warnfln("Device %s sent more than %d key requests in a minute, dropping repeated requests", deviceKey, limit)
+		}
+		if alreadySeen {
+			droppedKeyRequests.Inc()
+		} else {
+			filtered = append(filtered, evt)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,184 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const maxTargetLabels = 20
+const maxTargetLabelValueLength = 128
+
+// Label keys use the same format as Prometheus label names, so that they can be used in metrics.
+var labelKeyRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxTargetLabels {
+		return fmt.Errorf("too many labels (maximum is %d)", maxTargetLabels)
+	}
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) || strings.HasPrefix(key, "__") {
+			return fmt.Errorf("invalid label key %q", key)
+		} else if len(value) > maxTargetLabelValueLength {
+			return fmt.Errorf("value of label %q is too long", key)
+		}
+	}
+	return nil
+}
+
+func (target *SyncTarget) labelsJSON() string {
+	if len(target.Labels) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(target.Labels)
+	return string(data)
+}
+
+func parseLabelsJSON(data string) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var labels map[string]string
+	err := json.Unmarshal([]byte(data), &labels)
+	return labels, err
+}
+
+// targetLabelInfo is an info metric that maps target IDs to the label keys listed in METRIC_LABELS.
+// Other per-target metrics can be joined with it to aggregate by label, e.g.
+// `syncproxy_slo_burn_rate * on(target) group_left(customer) syncproxy_target_labels`.
+var targetLabelInfo *prometheus.GaugeVec
+
+func initTargetLabelMetric() {
+	if len(cfg.MetricLabels) == 0 {
+		return
+	}
+	targetLabelInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_labels",
+		Help: "Labels of each target, the value is always 1",
+	}, append([]string{"target"}, cfg.MetricLabels...))
+}
+
+// updateLabelMetric replaces the label info metric of the target with its current labels.
+func (target *SyncTarget) updateLabelMetric() {
+	if targetLabelInfo == nil {
+		return
+	}
+	values := make([]string, len(cfg.MetricLabels)+1)
+	values[0] = metricTargetLabel(target.ID())
+	for i, key := range cfg.MetricLabels {
+		values[i+1] = target.Labels[key]
+	}
+	target.statusLock.Lock()
+	prevValues := target.labelMetricValues
+	target.labelMetricValues = values
+	target.statusLock.Unlock()
+	if prevValues != nil {
+		targetLabelInfo.DeleteLabelValues(prevValues...)
+	}
+	targetLabelInfo.WithLabelValues(values...).Set(1)
+}
+
+// removeLabelMetric deletes the label info metric of the target.
+func (target *SyncTarget) removeLabelMetric() {
+	target.statusLock.Lock()
+	prevValues := target.labelMetricValues
+	target.labelMetricValues = nil
+	target.statusLock.Unlock()
+	if targetLabelInfo != nil && prevValues != nil {
+		targetLabelInfo.DeleteLabelValues(prevValues...)
+	}
+}
+
+// parseLabelFilter parses label filters in the key:value format.
+func parseLabelFilter(filters []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(filters))
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label filter %q, expected key:value", filter)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+func (target *SyncTarget) matchesLabels(filter map[string]string) bool {
+	for key, value := range filter {
+		if target.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// loadTargetStatuses returns the status of every target in the database that matches the label filter.
+// Targets that are in memory are used as-is, so that the status includes runtime information.
+func loadTargetStatuses(filter map[string]string) ([]*TargetStatus, error) {
+	dbTargets, err := store.GetTargets(context.Background(), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query targets: %w", err)
+	}
+	statuses := []*TargetStatus{}
+	for _, dbTarget := range dbTargets {
+		target := registry.GetLoaded(dbTarget.ID())
+		if target == nil {
+			target = dbTarget
+		}
+		if target.matchesLabels(filter) {
+			statuses = append(statuses, target.Status())
+		}
+	}
+	return statuses, nil
+}
+
+// listTargets returns the status of every target in the database, optionally filtered by labels.
+func listTargets(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	filter, err := parseLabelFilter(r.URL.Query()["label"])
+	if err != nil {
+		formatError(errInvalidLabelFilter, err).Write(w)
+		return
+	}
+	statuses, err := loadTargetStatuses(filter)
+	if err != nil {
+		log.Warnln("Failed to load targets for list request:", err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	profile := requestProfile(r).Name
+	onlyStale := r.URL.Query().Get("stale") == "true"
+	profileStatuses := statuses[:0]
+	for _, status := range statuses {
+		if status.Profile == profile && (!onlyStale || status.Stale) {
+			profileStatuses = append(profileStatuses, status)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"targets": profileStatuses,
+	})
+}
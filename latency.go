@@ -0,0 +1,177 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindows are the rolling windows that latency percentiles and SLO burn rates are computed over.
+// The short and long windows match the usual multi-window burn rate alerting setup.
+var latencyWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+var latencyQuantiles = []struct {
+	Name     string
+	Quantile float64
+}{
+	{"0.5", 0.5},
+	{"0.9", 0.9},
+	{"0.99", 0.99},
+}
+
+const maxLatencySamples = 10000
+const latencyMetricsInterval = 15 * time.Second
+
+type latencySample struct {
+	At      time.Time
+	Latency time.Duration
+	Events  int
+}
+
+// latencyTracker keeps the delivery latencies of a target's transactions for the longest latency window.
+type latencyTracker struct {
+	samples []latencySample
+	lock    sync.Mutex
+}
+
+type LatencySummary struct {
+	Transactions int                `json:"transactions"`
+	Events       int                `json:"events"`
+	Percentiles  map[string]float64 `json:"percentiles_ms"`
+	GoodRatio    float64            `json:"good_ratio"`
+	BurnRate     float64            `json:"burn_rate"`
+}
+
+func (lt *latencyTracker) prune(now time.Time) {
+	maxAge := latencyWindows[len(latencyWindows)-1].Duration
+	cutoff := 0
+	for cutoff < len(lt.samples) && (now.Sub(lt.samples[cutoff].At) > maxAge || len(lt.samples)-cutoff > maxLatencySamples) {
+		cutoff++
+	}
+	if cutoff > 0 {
+		lt.samples = append(lt.samples[:0], lt.samples[cutoff:]...)
+	}
+}
+
+// Record stores the time it took to deliver a transaction containing the given number of events
+// after the /sync response was received.
+func (lt *latencyTracker) Record(latency time.Duration, events int) {
+	if events < 1 {
+		events = 1
+	}
+	now := time.Now()
+	lt.lock.Lock()
+	lt.samples = append(lt.samples, latencySample{At: now, Latency: latency, Events: events})
+	lt.prune(now)
+	lt.lock.Unlock()
+	deliveryLatency.Observe(latency.Seconds())
+}
+
+// Summary computes the latency percentiles and SLO compliance for the given window.
+// Percentiles and the good ratio are weighted by the number of events in each transaction.
+func (lt *latencyTracker) Summary(window time.Duration) *LatencySummary {
+	now := time.Now()
+	lt.lock.Lock()
+	lt.prune(now)
+	var samples []latencySample
+	for _, sample := range lt.samples {
+		if now.Sub(sample.At) <= window {
+			samples = append(samples, sample)
+		}
+	}
+	lt.lock.Unlock()
+
+	summary := &LatencySummary{
+		Transactions: len(samples),
+		Percentiles:  make(map[string]float64, len(latencyQuantiles)),
+		GoodRatio:    1,
+	}
+	if len(samples) == 0 {
+		for _, q := range latencyQuantiles {
+			summary.Percentiles[q.Name] = 0
+		}
+		return summary
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Latency < samples[j].Latency
+	})
+	goodEvents := 0
+	for _, sample := range samples {
+		summary.Events += sample.Events
+		if sample.Latency <= cfg.SLO.LatencyThreshold {
+			goodEvents += sample.Events
+		}
+	}
+	for _, q := range latencyQuantiles {
+		rank := int(q.Quantile * float64(summary.Events))
+		seen := 0
+		for _, sample := range samples {
+			seen += sample.Events
+			if seen > rank {
+				summary.Percentiles[q.Name] = float64(sample.Latency) / float64(time.Millisecond)
+				break
+			}
+		}
+	}
+	summary.GoodRatio = float64(goodEvents) / float64(summary.Events)
+	if cfg.SLO.Objective < 1 {
+		summary.BurnRate = (1 - summary.GoodRatio) / (1 - cfg.SLO.Objective)
+	}
+	return summary
+}
+
+// LatencySummaries returns the latency summaries of the target for each latency window.
+func (target *SyncTarget) LatencySummaries() map[string]*LatencySummary {
+	summaries := make(map[string]*LatencySummary, len(latencyWindows))
+	for _, window := range latencyWindows {
+		summaries[window.Name] = target.latency.Summary(window.Duration)
+	}
+	return summaries
+}
+
+func updateLatencyMetrics() {
+	for _, target := range registry.Snapshot() {
+		targetID, ok := seriesLimiter.Label(target.ID())
+		if !ok {
+			continue
+		}
+		for windowName, summary := range target.LatencySummaries() {
+			for quantile, value := range summary.Percentiles {
+				targetDeliveryLatency.WithLabelValues(targetID, windowName, quantile).Set(value / 1000)
+			}
+			sloGoodRatio.WithLabelValues(targetID, windowName).Set(summary.GoodRatio)
+			sloBurnRate.WithLabelValues(targetID, windowName).Set(summary.BurnRate)
+		}
+	}
+}
+
+// loopUpdateLatencyMetrics periodically recomputes the per-target latency and lag gauges,
+// so that the rolling windows move forward even when nothing is being delivered.
+func loopUpdateLatencyMetrics() {
+	for range time.Tick(latencyMetricsInterval) {
+		updateLatencyMetrics()
+		updateLagMetrics()
+	}
+}
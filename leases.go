@@ -0,0 +1,262 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// Leases let multiple instances of the proxy share a database without syncing the same target twice.
+// Every instance starts the active targets, but a sync loop only syncs while its instance holds the lease
+// of the target in the database. The other loops wait, and take over once the lease expires, e.g. because
+// the holder died. Leases are renewed several times per lease duration, and a holder that fails to renew
+// its lease stops syncing and goes back to waiting.
+
+const defaultLeaseDuration = 30 * time.Second
+
+type LeaseConfig struct {
+	// Enabled makes instances that share a database coordinate which one syncs each target.
+	Enabled bool `yaml:"enabled"`
+	// Duration is how long a lease is valid without being renewed.
+	Duration time.Duration `yaml:"duration"`
+}
+
+// leasesReleased is set during shutdown to stop the sync loops from renewing the leases that were released.
+var leasesReleased int32
+
+var errTargetNotActiveInDatabase = errors.New("target was stopped or deleted by another instance")
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// tryAcquireLease takes or renews the lease of the target. If force is set, the lease is taken even if
+// another instance holds it. The returned timestamp is when the lease expires if it isn't renewed.
+func (target *SyncTarget) tryAcquireLease(force bool) (bool, int64, error) {
+	now := nowMillis()
+	expiresAt := now + cfg.Leases.Duration.Milliseconds()
+	takeOverBefore := now
+	if force {
+		takeOverBefore = math.MaxInt64
+	}
+	acquired, err := store.AcquireLease(context.Background(), target.storageID(), target.DeviceKey, cfg.InstanceID, expiresAt, takeOverBefore)
+	return acquired, expiresAt, err
+}
+
+// setLeaseExpiry records when the lease held by this instance expires, or zero if it isn't held.
+func (target *SyncTarget) setLeaseExpiry(expiresAt int64) {
+	atomic.StoreInt64(&target.leaseExpiresAt, expiresAt)
+}
+
+// holdsLease returns whether this instance holds the lease of the target. It's always true if leases are disabled.
+func (target *SyncTarget) holdsLease() bool {
+	return !cfg.Leases.Enabled || atomic.LoadInt64(&target.leaseExpiresAt) > nowMillis()
+}
+
+func (target *SyncTarget) releaseLease() error {
+	target.setLeaseExpiry(0)
+	return store.ReleaseLease(context.Background(), target.storageID(), target.DeviceKey, cfg.InstanceID)
+}
+
+// reloadSyncPosition reads the sync position of the target from the database after taking over its lease,
+// since the previous holder has most likely advanced it. It fails if the target isn't active anymore.
+func (target *SyncTarget) reloadSyncPosition() error {
+	dbTarget, err := store.GetTarget(context.Background(), target.storageID(), target.DeviceKey)
+	if err != nil {
+		return err
+	} else if dbTarget == nil || !dbTarget.Active {
+		return errTargetNotActiveInDatabase
+	}
+	target.statusLock.Lock()
+	target.NextBatch = dbTarget.NextBatch
+	target.slidingSync = dbTarget.slidingSync
+	target.txnSequence = dbTarget.txnSequence
+	target.statusLock.Unlock()
+	return nil
+}
+
+// holdLease waits until the target's lease is acquired and keeps renewing it in the background. The returned
+// context is canceled when the lease is lost, and lost reports whether that happened. If leases are disabled,
+// the parent context is returned as-is.
+func (target *SyncTarget) holdLease(ctx context.Context) (leaseCtx context.Context, lost func() bool, err error) {
+	if !cfg.Leases.Enabled {
+		return ctx, func() bool { return false }, nil
+	}
+	syncLog := ctx.Value(logContextKey).(maulogger.Logger)
+	target.statusLock.Lock()
+	force := target.leaseTakeover
+	target.leaseTakeover = false
+	target.statusLock.Unlock()
+	var expiresAt int64
+	waiting := false
+	for {
+		var acquired bool
+		if atomic.LoadInt32(&leasesReleased) == 1 {
+			// Don't take over targets during shutdown.
+		} else if acquired, expiresAt, err = target.tryAcquireLease(force); err != nil {
+			syncLog.Warnln("Failed to acquire lease:", err)
+		} else if acquired {
+			break
+		} else if !waiting {
+			syncLog.Infoln("Target is being synced by another instance, waiting for its lease to expire")
+			waiting = true
+		}
+		retryIn := cfg.Leases.Duration / 2
+		target.heartbeat(retryIn)
+		select {
+		case <-time.After(retryIn):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	if force {
+		syncLog.Infoln("Took over lease from other instances")
+	} else if waiting {
+		syncLog.Infoln("Acquired lease after it expired")
+	}
+	if err = target.reloadSyncPosition(); err != nil {
+		if releaseErr := target.releaseLease(); releaseErr != nil {
+			syncLog.Warnln("Failed to release lease:", releaseErr)
+		}
+		return nil, nil, err
+	}
+	target.setLeaseExpiry(expiresAt)
+	leaseCtx, cancel := context.WithCancel(ctx)
+	lostChan := make(chan struct{})
+	go target.renewLease(leaseCtx, cancel, expiresAt, lostChan)
+	return leaseCtx, func() bool {
+		select {
+		case <-lostChan:
+			return true
+		default:
+			return false
+		}
+	}, nil
+}
+
+// renewLease renews the lease until the context is canceled, and cancels it if the lease is lost.
+// The lease is released when the sync loop stops.
+func (target *SyncTarget) renewLease(ctx context.Context, cancel context.CancelFunc, expiresAt int64, lostChan chan struct{}) {
+	syncLog := ctx.Value(logContextKey).(maulogger.Logger)
+	ticker := time.NewTicker(cfg.Leases.Duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := target.releaseLease(); err != nil {
+				syncLog.Warnln("Failed to release lease:", err)
+			}
+			return
+		}
+		if atomic.LoadInt32(&leasesReleased) == 1 {
+			return
+		}
+		acquired, newExpiresAt, err := target.tryAcquireLease(false)
+		if err != nil {
+			syncLog.Warnln("Failed to renew lease:", err)
+			if nowMillis() < expiresAt {
+				continue
+			}
+			syncLog.Warnln("Lease expired without being renewed, stopping syncing")
+		} else if acquired {
+			expiresAt = newExpiresAt
+			target.setLeaseExpiry(expiresAt)
+			continue
+		} else {
+			syncLog.Warnln("Lease was taken over by another instance, stopping syncing")
+		}
+		target.setLeaseExpiry(0)
+		close(lostChan)
+		cancel()
+		return
+	}
+}
+
+// releaseLeases releases the leases of all running targets during shutdown, so that other instances
+// can take over immediately instead of waiting for the leases to expire.
+func releaseLeases() {
+	if !cfg.Leases.Enabled {
+		return
+	}
+	atomic.StoreInt32(&leasesReleased, 1)
+	released := 0
+	for _, target := range registry.Snapshot() {
+		if !target.isRunning() {
+			continue
+		} else if err := target.releaseLease(); err != nil {
+			target.log.Warnln("Failed to release lease:", err)
+		} else {
+			released++
+		}
+	}
+	maulogger.Infofln("Released leases of %d targets", released)
+}
+
+// adoptTarget starts a target that's active in the database but not in this instance. Targets that are loaded
+// but inactive are replaced with the database version, since their settings may have been changed through another
+// instance. Targets that are active in memory are skipped even if they're not running yet, as they may be waiting
+// for the startup probe.
+func adoptTarget(dbTarget *SyncTarget) bool {
+	targetID := dbTarget.ID()
+	unlock := registry.LockTarget(targetID)
+	defer unlock()
+	if existing := registry.GetLoaded(targetID); existing != nil && (existing.Active || existing.isRunning()) {
+		return false
+	} else if err := dbTarget.Init(); err != nil {
+		dbTarget.log.Warnln("Failed to initialize target (adopting from database):", err)
+		return false
+	}
+	registry.Add(dbTarget)
+	dbTarget.startInBackground()
+	return true
+}
+
+// loopAdoptTargets periodically starts the active targets in the database that this instance isn't running,
+// e.g. because they were registered through another instance, so that every instance is ready to take over
+// every target if the instance syncing it dies.
+func loopAdoptTargets() {
+	if !cfg.Leases.Enabled {
+		return
+	}
+	for {
+		time.Sleep(cfg.Leases.Duration)
+		if atomic.LoadInt32(&leasesReleased) == 1 {
+			return
+		}
+		dbTargets, err := store.GetTargets(context.Background(), true)
+		if err != nil {
+			maulogger.Warnln("Failed to check database for targets to adopt:", err)
+			continue
+		}
+		adopted := 0
+		for _, dbTarget := range dbTargets {
+			if dbTarget.Active && dbTarget.SuspendedUntil == 0 && adoptTarget(dbTarget) {
+				adopted++
+			}
+		}
+		if adopted > 0 {
+			maulogger.Infofln("Started %d active targets from the database that weren't running in this instance", adopted)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const unixSocketPrefix = "unix://"
+
+// parseSocketMode parses an octal file mode like 0660.
+func parseSocketMode(val string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal permission mode", val)
+	}
+	return os.FileMode(mode), nil
+}
+
+// tcpNetwork returns the network to listen on for a TCP address. IP literals only listen on their own
+// address family, so that e.g. 0.0.0.0 and [::] can be listened on separately without conflicting.
+func tcpNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "tcp"
+	} else if ip := net.ParseIP(host); ip == nil {
+		return "tcp"
+	} else if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// listenAll opens a listener for each address in a comma-separated list. If any of them fails,
+// the already opened listeners are closed.
+func listenAll(addresses string, socketMode os.FileMode) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if len(address) == 0 {
+			continue
+		} else if _, duplicate := listeners[address]; duplicate {
+			continue
+		}
+		listener, err := listen(address, socketMode)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", address, err)
+		}
+		listeners[address] = listener
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listen addresses specified")
+	}
+	return listeners, nil
+}
+
+// inheritedListenersEnv is the comma-separated list of addresses whose listeners were passed to this process
+// by the previous process (see Proxy.Restart), starting from file descriptor 3.
+const inheritedListenersEnv = "SYNCPROXY_INHERITED_LISTENERS"
+
+const inheritedFDStart = 3
+
+// inheritedListeners are the listeners passed from the previous process by address.
+var inheritedListeners map[string]net.Listener
+
+// loadInheritedListeners reads the listeners passed from the previous process, if any.
+func loadInheritedListeners() error {
+	addresses := os.Getenv(inheritedListenersEnv)
+	if len(addresses) == 0 {
+		return nil
+	}
+	_ = os.Unsetenv(inheritedListenersEnv)
+	inheritedListeners = make(map[string]net.Listener)
+	for i, address := range strings.Split(addresses, ",") {
+		file := os.NewFile(uintptr(inheritedFDStart+i), address)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to use listener of %s from previous process: %w", address, err)
+		}
+		inheritedListeners[address] = listener
+	}
+	return nil
+}
+
+// listen opens the listener for the HTTP server. Addresses starting with unix:// are Unix domain socket paths,
+// anything else is a TCP address. Listeners passed from the previous process are used instead if there are any.
+func listen(address string, socketMode os.FileMode) (net.Listener, error) {
+	if listener, ok := inheritedListeners[address]; ok {
+		delete(inheritedListeners, address)
+		return listener, nil
+	} else if !strings.HasPrefix(address, unixSocketPrefix) {
+		return net.Listen(tcpNetwork(address), address)
+	}
+	path := strings.TrimPrefix(address, unixSocketPrefix)
+	// A socket left behind by a process that didn't shut down cleanly would make listening fail.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove old socket: %w", err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, socketMode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,67 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+)
+
+// logFields are structured fields that are attached to log lines. They're only visible in the JSON log format,
+// the text format has the same information in the module name. Sub-loggers don't inherit the fields of their
+// parent, so the fields of the sync loop are passed down in the context along with its logger.
+type logFields map[string]interface{}
+
+const logFieldsContextKey = "log_fields"
+
+// with returns a copy of the fields with the given field added.
+func (fields logFields) with(key string, value interface{}) logFields {
+	copied := make(logFields, len(fields)+1)
+	for existingKey, existingValue := range fields {
+		copied[existingKey] = existingValue
+	}
+	copied[key] = value
+	return copied
+}
+
+func (target *SyncTarget) logFields() logFields {
+	fields := logFields{"appservice_id": target.AppserviceID}
+	if len(target.DeviceKey) > 0 {
+		fields["device_key"] = target.DeviceKey
+	}
+	if len(target.Profile) > 0 {
+		fields["profile"] = target.Profile
+	}
+	return fields
+}
+
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+func parseLogFormat(val string) (LogFormat, error) {
+	switch format := LogFormat(val); format {
+	case "", LogFormatText:
+		return LogFormatText, nil
+	case LogFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q (expected text or json)", val)
+	}
+}
@@ -0,0 +1,227 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+type LogFileConfig struct {
+	// Path is the file that logs are written to in addition to stdout. Empty disables file logging.
+	Path string `yaml:"path"`
+	// MaxSize is the size in megabytes after which the file is rotated. Zero disables size-based rotation.
+	MaxSize int `yaml:"max_size"`
+	// RotateInterval is how often the file is rotated regardless of its size. Zero disables time-based rotation.
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	// MaxBackups is the number of rotated files to keep. Zero keeps all of them.
+	MaxBackups int `yaml:"max_backups"`
+	// MaxAge is how long rotated files are kept. Zero keeps them regardless of age.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+const rotatedLogTimeFormat = "2006-01-02T15-04-05"
+
+// rotatingLogFile receives log lines from maulogger through a pipe and writes them to a file that's rotated based
+// on size and age. maulogger can only write to an *os.File, so the pipe is what lets lines be counted and files
+// be swapped without racing with the logger.
+type rotatingLogFile struct {
+	cfg      LogFileConfig
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	pipe     *os.File
+	done     chan struct{}
+	closed   sync.Once
+}
+
+var logFile *rotatingLogFile
+
+// openLogFile opens the log file and makes the default logger write to it.
+func openLogFile(cfg LogFileConfig, format LogFormat) (*rotatingLogFile, error) {
+	lf := &rotatingLogFile{cfg: cfg, done: make(chan struct{})}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		_ = lf.file.Close()
+		return nil, fmt.Errorf("failed to create log pipe: %w", err)
+	}
+	lf.pipe = writer
+	lf.removeOldFiles()
+	go lf.loop(reader)
+	log.DefaultLogger.JSONFile = format == LogFormatJSON
+	log.DefaultLogger.SetWriter(writer)
+	return lf, nil
+}
+
+func (lf *rotatingLogFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(lf.cfg.Path), 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(lf.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	lf.file = file
+	lf.size = info.Size()
+	lf.openedAt = time.Now()
+	if lf.size > 0 {
+		lf.openedAt = lastRotation(lf.cfg.Path, lf.openedAt)
+	}
+	return nil
+}
+
+// lastRotation returns when the current log file was started, so that restarting doesn't postpone time-based
+// rotation. Go doesn't expose file creation times, so the timestamp of the newest rotated file is used instead.
+func lastRotation(path string, defVal time.Time) time.Time {
+	backups := listLogBackups(path)
+	if len(backups) == 0 {
+		return defVal
+	}
+	ts, err := time.ParseInLocation(rotatedLogTimeFormat, backupTimestamp(path, backups[len(backups)-1]), time.Local)
+	if err != nil {
+		return defVal
+	}
+	return ts
+}
+
+func (lf *rotatingLogFile) shouldRotate(now time.Time, lineLen int) bool {
+	if lf.size == 0 {
+		return false
+	} else if lf.cfg.MaxSize > 0 && lf.size+int64(lineLen) > int64(lf.cfg.MaxSize)*1024*1024 {
+		return true
+	}
+	return lf.cfg.RotateInterval > 0 && now.Sub(lf.openedAt) >= lf.cfg.RotateInterval
+}
+
+func (lf *rotatingLogFile) rotate(now time.Time) error {
+	if err := lf.file.Close(); err != nil {
+		return err
+	}
+	backupPath := fmt.Sprintf("%s.%s", lf.cfg.Path, now.Format(rotatedLogTimeFormat))
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+			break
+		}
+		backupPath = fmt.Sprintf("%s.%s.%d", lf.cfg.Path, now.Format(rotatedLogTimeFormat), i)
+	}
+	if err := os.Rename(lf.cfg.Path, backupPath); err != nil {
+		// Keep writing to the same file rather than losing logs.
+		_ = lf.open()
+		return err
+	}
+	err := lf.open()
+	lf.removeOldFiles()
+	return err
+}
+
+// listLogBackups returns the rotated files of the log file at path, oldest first.
+func listLogBackups(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	backups := matches[:0]
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedLogTimeFormat, backupTimestamp(path, match)); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// The timestamp format sorts chronologically as a string.
+	sort.Strings(backups)
+	return backups
+}
+
+func backupTimestamp(path, backup string) string {
+	ts := strings.TrimPrefix(backup, path+".")
+	if len(ts) > len(rotatedLogTimeFormat) {
+		ts = ts[:len(rotatedLogTimeFormat)]
+	}
+	return ts
+}
+
+// removeOldFiles deletes rotated files that are beyond the retention limits.
+func (lf *rotatingLogFile) removeOldFiles() {
+	backups := listLogBackups(lf.cfg.Path)
+	remove := 0
+	if lf.cfg.MaxBackups > 0 && len(backups) > lf.cfg.MaxBackups {
+		remove = len(backups) - lf.cfg.MaxBackups
+	}
+	if lf.cfg.MaxAge > 0 {
+		cutoff := time.Now().Add(-lf.cfg.MaxAge)
+		for remove < len(backups) {
+			info, err := os.Stat(backups[remove])
+			if err != nil || !info.ModTime().Before(cutoff) {
+				break
+			}
+			remove++
+		}
+	}
+	for _, backup := range backups[:remove] {
+		if err := os.Remove(backup); err != nil {
+			// Logging here would write back into the pipe that's being read, so this goes to stderr directly.
+			_, _ = fmt.Fprintln(os.Stderr, "Failed to remove old log file:", err)
+		}
+	}
+}
+
+func (lf *rotatingLogFile) loop(reader *os.File) {
+	defer close(lf.done)
+	lines := bufio.NewReader(reader)
+	for {
+		// Lines are read whole so that rotation never splits one between files.
+		line, readErr := lines.ReadBytes('\n')
+		if len(line) > 0 {
+			now := time.Now()
+			if lf.shouldRotate(now, len(line)) {
+				if err := lf.rotate(now); err != nil {
+					_, _ = fmt.Fprintln(os.Stderr, "Failed to rotate log file:", err)
+				}
+			}
+			n, err := lf.file.Write(line)
+			lf.size += int64(n)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, "Failed to write to log file:", err)
+			}
+		}
+		if readErr != nil {
+			_ = reader.Close()
+			_ = lf.file.Close()
+			return
+		}
+	}
+}
+
+// Close stops writing logs to the file after the lines that were already logged have been written.
+func (lf *rotatingLogFile) Close() {
+	lf.closed.Do(func() {
+		_ = lf.pipe.Close()
+		<-lf.done
+	})
+}
@@ -0,0 +1,64 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// Targets with MasqueradeDevice set use the as_token of the appservice as the bot access token, and every
+// request to the homeserver identifies the bot user and device with the user_id and MSC3202 device_id
+// query parameters, so bridges don't need to log in a separate device just for syncing.
+
+const msc3202DeviceIDParam = "org.matrix.msc3202.device_id"
+
+// masqueradeTransport adds the appservice masquerading query parameters to every request.
+type masqueradeTransport struct {
+	next     http.RoundTripper
+	userID   id.UserID
+	deviceID id.DeviceID
+}
+
+func (mt *masqueradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they're given.
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("user_id", string(mt.userID))
+	query.Set(msc3202DeviceIDParam, string(mt.deviceID))
+	req.URL.RawQuery = query.Encode()
+	return mt.next.RoundTrip(req)
+}
+
+// newClient creates a homeserver client for the target with the given access token,
+// which masquerades as the user and device of the target if MasqueradeDevice is set.
+func (target *SyncTarget) newClient(userID id.UserID, accessToken string) (*mautrix.Client, error) {
+	client, err := newHomeserverClient(target.homeserverURL(), userID, accessToken)
+	if err != nil || !target.MasqueradeDevice {
+		return client, err
+	}
+	masqueradeClient := *homeserverHTTPClient
+	masqueradeClient.Transport = &masqueradeTransport{
+		next:     homeserverHTTPClient.Transport,
+		userID:   target.UserID,
+		deviceID: target.DeviceID,
+	}
+	client.Client = &masqueradeClient
+	return client, nil
+}
@@ -0,0 +1,71 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+// Rough per-item sizes for the parts of a transaction that don't have raw JSON available.
+const (
+	estimatedEventOverhead    = 256
+	estimatedDeviceListSize   = 64
+	estimatedOTKCountOverhead = 64
+)
+
+// estimateTransactionSize returns the approximate number of bytes a transaction takes in memory.
+// It doesn't need to be exact, it's only used for accounting and backpressure.
+func estimateTransactionSize(txn *Transaction) int64 {
+	if txn == nil {
+		return 0
+	}
+	size := int64(0)
+	for _, evt := range txn.EphemeralEvents {
+		size += estimatedEventOverhead + int64(len(evt.Content.VeryRaw))
+	}
+	if txn.DeviceLists != nil {
+		size += int64(len(txn.DeviceLists.Changed)+len(txn.DeviceLists.Left)) * estimatedDeviceListSize
+	}
+	size += int64(len(txn.DeviceOTKCount)) * estimatedOTKCountOverhead
+	return size
+}
+
+// addBuffered adjusts the number of bytes the target is holding in memory.
+func (target *SyncTarget) addBuffered(delta int64) {
+	if delta == 0 {
+		return
+	}
+	target.statusLock.Lock()
+	target.bufferedBytes += delta
+	current := target.bufferedBytes
+	target.statusLock.Unlock()
+	if label, ok := seriesLimiter.Label(target.ID()); ok {
+		targetBufferedBytes.WithLabelValues(label).Set(float64(current))
+	}
+}
+
+// BufferedBytes returns the approximate number of bytes of transactions the target is holding in memory.
+func (target *SyncTarget) BufferedBytes() int64 {
+	target.statusLock.RLock()
+	defer target.statusLock.RUnlock()
+	return target.bufferedBytes
+}
+
+// getMaxBufferedBytes returns the buffer cap of the target, or the global default set with MAX_TARGET_BUFFERED_BYTES.
+// Zero means there's no cap.
+func (target *SyncTarget) getMaxBufferedBytes() int64 {
+	if target.MaxBufferedBytes > 0 {
+		return target.MaxBufferedBytes
+	}
+	return cfg.MaxTargetBufferedBytes
+}
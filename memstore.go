@@ -0,0 +1,685 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type memoryTargetKey struct {
+	appserviceID string
+	deviceKey    string
+}
+
+type memoryQueuedTransaction struct {
+	QueuedTransaction
+	target memoryTargetKey
+}
+
+type memoryDeadLetter struct {
+	StoredDeadLetter
+	target memoryTargetKey
+}
+
+type memoryLease struct {
+	holder    string
+	expiresAt int64
+}
+
+type memoryRegistrationToken struct {
+	appserviceID string
+	deviceKey    string
+	expiresAt    int64
+}
+
+type memoryFilterKey struct {
+	userID     id.UserID
+	filterHash string
+}
+
+// memoryStore is a Store that keeps everything in memory. It's meant for testing the sync and delivery logic
+// without a database, so values are copied in and out to behave like a real backend.
+type memoryStore struct {
+	targets     map[memoryTargetKey]*SyncTarget
+	queue       map[string]*memoryQueuedTransaction
+	history     map[string]*TransactionHistoryEntry
+	deadLetters map[string]*memoryDeadLetter
+	errors      map[memoryTargetKey][]TargetError
+	leases      map[memoryTargetKey]memoryLease
+	mgmtTokens  map[string]string
+	regTokens   map[string]memoryRegistrationToken
+	filters     map[memoryFilterKey]string
+	txnIDClock  int64
+	lock        sync.Mutex
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		targets:     make(map[memoryTargetKey]*SyncTarget),
+		queue:       make(map[string]*memoryQueuedTransaction),
+		history:     make(map[string]*TransactionHistoryEntry),
+		deadLetters: make(map[string]*memoryDeadLetter),
+		errors:      make(map[memoryTargetKey][]TargetError),
+		leases:      make(map[memoryTargetKey]memoryLease),
+		mgmtTokens:  make(map[string]string),
+		regTokens:   make(map[string]memoryRegistrationToken),
+		filters:     make(map[memoryFilterKey]string),
+	}
+}
+
+// copyStoredTarget copies the persisted fields of the target. The profile is split from the appservice ID
+// the same way as when loading from the database.
+func copyStoredTarget(target *SyncTarget) *SyncTarget {
+	copied := &SyncTarget{
+		AppserviceID:           target.AppserviceID,
+		Profile:                target.Profile,
+		DeviceKey:              target.DeviceKey,
+		BotAccessToken:         target.BotAccessToken,
+		HSToken:                target.HSToken,
+		Address:                target.Address,
+		UserID:                 target.UserID,
+		DeviceID:               target.DeviceID,
+		IsProxy:                target.IsProxy,
+		Template:               target.Template,
+		DryRun:                 target.DryRun,
+		AtMostOnce:             target.AtMostOnce,
+		SynchronousPolicy:      target.SynchronousPolicy,
+		MaxBufferedBytes:       target.MaxBufferedBytes,
+		ForwardPresence:        target.ForwardPresence,
+		DropDeviceListLeft:     target.DropDeviceListLeft,
+		OTKCountThreshold:      target.OTKCountThreshold,
+		OTKCountDelta:          target.OTKCountDelta,
+		DeviceListDedupMinutes: target.DeviceListDedupMinutes,
+		MasqueradeDevice:       target.MasqueradeDevice,
+		FullSync:               target.FullSync,
+		SyncBackend:            target.SyncBackend,
+		HomeserverURL:          target.HomeserverURL,
+		NextBatch:              target.NextBatch,
+		Active:                 target.Active,
+		SuspendedUntil:         target.SuspendedUntil,
+		Paused:                 target.Paused,
+
+		retryPolicy:   target.retryPolicy,
+		txnSequence:   target.txnSequence,
+		slidingSync:   target.slidingSync,
+		registeredAt:  target.registeredAt,
+		firstSyncedAt: target.firstSyncedAt,
+		lastStop:      target.lastStop,
+		syncRetry:     target.syncRetry,
+	}
+	if target.checkpoint != nil {
+		checkpoint := *target.checkpoint
+		copied.checkpoint = &checkpoint
+	}
+	if target.QuietHours != nil {
+		quietHours := *target.QuietHours
+		copied.QuietHours = &quietHours
+	}
+	if target.Recipients != nil {
+		copied.Recipients = append([]string{}, target.Recipients...)
+	}
+	if target.Delivery != nil {
+		delivery := *target.Delivery
+		copied.Delivery = &delivery
+	}
+	if target.Retry != nil {
+		retry := *target.Retry
+		copied.Retry = &retry
+	}
+	if target.Filter != nil {
+		filter := *target.Filter
+		copied.Filter = &filter
+	}
+	if target.Labels != nil {
+		copied.Labels = make(map[string]string, len(target.Labels))
+		for key, value := range target.Labels {
+			copied.Labels[key] = value
+		}
+	}
+	return copied
+}
+
+func copyHistoryEntry(entry *TransactionHistoryEntry) *TransactionHistoryEntry {
+	copied := *entry
+	copied.Events = append([]HistoryEvent{}, entry.Events...)
+	if entry.SentTo != nil {
+		copied.SentTo = make(map[string]SendStatus, len(entry.SentTo))
+		for address, status := range entry.SentTo {
+			copied.SentTo[address] = status
+		}
+	}
+	return &copied
+}
+
+func (ms *memoryStore) GetTarget(ctx context.Context, appserviceID, deviceKey string) (*SyncTarget, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]
+	if !ok {
+		return nil, nil
+	}
+	return copyStoredTarget(target), nil
+}
+
+func (ms *memoryStore) GetTargets(ctx context.Context, onlyStartable bool) ([]*SyncTarget, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var result []*SyncTarget
+	for _, target := range ms.targets {
+		if !onlyStartable || target.Active || target.SuspendedUntil > 0 {
+			result = append(result, copyStoredTarget(target))
+		}
+	}
+	return result, nil
+}
+
+func (ms *memoryStore) UpsertTarget(ctx context.Context, target *SyncTarget) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{target.storageID(), target.DeviceKey}
+	copied := copyStoredTarget(target)
+	if existing, ok := ms.targets[key]; ok {
+		copied.NextBatch = existing.NextBatch
+		copied.Active = existing.Active
+		copied.SuspendedUntil = existing.SuspendedUntil
+		copied.Paused = existing.Paused
+		copied.txnSequence = existing.txnSequence
+		copied.slidingSync = existing.slidingSync
+		copied.registeredAt = existing.registeredAt
+		copied.firstSyncedAt = existing.firstSyncedAt
+		copied.lastStop = existing.lastStop
+		copied.syncRetry = existing.syncRetry
+		copied.checkpoint = existing.checkpoint
+	}
+	ms.targets[key] = copied
+	return nil
+}
+
+func (ms *memoryStore) SetTargetActive(ctx context.Context, appserviceID, deviceKey string, active bool) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.Active = active
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetPaused(ctx context.Context, appserviceID, deviceKey string, paused bool) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.Paused = paused
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetNextBatch(ctx context.Context, appserviceID, deviceKey, nextBatch string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.NextBatch = nextBatch
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetSlidingSyncPosition(ctx context.Context, appserviceID, deviceKey string, position SlidingSyncPosition) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.slidingSync = position
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetFirstSyncedAt(ctx context.Context, appserviceID, deviceKey string, firstSyncedAt int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.firstSyncedAt = firstSyncedAt
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetTxnSequence(ctx context.Context, appserviceID, deviceKey string, sequence uint64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.txnSequence = sequence
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetLastStop(ctx context.Context, appserviceID, deviceKey string, lastStop *LastStop) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.lastStop = lastStop
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetSyncRetry(ctx context.Context, appserviceID, deviceKey string, retry *SyncRetryState) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.syncRetry = retry
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetCredentials(ctx context.Context, appserviceID, deviceKey, botAccessToken, hsToken string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.BotAccessToken = botAccessToken
+		target.HSToken = hsToken
+	}
+	return nil
+}
+
+func (ms *memoryStore) DeleteTarget(ctx context.Context, appserviceID, deviceKey string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	delete(ms.targets, key)
+	for txnID, txn := range ms.queue {
+		if txn.target == key {
+			delete(ms.queue, txnID)
+		}
+	}
+	for txnID, entry := range ms.history {
+		if entry.AppserviceID == appserviceID && entry.DeviceKey == deviceKey {
+			delete(ms.history, txnID)
+		}
+	}
+	for txnID, letter := range ms.deadLetters {
+		if letter.target == key {
+			delete(ms.deadLetters, txnID)
+		}
+	}
+	delete(ms.errors, key)
+	delete(ms.leases, key)
+	return nil
+}
+
+func (ms *memoryStore) QueueTransaction(ctx context.Context, appserviceID, deviceKey string, txn QueuedTransaction) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exists := ms.queue[txn.TxnID]; !exists {
+		txn.Data = append([]byte{}, txn.Data...)
+		ms.queue[txn.TxnID] = &memoryQueuedTransaction{txn, memoryTargetKey{appserviceID, deviceKey}}
+	}
+	return nil
+}
+
+func (ms *memoryStore) DeleteQueuedTransaction(ctx context.Context, txnID string) error {
+	ms.lock.Lock()
+	delete(ms.queue, txnID)
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) GetQueuedTransactions(ctx context.Context, appserviceID, deviceKey string, after PendingCursor, maxBytes int64) ([]QueuedTransaction, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	var queued []QueuedTransaction
+	for _, txn := range ms.queue {
+		if txn.target == key && (txn.CreatedAt > after.CreatedAt || (txn.CreatedAt == after.CreatedAt && txn.TxnID > after.TxnID)) {
+			queued = append(queued, txn.QueuedTransaction)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].CreatedAt != queued[j].CreatedAt {
+			return queued[i].CreatedAt < queued[j].CreatedAt
+		}
+		return queued[i].TxnID < queued[j].TxnID
+	})
+	var totalSize int64
+	for i, txn := range queued {
+		totalSize += int64(len(txn.Data))
+		if maxBytes > 0 && totalSize >= maxBytes {
+			return queued[:i+1], nil
+		}
+	}
+	return queued, nil
+}
+
+func (ms *memoryStore) InsertHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exists := ms.history[entry.TxnID]; !exists {
+		ms.history[entry.TxnID] = copyHistoryEntry(entry)
+	}
+	return nil
+}
+
+func (ms *memoryStore) UpdateHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	existing, ok := ms.history[entry.TxnID]
+	if !ok {
+		return nil
+	}
+	updated := copyHistoryEntry(entry)
+	existing.Status = updated.Status
+	existing.Attempts = updated.Attempts
+	existing.SentAt = updated.SentAt
+	existing.SentTo = updated.SentTo
+	return nil
+}
+
+func (ms *memoryStore) GetHistoryEntry(ctx context.Context, appserviceID, txnID string) (*TransactionHistoryEntry, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	entry, ok := ms.history[txnID]
+	if !ok || entry.AppserviceID != appserviceID {
+		return nil, nil
+	}
+	return copyHistoryEntry(entry), nil
+}
+
+func (ms *memoryStore) GetRecentHistory(ctx context.Context, appserviceID, deviceKey string, limit int) ([]*TransactionHistoryEntry, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var entries []*TransactionHistoryEntry
+	for _, entry := range ms.history {
+		if entry.AppserviceID == appserviceID && entry.DeviceKey == deviceKey {
+			entries = append(entries, copyHistoryEntry(entry))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt > entries[j].CreatedAt
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (ms *memoryStore) QueryHistory(ctx context.Context, appserviceID, deviceKey string, query HistoryQuery) ([]*TransactionHistoryEntry, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var entries []*TransactionHistoryEntry
+	for _, entry := range ms.history {
+		if entry.AppserviceID == appserviceID && entry.DeviceKey == deviceKey && query.Matches(entry) {
+			entries = append(entries, copyHistoryEntry(entry))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt > entries[j].CreatedAt
+	})
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+	return entries, nil
+}
+
+func (ms *memoryStore) PruneHistory(ctx context.Context, before int64) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var count int64
+	for txnID, entry := range ms.history {
+		if entry.CreatedAt < before {
+			delete(ms.history, txnID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *memoryStore) PruneCheckpointedHistory(ctx context.Context, before int64) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	var count int64
+	for txnID, entry := range ms.history {
+		target, ok := ms.targets[memoryTargetKey{entry.AppserviceID, entry.DeviceKey}]
+		if ok && target.checkpoint != nil && entry.CreatedAt < before && entry.CreatedAt <= target.checkpoint.CreatedAt {
+			delete(ms.history, txnID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *memoryStore) SetTargetSuspendedUntil(ctx context.Context, appserviceID, deviceKey string, until int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if target, ok := ms.targets[memoryTargetKey{appserviceID, deviceKey}]; ok {
+		target.SuspendedUntil = until
+	}
+	return nil
+}
+
+func (ms *memoryStore) SetTargetCheckpoint(ctx context.Context, appserviceID, deviceKey string, checkpoint *Checkpoint) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	if target, ok := ms.targets[key]; ok {
+		copied := *checkpoint
+		target.checkpoint = &copied
+	}
+	var count int64
+	for txnID, txn := range ms.queue {
+		if txn.target == key && txn.CreatedAt <= checkpoint.CreatedAt {
+			delete(ms.queue, txnID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (ms *memoryStore) InsertDeadLetter(ctx context.Context, appserviceID, deviceKey string, letter StoredDeadLetter) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, exists := ms.deadLetters[letter.TxnID]; !exists {
+		if letter.Data != nil {
+			letter.Data = append([]byte{}, letter.Data...)
+		}
+		ms.deadLetters[letter.TxnID] = &memoryDeadLetter{letter, memoryTargetKey{appserviceID, deviceKey}}
+	}
+	return nil
+}
+
+func (ms *memoryStore) GetDeadLetters(ctx context.Context, appserviceID, deviceKey string, before int64, limit int) ([]StoredDeadLetter, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	var letters []StoredDeadLetter
+	for _, letter := range ms.deadLetters {
+		if letter.target == key && (before == 0 || letter.CreatedAt < before) {
+			letters = append(letters, letter.StoredDeadLetter)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].CreatedAt > letters[j].CreatedAt
+	})
+	if limit > 0 && len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (ms *memoryStore) DeleteDeadLetter(ctx context.Context, txnID string) error {
+	ms.lock.Lock()
+	delete(ms.deadLetters, txnID)
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *memoryStore) InsertTargetError(ctx context.Context, appserviceID, deviceKey string, entry TargetError, keep int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	errs := append(ms.errors[key], entry)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Timestamp > errs[j].Timestamp
+	})
+	if len(errs) > keep {
+		errs = errs[:keep]
+	}
+	ms.errors[key] = errs
+	return nil
+}
+
+func (ms *memoryStore) GetTargetErrors(ctx context.Context, appserviceID, deviceKey string, limit int) ([]TargetError, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	errs := ms.errors[memoryTargetKey{appserviceID, deviceKey}]
+	if len(errs) > limit {
+		errs = errs[:limit]
+	}
+	return append([]TargetError{}, errs...), nil
+}
+
+func (ms *memoryStore) AcquireLease(ctx context.Context, appserviceID, deviceKey, holder string, expiresAt, takeOverBefore int64) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	if existing, ok := ms.leases[key]; ok && existing.holder != holder && existing.expiresAt >= takeOverBefore {
+		return false, nil
+	}
+	ms.leases[key] = memoryLease{holder: holder, expiresAt: expiresAt}
+	return true, nil
+}
+
+func (ms *memoryStore) ReleaseLease(ctx context.Context, appserviceID, deviceKey, holder string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := memoryTargetKey{appserviceID, deviceKey}
+	if existing, ok := ms.leases[key]; ok && existing.holder == holder {
+		delete(ms.leases, key)
+	}
+	return nil
+}
+
+// EncryptStoredTokens does nothing, as tokens in memory aren't at rest.
+func (ms *memoryStore) EncryptStoredTokens(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (ms *memoryStore) SetManagementToken(ctx context.Context, appserviceID, tokenHash string, createdAt int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.mgmtTokens[appserviceID] = tokenHash
+	return nil
+}
+
+func (ms *memoryStore) DeleteManagementToken(ctx context.Context, appserviceID string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.mgmtTokens, appserviceID)
+	return nil
+}
+
+func (ms *memoryStore) CheckManagementToken(ctx context.Context, appserviceID, tokenHash string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	stored, ok := ms.mgmtTokens[appserviceID]
+	return ok && stored == tokenHash, nil
+}
+
+func (ms *memoryStore) InsertRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, createdAt, expiresAt int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for hash, token := range ms.regTokens {
+		if token.expiresAt < createdAt {
+			delete(ms.regTokens, hash)
+		}
+	}
+	ms.regTokens[tokenHash] = memoryRegistrationToken{appserviceID: appserviceID, deviceKey: deviceKey, expiresAt: expiresAt}
+	return nil
+}
+
+func (ms *memoryStore) CheckRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, now int64) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	token, ok := ms.regTokens[tokenHash]
+	return ok && token.appserviceID == appserviceID && (token.deviceKey == "" || token.deviceKey == deviceKey) &&
+		token.expiresAt >= now, nil
+}
+
+func (ms *memoryStore) ConsumeRegistrationToken(ctx context.Context, tokenHash string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	_, ok := ms.regTokens[tokenHash]
+	delete(ms.regTokens, tokenHash)
+	return ok, nil
+}
+
+func (ms *memoryStore) GetFilterID(ctx context.Context, userID id.UserID, filterHash string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.filters[memoryFilterKey{userID, filterHash}], nil
+}
+
+func (ms *memoryStore) SetFilterID(ctx context.Context, userID id.UserID, filterHash, filterID string, createdAt int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.filters[memoryFilterKey{userID, filterHash}] = filterID
+	return nil
+}
+
+func (ms *memoryStore) DeleteFilterID(ctx context.Context, userID id.UserID, filterHash string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.filters, memoryFilterKey{userID, filterHash})
+	return nil
+}
+
+func (ms *memoryStore) CountFilters(ctx context.Context, userID id.UserID) (count int, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for key := range ms.filters {
+		if key.userID == userID {
+			count++
+		}
+	}
+	return
+}
+
+func (ms *memoryStore) CountOrphanedFilters(ctx context.Context) (count int, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	users := make(map[id.UserID]struct{}, len(ms.targets))
+	for _, target := range ms.targets {
+		users[target.UserID] = struct{}{}
+	}
+	for key := range ms.filters {
+		if _, ok := users[key.userID]; !ok {
+			count++
+		}
+	}
+	return
+}
+
+func (ms *memoryStore) GetTxnIDClockReservation(ctx context.Context) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.txnIDClock, nil
+}
+
+func (ms *memoryStore) SetTxnIDClockReservation(ctx context.Context, reservedUntil int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.txnIDClock = reservedUntil
+	return nil
+}
@@ -0,0 +1,104 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-syncproxy/testutil"
+)
+
+// TestSyncDeliveryMemoryStore runs the sync loop of a target against NewMemoryStore, without any database,
+// and checks that the synced events are delivered and the sync position and filter are kept in the store.
+func TestSyncDeliveryMemoryStore(t *testing.T) {
+	hs := testutil.NewMockHomeserver(t)
+	hs.AddUser("bot_token", "@bot:example.com", "DEVICE")
+	as := testutil.NewMockAppservice(t, "hs_token")
+
+	prevCfg, prevStore := cfg, store
+	cfg = DefaultConfig()
+	cfg.HomeserverURL = hs.URL
+	cfg.SharedSecret = "secret"
+	if err := applyConfig(); err != nil {
+		t.Fatal("Failed to apply config:", err)
+	}
+	memStore := NewMemoryStore()
+	store = memStore
+	t.Cleanup(func() {
+		cfg, store = prevCfg, prevStore
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req := &SyncTarget{
+		AppserviceID:   "memstore",
+		BotAccessToken: "bot_token",
+		HSToken:        "hs_token",
+		Address:        as.URL,
+		UserID:         "@bot:example.com",
+		DeviceID:       "DEVICE",
+	}
+	if apiErr, ok := req.prepareForPut(); !ok {
+		t.Fatal("Invalid target:", apiErr.Message)
+	} else if apiErr, ok = upsertTarget(ctx, req); !ok {
+		t.Fatal("Failed to upsert target:", apiErr.Message)
+	}
+	target := registry.Get(req.ID())
+	t.Cleanup(func() {
+		<-target.Stop(StopReasonShutdown)
+		registry.Remove(target)
+	})
+
+	var resp mautrix.RespSync
+	resp.ToDevice.Events = []*event.Event{{
+		Sender:  "@alice:example.com",
+		Type:    event.Type{Type: "fi.mau.syncproxy.test", Class: event.ToDeviceEventType},
+		Content: event.Content{Raw: map[string]interface{}{"n": 1}},
+	}}
+	hs.QueueSync("bot_token", &resp)
+	txn, err := as.WaitForTransaction(ctx, func(txn *testutil.ReceivedTransaction) bool {
+		return len(txn.Body.EphemeralEvents) > 0
+	})
+	if err != nil {
+		t.Fatal("Transaction wasn't delivered:", err)
+	} else if evt := txn.Body.EphemeralEvents[0]; evt.Sender != "@alice:example.com" || evt.ToDeviceID != "DEVICE" {
+		t.Errorf("Delivered event doesn't have the expected sender and recipient: %s -> %s", evt.Sender, evt.ToDeviceID)
+	}
+
+	// The sync token is stored after the transaction is delivered.
+	var stored *SyncTarget
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if stored, err = memStore.GetTarget(ctx, req.storageID(), ""); err != nil {
+			t.Fatal("Failed to get target from store:", err)
+		} else if stored != nil && len(stored.NextBatch) > 0 {
+			break
+		}
+	}
+	if stored == nil || len(stored.NextBatch) == 0 {
+		t.Fatal("Sync token wasn't stored in the memory store")
+	} else if stored.txnSequence != 1 {
+		t.Errorf("Expected transaction sequence 1 in the memory store, got %d", stored.txnSequence)
+	}
+	if filters, err := memStore.CountFilters(ctx, "@bot:example.com"); err != nil || filters != 1 {
+		t.Errorf("Expected the uploaded sync filter to be cached in the memory store, got %d (error: %v)", filters, err)
+	}
+}
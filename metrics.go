@@ -0,0 +1,216 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_build_info",
+		Help: "Version information of the running proxy, the value is always 1",
+	}, []string{"version", "commit", "build_time", "go_version"})
+	syncTerminations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_sync_terminations_total",
+		Help: "Number of times a sync loop stopped, by cause",
+	}, []string{"cause"})
+	deliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_delivery_failures_total",
+		Help: "Number of failed transaction delivery attempts, by cause",
+	}, []string{"cause"})
+	deadLetteredTransactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_dead_lettered_transactions_total",
+		Help: "Number of transactions that were moved to the dead letter table, by cause of the last failure",
+	}, []string{"cause"})
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_webhook_deliveries_total",
+		Help: "Number of webhook events, by result (sent, failed or dropped)",
+	}, []string{"result"})
+	keyRequestStorms = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_key_request_storms_total",
+		Help: "Number of times a device exceeded the key request rate limit",
+	})
+	droppedKeyRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_dropped_key_requests_total",
+		Help: "Number of repeated key requests that were dropped because the requesting device exceeded the rate limit",
+	})
+	deferredQuietEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_quiet_hours_deferred_events_total",
+		Help: "Number of to-device events that were deferred until the end of the target's quiet hours",
+	})
+	targetCacheLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_target_cache_loads_total",
+		Help: "Number of targets loaded from the database after not being found in the target cache",
+	})
+	targetCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_target_cache_misses_total",
+		Help: "Number of target lookups that weren't found in the cache or the database",
+	})
+	targetCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_target_cache_evictions_total",
+		Help: "Number of inactive targets evicted from the target cache",
+	})
+	missingSynchronousConfirmations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_missing_synchronous_confirmations_total",
+		Help: "Number of transactions accepted without synchronous delivery confirmation from targets with the prefer policy",
+	})
+	targetBufferedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_buffered_bytes",
+		Help: "Approximate number of bytes of transactions each target is holding in memory",
+	}, []string{"target"})
+	deferredDBWrites = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_deferred_database_writes",
+		Help: "Number of target state writes waiting to be retried because the database was unavailable",
+	})
+	syncStartPacingWaits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_sync_start_pacing_waits_total",
+		Help: "Number of sync loop starts that had to wait for the per-homeserver start rate limit",
+	})
+	circuitBreakerTrips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_circuit_breaker_trips_total",
+		Help: "Number of times a target's sync loop was stopped by the delivery circuit breaker",
+	})
+	syncStartsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_sync_starts_pending",
+		Help: "Number of sync loops waiting for the startup jitter or the per-homeserver start rate limit",
+	})
+	homeserverRateLimitedSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_homeserver_rate_limited_seconds_total",
+		Help: "Time sync loops have spent waiting because the homeserver responded with M_LIMIT_EXCEEDED",
+	})
+	dbSchemaVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_db_schema_version",
+		Help: "Current schema version of the database",
+	})
+	dbSupportedSchemaVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_db_supported_schema_version",
+		Help: "Latest database schema version supported by this build",
+	})
+	dbLastMigrationTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_db_last_migration_timestamp_seconds",
+		Help: "Unix timestamp of when the last database schema migration was applied",
+	})
+	dbLastMigrationDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_db_last_migration_duration_seconds",
+		Help: "Time taken by the last database schema migration",
+	})
+	syncFiltersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_sync_filters_created_total",
+		Help: "Number of sync filters uploaded to homeservers, reused filters aren't counted",
+	})
+	orphanedFilters = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_orphaned_sync_filters",
+		Help: "Number of uploaded sync filters whose account doesn't have any targets anymore",
+	})
+	processHeartbeat = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_heartbeat_timestamp_seconds",
+		Help: "Unix timestamp of the last heartbeat of the main process, updated every 10 seconds",
+	})
+	stalledSyncLoops = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_stalled_sync_loops",
+		Help: "Number of running sync loops that haven't shown any activity for longer than the watchdog stall timeout",
+	})
+	stateDivergences = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_state_divergences",
+		Help: "Number of differences between the in-memory and database state of targets found by the last consistency check",
+	})
+	staleRegistrations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_stale_registrations",
+		Help: "Number of targets that have never synced and are older than the stale registration age",
+	})
+	deduplicatedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_deduplicated_to_device_events_total",
+		Help: "Number of to-device events that were dropped because an identical event was delivered recently",
+	}, []string{"type"})
+	deduplicatedDeviceListUsers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "syncproxy_deduplicated_device_list_users_total",
+		Help: "Number of users that were dropped from device list changes because their change was delivered recently",
+	})
+	forwardedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_forwarded_to_device_events_total",
+		Help: "Number of to-device events delivered to each target, by event type",
+	}, []string{"target", "type"})
+
+	httpConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_http_connections_total",
+		Help: "Number of connections used for outgoing requests, by client (homeserver or target) and whether the connection was reused",
+	}, []string{"client", "reused"})
+	databaseUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "syncproxy_db_up",
+		Help: "Whether the last periodic database ping succeeded",
+	})
+	dbOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "syncproxy_db_operation_duration_seconds",
+		Help:    "Time taken by store operations, e.g. sync token writes",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"operation"})
+	httpDNSDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "syncproxy_http_dns_duration_seconds",
+		Help:    "Time taken by DNS lookups of outgoing requests",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"client"})
+	httpConnectDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "syncproxy_http_connect_duration_seconds",
+		Help:    "Time taken to establish TCP connections for outgoing requests",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"client"})
+	httpTLSHandshakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "syncproxy_http_tls_handshake_duration_seconds",
+		Help:    "Time taken by TLS handshakes of outgoing requests",
+		Buckets: []float64{.005, .01, .05, .1, .25, .5, 1, 5},
+	}, []string{"client"})
+
+	deliveryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "syncproxy_delivery_latency_seconds",
+		Help:    "Time from receiving a /sync response to the transaction being delivered to the target",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	})
+	targetSyncLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_seconds_since_last_sync",
+		Help: "Seconds since the last successful sync request of each running target",
+	}, []string{"target"})
+	targetDeliveryLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_seconds_since_last_delivery",
+		Help: "Seconds since a transaction was last delivered to each running target",
+	}, []string{"target"})
+	targetReachable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_reachable",
+		Help: "Whether the latest periodic ping of each active target got a response (1) or not (0)",
+	}, []string{"target"})
+	targetPingLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_ping_latency_seconds",
+		Help: "Duration of the latest successful periodic ping of each active target",
+	}, []string{"target"})
+	syncLoopRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syncproxy_target_sync_loop_restarts_total",
+		Help: "Number of times the sync loop of each target was started again after the first start",
+	}, []string{"target"})
+	targetDeliveryLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_target_delivery_latency_seconds",
+		Help: "Delivery latency percentiles of each target over rolling windows",
+	}, []string{"target", "window", "quantile"})
+	sloGoodRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_slo_good_ratio",
+		Help: "Fraction of events delivered within the SLO latency threshold over rolling windows",
+	}, []string{"target", "window"})
+	sloBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "syncproxy_slo_burn_rate",
+		Help: "Rate at which the latency SLO error budget is being consumed over rolling windows (1 = exactly on budget)",
+	}, []string{"target", "window"})
+)
@@ -0,0 +1,118 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"maunium.net/go/mautrix/appservice"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// Management tokens let a bridge manage its own targets without knowing the shared secret. Each appservice ID
+// has at most one token, which can be used for PUT and DELETE requests of any target of that appservice.
+// Unlike registration tokens, they don't expire and can be used any number of times until they're replaced
+// or revoked. Only a hash of the token is stored.
+
+const managementTokenPrefix = "spmt_"
+
+type respManagementToken struct {
+	Token        string `json:"token"`
+	AppserviceID string `json:"appservice_id"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// manageManagementToken issues a new management token for an appservice (POST), replacing the previous one,
+// or revokes the current token (DELETE).
+func manageManagementToken(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	appserviceID := mux.Vars(r)["appserviceID"]
+	if strings.Contains(appserviceID, profileSeparator) {
+		errInvalidAppserviceID.Write(w)
+		return
+	}
+	storageID := storageAppserviceID(requestProfile(r).Name, appserviceID)
+	if r.Method == http.MethodDelete {
+		err := store.DeleteManagementToken(r.Context(), storageID)
+		if err != nil {
+			log.Errorfln("Failed to revoke management token of %s: %v", storageID, err)
+			errDatabaseQueryFailed.Write(w)
+			return
+		}
+		log.Infofln("Revoked management token of %s from %s", storageID, clientIP(r))
+		appservice.WriteBlankOK(w)
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Errorln("Failed to generate management token:", err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	token := managementTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	createdAt := time.Now().UnixNano() / int64(time.Millisecond)
+	err := store.SetManagementToken(r.Context(), storageID, hashRegistrationToken(token), createdAt)
+	if err != nil {
+		log.Errorfln("Failed to store management token for %s: %v", storageID, err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	log.Infofln("Issued management token for %s from %s", storageID, clientIP(r))
+	writeJSON(w, http.StatusOK, &respManagementToken{
+		Token:        token,
+		AppserviceID: appserviceID,
+		CreatedAt:    createdAt,
+	})
+}
+
+// checkManagementToken checks that the management token belongs to the given appservice.
+func checkManagementToken(w http.ResponseWriter, r *http.Request, token, storageID string) bool {
+	w.Header().Add("Content-Type", "application/json")
+	valid, err := store.CheckManagementToken(r.Context(), storageID, hashRegistrationToken(token))
+	if err != nil {
+		log.Errorln("Failed to check management token:", err)
+		errDatabaseQueryFailed.Write(w)
+		return false
+	} else if !valid {
+		log.Warnfln("Request to %s from %s had an invalid management token", r.URL.Path, clientIP(r))
+		errUnknownToken.Write(w)
+		return false
+	}
+	return true
+}
+
+// isTargetHSToken checks if the token is the hs_token of the target, or of the target without a device key
+// of the same appservice, so that a bridge can use the token it already has to manage its additional devices.
+// Only existing targets are checked, new targets can't be created with their own hs_token.
+func isTargetHSToken(token, storageID, deviceKey string) bool {
+	for _, targetID := range []string{TargetID(storageID, deviceKey), TargetID(storageID, "")} {
+		target := registry.Get(targetID)
+		if target != nil && subtle.ConstantTimeCompare([]byte(token), []byte(target.getHSToken())) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// Schema migrations are SQL files in the migrations directory. Files named NN-description.sql are used for every
+// database, and files named NN-description.<dialect>.sql only for that dialect (postgres or sqlite), so each
+// version needs either a common file or a file for every dialect. The first line of a file is the header:
+//
+//	-- v38: Description of the change
+//	-- v38 (compatible with v37+): Description of a change that older versions of the proxy can live with
+//
+// The compatible version is the oldest schema version that the code must support to keep using the database after
+// the migration, which lets a downgraded proxy start as long as the newer changes are only additive. It defaults to
+// the migration's own version. A second line of "-- transaction: off" runs the file outside a transaction, for
+// statements like CREATE INDEX CONCURRENTLY that can't be in one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var dialects = []string{"postgres", "sqlite"}
+
+type Migration struct {
+	Version       int
+	CompatVersion int
+	Message       string
+	Transaction   bool
+
+	// sql contains the statements for each dialect. The empty key is used for dialects without a file of their own.
+	sql map[string]string
+}
+
+var (
+	migrationFileRegex   = regexp.MustCompile(`^(\d+)-[a-z0-9-]+(?:\.(postgres|sqlite))?\.sql$`)
+	migrationHeaderRegex = regexp.MustCompile(`^-- v(\d+)(?: \(compatible with v(\d+)\+\))?: (.+)$`)
+)
+
+const migrationNoTransaction = "-- transaction: off"
+
+// SQL returns the statements of the migration for the given dialect.
+func (migration *Migration) SQL(dialect string) string {
+	if query, ok := migration.sql[dialect]; ok {
+		return query
+	}
+	return migration.sql[""]
+}
+
+func parseMigration(name, content string) (*Migration, string, error) {
+	fileMatch := migrationFileRegex.FindStringSubmatch(name)
+	if fileMatch == nil {
+		return nil, "", fmt.Errorf("invalid file name")
+	}
+	lines := strings.SplitN(content, "\n", 3)
+	headerMatch := migrationHeaderRegex.FindStringSubmatch(strings.TrimSpace(lines[0]))
+	if headerMatch == nil {
+		return nil, "", fmt.Errorf("invalid header %q", lines[0])
+	}
+	migration := &Migration{Message: headerMatch[3], Transaction: true}
+	migration.Version, _ = strconv.Atoi(headerMatch[1])
+	if fileVersion, _ := strconv.Atoi(fileMatch[1]); fileVersion != migration.Version {
+		return nil, "", fmt.Errorf("header version v%d doesn't match file name", migration.Version)
+	}
+	migration.CompatVersion = migration.Version
+	if len(headerMatch[2]) > 0 {
+		migration.CompatVersion, _ = strconv.Atoi(headerMatch[2])
+		if migration.CompatVersion > migration.Version {
+			return nil, "", fmt.Errorf("compatible version v%d is newer than the migration", migration.CompatVersion)
+		}
+	}
+	if len(lines) > 1 && strings.TrimSpace(lines[1]) == migrationNoTransaction {
+		migration.Transaction = false
+	}
+	return migration, fileMatch[2], nil
+}
+
+// loadMigrations reads the migrations from the given directory of the file system and checks that every version
+// from v1 up is there for every dialect.
+func loadMigrations(fs embed.FS, dir string) ([]*Migration, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		content, err := fs.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migration, dialect, err := parseMigration(file.Name(), string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse migration %s: %w", file.Name(), err)
+		}
+		existing, ok := byVersion[migration.Version]
+		if !ok {
+			migration.sql = make(map[string]string)
+			byVersion[migration.Version] = migration
+			existing = migration
+		} else if existing.Message != migration.Message || existing.CompatVersion != migration.CompatVersion ||
+			existing.Transaction != migration.Transaction {
+			return nil, fmt.Errorf("migration %s has a different header than other files of v%d", file.Name(), migration.Version)
+		}
+		if _, duplicate := existing.sql[dialect]; duplicate {
+			return nil, fmt.Errorf("migration %s is a duplicate of another file of v%d", file.Name(), migration.Version)
+		}
+		existing.sql[dialect] = string(content)
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration v%d is missing", i+1)
+		}
+		for _, dialect := range dialects {
+			if len(migration.SQL(dialect)) == 0 {
+				return nil, fmt.Errorf("migration v%d doesn't have a file for %s", migration.Version, dialect)
+			}
+		}
+	}
+	return migrations, nil
+}
+
+var migrations = mustLoadMigrations()
+
+func mustLoadMigrations() []*Migration {
+	loaded, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		panic(fmt.Errorf("invalid embedded schema migrations: %w", err))
+	}
+	return loaded
+}
+
+// dialect returns the name of the database dialect used in migration file names.
+func (db *Database) dialect() string {
+	if db.scheme == "pgx" {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx, so that migrations can run with or without a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func setVersion(conn execer, migration *Migration, appliedAt, duration int64) error {
+	_, err := conn.Exec("DELETE FROM version")
+	if err != nil {
+		return fmt.Errorf("failed to delete current version row: %w", err)
+	}
+	_, err = conn.Exec("INSERT INTO version (version, compat) VALUES ($1, $2)", migration.Version, migration.CompatVersion)
+	if err != nil {
+		return fmt.Errorf("failed to insert new version row: %w", err)
+	}
+	_, err = conn.Exec("INSERT INTO schema_migrations (version, applied_at, duration_ms) VALUES ($1, $2, $3)",
+		migration.Version, appliedAt, duration)
+	if err != nil {
+		return fmt.Errorf("failed to insert migration log row: %w", err)
+	}
+	return nil
+}
+
+// ensureVersionTable creates the version and migration log tables, and adds the compat column to version tables
+// created before it existed.
+func (db *Database) ensureVersionTable() error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS version (version INTEGER PRIMARY KEY, compat INTEGER)")
+	if err != nil {
+		return fmt.Errorf("failed to ensure version table exists: %w", err)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL, duration_ms BIGINT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("failed to ensure migration log table exists: %w", err)
+	}
+	var hasCompat bool
+	if db.dialect() == "postgres" {
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.columns WHERE table_name='version' AND column_name='compat')").Scan(&hasCompat)
+	} else {
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info('version') WHERE name='compat')").Scan(&hasCompat)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check if version table has compat column: %w", err)
+	} else if !hasCompat {
+		if _, err = db.Exec("ALTER TABLE version ADD COLUMN compat INTEGER"); err != nil {
+			return fmt.Errorf("failed to add compat column to version table: %w", err)
+		}
+	}
+	return nil
+}
+
+// getVersion returns the current schema version and the oldest version that's compatible with it.
+func (db *Database) getVersion() (version, compat int, err error) {
+	err = db.QueryRow("SELECT version, COALESCE(compat, version) FROM version").Scan(&version, &compat)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func (db *Database) runMigration(migration *Migration) error {
+	log.Infofln("Updating database schema to v%d: %s", migration.Version, migration.Message)
+	start := time.Now()
+	finish := func(conn execer) error {
+		err := setVersion(conn, migration, start.UnixNano()/int64(time.Millisecond), time.Since(start).Milliseconds())
+		if err != nil {
+			return fmt.Errorf("failed to store new version v%d in database: %w", migration.Version, err)
+		}
+		return nil
+	}
+	// Migrations can take a long time on large databases, so they don't use the query timeout.
+	if !migration.Transaction {
+		if _, err := db.conn.Exec(migration.SQL(db.dialect())); err != nil {
+			return fmt.Errorf("failed to upgrade database schema to v%d: %w", migration.Version, err)
+		}
+		return finish(db.conn)
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction to upgrade database schema to v%d: %w", migration.Version, err)
+	} else if _, err = tx.Exec(migration.SQL(db.dialect())); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to upgrade database schema to v%d: %w", migration.Version, err)
+	} else if err = finish(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	} else if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit upgrade of database schema to v%d: %w", migration.Version, err)
+	}
+	return nil
+}
+
+// Upgrade updates the database schema to the latest version. If the schema is newer than this version of
+// the proxy supports, it's only used if the newer migrations declared that they're compatible with this version,
+// or if allowNewer is set. Otherwise an error is returned, as running an old version against a newer schema
+// may corrupt data.
+func (db *Database) Upgrade(allowNewer bool) error {
+	if err := db.ensureVersionTable(); err != nil {
+		return err
+	}
+	version, compat, err := db.getVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get current database schema version: %w", err)
+	}
+	latest := len(migrations)
+	if version > latest {
+		if compat <= latest {
+			log.Infofln("Database schema v%d is newer than the latest version supported by this build (v%d), but it's compatible with v%d", version, latest, compat)
+		} else if !allowNewer {
+			return fmt.Errorf("database schema v%d is newer than the latest version supported by this build (v%d) and requires at least v%d, refusing to start", version, latest, compat)
+		} else {
+			log.Warnfln("Database schema v%d is newer than the latest version supported by this build (v%d) and requires at least v%d", version, latest, compat)
+		}
+	} else if latest > version {
+		for _, migration := range migrations[version:] {
+			if err = db.runMigration(migration); err != nil {
+				return err
+			}
+		}
+		log.Infofln("Database schema updated to v%d", latest)
+	}
+	return db.loadSchemaInfo()
+}
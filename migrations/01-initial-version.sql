@@ -0,0 +1,12 @@
+-- v1: Initial version
+CREATE TABLE targets (
+	appservice_id    TEXT    PRIMARY KEY,
+	bot_access_token TEXT    NOT NULL,
+	hs_token         TEXT    NOT NULL,
+	address          TEXT    NOT NULL,
+	user_id          TEXT    NOT NULL,
+	device_id        TEXT    NOT NULL,
+	is_proxy         BOOLEAN NOT NULL,
+	next_batch       TEXT    NOT NULL,
+	active           BOOLEAN DEFAULT false
+);
@@ -0,0 +1,14 @@
+-- v2: Add transaction history table
+CREATE TABLE transaction_history (
+	txn_id              TEXT    PRIMARY KEY,
+	appservice_id       TEXT    NOT NULL,
+	status              TEXT    NOT NULL,
+	attempts            INTEGER NOT NULL,
+	created_at          BIGINT  NOT NULL,
+	sent_at             BIGINT,
+	events              TEXT    NOT NULL,
+	device_list_changed INTEGER NOT NULL,
+	device_list_left    INTEGER NOT NULL,
+	otk_count           BOOLEAN NOT NULL
+);
+CREATE INDEX transaction_history_appservice_idx ON transaction_history (appservice_id, created_at);
@@ -0,0 +1,19 @@
+-- v3: Allow multiple devices per appservice
+CREATE TABLE targets_new (
+	appservice_id    TEXT    NOT NULL,
+	device_key       TEXT    NOT NULL DEFAULT '',
+	bot_access_token TEXT    NOT NULL,
+	hs_token         TEXT    NOT NULL,
+	address          TEXT    NOT NULL,
+	user_id          TEXT    NOT NULL,
+	device_id        TEXT    NOT NULL,
+	is_proxy         BOOLEAN NOT NULL,
+	next_batch       TEXT    NOT NULL,
+	active           BOOLEAN DEFAULT false,
+
+	PRIMARY KEY (appservice_id, device_key)
+);
+INSERT INTO targets_new (appservice_id, device_key, bot_access_token, hs_token, address, user_id, device_id, is_proxy, next_batch, active)
+SELECT appservice_id, '', bot_access_token, hs_token, address, user_id, device_id, is_proxy, next_batch, active FROM targets;
+DROP TABLE targets;
+ALTER TABLE targets_new RENAME TO targets;
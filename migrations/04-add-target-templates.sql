@@ -0,0 +1,2 @@
+-- v4: Add target templates
+ALTER TABLE targets ADD COLUMN template TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v5: Add dry run flag for targets
+ALTER TABLE targets ADD COLUMN dry_run BOOLEAN NOT NULL DEFAULT false;
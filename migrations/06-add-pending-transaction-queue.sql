@@ -0,0 +1,9 @@
+-- v6: Add pending transaction queue
+CREATE TABLE pending_transactions (
+	txn_id        TEXT   PRIMARY KEY,
+	appservice_id TEXT   NOT NULL,
+	device_key    TEXT   NOT NULL,
+	data          TEXT   NOT NULL,
+	created_at    BIGINT NOT NULL
+);
+CREATE INDEX pending_transactions_target_idx ON pending_transactions (appservice_id, device_key, created_at);
@@ -0,0 +1,10 @@
+-- v7: Add table for recent target errors
+CREATE TABLE target_errors (
+	appservice_id TEXT   NOT NULL,
+	device_key    TEXT   NOT NULL DEFAULT '',
+	timestamp     BIGINT NOT NULL,
+	source        TEXT   NOT NULL,
+	category      TEXT   NOT NULL,
+	message       TEXT   NOT NULL
+);
+CREATE INDEX target_errors_target_idx ON target_errors (appservice_id, device_key, timestamp);
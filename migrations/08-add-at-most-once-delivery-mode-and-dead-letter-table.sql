@@ -0,0 +1,11 @@
+-- v8: Add at-most-once delivery mode and dead letter table
+ALTER TABLE targets ADD COLUMN at_most_once BOOLEAN NOT NULL DEFAULT false;
+CREATE TABLE dead_letters (
+	txn_id        TEXT   PRIMARY KEY,
+	appservice_id TEXT   NOT NULL,
+	device_key    TEXT   NOT NULL,
+	reason        TEXT   NOT NULL,
+	data          TEXT,
+	created_at    BIGINT NOT NULL
+);
+CREATE INDEX dead_letters_target_idx ON dead_letters (appservice_id, device_key, created_at);
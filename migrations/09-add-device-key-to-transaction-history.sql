@@ -0,0 +1,3 @@
+-- v9: Add device key to transaction history
+ALTER TABLE transaction_history ADD COLUMN device_key TEXT NOT NULL DEFAULT '';
+CREATE INDEX transaction_history_target_idx ON transaction_history (appservice_id, device_key, created_at);
@@ -0,0 +1,2 @@
+-- v10: Add suspension timestamp to targets
+ALTER TABLE targets ADD COLUMN suspended_until BIGINT NOT NULL DEFAULT 0;
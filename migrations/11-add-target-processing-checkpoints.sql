@@ -0,0 +1,3 @@
+-- v11: Add target processing checkpoints
+ALTER TABLE targets ADD COLUMN checkpoint_txn_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE targets ADD COLUMN checkpoint_at BIGINT NOT NULL DEFAULT 0;
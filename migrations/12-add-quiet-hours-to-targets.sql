@@ -0,0 +1,2 @@
+-- v12: Add quiet hours to targets
+ALTER TABLE targets ADD COLUMN quiet_hours TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v13: Add labels to targets
+ALTER TABLE targets ADD COLUMN labels TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- v14: Add additional recipients to targets
+ALTER TABLE targets ADD COLUMN recipients TEXT NOT NULL DEFAULT '';
+ALTER TABLE transaction_history ADD COLUMN sent_to TEXT NOT NULL DEFAULT '';
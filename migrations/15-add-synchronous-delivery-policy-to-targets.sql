@@ -0,0 +1,2 @@
+-- v15: Add synchronous delivery policy to targets
+ALTER TABLE targets ADD COLUMN synchronous_policy TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v16: Add buffer cap to targets
+ALTER TABLE targets ADD COLUMN max_buffered_bytes BIGINT NOT NULL DEFAULT 0;
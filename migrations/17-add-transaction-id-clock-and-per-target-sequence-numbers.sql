@@ -0,0 +1,5 @@
+-- v17: Add transaction ID clock and per-target sequence numbers
+CREATE TABLE txn_id_clock (reserved_until BIGINT NOT NULL);
+INSERT INTO txn_id_clock (reserved_until) VALUES (0);
+ALTER TABLE targets ADD COLUMN txn_sequence BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE pending_transactions ADD COLUMN sequence BIGINT NOT NULL DEFAULT 0;
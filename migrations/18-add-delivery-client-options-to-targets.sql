@@ -0,0 +1,2 @@
+-- v18: Add delivery client options to targets
+ALTER TABLE targets ADD COLUMN delivery_options TEXT NOT NULL DEFAULT '';
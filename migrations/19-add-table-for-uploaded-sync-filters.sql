@@ -0,0 +1,8 @@
+-- v19: Add table for uploaded sync filters
+CREATE TABLE sync_filters (
+	user_id     TEXT   NOT NULL,
+	filter_hash TEXT   NOT NULL,
+	filter_id   TEXT   NOT NULL,
+	created_at  BIGINT NOT NULL,
+	PRIMARY KEY (user_id, filter_hash)
+);
@@ -0,0 +1,2 @@
+-- v20: Add custom sync filters to targets
+ALTER TABLE targets ADD COLUMN filter TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v21: Add presence forwarding option to targets
+ALTER TABLE targets ADD COLUMN forward_presence BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+-- v22: Add full sync mode option to targets
+ALTER TABLE targets ADD COLUMN full_sync BOOLEAN NOT NULL DEFAULT false;
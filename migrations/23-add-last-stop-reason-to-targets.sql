@@ -0,0 +1,4 @@
+-- v23: Add last stop reason to targets
+ALTER TABLE targets ADD COLUMN last_stop_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE targets ADD COLUMN last_stop_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE targets ADD COLUMN last_stop_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- v24: Add table for registration tokens
+CREATE TABLE registration_tokens (
+	token_hash    TEXT   PRIMARY KEY,
+	appservice_id TEXT   NOT NULL,
+	device_key    TEXT   NOT NULL,
+	created_at    BIGINT NOT NULL,
+	expires_at    BIGINT NOT NULL
+);
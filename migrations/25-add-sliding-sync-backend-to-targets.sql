@@ -0,0 +1,4 @@
+-- v25: Add sliding sync backend to targets
+ALTER TABLE targets ADD COLUMN sync_backend TEXT NOT NULL DEFAULT '';
+ALTER TABLE targets ADD COLUMN sliding_sync_pos TEXT NOT NULL DEFAULT '';
+ALTER TABLE targets ADD COLUMN sliding_to_device_since TEXT NOT NULL DEFAULT '';
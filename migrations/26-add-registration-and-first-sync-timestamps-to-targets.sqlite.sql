@@ -0,0 +1,7 @@
+-- v26: Add registration and first sync timestamps to targets
+ALTER TABLE targets ADD COLUMN registered_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE targets ADD COLUMN first_synced_at BIGINT NOT NULL DEFAULT 0;
+-- The real registration time of existing targets is unknown, so the age is counted from the upgrade.
+-- Targets that have a sync token have synced at some point.
+UPDATE targets SET registered_at=CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER);
+UPDATE targets SET first_synced_at=registered_at WHERE next_batch<>'';
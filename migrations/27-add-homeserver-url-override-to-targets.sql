@@ -0,0 +1,2 @@
+-- v27: Add homeserver URL override to targets
+ALTER TABLE targets ADD COLUMN homeserver_url TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v28: Add device list left toggle to targets
+ALTER TABLE targets ADD COLUMN drop_device_list_left BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,6 @@
+-- v29: Add table for management tokens
+CREATE TABLE management_tokens (
+	appservice_id TEXT   PRIMARY KEY,
+	token_hash    TEXT   NOT NULL UNIQUE,
+	created_at    BIGINT NOT NULL
+);
@@ -0,0 +1,9 @@
+-- v30: Add table for target leases
+CREATE TABLE target_leases (
+	appservice_id TEXT   NOT NULL,
+	device_key    TEXT   NOT NULL,
+	holder        TEXT   NOT NULL,
+	expires_at    BIGINT NOT NULL,
+
+	PRIMARY KEY (appservice_id, device_key)
+);
@@ -0,0 +1,2 @@
+-- v31: Add retry policy to targets
+ALTER TABLE targets ADD COLUMN retry_policy TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- v32: Add sync retry state to targets
+ALTER TABLE targets ADD COLUMN sync_retry_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE targets ADD COLUMN sync_retry_interval BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE targets ADD COLUMN sync_retry_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE targets ADD COLUMN sync_retry_error TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v33: Add paused flag to targets
+ALTER TABLE targets ADD COLUMN paused BOOLEAN NOT NULL DEFAULT false;
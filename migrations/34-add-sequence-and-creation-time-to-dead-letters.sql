@@ -0,0 +1,3 @@
+-- v34: Add sequence and creation time to dead letters
+ALTER TABLE dead_letters ADD COLUMN sequence BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE dead_letters ADD COLUMN txn_created_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- v35: Add OTK count thresholds to targets
+ALTER TABLE targets ADD COLUMN otk_count_threshold INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE targets ADD COLUMN otk_count_delta INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- v36: Add device list dedup window to targets
+ALTER TABLE targets ADD COLUMN device_list_dedup_minutes INTEGER NOT NULL DEFAULT 0;
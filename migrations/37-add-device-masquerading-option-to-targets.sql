@@ -0,0 +1,2 @@
+-- v37: Add device masquerading option to targets
+ALTER TABLE targets ADD COLUMN masquerade_device BOOLEAN NOT NULL DEFAULT false;
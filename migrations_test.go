@@ -0,0 +1,157 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationsLoaded(t *testing.T) {
+	if len(migrations) == 0 {
+		t.Fatal("No migrations were loaded")
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("Migration at index %d has version v%d", i, migration.Version)
+		} else if migration.CompatVersion > migration.Version {
+			t.Errorf("Migration v%d has compat version v%d", migration.Version, migration.CompatVersion)
+		}
+	}
+	// v26 has separate files for each dialect.
+	if migrations[25].SQL("postgres") == migrations[25].SQL("sqlite") {
+		t.Error("Expected v26 to have different SQL for postgres and sqlite")
+	}
+}
+
+func TestParseMigration(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		content     string
+		version     int
+		compat      int
+		dialect     string
+		transaction bool
+		fail        bool
+	}{
+		{"Common", "05-test.sql", "-- v5: Test\nSELECT 1;", 5, 5, "", true, false},
+		{"Dialect", "05-test.postgres.sql", "-- v5: Test\nSELECT 1;", 5, 5, "postgres", true, false},
+		{"Compatible", "05-test.sql", "-- v5 (compatible with v3+): Test\nSELECT 1;", 5, 3, "", true, false},
+		{"NoTransaction", "05-test.sql", "-- v5: Test\n-- transaction: off\nSELECT 1;", 5, 5, "", false, false},
+		{"VersionMismatch", "06-test.sql", "-- v5: Test\nSELECT 1;", 0, 0, "", false, true},
+		{"UnknownDialect", "05-test.mysql.sql", "-- v5: Test\nSELECT 1;", 0, 0, "", false, true},
+		{"NoHeader", "05-test.sql", "SELECT 1;", 0, 0, "", false, true},
+		{"CompatNewer", "05-test.sql", "-- v5 (compatible with v6+): Test\nSELECT 1;", 0, 0, "", false, true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			migration, dialect, err := parseMigration(tc.file, tc.content)
+			if tc.fail {
+				if err == nil {
+					t.Error("Expected parsing to fail")
+				}
+				return
+			} else if err != nil {
+				t.Fatal("Failed to parse migration:", err)
+			}
+			if migration.Version != tc.version || migration.CompatVersion != tc.compat || dialect != tc.dialect || migration.Transaction != tc.transaction {
+				t.Errorf("Unexpected result: %+v for dialect %q", migration, dialect)
+			}
+		})
+	}
+}
+
+func openTestSQLite(t *testing.T) *Database {
+	t.Helper()
+	testDB, err := Connect("sqlite:///"+filepath.Join(t.TempDir(), "syncproxy.db"), DatabaseOpts{MaxOpenConns: 1, MaxIdleConns: 1})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() {
+		_ = testDB.conn.Close()
+	})
+	return testDB
+}
+
+func TestUpgrade(t *testing.T) {
+	testDB := openTestSQLite(t)
+	if err := testDB.Upgrade(false); err != nil {
+		t.Fatal("Failed to upgrade empty database:", err)
+	}
+	if schema := testDB.Schema(); schema.Version != len(migrations) || schema.CompatVersion != len(migrations) {
+		t.Errorf("Unexpected schema after upgrade: %+v", schema)
+	}
+	if err := testDB.Upgrade(false); err != nil {
+		t.Fatal("Upgrading an up-to-date database failed:", err)
+	}
+}
+
+func TestUpgradeLegacyVersionTable(t *testing.T) {
+	testDB := openTestSQLite(t)
+	if err := testDB.Upgrade(false); err != nil {
+		t.Fatal("Failed to upgrade empty database:", err)
+	}
+	// Version tables created before the compat column only have the version.
+	for _, query := range []string{"DROP TABLE version", "CREATE TABLE version (version INTEGER PRIMARY KEY)"} {
+		if _, err := testDB.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := testDB.Exec("INSERT INTO version VALUES ($1)", len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.Upgrade(false); err != nil {
+		t.Fatal("Failed to upgrade database with old version table:", err)
+	}
+	if schema := testDB.Schema(); schema.Version != len(migrations) || schema.CompatVersion != len(migrations) {
+		t.Errorf("Unexpected schema after upgrade: %+v", schema)
+	}
+}
+
+func TestUpgradeNewerSchema(t *testing.T) {
+	latest := len(migrations)
+	tests := []struct {
+		name       string
+		compat     int
+		allowNewer bool
+		fail       bool
+	}{
+		{"Compatible", latest, false, false},
+		{"Incompatible", latest + 1, false, true},
+		{"IncompatibleAllowed", latest + 1, true, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			testDB := openTestSQLite(t)
+			if err := testDB.Upgrade(false); err != nil {
+				t.Fatal("Failed to upgrade empty database:", err)
+			}
+			if _, err := testDB.Exec("UPDATE version SET version=$1, compat=$2", latest+2, tc.compat); err != nil {
+				t.Fatal(err)
+			}
+			err := testDB.Upgrade(tc.allowNewer)
+			if tc.fail && err == nil {
+				t.Error("Expected upgrade to refuse the newer schema")
+			} else if !tc.fail && err != nil {
+				t.Error("Expected upgrade to accept the newer schema, got", err)
+			}
+		})
+	}
+}
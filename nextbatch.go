@@ -0,0 +1,139 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// maxSkipSyncRequests limits how many /sync requests skipping to the current position may make
+// while the homeserver still returns to-device events.
+const maxSkipSyncRequests = 100
+
+// skipBacklogTimeout is how long skipping the backlog of a new target in a PUT request may take.
+const skipBacklogTimeout = 2 * time.Minute
+
+type reqResetNextBatch struct {
+	// NextBatch is the sync token to continue from, e.g. an older token to replay events from.
+	NextBatch string `json:"next_batch"`
+	// SkipToNow discards everything that hasn't been synced yet and continues from the current position.
+	SkipToNow bool `json:"skip_to_now"`
+}
+
+type respResetNextBatch struct {
+	PreviousNextBatch string `json:"previous_next_batch"`
+	NextBatch         string `json:"next_batch"`
+	// SkippedToDeviceEvents is the number of to-device events that were discarded by skip_to_now.
+	SkippedToDeviceEvents int  `json:"skipped_to_device_events,omitempty"`
+	Restarted             bool `json:"restarted"`
+}
+
+// skipToNow syncs without forwarding anything until the homeserver has no more to-device events for the target,
+// and returns the resulting sync token along with the number of discarded to-device events.
+func (target *SyncTarget) skipToNow(ctx context.Context) (nextBatch string, skipped int, err error) {
+	filter, err := target.createSyncFilter(target.getHomeserverInfo())
+	if err != nil {
+		return "", 0, err
+	}
+	for i := 0; i < maxSkipSyncRequests; i++ {
+		resp, err := target.getClient().SyncRequest(0, nextBatch, filter, false, event.PresenceOffline, ctx)
+		if err != nil {
+			return "", skipped, err
+		}
+		nextBatch = resp.NextBatch
+		skipped += len(resp.ToDevice.Events)
+		if len(resp.ToDevice.Events) == 0 {
+			return nextBatch, skipped, nil
+		}
+	}
+	return "", skipped, errors.New("homeserver kept returning to-device events")
+}
+
+// skipInitialBacklog returns the current sync position for a target that was PUT with skip_backlog and
+// doesn't have a sync token yet, so that it only receives to-device events sent after it was registered.
+// The returned bool is false if there's nothing to skip.
+func (target *SyncTarget) skipInitialBacklog(req *SyncTarget) (string, bool, error) {
+	if !req.skipBacklog || len(req.NextBatch) > 0 || len(target.NextBatch) > 0 || target.SyncBackend == SyncBackendSliding {
+		return "", false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), skipBacklogTimeout)
+	defer cancel()
+	nextBatch, skipped, err := target.skipToNow(ctx)
+	if err != nil {
+		target.log.Warnln("Failed to skip initial backlog:", err)
+		return "", false, err
+	}
+	target.log.Infofln("Skipped %d to-device events from before the target was registered", skipped)
+	return nextBatch, true, nil
+}
+
+// resetNextBatch replaces the sync token of a target, either with a given token or with the current position.
+// The sync loop is stopped while the token is replaced and started again afterwards if it was running.
+func resetNextBatch(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	targetID := requestTargetID(r, vars["appserviceID"], vars["deviceID"])
+	var req reqResetNextBatch
+	if !getJSON(w, r, &req) {
+		return
+	} else if req.SkipToNow == (len(req.NextBatch) > 0) {
+		errInvalidNextBatchReset.Write(w)
+		return
+	} else if !confirmDestructive(w, r, "reset-next-batch", targetID) {
+		return
+	}
+	unlock := registry.LockTarget(targetID)
+	defer unlock()
+	target := registry.Get(targetID)
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	} else if target.SyncBackend == SyncBackendSliding {
+		formatError(errNextBatchResetFailed, "sliding sync targets don't use next_batch").Write(w)
+		return
+	}
+	resp := &respResetNextBatch{PreviousNextBatch: target.NextBatch, NextBatch: req.NextBatch}
+	resp.Restarted = target.isRunning()
+	<-target.Stop(StopReasonRestart)
+	if req.SkipToNow {
+		var err error
+		resp.NextBatch, resp.SkippedToDeviceEvents, err = target.skipToNow(r.Context())
+		if err != nil {
+			target.log.Warnln("Failed to skip to current sync position:", err)
+			formatError(errNextBatchResetFailed, err).Write(w)
+			if resp.Restarted {
+				target.startInBackground()
+			}
+			return
+		}
+	}
+	target.SetNextBatch(r.Context(), resp.NextBatch)
+	target.log.Infofln("Replaced sync token %s with %s after reset request (skipped %d to-device events)", resp.PreviousNextBatch, resp.NextBatch, resp.SkippedToDeviceEvents)
+	if resp.Restarted {
+		target.startInBackground()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,75 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ProxyConfig configures the proxies used for outgoing connections. Empty values use the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, and "direct" disables proxying.
+type ProxyConfig struct {
+	// Homeserver is the proxy for /sync and other requests to homeservers.
+	Homeserver string `yaml:"homeserver"`
+	// Delivery is the proxy for transactions, probes and websockets to targets.
+	Delivery string `yaml:"delivery"`
+}
+
+const directProxy = "direct"
+
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+var homeserverProxy proxyFunc = http.ProxyFromEnvironment
+var deliveryProxy proxyFunc = http.ProxyFromEnvironment
+
+// parseProxy parses a proxy URL. HTTP, HTTPS and SOCKS5 proxies are supported.
+func parseProxy(val string) (proxyFunc, error) {
+	if len(val) == 0 {
+		return http.ProxyFromEnvironment, nil
+	} else if val == directProxy {
+		return func(*http.Request) (*url.URL, error) {
+			return nil, nil
+		}, nil
+	}
+	proxyURL, err := url.Parse(val)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected http, https or socks5)", proxyURL.Scheme)
+	}
+	if len(proxyURL.Host) == 0 {
+		return nil, fmt.Errorf("proxy URL is missing the host")
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// newHomeserverTransport returns the transport for requests to homeservers, which uses the homeserver proxy.
+func newHomeserverTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		runtimeLock.RLock()
+		proxy := homeserverProxy
+		runtimeLock.RUnlock()
+		return proxy(req)
+	}
+	return transport
+}
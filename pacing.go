@@ -0,0 +1,116 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token bucket rate limiter. Waiters reserve tokens in order,
+// so the bucket may go negative, which makes later waiters sleep longer.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait before using it.
+func (tb *tokenBucket) reserve() time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token if the caller didn't use it.
+func (tb *tokenBucket) cancel() {
+	tb.lock.Lock()
+	tb.tokens++
+	tb.lock.Unlock()
+}
+
+var syncStartBuckets = make(map[string]*tokenBucket)
+var syncStartBucketsLock sync.Mutex
+
+func getSyncStartBucket(homeserverURL string) *tokenBucket {
+	syncStartBucketsLock.Lock()
+	defer syncStartBucketsLock.Unlock()
+	bucket, ok := syncStartBuckets[homeserverURL]
+	if !ok {
+		bucket = newTokenBucket(cfg.SyncStartPacing.Rate, cfg.SyncStartPacing.Burst)
+		syncStartBuckets[homeserverURL] = bucket
+	}
+	return bucket
+}
+
+// waitForSyncStart paces the filter creation and initial /sync of sync loops per homeserver,
+// so that a proxy restart doesn't hit the homeserver with every target at once.
+func waitForSyncStart(ctx context.Context, target *SyncTarget) error {
+	if cfg.SyncStartPacing.Rate <= 0 {
+		return nil
+	}
+	bucket := getSyncStartBucket(target.homeserverURL())
+	wait := bucket.reserve()
+	if wait <= 0 {
+		return nil
+	}
+	syncStartPacingWaits.Inc()
+	syncStartsPending.Inc()
+	defer syncStartsPending.Dec()
+	target.heartbeat(wait)
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		bucket.cancel()
+		return ctx.Err()
+	}
+}
+
+// startAfterJitter starts a target that was active before a restart after a random delay of up to maxJitter,
+// so that the sync loops don't all start at the same moment.
+func (target *SyncTarget) startAfterJitter(maxJitter time.Duration) {
+	if maxJitter > 0 {
+		syncStartsPending.Inc()
+		time.Sleep(time.Duration(rand.Int63n(int64(maxJitter))))
+		syncStartsPending.Dec()
+	}
+	target.StartWhenReachable(cfg.StartupProbeTimeout)
+}
@@ -0,0 +1,134 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+type respPause struct {
+	Paused    bool   `json:"paused"`
+	NextBatch string `json:"next_batch"`
+}
+
+// SetPaused updates the paused flag in memory and in the database.
+func (target *SyncTarget) SetPaused(paused bool) error {
+	target.statusLock.Lock()
+	target.Paused = paused
+	target.statusLock.Unlock()
+	return store.SetTargetPaused(context.Background(), target.storageID(), target.DeviceKey, paused)
+}
+
+// Pause stops syncing without any error notifications and marks the target as intentionally paused,
+// so that it isn't started on boot but can be resumed from the stored sync token later.
+func (target *SyncTarget) Pause() error {
+	if err := target.SetPaused(true); err != nil {
+		return err
+	}
+	target.CancelSuspension()
+	<-target.Stop(StopReasonPaused)
+	return nil
+}
+
+// clearPause removes the paused flag before the target is started by other means, e.g. a PUT request.
+func (target *SyncTarget) clearPause() {
+	if !target.Paused {
+		return
+	} else if err := target.SetPaused(false); err != nil {
+		target.log.Warnln("Failed to clear paused flag in database:", err)
+	}
+}
+
+func getPauseTarget(w http.ResponseWriter, r *http.Request) (*SyncTarget, func()) {
+	if !checkAuth(w, r) {
+		return nil, nil
+	}
+	vars := mux.Vars(r)
+	targetID := requestTargetID(r, vars["appserviceID"], vars["deviceID"])
+	unlock := registry.LockTarget(targetID)
+	target := registry.Get(targetID)
+	if target == nil {
+		unlock()
+		errTargetNotFound.Write(w)
+		return nil, nil
+	}
+	return target, unlock
+}
+
+func pauseTarget(w http.ResponseWriter, r *http.Request) {
+	target, unlock := getPauseTarget(w, r)
+	if target == nil {
+		return
+	}
+	defer unlock()
+	if !target.Active && target.SuspendedUntil == 0 && !target.Paused {
+		errTargetNotActive.Write(w)
+		return
+	} else if err := target.Pause(); err != nil {
+		target.log.Warnln("Failed to store paused flag in database:", err)
+		errUpsertFailed.Write(w)
+		return
+	}
+	target.log.Infoln("Paused syncing after pause request")
+	writeJSON(w, http.StatusOK, &respPause{Paused: true, NextBatch: target.NextBatch})
+}
+
+func resumeTarget(w http.ResponseWriter, r *http.Request) {
+	target, unlock := getPauseTarget(w, r)
+	if target == nil {
+		return
+	}
+	defer unlock()
+	if !target.Paused {
+		errTargetNotPaused.Write(w)
+		return
+	} else if !rejectIfDraining(w) {
+		return
+	} else if err := target.SetPaused(false); err != nil {
+		target.log.Warnln("Failed to clear paused flag in database:", err)
+		errUpsertFailed.Write(w)
+		return
+	}
+	target.log.Infoln("Resuming syncing after resume request")
+	target.statusLock.Lock()
+	target.leaseTakeover = true
+	target.statusLock.Unlock()
+	target.startInBackground()
+	writeJSON(w, http.StatusOK, &respPause{Paused: false, NextBatch: target.NextBatch})
+}
+
+// restartTarget stops the sync loop of a running target and starts it again from the stored sync token.
+func restartTarget(w http.ResponseWriter, r *http.Request) {
+	target, unlock := getPauseTarget(w, r)
+	if target == nil {
+		return
+	}
+	defer unlock()
+	if !target.isRunning() {
+		errTargetNotActive.Write(w)
+		return
+	}
+	target.log.Infoln("Restarting syncing after restart request")
+	<-target.Stop(StopReasonRestart)
+	target.startInBackground()
+	appservice.WriteBlankOK(w)
+}
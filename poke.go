@@ -0,0 +1,85 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// pollContext returns a context for a single /sync request that can be interrupted with Poke,
+// and whether the request should skip long-polling because the target was poked.
+func (target *SyncTarget) pollContext(ctx context.Context) (context.Context, context.CancelFunc, bool) {
+	pollCtx, cancel := context.WithCancel(ctx)
+	target.pokeLock.Lock()
+	poked := target.poked
+	target.poked = false
+	target.pollCancel = cancel
+	target.pokeLock.Unlock()
+	return pollCtx, cancel, poked
+}
+
+func (target *SyncTarget) clearPollContext() {
+	target.pokeLock.Lock()
+	target.pollCancel = nil
+	target.pokeLock.Unlock()
+}
+
+// wasPoked returns whether the target was poked since the last /sync request started.
+func (target *SyncTarget) wasPoked() bool {
+	target.pokeLock.Lock()
+	defer target.pokeLock.Unlock()
+	return target.poked
+}
+
+// Poke makes the sync loop do an immediate /sync request. If a long-poll is in progress, it's interrupted,
+// otherwise the next request is made without long-polling. Returns whether a long-poll was interrupted.
+func (target *SyncTarget) Poke() bool {
+	target.pokeLock.Lock()
+	defer target.pokeLock.Unlock()
+	target.poked = true
+	if target.pollCancel != nil {
+		target.pollCancel()
+		target.pollCancel = nil
+		return true
+	}
+	return false
+}
+
+type PokeResponse struct {
+	Interrupted bool `json:"interrupted"`
+}
+
+func pokeTarget(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	} else if !target.isRunning() {
+		errTargetNotActive.Write(w)
+		return
+	}
+	interrupted := target.Poke()
+	target.log.Debugfln("Target poked (interrupted long-poll: %t)", interrupted)
+	writeJSON(w, http.StatusOK, &PokeResponse{Interrupted: interrupted})
+}
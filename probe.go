@@ -0,0 +1,124 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const targetProbeInterval = 2 * time.Second
+const targetProbeRequestTimeout = 5 * time.Second
+
+// probe checks whether the target's address answers HTTP requests. Any HTTP response counts as reachable,
+// only errors that mean no response was received (e.g. connection refused) count as unreachable.
+func (target *SyncTarget) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, targetProbeRequestTimeout)
+	defer cancel()
+	if address := target.getAddress(); isWebsocketAddress(address) {
+		// The websocket is kept open, so the first transaction doesn't have to connect again.
+		_, err := target.getDeliveryWebsocket(ctx, address)
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.getAddress(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := target.getDeliveryClient().Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp.Body)
+	return nil
+}
+
+// pingBeforeStart sends an empty test transaction to the target of a PUT request if the request has ping=true,
+// so that a wrong address or hs_token is reported to the caller instead of only failing in the sync loop.
+// Dry run targets and websocket addresses aren't pinged.
+func pingBeforeStart(w http.ResponseWriter, r *http.Request, target *SyncTarget) bool {
+	if r.URL.Query().Get("ping") != "true" || target.DryRun || isWebsocketAddress(target.getAddress()) {
+		return true
+	}
+	err := target.sendTestTransaction(r.Context(), target.HSToken)
+	if err != nil {
+		log.Debugfln("Ping to %s before starting failed: %v", target.ID(), err)
+		formatError(errTargetPingFailed, err).Write(w)
+		return false
+	}
+	return true
+}
+
+// verifyCredentialsBeforeStart checks the bot access token of the target of a PUT request with /whoami if the
+// request has verify_credentials=true, so that a token of the wrong user or device is reported to the caller
+// instead of only being noticed when the target can't decrypt messages. Homeservers that don't return a device
+// ID only have the user ID checked.
+func verifyCredentialsBeforeStart(w http.ResponseWriter, r *http.Request, target *SyncTarget) bool {
+	if r.URL.Query().Get("verify_credentials") != "true" {
+		return true
+	}
+	client, err := target.newClient("", target.BotAccessToken)
+	if err != nil {
+		formatError(errVerifyCredentialsFailed, err).Write(w)
+		return false
+	}
+	resp, err := client.Whoami()
+	if err != nil {
+		log.Debugfln("Failed to verify credentials of %s: %v", target.ID(), err)
+		formatError(errVerifyCredentialsFailed, err).Write(w)
+		return false
+	} else if resp.UserID != target.UserID {
+		formatError(errCredentialsUserMismatch, resp.UserID, target.UserID).Write(w)
+		return false
+	} else if len(resp.DeviceID) > 0 && resp.DeviceID != target.DeviceID {
+		formatError(errCredentialsDeviceMismatch, resp.DeviceID, target.DeviceID).Write(w)
+		return false
+	}
+	return true
+}
+
+// waitUntilReachable probes the target until it responds or the timeout is reached.
+func (target *SyncTarget) waitUntilReachable(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		err := target.probe(ctx)
+		if err == nil {
+			return true
+		}
+		target.log.Debugfln("Target isn't reachable yet: %v", err)
+		select {
+		case <-time.After(targetProbeInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// StartWhenReachable starts the sync loop after the target's address answers a probe. If the target
+// doesn't answer within the timeout, the sync loop is started anyway. A zero timeout starts immediately.
+func (target *SyncTarget) StartWhenReachable(timeout time.Duration) {
+	if timeout > 0 && !target.DryRun {
+		target.log.Debugln("Waiting for target to be reachable before starting sync")
+		if !target.waitUntilReachable(timeout) {
+			target.log.Warnfln("Target didn't respond to probes within %v, starting sync anyway", timeout)
+		}
+	}
+	target.Start()
+}
@@ -0,0 +1,169 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Profile is a logical proxy with its own homeserver, shared secret and path prefix.
+// Targets of different profiles live in separate namespaces, so the same appservice ID can be used in each profile.
+// The unnamed default profile is configured with the top-level HOMESERVER_URL, SHARED_SECRET and BASE_PATH.
+type Profile struct {
+	Name          string `yaml:"name"`
+	HomeserverURL string `yaml:"homeserver_url"`
+	SharedSecret  string `yaml:"shared_secret"`
+	BasePath      string `yaml:"base_path"`
+}
+
+// profileSeparator separates the profile name from the appservice ID in the database and the targets map.
+const profileSeparator = "|"
+
+var profileNameRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+type profileContextKey struct{}
+
+var defaultProfile = &Profile{}
+
+func getProfile(name string) *Profile {
+	if len(name) == 0 {
+		return defaultProfile
+	}
+	for _, profile := range cfg.Profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+	return nil
+}
+
+// readProfiles reads the profiles listed in PROFILES from PROFILE_<NAME>_* environment variables.
+// They're validated along with the rest of the config.
+func readProfiles(env *configEnv, names string) []*Profile {
+	var profiles []*Profile
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		envPrefix := fmt.Sprintf("PROFILE_%s_", strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+		profiles = append(profiles, &Profile{
+			Name:          name,
+			HomeserverURL: env.getString(envPrefix+"HOMESERVER_URL", ""),
+			SharedSecret:  env.getString(envPrefix+"SHARED_SECRET", ""),
+			BasePath:      env.getString(envPrefix+"BASE_PATH", ""),
+		})
+	}
+	return profiles
+}
+
+// validateProfiles checks that the profiles have all the required fields and don't share base paths.
+// The base paths are normalized in place.
+func validateProfiles(profiles []*Profile) error {
+	seenPaths := map[string]struct{}{cfg.BasePath: {}}
+	for _, profile := range profiles {
+		profile.BasePath = normalizeBasePath(profile.BasePath)
+		if !profileNameRegex.MatchString(profile.Name) {
+			return fmt.Errorf("invalid profile name %q", profile.Name)
+		} else if len(profile.HomeserverURL) == 0 {
+			return fmt.Errorf("homeserver URL of profile %s is not set", profile.Name)
+		} else if len(profile.SharedSecret) == 0 {
+			return fmt.Errorf("shared secret of profile %s is not set", profile.Name)
+		} else if len(profile.BasePath) == 0 {
+			return fmt.Errorf("base path of profile %s is not set", profile.Name)
+		} else if _, ok := seenPaths[profile.BasePath]; ok {
+			return fmt.Errorf("base path %s of profile %s is already used", profile.BasePath, profile.Name)
+		}
+		seenPaths[profile.BasePath] = struct{}{}
+	}
+	return nil
+}
+
+// Middleware marks requests as belonging to the profile.
+func (profile *Profile) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), profileContextKey{}, profile)))
+	})
+}
+
+// secret returns the shared secret of the profile, which can change when the config is reloaded.
+func (profile *Profile) secret() string {
+	runtimeLock.RLock()
+	defer runtimeLock.RUnlock()
+	return profile.SharedSecret
+}
+
+// homeserver returns the homeserver URL of the profile, which can change when the config is reloaded.
+func (profile *Profile) homeserver() string {
+	runtimeLock.RLock()
+	defer runtimeLock.RUnlock()
+	return profile.HomeserverURL
+}
+
+// requestProfile returns the profile whose path prefix the request was made to.
+func requestProfile(r *http.Request) *Profile {
+	if profile, ok := r.Context().Value(profileContextKey{}).(*Profile); ok {
+		return profile
+	}
+	return defaultProfile
+}
+
+// storageAppserviceID returns the appservice ID namespaced with the profile name, which is used as the appservice ID
+// in the database. Targets of the default profile aren't namespaced, so that existing databases work as-is.
+func storageAppserviceID(profile, appserviceID string) string {
+	if len(profile) == 0 {
+		return appserviceID
+	}
+	return profile + profileSeparator + appserviceID
+}
+
+func splitStorageAppserviceID(storageID string) (profile, appserviceID string) {
+	if sep := strings.Index(storageID, profileSeparator); sep >= 0 {
+		return storageID[:sep], storageID[sep+len(profileSeparator):]
+	}
+	return "", storageID
+}
+
+func (target *SyncTarget) storageID() string {
+	return storageAppserviceID(target.Profile, target.AppserviceID)
+}
+
+// requestTargetID returns the ID of the target that the request path refers to.
+func requestTargetID(r *http.Request, appserviceID, deviceKey string) string {
+	return TargetID(storageAppserviceID(requestProfile(r).Name, appserviceID), deviceKey)
+}
+
+func validateHomeserverURL(homeserverURL string) error {
+	if len(homeserverURL) == 0 {
+		return nil
+	} else if parsed, err := url.Parse(homeserverURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return fmt.Errorf("%q is not an absolute http or https URL", homeserverURL)
+	}
+	return nil
+}
+
+// homeserverURL returns the homeserver URL of the target, or the URL of its profile if it doesn't have its own.
+func (target *SyncTarget) homeserverURL() string {
+	if len(target.HomeserverURL) > 0 {
+		return target.HomeserverURL
+	} else if profile := getProfile(target.Profile); profile != nil {
+		return profile.homeserver()
+	}
+	return ""
+}
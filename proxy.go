@@ -0,0 +1,364 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "maunium.net/go/maulogger/v2"
+)
+
+var cfg Config
+var db *Database
+
+// Proxy is an instance of the sync proxy. It can be embedded in another program (e.g. a bridge) instead of
+// running the mautrix-syncproxy command. The proxy still keeps its state in package-level variables,
+// so only one Proxy can be created per process.
+type Proxy struct {
+	// Store overrides where targets and all their data (pending transactions, history, dead letters etc) and
+	// proxy-wide data like the sync filter cache and management tokens are stored. If nil, they're stored in
+	// the database from the config. If Store is set, the database URL is optional, and the health checks and
+	// in-memory SQLite snapshots are skipped without one.
+	Store Store
+	// ConfigLoader reads the config again when it's reloaded with Reload or the admin API.
+	// If nil, the config can only be changed with UpdateConfig.
+	ConfigLoader func() (Config, error)
+
+	router        *mux.Router
+	metricsRouter *mux.Router
+	server        *http.Server
+	metricsServer *http.Server
+	listenErrors  chan error
+	// listeners are the open listeners of both servers by address, which are passed on by Restart.
+	listeners  map[string]net.Listener
+	restarted  chan struct{}
+	restarting int32
+}
+
+// New validates the config and creates a proxy with it. The proxy doesn't do anything until Start is called,
+// but the HTTP handler is already available, e.g. to mount it in another server.
+func New(config Config) (*Proxy, error) {
+	cfg = config
+	if err := applyConfig(); err != nil {
+		return nil, err
+	}
+	proxy := &Proxy{
+		listenErrors: make(chan error, 1),
+		listeners:    make(map[string]net.Listener),
+		restarted:    make(chan struct{}),
+	}
+	proxy.router = newRouter()
+	if len(cfg.Metrics.ListenAddress) > 0 {
+		proxy.metricsRouter = newMetricsRouter()
+	}
+	currentProxy = proxy
+	return proxy, nil
+}
+
+// newRouter creates the router with all the endpoints of the proxy.
+func newRouter() *mux.Router {
+	rootRouter := mux.NewRouter()
+	rootRouter.Use(requestIDMiddleware, accessLogMiddleware)
+	for _, profile := range cfg.Profiles {
+		profileRouter := rootRouter.PathPrefix(profile.BasePath).Subrouter()
+		profileRouter.Use(profile.Middleware)
+		registerTargetRoutes(profileRouter)
+	}
+	router := rootRouter
+	if len(cfg.BasePath) > 0 {
+		router = rootRouter.PathPrefix(cfg.BasePath).Subrouter()
+	}
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/support-bundle", getSupportBundle).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/admin/config", getAdminConfig).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/admin/config", postAdminConfig).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/admin/reload", postAdminReload).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/admin/restart", postAdminRestart).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/admin/drain", getDrain).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/admin/drain", postDrain).Methods(http.MethodPost)
+	registerTargetRoutes(router)
+	router.HandleFunc("/version", getVersion).Methods(http.MethodGet)
+	router.HandleFunc("/health", getHealth).Methods(http.MethodGet)
+	router.HandleFunc("/live", getLive).Methods(http.MethodGet)
+	router.HandleFunc("/ready", getReady).Methods(http.MethodGet)
+	if len(cfg.Metrics.ListenAddress) == 0 {
+		registerMetricsRoutes(router, cfg.BasePath)
+	}
+	return rootRouter
+}
+
+// newMetricsRouter creates the router for the separate metrics listener, which also has the health check endpoints.
+func newMetricsRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/health", getHealth).Methods(http.MethodGet)
+	router.HandleFunc("/live", getLive).Methods(http.MethodGet)
+	router.HandleFunc("/ready", getReady).Methods(http.MethodGet)
+	registerMetricsRoutes(router, "")
+	return router
+}
+
+// registerMetricsRoutes adds the metrics endpoint, and the profiler endpoints if they're enabled.
+func registerMetricsRoutes(router *mux.Router, basePath string) {
+	router.Handle("/metrics", promhttp.Handler())
+	if cfg.EnablePprof {
+		registerPprofRoutes(router, basePath)
+	}
+}
+
+// registerTargetRoutes adds the target management endpoints, which are available for every profile.
+func registerTargetRoutes(router *mux.Router) {
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy", listTargets).Methods(http.MethodGet)
+	if cfg.EnableDashboard {
+		router.HandleFunc("/admin", getDashboard).Methods(http.MethodGet)
+	}
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/errors-catalog", getErrorCatalog).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/registration-tokens", createRegistrationToken).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/bulk", bulkTargets).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}", startSync).Methods(http.MethodPut, http.MethodDelete)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}", getTargetStatus).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/registration", putRegistration).Methods(http.MethodPut)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/selftest", runSelfTest).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/errors", getRecentErrors).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/suspend", suspendTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/pause", pauseTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/next-batch", resetNextBatch).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/resume", resumeTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/restart", restartTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/checkpoint", putCheckpoint).Methods(http.MethodPut)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/poke", pokeTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/rotate-tokens", rotateTargetTokens).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/management-token", manageManagementToken).Methods(http.MethodPost, http.MethodDelete)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/transactions", queryTransactions).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/dead-letters", getDeadLetters).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/dead-letters/replay", replayDeadLetters).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}", startSync).Methods(http.MethodPut, http.MethodDelete)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}", getTargetStatus).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/transactions/{txnID}", getTransaction).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/selftest", runSelfTest).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/errors", getRecentErrors).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/transactions", queryTransactions).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/dead-letters", getDeadLetters).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/dead-letters/replay", replayDeadLetters).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/suspend", suspendTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/pause", pauseTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/next-batch", resetNextBatch).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/resume", resumeTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/restart", restartTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/checkpoint", putCheckpoint).Methods(http.MethodPut)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/poke", pokeTarget).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/fi.mau.syncproxy/{appserviceID}/{deviceID}/rotate-tokens", rotateTargetTokens).Methods(http.MethodPost)
+}
+
+// Handler returns the HTTP handler of the proxy. Embedders that don't want the proxy to listen by itself
+// can leave the listen address empty and serve the handler in their own server instead.
+func (proxy *Proxy) Handler() http.Handler {
+	return proxy.router
+}
+
+// ListenErrors returns a channel that receives an error if one of the listeners fails after Start.
+func (proxy *Proxy) ListenErrors() <-chan error {
+	return proxy.listenErrors
+}
+
+// Start connects to the database, loads and starts the stored targets and starts listening on the configured addresses.
+func (proxy *Proxy) Start() error {
+	if err := loadInheritedListeners(); err != nil {
+		return err
+	}
+	buildInfo.WithLabelValues(Version, Commit, BuildTime, runtime.Version()).Set(1)
+	initTargetLabelMetric()
+	if cfg.Debug {
+		log.DefaultLogger.PrintLevel = log.LevelDebug.Severity
+	}
+	if cfg.LogFormat == LogFormatJSON {
+		log.DefaultLogger.EnableJSONStdout()
+	}
+	if len(cfg.LogFile.Path) > 0 {
+		var err error
+		if logFile, err = openLogFile(cfg.LogFile, cfg.LogFormat); err != nil {
+			return err
+		}
+	}
+	log.Infoln(VersionString())
+	if sentry != nil {
+		go sentry.Loop()
+	}
+	if webhook != nil {
+		go webhook.Loop()
+	}
+	if len(cfg.DeliveryClient.ClientCert) > 0 {
+		var err error
+		deliveryClientCert, err = newCertReloader(cfg.DeliveryClient.ClientCert, cfg.DeliveryClient.ClientKey)
+		if err != nil {
+			return fmt.Errorf("failed to load delivery client certificate: %w", err)
+		}
+		go deliveryClientCert.Loop()
+	}
+	var err error
+	if len(cfg.DatabaseURL) > 0 {
+		if db, err = Connect(cfg.DatabaseURL, cfg.DatabaseOpts); err != nil {
+			return fmt.Errorf("failed to connect to database: %w", err)
+		} else if err = db.WaitForConnection(cfg.DatabaseOpts.StartupTimeout); err != nil {
+			return fmt.Errorf("database didn't become reachable: %w", err)
+		} else if err = db.Upgrade(cfg.AllowNewerSchema); err != nil {
+			return fmt.Errorf("failed to upgrade database: %w", err)
+		}
+	} else if proxy.Store == nil {
+		return fmt.Errorf("database URL is not set (DATABASE_URL or database_url)")
+	}
+	store = proxy.Store
+	if store == nil {
+		store = NewSQLStore(db)
+	}
+	store = instrumentStore(store)
+
+	if encrypted, err := store.EncryptStoredTokens(context.Background()); err != nil {
+		return fmt.Errorf("failed to encrypt stored tokens: %w", err)
+	} else if encrypted > 0 {
+		log.Infofln("Encrypted the stored tokens of %d targets", encrypted)
+	}
+	if err = txnClock.Load(context.Background()); err != nil {
+		return fmt.Errorf("failed to load transaction ID clock from database: %w", err)
+	} else if err = LoadTargets(); err != nil {
+		return fmt.Errorf("failed to load old targets from database: %w", err)
+	}
+	updateOrphanedFilterMetric()
+	go pruneTransactionHistory()
+	go loopUpdateLatencyMetrics()
+	go loopRerankTargetSeries()
+	go deferredWrites.Loop()
+	go loopHeartbeat()
+	if db != nil {
+		go loopCheckDatabase()
+		go db.loopSnapshot()
+	}
+	go loopSweepStaleRegistrations()
+	go loopCheckConsistency()
+	go loopCheckReachability()
+	go loopAdoptTargets()
+
+	log.Infoln("Starting old active targets")
+	startedCount := 0
+	loadedTargets := registry.Snapshot()
+	for _, target := range loadedTargets {
+		if target.SuspendedUntil > 0 {
+			target.log.Infoln("Target is suspended, scheduling resume")
+			target.scheduleResume()
+		} else if target.Active {
+			go target.startAfterJitter(cfg.SyncStartPacing.Jitter)
+			startedCount += 1
+		}
+	}
+	log.Infofln("Started %d active targets out of %d total old targets", startedCount, len(loadedTargets))
+	if len(cfg.RegistrationFiles) > 0 {
+		// Deriving the targets requires asking the homeserver who the bots are, which shouldn't delay startup.
+		go importRegistrationFiles(cfg.RegistrationFiles)
+	}
+
+	if len(cfg.ListenAddress) > 0 {
+		proxy.server = &http.Server{
+			Handler: proxy.router,
+		}
+		if cfg.TLS.Enabled() {
+			certs, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+			if err != nil {
+				return fmt.Errorf("failed to load TLS certificate: %w", err)
+			}
+			go certs.Loop()
+			proxy.server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		}
+		if err = proxy.listen(proxy.server, cfg.ListenAddress); err != nil {
+			return err
+		}
+	}
+	if proxy.metricsRouter != nil {
+		proxy.metricsServer = &http.Server{
+			Handler: proxy.metricsRouter,
+		}
+		if err = proxy.listen(proxy.metricsServer, cfg.Metrics.ListenAddress); err != nil {
+			return fmt.Errorf("metrics listener: %w", err)
+		}
+	}
+	notifyRestartReady()
+	return nil
+}
+
+// listen starts serving the server on each address in the comma-separated list.
+func (proxy *Proxy) listen(server *http.Server, addresses string) error {
+	socketMode, _ := parseSocketMode(cfg.ListenSocketMode)
+	listeners, err := listenAll(addresses, socketMode)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	for address, listener := range listeners {
+		proxy.listeners[address] = listener
+		go func(address string, listener net.Listener) {
+			var err error
+			if server.TLSConfig != nil {
+				log.Infoln("Starting to listen with TLS on", address)
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				log.Infoln("Starting to listen on", address)
+				err = server.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				select {
+				case proxy.listenErrors <- fmt.Errorf("error in listener %s: %w", address, err):
+				default:
+				}
+			}
+		}(address, listener)
+	}
+	return nil
+}
+
+// Stop hands off in-flight transactions, stops all sync loops and closes the listeners.
+func (proxy *Proxy) Stop() {
+	handOffInFlight()
+	if remaining := stopAllTargets(cfg.ShutdownTimeout); remaining > 0 {
+		log.Warnfln("%d sync loops didn't stop within %v, their in-flight transactions were already handed off", remaining, cfg.ShutdownTimeout)
+	}
+	recordShutdown()
+	if remaining := deferredWrites.Flush(); remaining > 0 {
+		log.Warnfln("%d deferred database writes couldn't be flushed before shutting down", remaining)
+	}
+	releaseLeases()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range []*http.Server{proxy.server, proxy.metricsServer} {
+		if server == nil {
+			continue
+		} else if err := server.Shutdown(ctx); err != nil {
+			log.Errorln("Failed to close server:", err)
+		}
+	}
+	if db != nil {
+		if err := db.Snapshot(context.Background()); err != nil {
+			log.Errorln("Failed to snapshot in-memory database before shutting down:", err)
+		}
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+}
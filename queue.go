@@ -0,0 +1,189 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// queuedError is returned by tryPostTransaction when delivery was interrupted,
+// but the transaction was stored in the pending queue to be delivered when the target is started again.
+type queuedError struct {
+	TxnID string
+	Err   error
+}
+
+func (qe *queuedError) Error() string {
+	return fmt.Sprintf("transaction %s was queued for later delivery: %v", qe.TxnID, qe.Err)
+}
+
+func (qe *queuedError) Unwrap() error {
+	return qe.Err
+}
+
+type inFlightTransaction struct {
+	TxnID string
+	Meta  txnMetadata
+	Txn   *Transaction
+
+	queueOnce sync.Once
+	queueErr  error
+	queued    bool
+}
+
+// Queue stores the transaction in the pending queue. It's safe to call multiple times
+// (e.g. from a forced DELETE and the sync loop noticing the cancellation), only the first call does anything.
+func (ift *inFlightTransaction) Queue(target *SyncTarget) error {
+	ift.queueOnce.Do(func() {
+		ift.queueErr = target.queuePendingTransaction(ift.TxnID, ift.Meta, ift.Txn)
+		ift.queued = ift.queueErr == nil
+	})
+	return ift.queueErr
+}
+
+// MarkDelivered prevents the transaction from being queued in the future and returns whether it was already queued.
+func (ift *inFlightTransaction) MarkDelivered() bool {
+	ift.queueOnce.Do(func() {})
+	return ift.queued
+}
+
+func (target *SyncTarget) setInFlight(ift *inFlightTransaction) {
+	target.inFlightLock.Lock()
+	target.inFlight = ift
+	target.inFlightLock.Unlock()
+}
+
+func (target *SyncTarget) getInFlight() *inFlightTransaction {
+	target.inFlightLock.Lock()
+	defer target.inFlightLock.Unlock()
+	return target.inFlight
+}
+
+// QueueInFlight stores the transaction currently being delivered (if any) in the pending queue.
+func (target *SyncTarget) QueueInFlight() (string, error) {
+	ift := target.getInFlight()
+	if ift == nil {
+		return "", nil
+	}
+	return ift.TxnID, ift.Queue(target)
+}
+
+// queuePendingTransaction stores the transaction in the pending queue. The queue is ordered by
+// the creation time of the transactions rather than the time they were queued.
+func (target *SyncTarget) queuePendingTransaction(txnID string, meta txnMetadata, txn *Transaction) error {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transaction: %w", err)
+	}
+	return store.QueueTransaction(context.Background(), target.storageID(), target.DeviceKey, QueuedTransaction{
+		TxnID:     txnID,
+		Sequence:  meta.Sequence,
+		Data:      data,
+		CreatedAt: meta.CreatedAt,
+	})
+}
+
+func (target *SyncTarget) deletePendingTransaction(ctx context.Context, txnID string) error {
+	return store.DeleteQueuedTransaction(ctx, txnID)
+}
+
+type pendingTransaction struct {
+	TxnID     string
+	Sequence  uint64
+	Txn       *Transaction
+	Size      int64
+	CreatedAt int64
+}
+
+// PendingCursor is the position in the pending queue after the last loaded transaction.
+type PendingCursor struct {
+	CreatedAt int64
+	TxnID     string
+}
+
+// getPendingTransactions loads the next batch of pending transactions after the cursor. If maxBytes is set,
+// transactions are loaded until their total size reaches it, but at least one transaction is always returned.
+func (target *SyncTarget) getPendingTransactions(ctx context.Context, after PendingCursor, maxBytes int64) ([]pendingTransaction, error) {
+	queued, err := store.GetQueuedTransactions(ctx, target.storageID(), target.DeviceKey, after, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]pendingTransaction, len(queued))
+	for i, item := range queued {
+		var txn Transaction
+		if err = json.Unmarshal(item.Data, &txn); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pending transaction %s: %w", item.TxnID, err)
+		}
+		pending[i] = pendingTransaction{TxnID: item.TxnID, Sequence: item.Sequence, Txn: &txn, Size: int64(len(item.Data)), CreatedAt: item.CreatedAt}
+	}
+	return pending, nil
+}
+
+// deliverPendingTransactions sends all transactions in the pending queue of the target, in the order they were queued.
+func (target *SyncTarget) deliverPendingTransactions(ctx context.Context) error {
+	syncLog := ctx.Value(logContextKey).(maulogger.Logger)
+	var cursor PendingCursor
+	for {
+		pending, err := target.getPendingTransactions(ctx, cursor, target.getMaxBufferedBytes())
+		if err != nil {
+			return fmt.Errorf("failed to get pending transactions: %w", err)
+		} else if len(pending) == 0 {
+			return nil
+		}
+		cursor = PendingCursor{CreatedAt: pending[len(pending)-1].CreatedAt, TxnID: pending[len(pending)-1].TxnID}
+		if err = target.deliverPendingBatch(ctx, syncLog, pending); err != nil {
+			return err
+		}
+	}
+}
+
+func (target *SyncTarget) deliverPendingBatch(ctx context.Context, syncLog maulogger.Logger, pending []pendingTransaction) error {
+	var batchSize int64
+	for _, item := range pending {
+		batchSize += item.Size
+	}
+	target.addBuffered(batchSize)
+	defer func() {
+		target.addBuffered(-batchSize)
+	}()
+	syncLog.Infofln("Delivering %d pending transactions", len(pending))
+	for _, item := range pending {
+		// tryPostTransactionWithID accounts for the transaction while it's being delivered.
+		batchSize -= item.Size
+		target.addBuffered(-item.Size)
+		meta := txnMetadata{Sequence: item.Sequence, CreatedAt: item.CreatedAt}
+		if meta.Sequence == 0 {
+			// Transactions queued before sequence numbers were added don't have one.
+			var err error
+			if meta.Sequence, err = target.nextSequence(); err != nil {
+				return err
+			}
+		}
+		err := target.tryPostTransactionWithID(ctx, item.TxnID, item.TxnID, meta, item.Txn, nil)
+		if err != nil {
+			return &deliveryError{Err: err}
+		} else if err = target.deletePendingTransaction(outcomeContext(ctx), item.TxnID); err != nil {
+			syncLog.Warnfln("Failed to remove delivered transaction %s from pending queue: %v", item.TxnID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+// defaultUrgentTypes are the to-device event types that are delivered immediately even during quiet hours.
+// Olm-encrypted events are included, because room keys are sent inside them.
+var defaultUrgentTypes = []string{
+	event.ToDeviceEncrypted.Type,
+	event.ToDeviceRoomKey.Type,
+	event.ToDeviceForwardedRoomKey.Type,
+}
+
+// QuietHours is a daily time window during which non-urgent to-device events are
+// buffered in the pending queue and delivered together after the window ends.
+type QuietHours struct {
+	// Start and end of the window as HH:MM. If end is before start, the window crosses midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// IANA timezone name, defaults to UTC.
+	Timezone    string   `json:"timezone,omitempty"`
+	UrgentTypes []string `json:"urgent_types,omitempty"`
+
+	startMinute int
+	endMinute   int
+	location    *time.Location
+	urgent      map[string]struct{}
+}
+
+func parseClockTime(val string) (int, error) {
+	parsed, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s: expected HH:MM", strconv.Quote(val))
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// Parse validates the quiet hours and prepares them for use.
+func (qh *QuietHours) Parse() (err error) {
+	if qh.startMinute, err = parseClockTime(qh.Start); err != nil {
+		return
+	} else if qh.endMinute, err = parseClockTime(qh.End); err != nil {
+		return
+	} else if qh.location, err = time.LoadLocation(qh.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	urgentTypes := qh.UrgentTypes
+	if len(urgentTypes) == 0 {
+		urgentTypes = defaultUrgentTypes
+	}
+	qh.urgent = make(map[string]struct{}, len(urgentTypes))
+	for _, evtType := range urgentTypes {
+		qh.urgent[evtType] = struct{}{}
+	}
+	return nil
+}
+
+// Active returns whether the given time is inside the quiet hours.
+func (qh *QuietHours) Active(now time.Time) bool {
+	if qh == nil || qh.location == nil || qh.startMinute == qh.endMinute {
+		return false
+	}
+	local := now.In(qh.location)
+	minute := local.Hour()*60 + local.Minute()
+	if qh.startMinute < qh.endMinute {
+		return minute >= qh.startMinute && minute < qh.endMinute
+	}
+	return minute >= qh.startMinute || minute < qh.endMinute
+}
+
+// Split separates the events into ones that should be delivered immediately and ones that can wait.
+func (qh *QuietHours) Split(evts []*event.Event) (urgent, deferred []*event.Event) {
+	for _, evt := range evts {
+		if _, isUrgent := qh.urgent[evt.Type.Type]; isUrgent {
+			urgent = append(urgent, evt)
+		} else {
+			deferred = append(deferred, evt)
+		}
+	}
+	return
+}
+
+func (target *SyncTarget) quietHoursJSON() string {
+	if target.QuietHours == nil {
+		return ""
+	}
+	data, _ := json.Marshal(target.QuietHours)
+	return string(data)
+}
+
+func parseQuietHoursJSON(data string) (*QuietHours, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var qh QuietHours
+	if err := json.Unmarshal([]byte(data), &qh); err != nil {
+		return nil, err
+	} else if err = qh.Parse(); err != nil {
+		return nil, err
+	}
+	return &qh, nil
+}
+
+// deferQuietEvents stores the non-urgent to-device events in the pending queue if the target is in its quiet hours,
+// and returns the events that should be delivered immediately.
+func (target *SyncTarget) deferQuietEvents(evts []*event.Event) ([]*event.Event, error) {
+	qh := target.QuietHours
+	if len(evts) == 0 || !qh.Active(time.Now()) {
+		return evts, nil
+	}
+	urgent, deferred := qh.Split(evts)
+	if len(deferred) == 0 {
+		return evts, nil
+	}
+	txn := &Transaction{Transaction: appservice.Transaction{
+		EphemeralEvents:        deferred,
+		MSC2409EphemeralEvents: deferred,
+	}}
+	for _, evt := range deferred {
+		evt.ToUserID = target.UserID
+		evt.ToDeviceID = target.DeviceID
+	}
+	txnID, meta, err := target.newDataTxn()
+	if err == nil {
+		err = target.queuePendingTransaction(txnID, meta, txn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue deferred events: %w", err)
+	}
+	target.hasDeferred = true
+	deferredQuietEvents.Add(float64(len(deferred)))
+	return urgent, nil
+}
@@ -0,0 +1,64 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// rateLimitDelay checks whether the error is a 429 response from the homeserver. The returned delay is
+// retry_after_ms from the error body or the Retry-After header, or zero if the homeserver didn't say how long to wait.
+func rateLimitDelay(err error) (delay time.Duration, limited bool) {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Response == nil || httpErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if httpErr.RespError != nil {
+		if retryAfterMS, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && retryAfterMS > 0 {
+			return time.Duration(retryAfterMS) * time.Millisecond, true
+		}
+	}
+	if retryAfter := httpErr.Response.Header.Get("Retry-After"); len(retryAfter) > 0 {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		} else if date, err := http.ParseTime(retryAfter); err == nil && time.Until(date) > 0 {
+			return time.Until(date), true
+		}
+	}
+	return 0, true
+}
+
+// waitForRateLimit sleeps for the delay requested by the homeserver and counts the time in the rate limit metric.
+func (target *SyncTarget) waitForRateLimit(ctx context.Context, delay time.Duration) error {
+	target.heartbeat(delay)
+	start := time.Now()
+	defer func() {
+		homeserverRateLimitedSeconds.Add(time.Since(start).Seconds())
+	}()
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,182 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+type ReachabilityConfig struct {
+	// Interval is how often active targets are pinged, even when there's nothing to deliver. Zero disables the pings.
+	Interval time.Duration `yaml:"interval"`
+	// PauseAfter is how long pings must have been failing before syncing is stopped until the target answers again.
+	// Zero keeps syncing regardless of the pings.
+	PauseAfter time.Duration `yaml:"pause_after"`
+}
+
+// reachabilityPingPath is the appservice ping endpoint from MSC2659. Targets that don't implement it
+// still count as reachable, since any HTTP response means that the target is up.
+const reachabilityPingPath = "/_matrix/app/v1/ping"
+const pingTxnIDFormat = "fi.mau.syncproxy.ping_%d"
+const maxConcurrentReachabilityChecks = 16
+
+// Reachability is the result of the latest periodic ping of a target.
+type Reachability struct {
+	Reachable bool `json:"reachable"`
+	// LastCheckAt is the time of the latest ping.
+	LastCheckAt int64 `json:"last_check_at"`
+	// LatencyMS is how long the latest ping took, if it succeeded.
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// UnreachableSince is the time of the first failed ping, if the target is currently unreachable.
+	UnreachableSince int64 `json:"unreachable_since,omitempty"`
+	// Paused is true if syncing was stopped because the target was unreachable for too long.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// ping sends an authenticated ping to the target's address. Websocket addresses are probed by connecting instead.
+func (target *SyncTarget) ping(ctx context.Context) error {
+	address := target.getAddress()
+	if isWebsocketAddress(address) {
+		return target.probe(ctx)
+	}
+	pingURL, err := createTxnURL(address, reachabilityPingPath, target.Delivery.appserviceIDParam(), target.AppserviceID, "")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]string{"transaction_id": fmt.Sprintf(pingTxnIDFormat, time.Now().UnixNano())})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, targetProbeRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pingURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", target.getHSToken()))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := target.getDeliveryClient().Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp.Body)
+	return nil
+}
+
+// checkReachability pings the target and records the result. If the target has been unreachable for longer than
+// the configured pause period, the sync loop is stopped, and it's started again once the target answers.
+func (target *SyncTarget) checkReachability(ctx context.Context) {
+	start := time.Now()
+	err := target.ping(ctx)
+	latency := time.Since(start)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	target.statusLock.Lock()
+	var state Reachability
+	if target.reachability != nil {
+		state = *target.reachability
+	}
+	if state.Paused && target.isRunning() {
+		// Syncing was started by other means, e.g. a PUT request.
+		state.Paused = false
+	}
+	state.LastCheckAt = now
+	state.Reachable = err == nil
+	pause, resume := false, false
+	if err == nil {
+		state.LatencyMS = latency.Milliseconds()
+		state.Error = ""
+		state.UnreachableSince = 0
+		resume = state.Paused
+		state.Paused = false
+	} else {
+		state.LatencyMS = 0
+		state.Error = err.Error()
+		if state.UnreachableSince == 0 {
+			state.UnreachableSince = now
+		}
+		unreachableFor := time.Duration(now-state.UnreachableSince) * time.Millisecond
+		if !state.Paused && cfg.Reachability.PauseAfter > 0 && unreachableFor >= cfg.Reachability.PauseAfter && target.isRunning() {
+			pause = true
+			state.Paused = true
+		}
+	}
+	target.reachability = &state
+	// Syncing isn't resumed if the target was stopped, paused or suspended by other means in the meantime.
+	resume = resume && target.Active && !target.isRunning() && !target.Paused && target.SuspendedUntil == 0
+	target.statusLock.Unlock()
+
+	if label, ok := seriesLimiter.Label(target.ID()); ok {
+		if err == nil {
+			targetReachable.WithLabelValues(label).Set(1)
+			targetPingLatency.WithLabelValues(label).Set(latency.Seconds())
+		} else {
+			targetReachable.WithLabelValues(label).Set(0)
+		}
+	}
+	if pause {
+		target.log.Warnfln("Target has been unreachable for over %v (%v), stopping syncing until it answers again", cfg.Reachability.PauseAfter, err)
+		<-target.Stop(StopReasonReachability)
+	} else if resume {
+		target.log.Infoln("Target is reachable again, resuming syncing")
+		target.startInBackground()
+	} else if err != nil {
+		target.log.Debugln("Reachability ping failed:", err)
+	}
+}
+
+func checkReachability() {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentReachabilityChecks)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Reachability.Interval)
+	defer cancel()
+	for _, target := range registry.Snapshot() {
+		if !target.Active || target.DryRun {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(target *SyncTarget) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			target.checkReachability(ctx)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// loopCheckReachability periodically pings all active targets until the process exits.
+func loopCheckReachability() {
+	if cfg.Reachability.Interval <= 0 {
+		return
+	}
+	log.Debugfln("Pinging active targets every %v", cfg.Reachability.Interval)
+	for range time.Tick(cfg.Reachability.Interval) {
+		checkReachability()
+	}
+}
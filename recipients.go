@@ -0,0 +1,117 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+const maxTargetRecipients = 10
+
+func validateRecipients(recipients []string) error {
+	if len(recipients) > maxTargetRecipients {
+		return fmt.Errorf("too many recipients (maximum is %d)", maxTargetRecipients)
+	}
+	seen := make(map[string]struct{}, len(recipients))
+	for _, recipient := range recipients {
+		if parsed, err := url.Parse(recipient); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+			return fmt.Errorf("invalid recipient address %q", recipient)
+		} else if _, ok := seen[recipient]; ok {
+			return fmt.Errorf("duplicate recipient address %q", recipient)
+		}
+		seen[recipient] = struct{}{}
+	}
+	return nil
+}
+
+func (target *SyncTarget) recipientsJSON() string {
+	if len(target.Recipients) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(target.Recipients)
+	return string(data)
+}
+
+func parseRecipientsJSON(data string) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var recipients []string
+	err := json.Unmarshal([]byte(data), &recipients)
+	return recipients, err
+}
+
+// deliveryAddresses returns the main address of the target followed by the additional recipients.
+func (target *SyncTarget) deliveryAddresses() []string {
+	return append([]string{target.getAddress()}, target.Recipients...)
+}
+
+// fanOutDelivery keeps track of which recipients have confirmed a transaction,
+// so that retries are only sent to the recipients that haven't received it yet.
+type fanOutDelivery struct {
+	addresses []string
+	sentTo    map[string]SendStatus
+}
+
+func newFanOutDelivery(addresses []string) *fanOutDelivery {
+	return &fanOutDelivery{
+		addresses: addresses,
+		sentTo:    make(map[string]SendStatus, len(addresses)),
+	}
+}
+
+// Pending returns the addresses that haven't confirmed the transaction yet.
+func (fod *fanOutDelivery) Pending() []string {
+	pending := make([]string, 0, len(fod.addresses))
+	for _, address := range fod.addresses {
+		if fod.sentTo[address] != SendStatusOK {
+			pending = append(pending, address)
+		}
+	}
+	return pending
+}
+
+// Post sends the transaction to every recipient that hasn't confirmed it yet. The first error is returned,
+// but the transaction is still sent to the remaining recipients so that one broken recipient doesn't block the others.
+func (fod *fanOutDelivery) Post(post func(address string) error) error {
+	var firstErr error
+	for _, address := range fod.Pending() {
+		err := post(address)
+		if err == nil {
+			fod.sentTo[address] = SendStatusOK
+			continue
+		}
+		fod.sentTo[address] = SendStatusFailed
+		if len(fod.addresses) > 1 {
+			err = fmt.Errorf("recipient %s: %w", address, err)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SentTo returns the delivery status of each recipient, or nil if the target doesn't have additional recipients.
+func (fod *fanOutDelivery) SentTo() map[string]SendStatus {
+	if len(fod.addresses) <= 1 {
+		return nil
+	}
+	return fod.sentTo
+}
@@ -0,0 +1,243 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+const maxRegistrationSize = 64 * 1024
+
+// RegistrationSupplement contains the syncproxy-specific fields that can't be derived from a standard
+// appservice registration. It's read from the fi.mau.syncproxy key of the registration file.
+type RegistrationSupplement struct {
+	BotAccessToken string      `yaml:"bot_access_token"`
+	DeviceID       id.DeviceID `yaml:"device_id"`
+	Address        string      `yaml:"address"`
+	IsProxy        bool        `yaml:"is_proxy"`
+}
+
+type SyncProxyRegistration struct {
+	appservice.Registration `yaml:",inline"`
+
+	SyncProxy RegistrationSupplement `yaml:"fi.mau.syncproxy"`
+}
+
+// ToTarget derives a sync target from the registration. If the supplement doesn't specify a bot access token,
+// the as_token is used instead. The user ID (and device ID if not specified) are fetched using /whoami.
+func (reg *SyncProxyRegistration) ToTarget() (*SyncTarget, error) {
+	target := &SyncTarget{
+		AppserviceID:   reg.ID,
+		BotAccessToken: reg.SyncProxy.BotAccessToken,
+		HSToken:        reg.ServerToken,
+		Address:        reg.SyncProxy.Address,
+		DeviceID:       reg.SyncProxy.DeviceID,
+		IsProxy:        reg.SyncProxy.IsProxy,
+	}
+	if len(target.BotAccessToken) == 0 {
+		target.BotAccessToken = reg.AppToken
+	}
+	if len(target.Address) == 0 {
+		target.Address = reg.URL
+	}
+	if len(target.AppserviceID) == 0 {
+		return nil, errors.New("registration is missing id")
+	} else if len(target.HSToken) == 0 {
+		return nil, errors.New("registration is missing hs_token")
+	} else if len(target.BotAccessToken) == 0 {
+		return nil, errors.New("registration is missing as_token")
+	} else if len(target.Address) == 0 {
+		return nil, errors.New("registration is missing url")
+	}
+
+	if err := target.FetchIdentity(); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func putRegistration(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) || !rejectIfDraining(w) {
+		return
+	}
+	appserviceID := mux.Vars(r)["appserviceID"]
+	if strings.Contains(appserviceID, profileSeparator) {
+		errInvalidAppserviceID.Write(w)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRegistrationSize))
+	if err != nil {
+		errRegistrationInvalid.Write(w)
+		return
+	}
+	var reg SyncProxyRegistration
+	if err = yaml.Unmarshal(data, &reg); err != nil {
+		log.Debugfln("Failed to parse registration uploaded for %s: %v", appserviceID, err)
+		errRegistrationInvalid.Write(w)
+		return
+	} else if len(reg.ID) == 0 {
+		reg.ID = appserviceID
+	} else if reg.ID != appserviceID {
+		errAppserviceIDMismatch.Write(w)
+		return
+	}
+	target, err := reg.ToTarget()
+	if err != nil {
+		log.Debugfln("Failed to derive target from registration uploaded for %s: %v", appserviceID, err)
+		formatError(errInvalidRegistrationTarget, err).Write(w)
+		return
+	}
+	target.Profile = requestProfile(r).Name
+	log.Debugfln("Received registration upload for appservice %s (user: %s, device: %s, address: %s, proxy: %t)", target.AppserviceID, target.UserID, target.DeviceID, target.Address, target.IsProxy)
+	if !verifyCredentialsBeforeStart(w, r, target) || !pingBeforeStart(w, r, target) {
+		return
+	}
+	putTarget(w, r, target)
+}
+
+// expandRegistrationPaths returns the files matching the given paths or glob patterns.
+func expandRegistrationPaths(patterns []string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registration file pattern %q: %w", pattern, err)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("no registration files match %q", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// readRegistrationFile reads an appservice registration file with the optional fi.mau.syncproxy supplement.
+func readRegistrationFile(path string) (*SyncProxyRegistration, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	} else if len(data) > maxRegistrationSize {
+		return nil, nil, fmt.Errorf("file is larger than %d bytes", maxRegistrationSize)
+	}
+	var reg SyncProxyRegistration
+	if err = yaml.Unmarshal(data, &reg); err != nil {
+		return nil, nil, err
+	} else if len(reg.ID) == 0 {
+		return nil, nil, errors.New("registration is missing id")
+	} else if strings.Contains(reg.ID, profileSeparator) {
+		return nil, nil, fmt.Errorf("appservice ID can't contain %q", profileSeparator)
+	}
+	return &reg, data, nil
+}
+
+// importRegistrationFiles creates or updates targets from the registration files in the config, like uploading
+// them to the registration endpoint would. Files that fail are logged and skipped.
+func importRegistrationFiles(patterns []string) {
+	paths, err := expandRegistrationPaths(patterns)
+	if err != nil {
+		log.Errorln("Failed to import registration files:", err)
+		return
+	}
+	imported := 0
+	for _, path := range paths {
+		reg, _, err := readRegistrationFile(path)
+		if err != nil {
+			log.Errorfln("Failed to read registration file %s: %v", path, err)
+			continue
+		}
+		target, err := reg.ToTarget()
+		if err != nil {
+			log.Errorfln("Failed to derive target from registration file %s: %v", path, err)
+			continue
+		}
+		log.Debugfln("Importing registration file %s for appservice %s (user: %s, device: %s, address: %s, proxy: %t)", path, target.AppserviceID, target.UserID, target.DeviceID, target.Address, target.IsProxy)
+		if apiErr, ok := upsertTarget(context.Background(), target); !ok {
+			log.Errorfln("Failed to import registration file %s: %s", path, apiErr.Message)
+			continue
+		}
+		imported++
+	}
+	log.Infofln("Imported %d out of %d registration files", imported, len(paths))
+}
+
+const registrationUploadTimeout = 1 * time.Minute
+
+// UploadRegistrationFiles uploads appservice registration files to the registration endpoint of a proxy
+// running locally with the given config, so that targets can be added from the command line.
+// It returns the IDs of the appservices that were uploaded successfully and the errors of the rest.
+func UploadRegistrationFiles(config Config, patterns []string) (uploaded []string, errs []error) {
+	paths, err := expandRegistrationPaths(patterns)
+	if err != nil {
+		return nil, []error{err}
+	}
+	for _, path := range paths {
+		reg, data, err := readRegistrationFile(path)
+		if err == nil {
+			err = uploadRegistration(config, reg.ID, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		} else {
+			uploaded = append(uploaded, reg.ID)
+		}
+	}
+	return
+}
+
+func uploadRegistration(config Config, appserviceID string, data []byte) error {
+	path := fmt.Sprintf("/_matrix/client/unstable/fi.mau.syncproxy/%s/registration", url.PathEscape(appserviceID))
+	uploadURL, socketPath, err := localURL(config, path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.SharedSecret))
+	req.Header.Set("Content-Type", "application/yaml")
+	resp, err := localClient(socketPath, registrationUploadTimeout).Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var respErr appservice.Error
+		if json.NewDecoder(resp.Body).Decode(&respErr) == nil && len(respErr.Message) > 0 {
+			return fmt.Errorf("%s (HTTP %d, %s)", respErr.Message, resp.StatusCode, respErr.ErrorCode)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"sync"
+)
+
+type TargetEventType string
+
+const (
+	TargetAdded   TargetEventType = "added"
+	TargetRemoved TargetEventType = "removed"
+)
+
+// TargetEvent is sent to registry subscribers when a target is added to or removed from memory.
+type TargetEvent struct {
+	Type   TargetEventType
+	Target *SyncTarget
+}
+
+// targetIDLock is a lock for a single target ID that's removed from the registry when nobody is holding it.
+type targetIDLock struct {
+	sync.Mutex
+	refs int
+}
+
+// targetRegistry holds the targets that are loaded in memory.
+//
+// lock protects the map and the LRU cache. It's held while loading targets into the cache, so that the same
+// target isn't loaded twice, but otherwise it's only held briefly. Modifications of a single target
+// (e.g. PUT and DELETE requests) are serialized with LockTarget instead, and targets aren't evicted from the
+// cache while their ID is locked. idLocksLock may be taken while holding lock, but not the other way around.
+type targetRegistry struct {
+	targets map[string]*SyncTarget
+	lock    sync.Mutex
+
+	idLocks     map[string]*targetIDLock
+	idLocksLock sync.Mutex
+
+	subscribers     []func(TargetEvent)
+	subscribersLock sync.RWMutex
+}
+
+var registry = &targetRegistry{
+	targets: make(map[string]*SyncTarget),
+	idLocks: make(map[string]*targetIDLock),
+}
+
+// Subscribe registers a function that's called after targets are added or removed. It's called
+// synchronously without the registry lock held, so it may use the registry, but it should return quickly.
+func (tr *targetRegistry) Subscribe(fn func(TargetEvent)) {
+	tr.subscribersLock.Lock()
+	tr.subscribers = append(tr.subscribers, fn)
+	tr.subscribersLock.Unlock()
+}
+
+func (tr *targetRegistry) dispatch(events []TargetEvent) {
+	if len(events) == 0 {
+		return
+	}
+	tr.subscribersLock.RLock()
+	defer tr.subscribersLock.RUnlock()
+	for _, evt := range events {
+		for _, fn := range tr.subscribers {
+			fn(evt)
+		}
+	}
+}
+
+// LockTarget locks the given target ID and returns a function to unlock it.
+// It doesn't matter whether the target exists, so it can be used to serialize creating targets too.
+func (tr *targetRegistry) LockTarget(targetID string) (unlock func()) {
+	tr.idLocksLock.Lock()
+	idLock, ok := tr.idLocks[targetID]
+	if !ok {
+		idLock = &targetIDLock{}
+		tr.idLocks[targetID] = idLock
+	}
+	idLock.refs++
+	tr.idLocksLock.Unlock()
+	idLock.Lock()
+	return func() {
+		idLock.Unlock()
+		tr.idLocksLock.Lock()
+		idLock.refs--
+		if idLock.refs == 0 {
+			delete(tr.idLocks, targetID)
+		}
+		tr.idLocksLock.Unlock()
+	}
+}
+
+// isLocked returns whether someone is holding or waiting for the lock of the given target ID.
+func (tr *targetRegistry) isLocked(targetID string) bool {
+	tr.idLocksLock.Lock()
+	defer tr.idLocksLock.Unlock()
+	_, ok := tr.idLocks[targetID]
+	return ok
+}
+
+// Get returns the target with the given ID, or nil if it doesn't exist. If the target cache is enabled,
+// targets that aren't in memory are loaded from the database.
+func (tr *targetRegistry) Get(targetID string) *SyncTarget {
+	tr.lock.Lock()
+	target, ok := tr.targets[targetID]
+	var events []TargetEvent
+	if !ok && cfg.TargetCacheSize > 0 {
+		target, events = tr.loadByID(targetID)
+	} else if ok {
+		targetCache.Touch(targetID)
+	}
+	tr.lock.Unlock()
+	tr.dispatch(events)
+	return target
+}
+
+// GetLoaded returns the target with the given ID if it's in memory, without loading it or marking it as used.
+func (tr *targetRegistry) GetLoaded(targetID string) *SyncTarget {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	return tr.targets[targetID]
+}
+
+// Add adds an initialized target to memory, replacing any existing target with the same ID.
+// Callers should hold the target ID lock and check that the target doesn't exist first.
+func (tr *targetRegistry) Add(target *SyncTarget) {
+	targetID := target.ID()
+	tr.lock.Lock()
+	events := []TargetEvent{{Type: TargetAdded, Target: target}}
+	if existing, ok := tr.targets[targetID]; ok && existing != target {
+		events = append(events, TargetEvent{Type: TargetRemoved, Target: existing})
+	}
+	tr.targets[targetID] = target
+	targetCache.Touch(targetID)
+	events = append(events, tr.evict()...)
+	tr.lock.Unlock()
+	tr.dispatch(events)
+}
+
+// Remove drops the target from memory. It doesn't touch the database.
+func (tr *targetRegistry) Remove(target *SyncTarget) {
+	targetID := target.ID()
+	tr.lock.Lock()
+	existing, ok := tr.targets[targetID]
+	if ok && existing == target {
+		delete(tr.targets, targetID)
+		targetCache.Remove(targetID)
+	}
+	tr.lock.Unlock()
+	if ok && existing == target {
+		tr.dispatch([]TargetEvent{{Type: TargetRemoved, Target: target}})
+	}
+}
+
+// Snapshot returns the targets that are currently in memory. The registry isn't locked while
+// the caller iterates over the result, so targets may be added or removed in the meantime.
+func (tr *targetRegistry) Snapshot() []*SyncTarget {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	snapshot := make([]*SyncTarget, 0, len(tr.targets))
+	for _, target := range tr.targets {
+		snapshot = append(snapshot, target)
+	}
+	return snapshot
+}
+
+// Len returns the number of targets in memory.
+func (tr *targetRegistry) Len() int {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	return len(tr.targets)
+}
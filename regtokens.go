@@ -0,0 +1,147 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// Registration tokens let a bridge register its own target without knowing the shared secret. Each token
+// is bound to an appservice ID (and optionally a device ID) and can only be used for a single PUT request.
+// Only a hash of the token is stored.
+
+const registrationTokenPrefix = "sprt_"
+const defaultRegistrationTokenLifetime = 24 * time.Hour
+const maxRegistrationTokenLifetime = 30 * 24 * time.Hour
+
+type reqCreateRegistrationToken struct {
+	AppserviceID string `json:"appservice_id"`
+	// DeviceID restricts the token to the target with the given device ID. If empty, any device of the appservice is allowed.
+	DeviceID    string `json:"device_id,omitempty"`
+	ExpiresInMS int64  `json:"expires_in_ms,omitempty"`
+}
+
+type respCreateRegistrationToken struct {
+	Token        string `json:"token"`
+	AppserviceID string `json:"appservice_id"`
+	DeviceID     string `json:"device_id,omitempty"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+func hashRegistrationToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func createRegistrationToken(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	var req reqCreateRegistrationToken
+	if !getJSON(w, r, &req) {
+		return
+	} else if len(req.AppserviceID) == 0 || strings.Contains(req.AppserviceID, profileSeparator) {
+		errInvalidAppserviceID.Write(w)
+		return
+	}
+	lifetime := defaultRegistrationTokenLifetime
+	if req.ExpiresInMS != 0 {
+		lifetime = time.Duration(req.ExpiresInMS) * time.Millisecond
+	}
+	if lifetime <= 0 || lifetime > maxRegistrationTokenLifetime {
+		errInvalidTokenLifetime.Write(w)
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Errorln("Failed to generate registration token:", err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	token := registrationTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now()
+	expiresAt := now.Add(lifetime).UnixNano() / int64(time.Millisecond)
+	storageID := storageAppserviceID(requestProfile(r).Name, req.AppserviceID)
+	err := store.InsertRegistrationToken(r.Context(), hashRegistrationToken(token), storageID, req.DeviceID,
+		now.UnixNano()/int64(time.Millisecond), expiresAt)
+	if err != nil {
+		log.Errorfln("Failed to store registration token for %s: %v", storageID, err)
+		errDatabaseQueryFailed.Write(w)
+		return
+	}
+	log.Infofln("Created registration token for %s (device: %q) from %s, expires in %v", storageID, req.DeviceID, clientIP(r), lifetime)
+	writeJSON(w, http.StatusOK, &respCreateRegistrationToken{
+		Token:        token,
+		AppserviceID: req.AppserviceID,
+		DeviceID:     req.DeviceID,
+		ExpiresAt:    expiresAt,
+	})
+}
+
+// checkTargetAuth is like checkAuth, but it also accepts management tokens of the appservice, the hs_token of
+// the target if HSTokenAuth is enabled, and registration tokens for PUT requests. If a registration token was used,
+// its hash is returned, and the token must be consumed with consumeRegistrationToken before saving.
+func checkTargetAuth(w http.ResponseWriter, r *http.Request, storageID, deviceKey string) (regTokenHash string, ok bool) {
+	if !checkManagementAllowed(w, r) {
+		return "", false
+	}
+	token := requestAccessToken(r)
+	if strings.HasPrefix(token, managementTokenPrefix) && token != requestProfile(r).secret() {
+		return "", checkManagementToken(w, r, token, storageID)
+	} else if cfg.HSTokenAuth && len(token) > 0 && token != requestProfile(r).secret() && isTargetHSToken(token, storageID, deviceKey) {
+		w.Header().Add("Content-Type", "application/json")
+		return "", true
+	} else if r.Method != http.MethodPut || !strings.HasPrefix(token, registrationTokenPrefix) || token == requestProfile(r).secret() {
+		return "", checkAuth(w, r)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	hash := hashRegistrationToken(token)
+	valid, err := store.CheckRegistrationToken(r.Context(), hash, storageID, deviceKey, time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		log.Errorln("Failed to check registration token:", err)
+		errDatabaseQueryFailed.Write(w)
+		return "", false
+	} else if !valid {
+		log.Warnfln("Request to %s from %s had an invalid or expired registration token", r.URL.Path, clientIP(r))
+		errUnknownToken.Write(w)
+		return "", false
+	}
+	return hash, true
+}
+
+// consumeRegistrationToken deletes the registration token. It returns false if the token was already used
+// by a concurrent request, which means the caller must not proceed.
+func consumeRegistrationToken(w http.ResponseWriter, r *http.Request, hash string) bool {
+	consumed, err := store.ConsumeRegistrationToken(r.Context(), hash)
+	if err != nil {
+		log.Errorln("Failed to consume registration token:", err)
+		errDatabaseQueryFailed.Write(w)
+		return false
+	} else if !consumed {
+		errUnknownToken.Write(w)
+		return false
+	}
+	return true
+}
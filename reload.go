@@ -0,0 +1,168 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// currentProxy is the proxy created by New, which is used by the reload endpoint.
+var currentProxy *Proxy
+
+// reloadableConfig are the settings that can be changed by reloading the config.
+type reloadableConfig struct {
+	debug          bool
+	sharedSecret   string
+	homeserverURL  string
+	deliveryClient DeliveryClientConfig
+	proxies        ProxyConfig
+
+	homeserverProxy proxyFunc
+	deliveryProxy   proxyFunc
+}
+
+// parseReloadableConfig validates the reloadable settings of a new config.
+func parseReloadableConfig(config Config) (*reloadableConfig, error) {
+	rc := &reloadableConfig{
+		debug:          config.Debug,
+		sharedSecret:   config.SharedSecret,
+		homeserverURL:  config.HomeserverURL,
+		deliveryClient: config.DeliveryClient,
+		proxies:        config.Proxies,
+	}
+	var err error
+	if len(rc.sharedSecret) == 0 {
+		return nil, fmt.Errorf("shared secret is not set")
+	} else if len(rc.homeserverURL) == 0 {
+		return nil, fmt.Errorf("homeserver URL is not set")
+	} else if err = validateHomeserverURL(rc.homeserverURL); err != nil {
+		return nil, fmt.Errorf("invalid homeserver URL: %w", err)
+	} else if rc.homeserverProxy, err = parseProxy(rc.proxies.Homeserver); err != nil {
+		return nil, fmt.Errorf("invalid homeserver proxy: %w", err)
+	} else if rc.deliveryProxy, err = parseProxy(rc.proxies.Delivery); err != nil {
+		return nil, fmt.Errorf("invalid delivery proxy: %w", err)
+	} else if rc.deliveryClient.MaxIdleConnsPerHost < 1 || rc.deliveryClient.MaxIdleConnsPerHost > maxDeliveryIdleConns {
+		return nil, fmt.Errorf("invalid delivery client max idle connections per host: must be between 1 and %d", maxDeliveryIdleConns)
+	}
+	// The client certificate files are already reloaded when they change, but changing the paths requires a restart.
+	rc.deliveryClient.ClientCert = cfg.DeliveryClient.ClientCert
+	rc.deliveryClient.ClientKey = cfg.DeliveryClient.ClientKey
+	return rc, nil
+}
+
+// UpdateConfig applies the log level, shared secret, homeserver URL and HTTP client settings of the new config
+// without restarting sync loops. Other changes require a restart. It returns a description of the changes.
+//
+// Targets that use the default homeserver URL switch to the new one on their next request, and the HTTP clients
+// of targets are recreated on their next transaction, which also reconnects websockets.
+func (proxy *Proxy) UpdateConfig(config Config) ([]string, error) {
+	rc, err := parseReloadableConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimeLock.Lock()
+	var changes []string
+	if rc.debug != cfg.Debug {
+		changes = append(changes, fmt.Sprintf("debug: %t -> %t", cfg.Debug, rc.debug))
+		cfg.Debug = rc.debug
+		if cfg.Debug {
+			log.DefaultLogger.PrintLevel = log.LevelDebug.Severity
+		} else {
+			log.DefaultLogger.PrintLevel = log.LevelInfo.Severity
+		}
+	}
+	if rc.sharedSecret != cfg.SharedSecret {
+		changes = append(changes, "shared_secret")
+		cfg.SharedSecret = rc.sharedSecret
+		defaultProfile.SharedSecret = rc.sharedSecret
+	}
+	homeserverChanged := rc.homeserverURL != cfg.HomeserverURL
+	if homeserverChanged {
+		changes = append(changes, fmt.Sprintf("homeserver_url: %s -> %s", cfg.HomeserverURL, rc.homeserverURL))
+		cfg.HomeserverURL = rc.homeserverURL
+		defaultProfile.HomeserverURL = rc.homeserverURL
+	}
+	if rc.proxies.Homeserver != cfg.Proxies.Homeserver {
+		changes = append(changes, "proxies.homeserver")
+		homeserverProxy = rc.homeserverProxy
+	}
+	deliveryChanged := rc.proxies.Delivery != cfg.Proxies.Delivery || rc.deliveryClient != cfg.DeliveryClient
+	if rc.proxies.Delivery != cfg.Proxies.Delivery {
+		changes = append(changes, "proxies.delivery")
+		deliveryProxy = rc.deliveryProxy
+	}
+	if rc.deliveryClient != cfg.DeliveryClient {
+		changes = append(changes, fmt.Sprintf("delivery_client: %+v -> %+v", cfg.DeliveryClient, rc.deliveryClient))
+		cfg.DeliveryClient = rc.deliveryClient
+	}
+	cfg.Proxies = rc.proxies
+	runtimeLock.Unlock()
+
+	for _, target := range registry.Snapshot() {
+		if homeserverChanged && len(target.Profile) == 0 && len(target.HomeserverURL) == 0 {
+			target.credsLock.RLock()
+			botAccessToken, hsToken := target.BotAccessToken, target.HSToken
+			target.credsLock.RUnlock()
+			if err = target.UpdateCredentials(botAccessToken, hsToken); err != nil {
+				target.log.Warnln("Failed to switch to new homeserver URL:", err)
+			}
+		}
+		if deliveryChanged {
+			target.closeDeliveryClient()
+		}
+	}
+	return changes, nil
+}
+
+// Reload reads the config again with ConfigLoader and applies the settings that can be changed without restarting.
+func (proxy *Proxy) Reload() ([]string, error) {
+	if proxy.ConfigLoader == nil {
+		return nil, fmt.Errorf("config reloading is not available")
+	}
+	config, err := proxy.ConfigLoader()
+	if err != nil {
+		return nil, err
+	}
+	return proxy.UpdateConfig(config)
+}
+
+func postAdminReload(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	} else if currentProxy == nil || currentProxy.ConfigLoader == nil {
+		errConfigReloadUnavailable.Write(w)
+		return
+	}
+	changes, err := currentProxy.Reload()
+	if err != nil {
+		formatError(errConfigReloadFailed, err).Write(w)
+		return
+	}
+	for _, change := range changes {
+		log.Infofln("Config reloaded by %s: %s", clientIP(r), change)
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"changes": changes,
+	})
+}
@@ -0,0 +1,105 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// Management requests and sync iterations get IDs that are included in log lines and passed on in the
+// X-Request-ID header, so that a single event can be followed through the logs of the caller, the proxy
+// and the target.
+
+const requestIDHeader = "X-Request-ID"
+const requestIDContextKey = "request_id"
+const correlationIDContextKey = "correlation_id"
+
+const maxRequestIDLength = 128
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// isValidRequestID checks that a request ID from a client is safe to put in logs and response headers.
+func isValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, char := range id {
+		if !(char >= 'a' && char <= 'z') && !(char >= 'A' && char <= 'Z') && !(char >= '0' && char <= '9') && !strings.ContainsRune("-_.:", char) {
+			return false
+		}
+	}
+	return true
+}
+
+// incomingRequestID returns the X-Request-ID of the request, or the trace ID of its traceparent header if it
+// doesn't have one. A new ID is generated if the request has neither.
+func incomingRequestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); isValidRequestID(id) {
+		return id
+	}
+	// traceparent is version-traceid-parentid-flags, see https://www.w3.org/TR/trace-context/
+	parts := strings.Split(r.Header.Get(traceparentHeader), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && parts[1] != strings.Repeat("0", 32) {
+		if _, err := hex.DecodeString(parts[1]); err == nil {
+			return strings.ToLower(parts[1])
+		}
+	}
+	return newRequestID()
+}
+
+// requestIDMiddleware attaches a request ID to every request and returns it in the X-Request-ID response header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := incomingRequestID(r)
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// requestID returns the ID that requestIDMiddleware attached to the request.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// withCorrelationID returns a context for delivering one sync response, where the logger and log fields
+// include a new correlation ID that is also sent to the target with the transactions.
+func withCorrelationID(ctx context.Context) context.Context {
+	id := newRequestID()
+	fields, _ := ctx.Value(logFieldsContextKey).(logFields)
+	fields = fields.with("correlation_id", id)
+	iterLog := ctx.Value(logContextKey).(maulogger.Logger).Subm("", fields)
+	ctx = context.WithValue(context.WithValue(ctx, logContextKey, iterLog), logFieldsContextKey, fields)
+	return context.WithValue(ctx, correlationIDContextKey, id)
+}
+
+// correlationID returns the ID of the sync iteration that the context belongs to, or an empty string if the
+// transaction didn't come directly from a sync response.
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,170 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// restartReadyFDEnv is the file descriptor that a process started by Restart writes to when it's ready.
+const restartReadyFDEnv = "SYNCPROXY_RESTART_READY_FD"
+
+// restartReadyTimeout is how long Restart waits for the new process to load its targets and start listening.
+const restartReadyTimeout = 5 * time.Minute
+
+var errRestartWithoutLeases = errors.New("restarting without downtime requires target leases")
+var errAlreadyRestarting = errors.New("a restart is already in progress")
+
+// Restart starts a new process of the same executable with the same arguments and passes the listeners to it,
+// so that requests keep being accepted while the binary is replaced. Once the new process has loaded its targets
+// and started serving, the channel returned by Restarted is closed, and the caller should Stop this process.
+// Target leases must be enabled, so that the new process only starts syncing each target when this one has
+// handed off its in-flight transaction and released the lease.
+func (proxy *Proxy) Restart() error {
+	if !cfg.Leases.Enabled {
+		return errRestartWithoutLeases
+	} else if !atomic.CompareAndSwapInt32(&proxy.restarting, 0, 1) {
+		return errAlreadyRestarting
+	}
+	err := proxy.startNewProcess()
+	if err != nil {
+		atomic.StoreInt32(&proxy.restarting, 0)
+		return err
+	}
+	// The new process serves the Unix sockets now, so closing them here mustn't delete the socket files.
+	for _, listener := range proxy.listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	close(proxy.restarted)
+	return nil
+}
+
+// Restarted returns a channel that is closed when a new process started by Restart is ready.
+func (proxy *Proxy) Restarted() <-chan struct{} {
+	return proxy.restarted
+}
+
+func (proxy *Proxy) startNewProcess() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	files := make([]*os.File, 0, len(proxy.listeners)+1)
+	addresses := make([]string, 0, len(proxy.listeners))
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	for address, listener := range proxy.listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener of %s can't be passed to another process", address)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return fmt.Errorf("failed to get file of listener %s: %w", address, err)
+		}
+		files = append(files, file)
+		addresses = append(addresses, address)
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+	defer readyRead.Close()
+	files = append(files, readyWrite)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		inheritedListenersEnv+"="+strings.Join(addresses, ","),
+		fmt.Sprintf("%s=%d", restartReadyFDEnv, inheritedFDStart+len(addresses)))
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+	// Only the new process may hold the write end, so that reading fails if it exits before it's ready.
+	_ = readyWrite.Close()
+	files = files[:len(files)-1]
+	log.Infofln("Started new process %d, waiting for it to be ready", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyRead.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return fmt.Errorf("new process exited before it was ready")
+		}
+	case <-time.After(restartReadyTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("new process wasn't ready within %v", restartReadyTimeout)
+	}
+	log.Infofln("New process %d is ready, stopping this one", cmd.Process.Pid)
+	_ = cmd.Process.Release()
+	return nil
+}
+
+// notifyRestartReady tells the previous process that this one has started, if it was started by Restart.
+func notifyRestartReady() {
+	fd, err := strconv.Atoi(os.Getenv(restartReadyFDEnv))
+	if err != nil {
+		return
+	}
+	_ = os.Unsetenv(restartReadyFDEnv)
+	file := os.NewFile(uintptr(fd), "restart-ready")
+	if _, err = file.Write([]byte{1}); err != nil {
+		log.Warnln("Failed to notify previous process that the restart is done:", err)
+	}
+	_ = file.Close()
+}
+
+func postAdminRestart(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	} else if currentProxy == nil {
+		formatError(errRestartFailed, "the proxy isn't running").Write(w)
+		return
+	}
+	log.Infofln("Restart requested by %s", clientIP(r))
+	if err := currentProxy.Restart(); err != nil {
+		log.Errorln("Failed to restart:", err)
+		formatError(errRestartFailed, err).Write(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
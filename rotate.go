@@ -0,0 +1,165 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+)
+
+const rotationTestTimeout = 10 * time.Second
+
+type reqRotateTokens struct {
+	// BotAccessToken and HSToken are the new credentials. An empty value keeps the current one.
+	BotAccessToken string `json:"bot_access_token"`
+	HSToken        string `json:"hs_token"`
+	// SkipTestTransaction disables sending an empty transaction to the target with the new hs_token.
+	SkipTestTransaction bool `json:"skip_test_transaction,omitempty"`
+}
+
+// validateBotAccessToken checks that the given token belongs to the same user and device as the target.
+func (target *SyncTarget) validateBotAccessToken(token string) error {
+	client, err := target.newClient("", token)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	resp, err := client.Whoami()
+	if err != nil {
+		return fmt.Errorf("whoami failed: %w", err)
+	} else if resp.UserID != target.UserID {
+		return fmt.Errorf("token belongs to %s instead of %s", resp.UserID, target.UserID)
+	} else if len(resp.DeviceID) > 0 && resp.DeviceID != target.DeviceID {
+		return fmt.Errorf("token belongs to device %s instead of %s", resp.DeviceID, target.DeviceID)
+	}
+	return nil
+}
+
+// sendTestTransaction sends an empty transaction to the target using the given hs_token,
+// to check that the target accepts the token before it's used for real transactions.
+func (target *SyncTarget) sendTestTransaction(ctx context.Context, hsToken string) error {
+	_, txnID := nextTxnID(txnIDFormat)
+	txnURL, err := target.createTxnURL(target.getAddress(), txnID, false)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&transactionRequest{
+		Transaction:  &Transaction{},
+		WrappedTxnID: txnID,
+		UserID:       target.UserID,
+		DeviceID:     target.DeviceID,
+		InstanceID:   cfg.InstanceID,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, rotationTestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, txnURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", hsToken))
+	resp, err := target.getDeliveryClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("test transaction failed: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		var respErr mautrix.RespError
+		if err = json.NewDecoder(resp.Body).Decode(&respErr); err != nil || len(respErr.ErrCode) == 0 {
+			return fmt.Errorf("test transaction returned HTTP %d", resp.StatusCode)
+		}
+		return fmt.Errorf("test transaction returned HTTP %d: %w", resp.StatusCode, respErr)
+	}
+	return nil
+}
+
+// RotateTokens validates new credentials, stores them and swaps them into the running sync loop.
+// The sync loop isn't restarted: requests already in progress finish with the old credentials
+// and the next ones use the new credentials.
+func (target *SyncTarget) RotateTokens(ctx context.Context, req *reqRotateTokens) (validationErr, err error) {
+	target.credsLock.RLock()
+	botAccessToken, hsToken := target.BotAccessToken, target.HSToken
+	target.credsLock.RUnlock()
+	if len(req.BotAccessToken) > 0 && req.BotAccessToken != botAccessToken {
+		if validationErr = target.validateBotAccessToken(req.BotAccessToken); validationErr != nil {
+			return
+		}
+		botAccessToken = req.BotAccessToken
+	}
+	if len(req.HSToken) > 0 && req.HSToken != hsToken {
+		if !req.SkipTestTransaction && !target.DryRun {
+			if validationErr = target.sendTestTransaction(ctx, req.HSToken); validationErr != nil {
+				return
+			}
+		}
+		hsToken = req.HSToken
+	}
+	if err = store.SetTargetCredentials(ctx, target.storageID(), target.DeviceKey, botAccessToken, hsToken); err != nil {
+		return nil, fmt.Errorf("failed to store new credentials: %w", err)
+	} else if err = target.UpdateCredentials(botAccessToken, hsToken); err != nil {
+		return nil, fmt.Errorf("failed to update credentials: %w", err)
+	}
+	return nil, nil
+}
+
+func rotateTargetTokens(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	targetID := requestTargetID(r, vars["appserviceID"], vars["deviceID"])
+	unlock := registry.LockTarget(targetID)
+	defer unlock()
+	target := registry.Get(targetID)
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	}
+	var req reqRotateTokens
+	if !getJSON(w, r, &req) {
+		return
+	} else if len(req.BotAccessToken) == 0 && len(req.HSToken) == 0 {
+		errMissingTokens.Write(w)
+		return
+	}
+	validationErr, err := target.RotateTokens(r.Context(), &req)
+	if validationErr != nil {
+		target.log.Debugln("New credentials failed validation:", validationErr)
+		formatError(errTokenValidationFailed, validationErr).Write(w)
+		return
+	} else if err != nil {
+		target.log.Warnln("Failed to rotate credentials:", err)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		errUpsertFailed.Write(w)
+		return
+	}
+	target.log.Infoln("Rotated credentials after rotate request")
+	appservice.WriteBlankOK(w)
+}
@@ -0,0 +1,167 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var selfTestEventType = event.Type{Type: "fi.mau.syncproxy.selftest", Class: event.ToDeviceEventType}
+
+const defaultSelfTestTimeout = 30 * time.Second
+const maxSelfTestTimeout = 2 * time.Minute
+
+type selfTest struct {
+	synced    chan struct{}
+	delivered chan struct{}
+}
+
+type SelfTestResult struct {
+	Success        bool   `json:"success"`
+	Nonce          string `json:"nonce"`
+	SyncedAfter    int64  `json:"synced_after_ms,omitempty"`
+	DeliveredAfter int64  `json:"delivered_after_ms,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func (target *SyncTarget) addSelfTest(nonce string) *selfTest {
+	test := &selfTest{
+		synced:    make(chan struct{}),
+		delivered: make(chan struct{}),
+	}
+	target.selfTestLock.Lock()
+	if target.selfTests == nil {
+		target.selfTests = make(map[string]*selfTest)
+	}
+	target.selfTests[nonce] = test
+	target.selfTestLock.Unlock()
+	return test
+}
+
+func (target *SyncTarget) removeSelfTest(nonce string) {
+	target.selfTestLock.Lock()
+	delete(target.selfTests, nonce)
+	target.selfTestLock.Unlock()
+}
+
+// checkSelfTests marks the self-tests whose events are in the given list as synced or delivered.
+func (target *SyncTarget) checkSelfTests(evts []*event.Event, delivered bool) {
+	target.selfTestLock.Lock()
+	defer target.selfTestLock.Unlock()
+	if len(target.selfTests) == 0 {
+		return
+	}
+	for _, evt := range evts {
+		if evt.Type.Type != selfTestEventType.Type || evt.Sender != target.UserID {
+			continue
+		}
+		nonce, _ := evt.Content.Raw["nonce"].(string)
+		test, ok := target.selfTests[nonce]
+		if !ok {
+			continue
+		}
+		ch := test.synced
+		if delivered {
+			ch = test.delivered
+		}
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+func (target *SyncTarget) RunSelfTest(timeout time.Duration) *SelfTestResult {
+	nonceBytes := make([]byte, 16)
+	_, _ = rand.Read(nonceBytes)
+	result := &SelfTestResult{Nonce: hex.EncodeToString(nonceBytes)}
+	test := target.addSelfTest(result.Nonce)
+	defer target.removeSelfTest(result.Nonce)
+
+	start := time.Now()
+	deadline := time.After(timeout)
+	_, err := target.getClient().SendToDevice(selfTestEventType, &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			target.UserID: {
+				target.DeviceID: {Raw: map[string]interface{}{"nonce": result.Nonce}},
+			},
+		},
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to send test event: %v", err)
+		return result
+	}
+
+	select {
+	case <-test.synced:
+		result.SyncedAfter = time.Since(start).Milliseconds()
+	case <-deadline:
+		result.Error = "test event didn't come back through /sync before the deadline"
+		return result
+	}
+	select {
+	case <-test.delivered:
+		result.DeliveredAfter = time.Since(start).Milliseconds()
+		result.Success = true
+	case <-deadline:
+		result.Error = "test event wasn't delivered to the target before the deadline"
+	}
+	return result
+}
+
+func runSelfTest(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	} else if !target.isRunning() {
+		errTargetNotActive.Write(w)
+		return
+	}
+	timeout := defaultSelfTestTimeout
+	if timeoutMS, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && timeoutMS > 0 {
+		timeout = time.Duration(timeoutMS) * time.Millisecond
+		if timeout > maxSelfTestTimeout {
+			timeout = maxSelfTestTimeout
+		}
+	}
+	target.log.Debugln("Running self-test with timeout", timeout)
+	result := target.RunSelfTest(timeout)
+	if result.Success {
+		target.log.Debugfln("Self-test %s succeeded: synced after %d ms, delivered after %d ms", result.Nonce, result.SyncedAfter, result.DeliveredAfter)
+		writeJSON(w, http.StatusOK, result)
+	} else {
+		target.log.Warnfln("Self-test %s failed: %s", result.Nonce, result.Error)
+		writeJSON(w, http.StatusGatewayTimeout, result)
+	}
+}
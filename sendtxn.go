@@ -14,7 +14,7 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package syncproxy
 
 import (
 	"bytes"
@@ -25,6 +25,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -32,6 +34,7 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
 )
 
 const txnIDFormat = "fi.mau.syncproxy_%d_%d"
@@ -48,25 +51,65 @@ type SendStatus string
 const (
 	SendStatusOK                    SendStatus = "ok"
 	SendStatusWebsocketNotConnected SendStatus = "websocket-not-connected"
+	SendStatusFailed                SendStatus = "failed"
 )
 
+// Transaction is an appservice transaction with the fields that mautrix's Transaction struct doesn't have yet.
+type Transaction struct {
+	appservice.Transaction
+	DeviceUnusedFallbackKeyTypes        map[id.UserID][]id.KeyAlgorithm `json:"device_unused_fallback_key_types,omitempty"`
+	MSC3202DeviceUnusedFallbackKeyTypes map[id.UserID][]id.KeyAlgorithm `json:"org.matrix.msc3202.device_unused_fallback_key_types,omitempty"`
+}
+
 type transactionRequest struct {
-	*appservice.Transaction
-	WrappedTxnID  string   `json:"fi.mau.syncproxy.transaction_id,omitempty"`
-	SynchronousTo []string `json:"com.beeper.asmux.synchronous_to,omitempty"`
+	*Transaction
+	WrappedTxnID  string      `json:"fi.mau.syncproxy.transaction_id,omitempty"`
+	UserID        id.UserID   `json:"fi.mau.syncproxy.user_id,omitempty"`
+	DeviceID      id.DeviceID `json:"fi.mau.syncproxy.device_id,omitempty"`
+	SynchronousTo []string    `json:"com.beeper.asmux.synchronous_to,omitempty"`
+
+	// Sequence increases by one for each transaction to the target, including across restarts.
+	Sequence uint64 `json:"fi.mau.syncproxy.sequence,omitempty"`
+	// OriginServerTS is when the proxy created the transaction, for measuring end-to-end delay.
+	OriginServerTS int64  `json:"fi.mau.syncproxy.origin_server_ts,omitempty"`
+	InstanceID     string `json:"fi.mau.syncproxy.instance_id,omitempty"`
+
+	DroppedTransactions []string `json:"fi.mau.syncproxy.dropped_transactions,omitempty"`
 }
 
 type ProxyError string
 
 const (
 	ProxyErrorLoggedOut ProxyError = "FI.MAU.CLIENT_LOGGED_OUT"
-	ProxyErrorUnknown   ProxyError = "M_UNKNOWN"
+	// ProxyErrorSoftLoggedOut asks the target to PUT the target again with a new bot_access_token.
+	ProxyErrorSoftLoggedOut ProxyError = "FI.MAU.CLIENT_SOFT_LOGGED_OUT"
+	// ProxyErrorCircuitOpen means that syncing was stopped because transactions couldn't be delivered for too long.
+	ProxyErrorCircuitOpen ProxyError = "FI.MAU.SYNCPROXY.CIRCUIT_OPEN"
+	ProxyErrorUnknown     ProxyError = "M_UNKNOWN"
 )
 
 type errorRequest struct {
-	Error        ProxyError `json:"errcode"`
-	Message      string     `json:"error"`
-	WrappedTxnID string     `json:"fi.mau.syncproxy.transaction_id,omitempty"`
+	Error        ProxyError  `json:"errcode"`
+	Message      string      `json:"error"`
+	WrappedTxnID string      `json:"fi.mau.syncproxy.transaction_id,omitempty"`
+	UserID       id.UserID   `json:"fi.mau.syncproxy.user_id,omitempty"`
+	DeviceID     id.DeviceID `json:"fi.mau.syncproxy.device_id,omitempty"`
+
+	OriginServerTS int64  `json:"fi.mau.syncproxy.origin_server_ts,omitempty"`
+	InstanceID     string `json:"fi.mau.syncproxy.instance_id,omitempty"`
+}
+
+// deliveryError is returned by the sync loop when delivering a transaction failed.
+type deliveryError struct {
+	Err error
+}
+
+func (de *deliveryError) Error() string {
+	return fmt.Sprintf("error sending transaction: %v", de.Err)
+}
+
+func (de *deliveryError) Unwrap() error {
+	return de.Err
 }
 
 type transactionResponse struct {
@@ -79,70 +122,323 @@ var lastTxnID uint64
 func nextTxnID(format string) (uint64, string) {
 	txnIDCounter := atomic.AddUint64(&lastTxnID, 1)
 	return txnIDCounter, fmt.Sprintf(format,
-		time.Now().UnixNano(),
+		txnClock.Next(),
 		txnIDCounter)
 }
 
-func (target *SyncTarget) tryPostTransaction(ctx context.Context, txn *appservice.Transaction, error *errorRequest) error {
+func (target *SyncTarget) tryPostTransaction(ctx context.Context, txn *Transaction, error *errorRequest) error {
+	if txn != nil {
+		txnID, meta, err := target.newDataTxn()
+		if err != nil {
+			return err
+		}
+		return target.tryPostTransactionWithID(ctx, strconv.FormatUint(meta.Sequence, 10), txnID, meta, txn, error)
+	}
+	// Error notifications don't use the sequence, so they use the clock-based ID format.
 	counter, txnID := nextTxnID(txnIDFormat)
-	txnLog := ctx.Value(logContextKey).(maulogger.Logger).Sub(fmt.Sprintf("Txn-%d", counter))
+	meta, _ := target.newTxnMetadata(false)
+	return target.tryPostTransactionWithID(ctx, strconv.FormatUint(counter, 10), txnID, meta, txn, error)
+}
+
+func (target *SyncTarget) tryPostTransactionWithID(ctx context.Context, logID, txnID string, meta txnMetadata, txn *Transaction, errReq *errorRequest) error {
+	fields, _ := ctx.Value(logFieldsContextKey).(logFields)
+	txnLog := ctx.Value(logContextKey).(maulogger.Logger).Subm(fmt.Sprintf("Txn-%s", logID), fields.with("txn_id", txnID))
 	ctx = context.WithValue(ctx, logContextKey, txnLog)
 
 	if txn != nil {
-		deviceListChanges := 0
+		deviceListChanges, deviceListLeft := 0, 0
 		if txn.DeviceLists != nil {
 			deviceListChanges = len(txn.DeviceLists.Changed)
+			deviceListLeft = len(txn.DeviceLists.Left)
 		}
-		txnLog.Debugfln("Sending %d to-device events, %d device list changes and %d OTK counts to %s in transaction %s",
-			len(txn.EphemeralEvents), deviceListChanges, len(txn.DeviceOTKCount), target.AppserviceID, txnID)
+		txnLog.Debugfln("Sending %d to-device events, %d device list changes, %d device list leaves and %d OTK counts to %s in transaction %s",
+			len(txn.EphemeralEvents), deviceListChanges, deviceListLeft, len(txn.DeviceOTKCount), target.AppserviceID, txnID)
 	} else {
-		txnLog.Debugfln("Sending error '%s' to %s in transaction %s", error.Error, target.AppserviceID, txnID)
+		txnLog.Debugfln("Sending error '%s' to %s in transaction %s", errReq.Error, target.AppserviceID, txnID)
 	}
 
-	retryIn := initialTransactionRetrySleep
+	var history *TransactionHistoryEntry
+	if txn != nil {
+		history = newHistoryEntry(target.storageID(), target.DeviceKey, txnID, txn)
+		if err := history.Insert(ctx); err != nil {
+			txnLog.Warnfln("Failed to store transaction %s in history: %v", txnID, err)
+			history = nil
+		}
+	}
+	delivery := newFanOutDelivery(target.deliveryAddresses())
+	setHistoryStatus := func(status TransactionStatus, attempts int) {
+		if history == nil {
+			return
+		}
+		history.SentTo = delivery.SentTo()
+		if err := history.SetStatus(outcomeContext(ctx), status, attempts); err != nil {
+			txnLog.Warnfln("Failed to update status of transaction %s in history: %v", txnID, err)
+		}
+	}
+	// Transactions with to-device events of at-most-once targets are never retried or queued.
+	atMostOnce := target.AtMostOnce && txn != nil && len(txn.EphemeralEvents) > 0
+	var dropped []string
+	if txn != nil {
+		dropped = target.getDroppedTransactions()
+	}
+	if size := estimateTransactionSize(txn); size > 0 {
+		target.addBuffered(size)
+		defer target.addBuffered(-size)
+		if maxBytes := target.getMaxBufferedBytes(); maxBytes > 0 && size > maxBytes {
+			txnLog.Warnfln("Transaction %s is larger than the buffer cap (~%d > %d bytes)", txnID, size, maxBytes)
+		}
+	}
+	var inFlight *inFlightTransaction
+	if txn != nil && !atMostOnce {
+		inFlight = &inFlightTransaction{TxnID: txnID, Meta: meta, Txn: txn}
+		target.setInFlight(inFlight)
+		defer target.setInFlight(nil)
+	}
+	// interrupted is called when the context is canceled. Transactions are stored in the pending queue
+	// so that they can be delivered when the target is started again.
+	interrupted := func(attempts int) error {
+		setHistoryStatus(TransactionStatusFailed, attempts)
+		if inFlight == nil {
+			return ctx.Err()
+		} else if err := inFlight.Queue(target); err != nil {
+			txnLog.Warnfln("Failed to store interrupted transaction %s in pending queue: %v", txnID, err)
+			return ctx.Err()
+		}
+		txnLog.Debugfln("Stored interrupted transaction %s in pending queue", txnID)
+		return &queuedError{TxnID: txnID, Err: ctx.Err()}
+	}
+
+	retryPolicy := target.getRetryPolicy()
+	retryIn := retryPolicy.TransactionInitial
 	attemptNo := 1
+	var failingSince time.Time
+	singleAttempt := ctx.Value(singleAttemptContextKey) != nil
+	// rejections is the number of consecutive attempts that the target rejected with a permanent error.
+	// Single attempts are made by the outbound queue, which retries the same transaction until it's delivered.
+	rejections := 0
+	if singleAttempt && txn != nil {
+		rejections = target.backlogRejections
+	}
 	for {
-		err := target.postTransaction(ctx, txn, error, txnID, attemptNo)
-		attemptNo += 1
+		target.heartbeat(expectedDeliveryDuration)
+		err := delivery.Post(func(address string) error {
+			return target.postTransaction(ctx, address, txn, errReq, dropped, txnID, meta, attemptNo)
+		})
+		if err != nil {
+			cause := classifyDeliveryError(err)
+			deliveryFailures.WithLabelValues(string(cause)).Inc()
+			if cause != DeliveryFailureCanceled {
+				target.recordError(ErrorSourceDelivery, string(cause), err)
+			}
+			if attemptNo == sentryDeliveryFailureAttempts {
+				target.reportError("Transaction delivery keeps failing", err, map[string]interface{}{"txn_id": txnID, "cause": cause})
+			}
+		}
 		if err == nil {
+			target.clearFailing(WebhookFailureDelivery)
+			if target.DryRun {
+				setHistoryStatus(TransactionStatusDryRun, attemptNo)
+			} else {
+				setHistoryStatus(TransactionStatusSent, attemptNo)
+			}
+			if txn != nil {
+				if singleAttempt {
+					target.backlogRejections = 0
+				}
+				target.clearDroppedTransactions(len(dropped))
+				if !target.DryRun {
+					atomic.AddUint64(&target.sessionTransactions, 1)
+					target.recordDelivery()
+				}
+				target.dedup.MarkDelivered(txn.EphemeralEvents)
+				target.deviceLists.MarkDelivered(txn.DeviceLists, target.deviceListDedupWindow())
+				target.eventTypes.Count(target.ID(), txn.EphemeralEvents)
+				target.checkSelfTests(txn.EphemeralEvents, true)
+			}
+			if inFlight != nil && inFlight.MarkDelivered() {
+				// A forced DELETE queued the transaction while the request was finishing, so remove it from the queue.
+				if err = target.deletePendingTransaction(outcomeContext(ctx), txnID); err != nil {
+					txnLog.Warnfln("Failed to remove delivered transaction %s from pending queue: %v", txnID, err)
+				}
+			}
 			return nil
 		} else if ctx.Err() != nil {
 			if err != ctx.Err() {
 				txnLog.Debugfln("Sending transaction %s returned error %v, but context had different error %v", txnID, err, ctx.Err())
 			}
-			return ctx.Err()
+			return interrupted(attemptNo)
 		} else if errors.Is(err, errWebsocketNotConnected) {
+			setHistoryStatus(TransactionStatusFailed, attemptNo)
 			// Assume that the server will ask as to restart syncing when the websocket does connect again.
 			return err
+		} else if atMostOnce {
+			setHistoryStatus(TransactionStatusDropped, attemptNo)
+			txnLog.Warnfln("Failed to send transaction %s: %v. Dropping it as the target is in at-most-once mode", txnID, err)
+			if dlErr := target.deadLetter(txnID, meta, txn, err, false); dlErr != nil {
+				txnLog.Warnfln("Failed to store dropped transaction %s in dead letter table: %v", txnID, dlErr)
+			}
+			target.addDroppedTransaction(txnID)
+			return nil
 		}
+		if txn != nil {
+			if isPermanentDeliveryError(err) {
+				rejections++
+			} else {
+				rejections = 0
+			}
+			if singleAttempt {
+				target.backlogRejections = rejections
+			}
+			if cfg.DeadLetterAttempts > 0 && rejections >= cfg.DeadLetterAttempts {
+				txnLog.Errorfln("Target rejected transaction %s %d times in a row: %v. Moving it to the dead letter table", txnID, rejections, err)
+				if dlErr := target.deadLetter(txnID, meta, txn, err, true); dlErr != nil {
+					// Retrying forever is better than losing the transaction.
+					txnLog.Warnfln("Failed to store transaction %s in dead letter table: %v", txnID, dlErr)
+				} else {
+					setHistoryStatus(TransactionStatusDeadLettered, attemptNo)
+					target.addDroppedTransaction(txnID)
+					if singleAttempt {
+						target.backlogRejections = 0
+					}
+					if inFlight != nil && inFlight.MarkDelivered() {
+						if err = target.deletePendingTransaction(outcomeContext(ctx), txnID); err != nil {
+							txnLog.Warnfln("Failed to remove dead-lettered transaction %s from pending queue: %v", txnID, err)
+						}
+					}
+					return nil
+				}
+			}
+		}
+		if singleAttempt {
+			// The transaction is already in the outbound queue, the caller retries it later.
+			setHistoryStatus(TransactionStatusFailed, attemptNo)
+			return err
+		}
+		if failingSince.IsZero() {
+			failingSince = time.Now()
+		}
+		target.checkFailing(WebhookFailureDelivery, failingSince, err)
+		if shouldOpenCircuit(attemptNo, failingSince) {
+			circuitErr := circuitOpenError(attemptNo, failingSince, err)
+			txnLog.Errorfln("Giving up on transaction %s: %v", txnID, circuitErr)
+			setHistoryStatus(TransactionStatusFailed, attemptNo)
+			if inFlight == nil {
+				return circuitErr
+			} else if queueErr := inFlight.Queue(target); queueErr != nil {
+				txnLog.Warnfln("Failed to store transaction %s in pending queue: %v", txnID, queueErr)
+				return circuitErr
+			}
+			return &queuedError{TxnID: txnID, Err: circuitErr}
+		}
+		attemptNo += 1
 
 		txnLog.Warnfln("Failed to send transaction %s: %v. Retrying in %v", txnID, err, retryIn)
+		target.heartbeat(retryIn)
 		select {
 		case <-time.After(retryIn):
 		case <-ctx.Done():
 			txnLog.Debugfln("Context returned error while waiting to retry transaction %s", txnID)
-			return ctx.Err()
+			return interrupted(attemptNo - 1)
+		}
+		retryIn = retryPolicy.NextTransaction(retryIn)
+	}
+}
+
+// transactionHTTPError is returned when the target responds to a transaction with a non-2xx status code.
+type transactionHTTPError struct {
+	StatusCode int
+	// RespError is the Matrix error in the response body, or nil if the body wasn't JSON.
+	RespError *mautrix.RespError
+}
+
+func (err *transactionHTTPError) Error() string {
+	if err.RespError == nil {
+		return fmt.Sprintf("transaction returned HTTP %d and non-JSON body", err.StatusCode)
+	}
+	return fmt.Sprintf("transaction returned HTTP %d: %v", err.StatusCode, err.RespError)
+}
+
+// isPermanentDeliveryError checks whether the target rejected the transaction with a client error,
+// which means that retrying the same transaction is unlikely to help.
+func isPermanentDeliveryError(err error) bool {
+	var httpErr *transactionHTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return httpErr.StatusCode >= 400 && httpErr.StatusCode < 500
+}
+
+const defaultTransactionPath = "/_matrix/app/v1/transactions/{txn_id}"
+const defaultErrorPath = "/_matrix/app/unstable/fi.mau.syncproxy/error/{txn_id}"
+
+// validateTxnPathTemplate checks a custom transaction or error path. Empty paths use the default.
+func validateTxnPathTemplate(name, pathTemplate string) error {
+	if len(pathTemplate) == 0 {
+		return nil
+	} else if !strings.HasPrefix(pathTemplate, "/") {
+		return fmt.Errorf("%s must start with a slash", name)
+	} else if !strings.Contains(pathTemplate, "{txn_id}") {
+		return fmt.Errorf("%s must contain {txn_id}", name)
+	} else if strings.ContainsAny(pathTemplate, "?#") {
+		return fmt.Errorf("%s can't contain ? or #", name)
+	}
+	return nil
+}
+
+// txnPathTemplate returns the path template for transactions or errors from the delivery options of the target,
+// its template or the default, in that order.
+func (target *SyncTarget) txnPathTemplate(isError bool) string {
+	var fromOpts, fromTemplate, defaultPath string
+	tpl := target.getTemplate()
+	if isError {
+		defaultPath = defaultErrorPath
+		if target.Delivery != nil {
+			fromOpts = target.Delivery.ErrorPath
+		}
+		if tpl != nil {
+			fromTemplate = tpl.ErrorPath
+		}
+	} else {
+		defaultPath = defaultTransactionPath
+		if target.Delivery != nil {
+			fromOpts = target.Delivery.TransactionPath
 		}
-		retryIn *= 2
-		if retryIn > maxTransactionRetryInterval {
-			retryIn = maxTransactionRetryInterval
+		if tpl != nil {
+			fromTemplate = tpl.TransactionPath
 		}
 	}
+	if len(fromOpts) > 0 {
+		return fromOpts
+	} else if len(fromTemplate) > 0 {
+		return fromTemplate
+	}
+	return defaultPath
+}
+
+// createTxnURL forms the URL for sending a transaction or error to the given address of the target.
+func (target *SyncTarget) createTxnURL(address, txnID string, isError bool) (string, error) {
+	return createTxnURL(address, target.txnPathTemplate(isError), target.Delivery.appserviceIDParam(), target.AppserviceID, txnID)
 }
 
-func createTxnURL(address, appserviceID, txnID string, isError bool) (string, error) {
+// createTxnURL forms the URL for sending a transaction. {txn_id} and {appservice_id} in the path template
+// are replaced with the given values. The appservice ID is also added as a query parameter named
+// appserviceIDParam, unless the name is empty.
+func createTxnURL(address, pathTemplate, appserviceIDParam, appserviceID, txnID string) (string, error) {
 	parsedURL, err := url.Parse(address)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse target URL: %w", err)
 	}
-	if isError {
-		parsedURL.Path = fmt.Sprintf("/_matrix/app/unstable/fi.mau.syncproxy/error/%s", txnID)
-	} else {
-		parsedURL.Path = fmt.Sprintf("/_matrix/app/v1/transactions/%s", txnID)
+	parsedURL.Path = strings.NewReplacer("{txn_id}", txnID, "{appservice_id}", appserviceID).Replace(pathTemplate)
+	parsedURL.RawPath = ""
+	if len(appserviceIDParam) > 0 {
+		q := parsedURL.Query()
+		q.Add(appserviceIDParam, appserviceID)
+		parsedURL.RawQuery = q.Encode()
 	}
-	q := parsedURL.Query()
-	q.Add("appservice_id", appserviceID)
-	parsedURL.RawQuery = q.Encode()
 	return parsedURL.String(), nil
 }
 
@@ -150,7 +446,7 @@ func closeBody(body io.ReadCloser) {
 	_ = body.Close()
 }
 
-func (target *SyncTarget) postTransaction(ctx context.Context, txn *appservice.Transaction, error *errorRequest, txnID string, attemptNo int) error {
+func (target *SyncTarget) postTransaction(ctx context.Context, address string, txn *Transaction, error *errorRequest, dropped []string, txnID string, meta txnMetadata, attemptNo int) error {
 	txnLog := ctx.Value(logContextKey).(maulogger.Logger)
 	var buf bytes.Buffer
 	var req *http.Request
@@ -161,10 +457,22 @@ func (target *SyncTarget) postTransaction(ctx context.Context, txn *appservice.T
 		txnData = &transactionRequest{
 			Transaction:   txn,
 			WrappedTxnID:  txnID,
+			UserID:        target.UserID,
+			DeviceID:      target.DeviceID,
 			SynchronousTo: []string{target.AppserviceID},
+			Sequence:      meta.Sequence,
+
+			OriginServerTS: meta.CreatedAt,
+			InstanceID:     cfg.InstanceID,
+
+			DroppedTransactions: dropped,
 		}
 	} else {
 		error.WrappedTxnID = txnID
+		error.UserID = target.UserID
+		error.DeviceID = target.DeviceID
+		error.OriginServerTS = meta.CreatedAt
+		error.InstanceID = cfg.InstanceID
 		txnData = error
 	}
 
@@ -172,35 +480,64 @@ func (target *SyncTarget) postTransaction(ctx context.Context, txn *appservice.T
 	if target.IsProxy {
 		_, pathTxnID = nextTxnID(wrapperTxnIDFormat)
 	}
-	txnLog.Debugfln("Attempt #%d for transaction %s (path: %s)", attemptNo, txnID, pathTxnID)
+	traceparent := txnTraceparent(txnID)
+	correlation := correlationID(ctx)
+	txnLog.Debugfln("Attempt #%d for transaction %s (path: %s, traceparent: %s, correlation ID: %s)", attemptNo, txnID, pathTxnID, traceparent, correlation)
 
-	if txnURL, err := createTxnURL(target.Address, target.AppserviceID, pathTxnID, error != nil); err != nil {
+	hsToken := target.getHSToken()
+	if txnURL, err := target.createTxnURL(address, pathTxnID, error != nil); err != nil {
 		return fmt.Errorf("failed to form transaction URL: %w", err)
 	} else if err = json.NewEncoder(&buf).Encode(txnData); err != nil {
 		return fmt.Errorf("failed to encode transaction JSON: %w", err)
+	} else if target.DryRun {
+		return target.captureDryRunTransaction(txnLog, txnID, txnURL, buf.Bytes())
+	} else if isWebsocketAddress(address) {
+		wsResp, err := target.postWebsocketTransaction(ctx, address, txnID, buf.Bytes(), error != nil)
+		if err != nil {
+			return err
+		}
+		return target.checkTransactionResponse(txnLog, txnID, attemptNo, "websocket transaction was acknowledged", wsResp)
 	} else if req, err = http.NewRequestWithContext(ctx, http.MethodPut, txnURL, &buf); err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
-	} else if req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", target.HSToken)); len(target.HSToken) == 0 {
+	} else if len(hsToken) == 0 {
 		return fmt.Errorf("target is missing hs_token")
-	} else if resp, err = http.DefaultClient.Do(req); err != nil {
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", hsToken))
+	req.Header.Set(traceparentHeader, traceparent)
+	if len(correlation) > 0 {
+		req.Header.Set(requestIDHeader, correlation)
+	}
+	resp, err := target.getDeliveryClient().Do(req)
+	if err != nil {
 		return fmt.Errorf("failed to send transaction: %w", err)
 	}
 	defer closeBody(resp.Body)
 	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
 		var respErr mautrix.RespError
 		if err := json.NewDecoder(resp.Body).Decode(&respErr); err != nil {
-			return fmt.Errorf("transaction returned HTTP %d and non-JSON body", resp.StatusCode)
+			return &transactionHTTPError{StatusCode: resp.StatusCode}
 		} else if errors.Is(respErr, errFiMauWsNotConnected) {
 			return errWebsocketNotConnected
 		} else {
-			return fmt.Errorf("transaction returned HTTP %d: %w", resp.StatusCode, err)
+			return &transactionHTTPError{StatusCode: resp.StatusCode, RespError: &respErr}
 		}
 	} else if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
 		return fmt.Errorf("transaction returned HTTP %d, but had non-JSON body: %v", resp.StatusCode, err)
-	} else if !respData.Synchronous && cfg.ExpectSynchronous {
-		return fmt.Errorf("transaction returned HTTP %d, but EXPECT_SYNCHRONOUS is set and server didn't confirm support for synchronous delivery", resp.StatusCode)
+	}
+	return target.checkTransactionResponse(txnLog, txnID, attemptNo, fmt.Sprintf("transaction returned HTTP %d", resp.StatusCode), &respData)
+}
+
+// checkTransactionResponse checks the synchronous delivery confirmation of a successful response.
+// desc describes the response for error messages, e.g. "transaction returned HTTP 200".
+func (target *SyncTarget) checkTransactionResponse(txnLog maulogger.Logger, txnID string, attemptNo int, desc string, respData *transactionResponse) error {
+	if !respData.Synchronous && target.getSynchronousPolicy() == SynchronousPolicyRequire {
+		return fmt.Errorf("%s, but synchronous delivery is required and server didn't confirm support for it", desc)
+	} else if !respData.Synchronous && target.getSynchronousPolicy() == SynchronousPolicyPrefer {
+		missingSynchronousConfirmations.Inc()
+		txnLog.Warnfln("Sent transaction %s on attempt #%d, but server didn't confirm synchronous delivery", txnID, attemptNo)
+		return nil
 	} else if respData.Synchronous && respData.SentTo == nil {
-		return fmt.Errorf("transaction returned HTTP %d, but synchronous delivery confirmation was missing `com.beeper.asmux.sent_to` field", resp.StatusCode)
+		return fmt.Errorf("%s, but synchronous delivery confirmation was missing `com.beeper.asmux.sent_to` field", desc)
 	} else if respData.Synchronous {
 		status, ok := respData.SentTo[target.AppserviceID]
 		if status == SendStatusOK {
@@ -209,9 +546,9 @@ func (target *SyncTarget) postTransaction(ctx context.Context, txn *appservice.T
 		} else if status == SendStatusWebsocketNotConnected {
 			return errWebsocketNotConnected
 		} else if ok {
-			return fmt.Errorf("transaction returned HTTP %d, but server said it didn't reach the appservice (status %s)", resp.StatusCode, status)
+			return fmt.Errorf("%s, but server said it didn't reach the appservice (status %s)", desc, status)
 		} else {
-			return fmt.Errorf("transaction returned HTTP %d, but server didn't confirm synchronous delivery", resp.StatusCode)
+			return fmt.Errorf("%s, but server didn't confirm synchronous delivery", desc)
 		}
 	} else {
 		txnLog.Debugfln("Successfully sent transaction %s on attempt #%d", txnID, attemptNo)
@@ -0,0 +1,207 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const sentryQueueSize = 100
+const sentryRequestTimeout = 10 * time.Second
+
+// sentryReportInterval is the minimum time between reports with the same message and tags,
+// so that e.g. a database outage doesn't send an event for every failed write.
+const sentryReportInterval = 5 * time.Minute
+
+// sentryDeliveryFailureAttempts is the number of failed attempts after which a transaction is reported to Sentry.
+const sentryDeliveryFailureAttempts = 5
+
+// sentryReporter sends error events to Sentry using the store endpoint of the Sentry HTTP API.
+type sentryReporter struct {
+	endpoint   string
+	authHeader string
+	client     *http.Client
+	queue      chan *sentryEvent
+
+	lastReported     map[string]time.Time
+	lastReportedLock sync.Mutex
+}
+
+// sentry is the reporter for SENTRY_DSN, or nil if Sentry isn't configured.
+var sentry *sentryReporter
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryEvent struct {
+	EventID    string                 `json:"event_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Level      string                 `json:"level"`
+	Platform   string                 `json:"platform"`
+	Logger     string                 `json:"logger"`
+	Message    string                 `json:"message"`
+	Release    string                 `json:"release"`
+	ServerName string                 `json:"server_name,omitempty"`
+	Tags       map[string]string      `json:"tags,omitempty"`
+	Exception  *sentryExceptions      `json:"exception,omitempty"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+// parseSentryDSN parses a DSN in the https://<public key>@<host>/<project ID> format. An empty DSN returns nil.
+func parseSentryDSN(dsn string) (*sentryReporter, error) {
+	if len(dsn) == 0 {
+		return nil, nil
+	}
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	} else if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	} else if parsed.User == nil || len(parsed.User.Username()) == 0 {
+		return nil, errors.New("missing public key")
+	}
+	slash := strings.LastIndexByte(parsed.Path, '/')
+	projectID := parsed.Path[slash+1:]
+	if slash < 0 || len(projectID) == 0 {
+		return nil, errors.New("missing project ID")
+	}
+	authHeader := fmt.Sprintf("Sentry sentry_version=7, sentry_client=mautrix-syncproxy/%s, sentry_key=%s", Version, parsed.User.Username())
+	if password, ok := parsed.User.Password(); ok {
+		authHeader += ", sentry_secret=" + password
+	}
+	return &sentryReporter{
+		endpoint:     fmt.Sprintf("%s://%s%s/api/%s/store/", parsed.Scheme, parsed.Host, parsed.Path[:slash], projectID),
+		authHeader:   authHeader,
+		client:       &http.Client{Timeout: sentryRequestTimeout},
+		queue:        make(chan *sentryEvent, sentryQueueSize),
+		lastReported: make(map[string]time.Time),
+	}, nil
+}
+
+// Loop sends queued events until the process exits.
+func (sr *sentryReporter) Loop() {
+	for evt := range sr.queue {
+		if err := sr.send(evt); err != nil {
+			log.Debugfln("Failed to send event %s to Sentry: %v", evt.EventID, err)
+		}
+	}
+}
+
+func (sr *sentryReporter) send(evt *sentryEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sr.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", sr.authHeader)
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// shouldReport checks that an event with the same key hasn't been reported within the report interval.
+func (sr *sentryReporter) shouldReport(key string, now time.Time) bool {
+	sr.lastReportedLock.Lock()
+	defer sr.lastReportedLock.Unlock()
+	if last, ok := sr.lastReported[key]; ok && now.Sub(last) < sentryReportInterval {
+		return false
+	}
+	for existingKey, last := range sr.lastReported {
+		if now.Sub(last) >= sentryReportInterval {
+			delete(sr.lastReported, existingKey)
+		}
+	}
+	sr.lastReported[key] = now
+	return true
+}
+
+// reportToSentry queues an error event. It doesn't block, events are dropped if the queue is full.
+func reportToSentry(message string, err error, tags map[string]string, extra map[string]interface{}) {
+	if sentry == nil {
+		return
+	}
+	now := time.Now()
+	key := message
+	for _, tag := range []string{"appservice_id", "device_key", "profile"} {
+		key += "|" + tags[tag]
+	}
+	if !sentry.shouldReport(key, now) {
+		return
+	}
+	eventID := make([]byte, 16)
+	_, _ = rand.Read(eventID)
+	evt := &sentryEvent{
+		EventID:    hex.EncodeToString(eventID),
+		Timestamp:  now.UTC().Format(time.RFC3339),
+		Level:      "error",
+		Platform:   "go",
+		Logger:     "mautrix-syncproxy",
+		Message:    message,
+		Release:    Version,
+		ServerName: cfg.InstanceID,
+		Tags:       tags,
+		Extra:      extra,
+	}
+	if err != nil {
+		evt.Exception = &sentryExceptions{Values: []sentryException{{Type: fmt.Sprintf("%T", err), Value: err.Error()}}}
+	}
+	select {
+	case sentry.queue <- evt:
+	default:
+		log.Debugfln("Sentry queue is full, dropping event %s", evt.EventID)
+	}
+}
+
+// reportError reports an error of the target to Sentry, tagged with the appservice ID, device key and profile.
+func (target *SyncTarget) reportError(message string, err error, extra map[string]interface{}) {
+	if sentry == nil {
+		return
+	}
+	tags := make(map[string]string)
+	for key, value := range target.logFields() {
+		tags[key] = fmt.Sprint(value)
+	}
+	reportToSentry(message, err, tags, extra)
+}
@@ -0,0 +1,60 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// shuttingDown is set when the process starts shutting down, so that nothing starts new sync loops afterwards.
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// stopAllTargets cancels every running sync loop and waits up to the timeout for them to exit.
+// Interrupted transactions are stored in the pending queue, and the targets stay marked as active
+// in the database so that they're started again on boot. Returns the number of loops that didn't exit in time.
+func stopAllTargets(timeout time.Duration) int {
+	atomic.StoreInt32(&shuttingDown, 1)
+	var done []<-chan struct{}
+	for _, target := range registry.Snapshot() {
+		if target.isRunning() {
+			done = append(done, target.Stop(StopReasonShutdown))
+		}
+	}
+	if len(done) == 0 {
+		return 0
+	}
+	log.Infofln("Waiting up to %v for %d sync loops to stop", timeout, len(done))
+	deadline := time.After(timeout)
+	for i, ch := range done {
+		select {
+		case <-ch:
+		case <-deadline:
+			return len(done) - i
+		}
+	}
+	log.Infoln("All sync loops stopped")
+	return 0
+}
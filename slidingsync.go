@@ -0,0 +1,193 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type SyncBackend string
+
+const (
+	// SyncBackendV2 uses the normal /sync endpoint.
+	SyncBackendV2 SyncBackend = ""
+	// SyncBackendSliding uses simplified sliding sync (MSC4186) if the homeserver supports it, and /sync otherwise.
+	SyncBackendSliding SyncBackend = "sliding"
+)
+
+func (backend SyncBackend) Validate() error {
+	switch backend {
+	case SyncBackendV2, SyncBackendSliding:
+		return nil
+	default:
+		return fmt.Errorf("unknown sync backend %q", backend)
+	}
+}
+
+const slidingSyncFeature = "org.matrix.simplified_msc3575"
+
+var errUnknownPos = mautrix.RespError{ErrCode: "M_UNKNOWN_POS"}
+
+// SlidingSyncPosition is the persisted state of a target using the sliding sync backend.
+type SlidingSyncPosition struct {
+	// Pos is the position of the sliding sync connection.
+	Pos string
+	// ToDeviceSince is the to-device extension token, which is needed to resume
+	// without losing to-device events if the server has expired the connection.
+	ToDeviceSince string
+}
+
+type reqSlidingSyncToDevice struct {
+	Enabled bool   `json:"enabled"`
+	Since   string `json:"since,omitempty"`
+}
+
+type reqSlidingSyncE2EE struct {
+	Enabled bool `json:"enabled"`
+}
+
+// reqSlidingSync only enables the extensions that contain the data a /sync v2 request with the default filter would.
+// No rooms are requested, so room data isn't available with this backend.
+type reqSlidingSync struct {
+	Lists      map[string]interface{} `json:"lists"`
+	Extensions struct {
+		ToDevice reqSlidingSyncToDevice `json:"to_device"`
+		E2EE     reqSlidingSyncE2EE     `json:"e2ee"`
+	} `json:"extensions"`
+}
+
+type respSlidingSync struct {
+	Pos        string `json:"pos"`
+	Extensions struct {
+		ToDevice *struct {
+			NextBatch string         `json:"next_batch"`
+			Events    []*event.Event `json:"events"`
+		} `json:"to_device"`
+		E2EE *struct {
+			DeviceLists      mautrix.DeviceLists `json:"device_lists"`
+			DeviceOTKCount   *mautrix.OTKCount   `json:"device_one_time_keys_count"`
+			FallbackKeyTypes []id.KeyAlgorithm   `json:"device_unused_fallback_key_types"`
+		} `json:"e2ee"`
+	} `json:"extensions"`
+}
+
+// useSlidingSync decides whether the sync loop should use the sliding sync backend.
+func (target *SyncTarget) useSlidingSync(hsInfo *HomeserverInfo, syncLog maulogger.Logger) bool {
+	if target.SyncBackend != SyncBackendSliding {
+		return false
+	} else if !hsInfo.SlidingSync {
+		syncLog.Warnln("Homeserver doesn't advertise simplified sliding sync support, falling back to /sync")
+		return false
+	} else if target.FullSync || target.ForwardPresence || target.Filter != nil {
+		syncLog.Warnln("Sliding sync backend doesn't support room data, presence or custom filters, falling back to /sync")
+		return false
+	}
+	return true
+}
+
+// slidingSyncRequest makes a simplified sliding sync request and converts the response into the same form as
+// syncRequest. Only the to-device events, device lists and key counts are filled in the returned RespSync.
+func (target *SyncTarget) slidingSyncRequest(ctx context.Context, timeout int) (*mautrix.RespSync, syncExtras, error) {
+	target.statusLock.RLock()
+	position := target.slidingSync
+	target.statusLock.RUnlock()
+	resp, err := target.doSlidingSyncRequest(ctx, timeout, position)
+	if errors.Is(err, errUnknownPos) {
+		// The server expired the connection. The to-device token is independent of it, so nothing is lost.
+		target.log.Debugln("Sliding sync position expired, starting a new connection")
+		position.Pos = ""
+		resp, err = target.doSlidingSyncRequest(ctx, timeout, position)
+	}
+	if err != nil {
+		return nil, syncExtras{}, err
+	}
+	var syncResp mautrix.RespSync
+	extras := syncExtras{Sliding: &SlidingSyncPosition{Pos: resp.Pos, ToDeviceSince: position.ToDeviceSince}}
+	if toDevice := resp.Extensions.ToDevice; toDevice != nil {
+		syncResp.ToDevice.Events = toDevice.Events
+		if len(toDevice.NextBatch) > 0 {
+			extras.Sliding.ToDeviceSince = toDevice.NextBatch
+		}
+	}
+	if e2ee := resp.Extensions.E2EE; e2ee != nil {
+		syncResp.DeviceLists = e2ee.DeviceLists
+		if e2ee.DeviceOTKCount != nil {
+			syncResp.DeviceOTKCount = *e2ee.DeviceOTKCount
+			extras.OTKCountKnown = true
+		}
+		extras.FallbackKeyTypes = e2ee.FallbackKeyTypes
+	}
+	return &syncResp, extras, nil
+}
+
+func (target *SyncTarget) doSlidingSyncRequest(ctx context.Context, timeout int, position SlidingSyncPosition) (*respSlidingSync, error) {
+	client := target.getClient()
+	query := url.Values{"timeout": {strconv.Itoa(timeout)}}
+	if len(position.Pos) > 0 {
+		query.Set("pos", position.Pos)
+	}
+	var req reqSlidingSync
+	req.Lists = map[string]interface{}{}
+	req.Extensions.ToDevice = reqSlidingSyncToDevice{Enabled: true, Since: position.ToDeviceSince}
+	req.Extensions.E2EE.Enabled = true
+	var resp respSlidingSync
+	_, err := client.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodPost,
+		URL:          client.BuildBaseURL("_matrix", "client", "unstable", slidingSyncFeature, "sync") + "?" + query.Encode(),
+		RequestJSON:  &req,
+		ResponseJSON: &resp,
+		Context:      ctx,
+		// Retries are handled by the sync loop.
+		MaxAttempts: 1,
+	})
+	return &resp, err
+}
+
+// SetSlidingSyncPosition updates the sliding sync position in memory and in the database.
+func (target *SyncTarget) SetSlidingSyncPosition(ctx context.Context, position SlidingSyncPosition) {
+	target.statusLock.Lock()
+	if target.slidingSync == position {
+		target.statusLock.Unlock()
+		return
+	}
+	target.slidingSync = position
+	target.statusLock.Unlock()
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	deferredWrites.Exec(ctx, target, "sliding_sync_position", func(ctx context.Context) error {
+		return store.SetTargetSlidingSyncPosition(ctx, appserviceID, deviceKey, position)
+	})
+}
+
+// commitSyncPosition stores the position of the sync backend once the response has been handled.
+func (target *SyncTarget) commitSyncPosition(ctx context.Context, nextBatch string, extras syncExtras) {
+	if extras.Sliding != nil {
+		target.SetSlidingSyncPosition(ctx, *extras.Sliding)
+	} else {
+		target.SetNextBatch(ctx, nextBatch)
+	}
+}
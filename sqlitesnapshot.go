@@ -0,0 +1,180 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// In-memory SQLite mode keeps the whole database in memory, so that frequent writes like next_batch updates
+// don't wait for the disk. The database can be persisted with periodic snapshots, which are also taken on
+// shutdown and restored on startup, so that planned restarts don't lose any state. A crash loses everything
+// since the previous snapshot.
+
+const defaultSnapshotInterval = 5 * time.Minute
+
+type sqliteSnapshotter struct {
+	path     string
+	interval time.Duration
+}
+
+// parseMemorySQLiteURL checks if the database URL is an in-memory SQLite database, e.g.
+// sqlite://:memory:?snapshot=/data/syncproxy.db&snapshot_interval=1m. The snapshotter is nil if snapshots aren't enabled.
+// memory:// and none are shorthands for an in-memory database without snapshots.
+func parseMemorySQLiteURL(dbURL string) (isMemory bool, snapshotter *sqliteSnapshotter, err error) {
+	if dbURL == "memory://" || dbURL == "none" {
+		return true, nil, nil
+	}
+	var rest string
+	for _, scheme := range []string{"sqlite://", "sqlite3://"} {
+		if strings.HasPrefix(dbURL, scheme) {
+			rest = strings.TrimPrefix(strings.TrimPrefix(dbURL, scheme), "/")
+			break
+		}
+	}
+	if !strings.HasPrefix(rest, ":memory:") {
+		return false, nil, nil
+	}
+	rest = strings.TrimPrefix(rest, ":memory:")
+	if len(rest) == 0 {
+		return true, nil, nil
+	} else if rest[0] != '?' {
+		return true, nil, fmt.Errorf("unexpected data after :memory: in database URL")
+	}
+	query, err := url.ParseQuery(rest[1:])
+	if err != nil {
+		return true, nil, fmt.Errorf("failed to parse database URL query: %w", err)
+	}
+	path := query.Get("snapshot")
+	if len(path) == 0 {
+		return true, nil, nil
+	}
+	snapshotter = &sqliteSnapshotter{path: path, interval: defaultSnapshotInterval}
+	if interval := query.Get("snapshot_interval"); len(interval) > 0 {
+		snapshotter.interval, err = time.ParseDuration(interval)
+		if err != nil || snapshotter.interval <= 0 {
+			return true, nil, fmt.Errorf("invalid snapshot_interval %q", interval)
+		}
+	}
+	return true, snapshotter, nil
+}
+
+// connectMemorySQLite creates an in-memory SQLite database and restores the snapshot into it if one exists.
+func connectMemorySQLite(snapshotter *sqliteSnapshotter) (*Database, error) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to :memory: has its own database, so the pool must keep exactly one connection open forever.
+	// That also means nothing can query the database while the rows of another query are still open, so result
+	// sets must be read completely and closed before making other queries.
+	conn.SetMaxOpenConns(1)
+	conn.SetMaxIdleConns(1)
+	conn.SetConnMaxLifetime(0)
+	localDB := &Database{conn: conn, scheme: "sqlite3", snapshotter: snapshotter}
+	if snapshotter != nil {
+		if err = snapshotter.Restore(conn); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to restore snapshot: %w", err)
+		}
+	}
+	return localDB, nil
+}
+
+// Restore copies the snapshot file into the in-memory database using the SQLite backup API.
+func (ss *sqliteSnapshotter) Restore(conn *sql.DB) error {
+	if _, err := os.Stat(ss.path); os.IsNotExist(err) {
+		log.Infoln("Snapshot", ss.path, "doesn't exist, starting with an empty in-memory database")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", ss.path))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	ctx := context.Background()
+	destConn, err := conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	err = destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := destDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err = backup.Step(-1); err != nil {
+				_ = backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	if err == nil {
+		log.Infoln("Restored in-memory database from snapshot", ss.path)
+	}
+	return err
+}
+
+// Snapshot writes the in-memory database to the snapshot file. The database is first written to a temporary
+// file, which then replaces the old snapshot, so that a crash in the middle doesn't corrupt the previous snapshot.
+// Writing the snapshot is limited by the query timeout like any other query.
+func (db *Database) Snapshot(ctx context.Context) error {
+	if db.snapshotter == nil {
+		return nil
+	}
+	start := time.Now()
+	tempPath := db.snapshotter.path + ".tmp"
+	if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old temporary snapshot: %w", err)
+	} else if _, err = db.ExecContext(ctx, "VACUUM INTO $1", tempPath); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	} else if err = os.Rename(tempPath, db.snapshotter.path); err != nil {
+		return fmt.Errorf("failed to replace old snapshot: %w", err)
+	}
+	log.Debugfln("Wrote database snapshot to %s in %v", db.snapshotter.path, time.Since(start))
+	return nil
+}
+
+// loopSnapshot periodically snapshots the in-memory database until the process exits.
+func (db *Database) loopSnapshot() {
+	if db.snapshotter == nil {
+		return
+	}
+	for range time.Tick(db.snapshotter.interval) {
+		if err := db.Snapshot(context.Background()); err != nil {
+			log.Errorln("Failed to snapshot in-memory database:", err)
+		}
+	}
+}
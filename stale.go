@@ -0,0 +1,125 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const staleRegistrationSweepInterval = 1 * time.Hour
+
+type StaleRegistrationConfig struct {
+	// MaxAge is how long a registration can exist without ever syncing before it's considered stale. Zero disables the sweep.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Delete makes the sweep purge stale registrations instead of only flagging them in the list API.
+	Delete bool `yaml:"delete"`
+}
+
+// markFirstSync records that the sync loop of the target has completed a full iteration for the first time,
+// which means that the tokens and address work (or at least worked once).
+func (target *SyncTarget) markFirstSync() {
+	target.statusLock.Lock()
+	if target.firstSyncedAt != 0 {
+		target.statusLock.Unlock()
+		return
+	}
+	firstSyncedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	target.firstSyncedAt = firstSyncedAt
+	target.statusLock.Unlock()
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	deferredWrites.Exec(context.Background(), target, "first_synced_at", func(ctx context.Context) error {
+		return store.SetTargetFirstSyncedAt(ctx, appserviceID, deviceKey, firstSyncedAt)
+	})
+}
+
+// isStale returns whether the target was registered more than the configured maximum age ago and has never synced.
+// Targets registered before registration times were stored have registeredAt set to the time of the upgrade.
+func (target *SyncTarget) isStale(now time.Time) bool {
+	if cfg.StaleRegistrations.MaxAge <= 0 {
+		return false
+	}
+	target.statusLock.RLock()
+	defer target.statusLock.RUnlock()
+	cutoff := now.Add(-cfg.StaleRegistrations.MaxAge).UnixNano() / int64(time.Millisecond)
+	return target.firstSyncedAt == 0 && target.registeredAt > 0 && target.registeredAt < cutoff
+}
+
+// sweepStaleRegistrations finds stale registrations and purges them if configured to.
+// It returns the number of stale registrations that are left.
+func sweepStaleRegistrations(now time.Time) (int, error) {
+	dbTargets, err := store.GetTargets(context.Background(), false)
+	if err != nil {
+		return 0, err
+	}
+	stale := 0
+	for _, dbTarget := range dbTargets {
+		target := registry.GetLoaded(dbTarget.ID())
+		if target == nil {
+			target = dbTarget
+		}
+		if !target.isStale(now) {
+			continue
+		} else if !cfg.StaleRegistrations.Delete || !purgeStaleRegistration(target.ID(), now) {
+			stale++
+		}
+	}
+	return stale, nil
+}
+
+// purgeStaleRegistration stops and deletes the target if it's still stale after locking it.
+func purgeStaleRegistration(targetID string, now time.Time) bool {
+	unlock := registry.LockTarget(targetID)
+	defer unlock()
+	target := registry.Get(targetID)
+	if target == nil {
+		return true
+	} else if !target.isStale(now) {
+		return false
+	}
+	<-target.Stop(StopReasonStaleRegistration)
+	if _, _, err := target.exportBeforePurge(); err != nil {
+		target.log.Warnln("Failed to export pending transactions, not purging stale registration:", err)
+		return false
+	} else if err = target.Purge(context.Background()); err != nil {
+		target.log.Warnln("Failed to purge stale registration:", err)
+		return false
+	}
+	target.log.Infofln("Purged registration that hasn't synced since it was created %v ago",
+		now.Sub(time.Unix(0, target.registeredAt*int64(time.Millisecond))).Round(time.Minute))
+	return true
+}
+
+func loopSweepStaleRegistrations() {
+	if cfg.StaleRegistrations.MaxAge <= 0 {
+		return
+	}
+	for {
+		stale, err := sweepStaleRegistrations(time.Now())
+		if err != nil {
+			log.Warnln("Failed to sweep stale registrations:", err)
+		} else {
+			staleRegistrations.Set(float64(stale))
+			if stale > 0 {
+				log.Infofln("Found %d stale registrations that have never synced", stale)
+			}
+		}
+		time.Sleep(staleRegistrationSweepInterval)
+	}
+}
@@ -0,0 +1,401 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// StopReason describes why a sync loop stopped.
+type StopReason string
+
+const (
+	StopReasonOperator              StopReason = "operator-stop"
+	StopReasonRestart               StopReason = "restart"
+	StopReasonSuspended             StopReason = "suspended"
+	StopReasonShutdown              StopReason = "shutdown"
+	StopReasonHomeserverAuth        StopReason = "homeserver-auth"
+	StopReasonTargetUnreachable     StopReason = "target-unreachable"
+	StopReasonWebsocketNotConnected StopReason = "websocket-not-connected"
+	StopReasonPanic                 StopReason = "panic"
+	StopReasonError                 StopReason = "error"
+	// StopReasonStaleRegistration means the target was purged because it had never synced.
+	StopReasonStaleRegistration StopReason = "stale-registration"
+	// StopReasonLeaseLost means another instance took over the target.
+	StopReasonLeaseLost StopReason = "lease-lost"
+	// StopReasonSoftLogout means the homeserver soft logged out the access token,
+	// and the target was asked to provide a new one with a PUT request.
+	StopReasonSoftLogout StopReason = "soft-logout"
+	// StopReasonCircuitOpen means transactions failed for too long and the circuit breaker stopped syncing.
+	StopReasonCircuitOpen StopReason = "circuit-open"
+	// StopReasonPaused means syncing was stopped with the pause endpoint.
+	StopReasonPaused StopReason = "paused"
+	// StopReasonReachability means the target didn't answer pings for too long. Syncing is resumed when it answers again.
+	StopReasonReachability StopReason = "reachability"
+)
+
+// DeliveryFailureCause describes why a single transaction delivery attempt failed.
+type DeliveryFailureCause string
+
+const (
+	DeliveryFailureCanceled              DeliveryFailureCause = "canceled"
+	DeliveryFailureWebsocketNotConnected DeliveryFailureCause = "websocket-not-connected"
+	DeliveryFailureTargetUnreachable     DeliveryFailureCause = "target-unreachable"
+	DeliveryFailureTargetError           DeliveryFailureCause = "target-error"
+	DeliveryFailurePinMismatch           DeliveryFailureCause = "pin-mismatch"
+)
+
+func classifyDeliveryError(err error) DeliveryFailureCause {
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return DeliveryFailureCanceled
+	case errors.Is(err, errWebsocketNotConnected):
+		return DeliveryFailureWebsocketNotConnected
+	case errors.Is(err, errSPKIPinMismatch), errors.Is(err, errPinnedNotHTTPS):
+		return DeliveryFailurePinMismatch
+	case errors.As(err, &urlErr):
+		// http.Client.Do only returns *url.Errors, which means the request didn't get a response.
+		return DeliveryFailureTargetUnreachable
+	default:
+		return DeliveryFailureTargetError
+	}
+}
+
+// isSoftLogout checks whether the error is an M_UNKNOWN_TOKEN response with soft_logout set, which means
+// the device still exists and syncing can continue with a new access token for it.
+func isSoftLogout(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || httpErr.RespError.ErrCode != mautrix.MUnknownToken.ErrCode {
+		return false
+	}
+	softLogout, _ := httpErr.RespError.ExtraData["soft_logout"].(bool)
+	return softLogout
+}
+
+// classifyTermination figures out the StopReason for an error returned by the sync loop.
+// requested is the reason passed to Stop(), which is used if the loop was canceled.
+func classifyTermination(err error, requested StopReason) StopReason {
+	var delivErr *deliveryError
+	switch {
+	case errors.Is(err, context.Canceled):
+		if len(requested) == 0 {
+			return StopReasonOperator
+		}
+		return requested
+	case errors.Is(err, errCircuitOpen):
+		return StopReasonCircuitOpen
+	case isSoftLogout(err):
+		return StopReasonSoftLogout
+	case errors.Is(err, mautrix.MUnknownToken), errors.Is(err, mautrix.MMissingToken), errors.Is(err, mautrix.MForbidden):
+		return StopReasonHomeserverAuth
+	case errors.Is(err, errWebsocketNotConnected):
+		return StopReasonWebsocketNotConnected
+	case errors.As(err, &delivErr) && classifyDeliveryError(delivErr.Err) == DeliveryFailureTargetUnreachable:
+		return StopReasonTargetUnreachable
+	default:
+		return StopReasonError
+	}
+}
+
+type LastStop struct {
+	Reason    StopReason `json:"reason"`
+	Error     string     `json:"error,omitempty"`
+	Timestamp int64      `json:"timestamp"`
+}
+
+// SyncRetryState describes a failed sync request that is waiting to be retried.
+// It's stored in the database, so that the backoff continues after a restart.
+type SyncRetryState struct {
+	Attempts    int    `json:"attempts"`
+	NextRetryAt int64  `json:"next_retry_at"`
+	Error       string `json:"error"`
+	// IntervalMS is the delay before the retry, which the next delay is calculated from.
+	IntervalMS int64 `json:"interval_ms"`
+}
+
+type TargetStatus struct {
+	AppserviceID string      `json:"appservice_id"`
+	DeviceKey    string      `json:"device_key,omitempty"`
+	Profile      string      `json:"profile,omitempty"`
+	UserID       id.UserID   `json:"user_id"`
+	DeviceID     id.DeviceID `json:"device_id"`
+	Active       bool        `json:"active"`
+	Running      bool        `json:"running"`
+	LastStop     *LastStop   `json:"last_stop,omitempty"`
+	Checkpoint   *Checkpoint `json:"checkpoint,omitempty"`
+	// WaitingForCredentials is true if syncing stopped because of a soft logout and the target hasn't been PUT since.
+	WaitingForCredentials bool `json:"waiting_for_credentials,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// SuspendedUntil is the time when syncing will be resumed automatically, if the target is suspended.
+	SuspendedUntil int64 `json:"suspended_until,omitempty"`
+	// Paused is true if syncing was stopped with the pause endpoint and hasn't been resumed yet.
+	Paused bool `json:"paused,omitempty"`
+	// Reachability is the result of the latest periodic ping, if reachability monitoring is enabled.
+	Reachability *Reachability `json:"reachability,omitempty"`
+	// BufferedBytes is the approximate number of bytes of transactions the target is holding in memory.
+	BufferedBytes int64 `json:"buffered_bytes"`
+	// CatchUp is the progress of the catch-up phase, if the target is currently catching up.
+	CatchUp *CatchUpProgress `json:"catch_up,omitempty"`
+
+	NextBatch string `json:"next_batch,omitempty"`
+	// RegisteredAt is the time when the target was first registered.
+	RegisteredAt int64 `json:"registered_at,omitempty"`
+	// FirstSyncedAt is the time when the sync loop first completed successfully, or zero if it never has.
+	FirstSyncedAt int64 `json:"first_synced_at,omitempty"`
+	// Stale is true if the target has never synced and is older than the stale registration age.
+	Stale bool `json:"stale,omitempty"`
+	// LastSyncAt is the time of the last successful sync request.
+	LastSyncAt int64 `json:"last_sync_at,omitempty"`
+	// LastDeliveryAt is the time when a transaction was last delivered to the target.
+	LastDeliveryAt int64           `json:"last_delivery_at,omitempty"`
+	Retry          *SyncRetryState `json:"retry,omitempty"`
+	LastError      *TargetError    `json:"last_error,omitempty"`
+
+	// EventTypes is the number of to-device events delivered by event type since the target was loaded.
+	EventTypes map[string]uint64 `json:"event_types,omitempty"`
+
+	Latency            map[string]*LatencySummary `json:"latency"`
+	RecentTransactions *TransactionSummary        `json:"recent_transactions,omitempty"`
+	// FiltersCreated is the number of distinct sync filters uploaded for the target's account.
+	FiltersCreated int `json:"filters_created"`
+}
+
+func (target *SyncTarget) recordStop(reason StopReason, err error) {
+	syncTerminations.WithLabelValues(string(reason)).Inc()
+	lastStop := &LastStop{
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err != nil && reason != StopReasonOperator && reason != StopReasonRestart && reason != StopReasonShutdown && reason != StopReasonSuspended && reason != StopReasonPaused && reason != StopReasonReachability {
+		lastStop.Error = err.Error()
+		target.recordError(ErrorSourceStop, string(reason), err)
+	}
+	target.statusLock.Lock()
+	target.lastStop = lastStop
+	hadSyncRetry := target.syncRetry != nil
+	target.syncRetry = nil
+	target.syncFailingSince = time.Time{}
+	target.statusLock.Unlock()
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	deferredWrites.Exec(context.Background(), target, "last_stop", func(ctx context.Context) error {
+		return store.SetTargetLastStop(ctx, appserviceID, deviceKey, lastStop)
+	})
+	// The stored backoff is kept over shutdowns, so that the target doesn't retry at full speed after the restart.
+	if hadSyncRetry && reason != StopReasonShutdown {
+		target.storeSyncRetry(nil)
+	}
+	target.resetFailing()
+	target.notifyStopped(reason, err)
+	// Restarts are followed by a new sync loop, which notifies the waiters instead.
+	if reason != StopReasonRestart {
+		target.notifySyncWaiters(syncResult{Err: stoppedBeforeSyncError(reason, err)})
+	}
+}
+
+func (target *SyncTarget) storeSyncRetry(retry *SyncRetryState) {
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	deferredWrites.Exec(context.Background(), target, "sync_retry", func(ctx context.Context) error {
+		return store.SetTargetSyncRetry(ctx, appserviceID, deviceKey, retry)
+	})
+}
+
+// resumeSyncRetry returns how long to wait before the first sync request and the previous retry interval,
+// if syncing was failing when the target was last stopped by a shutdown.
+func (target *SyncTarget) resumeSyncRetry() (wait, interval time.Duration, ok bool) {
+	target.statusLock.RLock()
+	defer target.statusLock.RUnlock()
+	if target.syncRetry == nil || target.syncRetry.IntervalMS <= 0 {
+		return 0, 0, false
+	}
+	interval = time.Duration(target.syncRetry.IntervalMS) * time.Millisecond
+	wait = time.Until(time.Unix(0, target.syncRetry.NextRetryAt*int64(time.Millisecond)))
+	if wait > interval {
+		wait = interval
+	}
+	return wait, interval, true
+}
+
+// recordShutdown records the shutdown as the last stop of running targets. The sync loops aren't stopped,
+// because that would mark the targets inactive, and they should be started again after the restart.
+func recordShutdown() {
+	for _, target := range registry.Snapshot() {
+		if target.isRunning() {
+			target.recordStop(StopReasonShutdown, nil)
+		}
+	}
+}
+
+func (target *SyncTarget) recordSyncSuccess(nextBatch string) {
+	target.statusLock.Lock()
+	target.lastSyncAt = time.Now().UnixNano() / int64(time.Millisecond)
+	hadSyncRetry := target.syncRetry != nil
+	target.syncRetry = nil
+	target.syncFailingSince = time.Time{}
+	target.statusLock.Unlock()
+	if hadSyncRetry {
+		target.storeSyncRetry(nil)
+	}
+	target.clearFailing(WebhookFailureSync)
+	target.notifySyncWaiters(syncResult{NextBatch: nextBatch})
+}
+
+// recordLoopStart is called when the sync loop starts. Starts after the first one are counted as restarts.
+func (target *SyncTarget) recordLoopStart() {
+	target.statusLock.Lock()
+	restarted := target.loopStartedAt != 0
+	target.loopStartedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	target.statusLock.Unlock()
+	if restarted {
+		label, _ := seriesLimiter.Label(target.ID())
+		syncLoopRestarts.WithLabelValues(label).Inc()
+	}
+}
+
+func (target *SyncTarget) recordDelivery() {
+	target.statusLock.Lock()
+	target.lastDeliveryAt = time.Now().UnixNano() / int64(time.Millisecond)
+	target.statusLock.Unlock()
+}
+
+// updateLagMetrics sets the time since the last successful sync and delivery of each running target.
+// Both are counted from the start of the sync loop if it hasn't synced or delivered anything yet.
+func updateLagMetrics() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, target := range registry.Snapshot() {
+		label, ok := seriesLimiter.Label(target.ID())
+		if !ok {
+			continue
+		} else if !target.isRunning() {
+			targetSyncLag.DeleteLabelValues(label)
+			targetDeliveryLag.DeleteLabelValues(label)
+			continue
+		}
+		target.statusLock.RLock()
+		lastSync, lastDelivery, loopStart := target.lastSyncAt, target.lastDeliveryAt, target.loopStartedAt
+		target.statusLock.RUnlock()
+		if lastSync < loopStart {
+			lastSync = loopStart
+		}
+		if lastDelivery < loopStart {
+			lastDelivery = loopStart
+		}
+		targetSyncLag.WithLabelValues(label).Set(float64(now-lastSync) / 1000)
+		targetDeliveryLag.WithLabelValues(label).Set(float64(now-lastDelivery) / 1000)
+	}
+}
+
+func (target *SyncTarget) recordSyncRetry(err error, retryIn time.Duration) {
+	target.statusLock.Lock()
+	attempts := 1
+	if target.syncRetry != nil {
+		attempts = target.syncRetry.Attempts + 1
+	}
+	retry := &SyncRetryState{
+		Attempts:    attempts,
+		NextRetryAt: time.Now().Add(retryIn).UnixNano() / int64(time.Millisecond),
+		Error:       err.Error(),
+		IntervalMS:  retryIn.Milliseconds(),
+	}
+	target.syncRetry = retry
+	if target.syncFailingSince.IsZero() {
+		target.syncFailingSince = time.Now()
+	}
+	failingSince := target.syncFailingSince
+	target.statusLock.Unlock()
+	target.storeSyncRetry(retry)
+	target.checkFailing(WebhookFailureSync, failingSince, err)
+}
+
+func (target *SyncTarget) Status() *TargetStatus {
+	latency := target.LatencySummaries()
+	var lastError *TargetError
+	if recentErrors := target.recentErrors.List(); len(recentErrors) > 0 {
+		lastError = &recentErrors[0]
+	}
+	stale := target.isStale(time.Now())
+	target.statusLock.RLock()
+	defer target.statusLock.RUnlock()
+	return &TargetStatus{
+		AppserviceID: target.AppserviceID,
+		DeviceKey:    target.DeviceKey,
+		Profile:      target.Profile,
+		UserID:       target.UserID,
+		DeviceID:     target.DeviceID,
+		Active:       target.Active,
+		Running:      target.isRunning(),
+		LastStop:     target.lastStop,
+		Checkpoint:   target.checkpoint,
+
+		WaitingForCredentials: !target.isRunning() && target.lastStop != nil && target.lastStop.Reason == StopReasonSoftLogout,
+
+		Labels: target.Labels,
+
+		SuspendedUntil: target.SuspendedUntil,
+		Paused:         target.Paused,
+		Reachability:   target.reachability,
+		BufferedBytes:  target.bufferedBytes,
+		CatchUp:        target.catchUp.copy(),
+
+		NextBatch:      target.NextBatch,
+		RegisteredAt:   target.registeredAt,
+		FirstSyncedAt:  target.firstSyncedAt,
+		Stale:          stale,
+		LastSyncAt:     target.lastSyncAt,
+		LastDeliveryAt: target.lastDeliveryAt,
+		Retry:          target.syncRetry,
+		LastError:      lastError,
+
+		EventTypes: target.eventTypes.Snapshot(),
+
+		Latency: latency,
+	}
+}
+
+func getTargetStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, ok := checkTargetAuth(w, r, storageAppserviceID(requestProfile(r).Name, vars["appserviceID"]), vars["deviceID"]); !ok {
+		return
+	}
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	}
+	status := target.Status()
+	var err error
+	status.RecentTransactions, err = target.SummarizeRecentTransactions()
+	if err != nil {
+		target.log.Warnln("Failed to summarize recent transactions for status request:", err)
+	}
+	status.FiltersCreated, err = store.CountFilters(r.Context(), target.UserID)
+	if err != nil {
+		target.log.Warnln("Failed to count sync filters for status request:", err)
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,749 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Store is the persistent state of the proxy: targets, their sync tokens, pending transaction queues,
+// transaction history and the other per-target data (checkpoints, dead letters, persisted errors and leases).
+// Targets are identified by their storage ID (see SyncTarget.storageID) and device key. Operations should stop
+// when their context is canceled, and the SQL store also limits every query with the configured query timeout.
+//
+// Proxy-wide data that isn't tied to a target (the sync filter cache, management and registration tokens and
+// the transaction ID clock) is stored directly in the database.
+//
+// A custom implementation can be set in Proxy.Store. Target state that isn't exported (e.g. the transaction
+// sequence) is only restored by the built-in stores, so custom stores should wrap NewSQLStore or NewMemoryStore.
+type Store interface {
+	// GetTarget returns the target with the given ID, or nil if it doesn't exist.
+	GetTarget(ctx context.Context, appserviceID, deviceKey string) (*SyncTarget, error)
+	// GetTargets returns all targets, or only ones that need to be started on startup if onlyStartable is set.
+	GetTargets(ctx context.Context, onlyStartable bool) ([]*SyncTarget, error)
+	// UpsertTarget inserts the target, or updates its configuration and tokens if it already exists.
+	// The active flag and sync token of existing targets are only changed by their dedicated setters.
+	UpsertTarget(ctx context.Context, target *SyncTarget) error
+	SetTargetActive(ctx context.Context, appserviceID, deviceKey string, active bool) error
+	SetTargetPaused(ctx context.Context, appserviceID, deviceKey string, paused bool) error
+	SetTargetNextBatch(ctx context.Context, appserviceID, deviceKey, nextBatch string) error
+	SetTargetTxnSequence(ctx context.Context, appserviceID, deviceKey string, sequence uint64) error
+	SetTargetSlidingSyncPosition(ctx context.Context, appserviceID, deviceKey string, position SlidingSyncPosition) error
+	SetTargetFirstSyncedAt(ctx context.Context, appserviceID, deviceKey string, firstSyncedAt int64) error
+	SetTargetLastStop(ctx context.Context, appserviceID, deviceKey string, lastStop *LastStop) error
+	// SetTargetSyncRetry stores the backoff state of failing syncs. nil clears it.
+	SetTargetSyncRetry(ctx context.Context, appserviceID, deviceKey string, retry *SyncRetryState) error
+	// SetTargetCredentials replaces both tokens of the target in a single write.
+	SetTargetCredentials(ctx context.Context, appserviceID, deviceKey, botAccessToken, hsToken string) error
+	// DeleteTarget deletes the target along with its pending queue, transaction history and auxiliary data.
+	DeleteTarget(ctx context.Context, appserviceID, deviceKey string) error
+
+	// QueueTransaction adds a transaction to the pending queue of the target. Already queued IDs are ignored.
+	QueueTransaction(ctx context.Context, appserviceID, deviceKey string, txn QueuedTransaction) error
+	DeleteQueuedTransaction(ctx context.Context, txnID string) error
+	// GetQueuedTransactions returns queued transactions after the cursor, ordered by creation time and ID.
+	// If maxBytes is set, transactions are returned until their total size reaches it, but at least one is always returned.
+	GetQueuedTransactions(ctx context.Context, appserviceID, deviceKey string, after PendingCursor, maxBytes int64) ([]QueuedTransaction, error)
+
+	InsertHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error
+	// UpdateHistoryEntry stores the status, attempt count, sent timestamp and recipient statuses of the entry.
+	UpdateHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error
+	// GetHistoryEntry returns the history entry of the transaction, or nil if it doesn't exist.
+	GetHistoryEntry(ctx context.Context, appserviceID, txnID string) (*TransactionHistoryEntry, error)
+	// GetRecentHistory returns the latest history entries of the target, newest first.
+	GetRecentHistory(ctx context.Context, appserviceID, deviceKey string, limit int) ([]*TransactionHistoryEntry, error)
+	// QueryHistory returns the history entries of the target that match the query, newest first.
+	QueryHistory(ctx context.Context, appserviceID, deviceKey string, query HistoryQuery) ([]*TransactionHistoryEntry, error)
+	// PruneHistory deletes history entries created before the given timestamp and returns the number of deleted entries.
+	PruneHistory(ctx context.Context, before int64) (int64, error)
+	// PruneCheckpointedHistory deletes history entries created before the given timestamp that are also at or before
+	// the checkpoint of their target, and returns the number of deleted entries.
+	PruneCheckpointedHistory(ctx context.Context, before int64) (int64, error)
+
+	// SetTargetSuspendedUntil stores when syncing of a suspended target is resumed. Zero clears the suspension.
+	SetTargetSuspendedUntil(ctx context.Context, appserviceID, deviceKey string, until int64) error
+	// SetTargetCheckpoint stores the last transaction that the target has confirmed, deletes the pending transactions
+	// created at or before it and returns the number of deleted transactions.
+	SetTargetCheckpoint(ctx context.Context, appserviceID, deviceKey string, checkpoint *Checkpoint) (int64, error)
+
+	// InsertDeadLetter stores a transaction that won't be delivered anymore. Already stored IDs are ignored.
+	InsertDeadLetter(ctx context.Context, appserviceID, deviceKey string, letter StoredDeadLetter) error
+	// GetDeadLetters returns the dead letters of the target created before the given timestamp, newest first.
+	// Zero values for before and limit disable the respective filter.
+	GetDeadLetters(ctx context.Context, appserviceID, deviceKey string, before int64, limit int) ([]StoredDeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, txnID string) error
+
+	// InsertTargetError stores an error of the target and deletes all but the newest keep errors of the target.
+	InsertTargetError(ctx context.Context, appserviceID, deviceKey string, entry TargetError, keep int) error
+	// GetTargetErrors returns the newest stored errors of the target, newest first.
+	GetTargetErrors(ctx context.Context, appserviceID, deviceKey string, limit int) ([]TargetError, error)
+
+	// AcquireLease takes or renews the lease of the target for the holder. A lease of another holder is only taken
+	// over if it expires before takeOverBefore. Returns whether the holder has the lease now.
+	AcquireLease(ctx context.Context, appserviceID, deviceKey, holder string, expiresAt, takeOverBefore int64) (bool, error)
+	// ReleaseLease deletes the lease of the target if it's held by the holder.
+	ReleaseLease(ctx context.Context, appserviceID, deviceKey, holder string) error
+
+	// EncryptStoredTokens encrypts tokens that were stored before TOKEN_ENCRYPTION_KEY was set and returns the
+	// number of targets whose tokens were encrypted. Stores that don't keep tokens at rest can do nothing.
+	EncryptStoredTokens(ctx context.Context) (int, error)
+
+	// SetManagementToken stores the hash of the management token of the appservice, replacing the previous token.
+	SetManagementToken(ctx context.Context, appserviceID, tokenHash string, createdAt int64) error
+	DeleteManagementToken(ctx context.Context, appserviceID string) error
+	// CheckManagementToken returns whether the hash is of the current management token of the appservice.
+	CheckManagementToken(ctx context.Context, appserviceID, tokenHash string) (bool, error)
+
+	// InsertRegistrationToken stores a registration token and deletes the tokens that expired before it was created.
+	InsertRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, createdAt, expiresAt int64) error
+	// CheckRegistrationToken returns whether the hash is of a registration token that allows registering the target
+	// and hasn't expired at now. Tokens with an empty device key are valid for all devices of the appservice.
+	CheckRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, now int64) (bool, error)
+	// ConsumeRegistrationToken deletes the registration token. It returns false if the token didn't exist anymore.
+	ConsumeRegistrationToken(ctx context.Context, tokenHash string) (bool, error)
+
+	// GetFilterID returns the ID of the filter with the given hash that was uploaded for the account,
+	// or an empty string if there isn't one.
+	GetFilterID(ctx context.Context, userID id.UserID, filterHash string) (string, error)
+	SetFilterID(ctx context.Context, userID id.UserID, filterHash, filterID string, createdAt int64) error
+	DeleteFilterID(ctx context.Context, userID id.UserID, filterHash string) error
+	CountFilters(ctx context.Context, userID id.UserID) (int, error)
+	// CountOrphanedFilters returns the number of stored filters whose account doesn't have any targets.
+	CountOrphanedFilters(ctx context.Context) (int, error)
+
+	// GetTxnIDClockReservation returns the highest transaction ID timestamp that was reserved, or zero.
+	GetTxnIDClockReservation(ctx context.Context) (int64, error)
+	SetTxnIDClockReservation(ctx context.Context, reservedUntil int64) error
+}
+
+// QueuedTransaction is a serialized transaction in the pending queue.
+type QueuedTransaction struct {
+	TxnID     string
+	Sequence  uint64
+	Data      []byte
+	CreatedAt int64
+}
+
+// StoredDeadLetter is a transaction that was moved to the dead letters instead of being delivered.
+type StoredDeadLetter struct {
+	TxnID  string
+	Reason string
+	// Data is the serialized transaction, or nil if only the metadata was stored.
+	Data []byte
+	// CreatedAt is when the transaction was dead-lettered, TxnCreatedAt is when it was created from a /sync response.
+	CreatedAt    int64
+	TxnCreatedAt int64
+	Sequence     uint64
+}
+
+var store Store
+
+type sqlStore struct {
+	db *Database
+}
+
+func NewSQLStore(db *Database) Store {
+	return &sqlStore{db: db}
+}
+
+const targetColumns = "appservice_id, device_key, bot_access_token, hs_token, address, is_proxy, template, dry_run, at_most_once, quiet_hours, labels, recipients, synchronous_policy, max_buffered_bytes, delivery_options, filter, forward_presence, drop_device_list_left, otk_count_threshold, otk_count_delta, device_list_dedup_minutes, masquerade_device, full_sync, sync_backend, homeserver_url, retry_policy, user_id, device_id, next_batch, active, suspended_until, paused, checkpoint_txn_id, checkpoint_at, txn_sequence, sliding_sync_pos, sliding_to_device_since, registered_at, first_synced_at, last_stop_reason, last_stop_error, last_stop_at, sync_retry_attempts, sync_retry_interval, sync_retry_at, sync_retry_error"
+
+type scannable interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTarget(row scannable) (*SyncTarget, error) {
+	var target SyncTarget
+	var checkpoint Checkpoint
+	var lastStop LastStop
+	var syncRetry SyncRetryState
+	var quietHours, labels, recipients, deliveryOptions, retryPolicy, filter string
+	err := row.Scan(&target.AppserviceID, &target.DeviceKey, &target.BotAccessToken, &target.HSToken, &target.Address, &target.IsProxy, &target.Template, &target.DryRun, &target.AtMostOnce, &quietHours, &labels, &recipients, &target.SynchronousPolicy, &target.MaxBufferedBytes, &deliveryOptions, &filter, &target.ForwardPresence, &target.DropDeviceListLeft, &target.OTKCountThreshold, &target.OTKCountDelta, &target.DeviceListDedupMinutes, &target.MasqueradeDevice, &target.FullSync, &target.SyncBackend, &target.HomeserverURL, &retryPolicy, &target.UserID, &target.DeviceID, &target.NextBatch, &target.Active, &target.SuspendedUntil, &target.Paused, &checkpoint.TxnID, &checkpoint.CreatedAt, &target.txnSequence, &target.slidingSync.Pos, &target.slidingSync.ToDeviceSince, &target.registeredAt, &target.firstSyncedAt, &lastStop.Reason, &lastStop.Error, &lastStop.Timestamp, &syncRetry.Attempts, &syncRetry.IntervalMS, &syncRetry.NextRetryAt, &syncRetry.Error)
+	if err != nil {
+		return nil, err
+	} else if len(checkpoint.TxnID) > 0 {
+		target.checkpoint = &checkpoint
+	}
+	if target.BotAccessToken, err = decryptToken(target.BotAccessToken, target.AppserviceID, target.DeviceKey, tokenColumnBotAccessToken); err != nil {
+		return nil, fmt.Errorf("failed to read bot access token of %s: %w", target.AppserviceID, err)
+	} else if target.HSToken, err = decryptToken(target.HSToken, target.AppserviceID, target.DeviceKey, tokenColumnHSToken); err != nil {
+		return nil, fmt.Errorf("failed to read hs_token of %s: %w", target.AppserviceID, err)
+	}
+	if len(lastStop.Reason) > 0 {
+		target.lastStop = &lastStop
+	}
+	if syncRetry.Attempts > 0 {
+		target.syncRetry = &syncRetry
+	}
+	target.Profile, target.AppserviceID = splitStorageAppserviceID(target.AppserviceID)
+	if target.QuietHours, err = parseQuietHoursJSON(quietHours); err != nil {
+		log.Warnfln("Failed to parse quiet hours of %s, ignoring them: %v", target.ID(), err)
+	}
+	if target.Labels, err = parseLabelsJSON(labels); err != nil {
+		log.Warnfln("Failed to parse labels of %s, ignoring them: %v", target.ID(), err)
+	}
+	if target.Recipients, err = parseRecipientsJSON(recipients); err != nil {
+		log.Warnfln("Failed to parse additional recipients of %s, ignoring them: %v", target.ID(), err)
+	}
+	if target.Delivery, err = parseDeliveryOptionsJSON(deliveryOptions); err != nil {
+		log.Warnfln("Failed to parse delivery options of %s, ignoring them: %v", target.ID(), err)
+		target.Delivery = nil
+	}
+	if target.Retry, target.retryPolicy, err = parseRetryPolicyJSON(retryPolicy); err != nil {
+		log.Warnfln("Failed to parse retry policy of %s, ignoring it: %v", target.ID(), err)
+		target.Retry, target.retryPolicy = nil, RetryPolicy{}
+	}
+	if target.Filter, err = parseSyncFilterJSON(filter); err != nil {
+		log.Warnfln("Failed to parse sync filter of %s, using the default filter: %v", target.ID(), err)
+		target.Filter = nil
+	}
+	return &target, nil
+}
+
+func (ss *sqlStore) GetTarget(ctx context.Context, appserviceID, deviceKey string) (*SyncTarget, error) {
+	row := ss.db.QueryRowContext(ctx, "SELECT "+targetColumns+" FROM targets WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey)
+	target, err := scanTarget(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return target, err
+}
+
+func (ss *sqlStore) GetTargets(ctx context.Context, onlyStartable bool) ([]*SyncTarget, error) {
+	query := "SELECT " + targetColumns + " FROM targets"
+	if onlyStartable {
+		query += " WHERE active=true OR suspended_until>0"
+	}
+	rows, err := ss.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*SyncTarget
+	for rows.Next() {
+		target, err := scanTarget(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan target: %w", err)
+		}
+		result = append(result, target)
+	}
+	return result, rows.Err()
+}
+
+func (ss *sqlStore) UpsertTarget(ctx context.Context, target *SyncTarget) error {
+	botAccessToken, hsToken, err := encryptTokens(target.storageID(), target.DeviceKey, target.BotAccessToken, target.HSToken)
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.ExecContext(ctx, `
+		INSERT INTO targets (appservice_id, device_key, bot_access_token, hs_token, address, user_id, device_id, is_proxy, template, dry_run, at_most_once, quiet_hours, labels, recipients, synchronous_policy, max_buffered_bytes, next_batch, active, delivery_options, filter, forward_presence, full_sync, sync_backend, registered_at, homeserver_url, drop_device_list_left, retry_policy, otk_count_threshold, otk_count_delta, device_list_dedup_minutes, masquerade_device)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31)
+		ON CONFLICT (appservice_id, device_key) DO UPDATE
+		SET bot_access_token=$3, hs_token=$4, address=$5, user_id=$6, device_id=$7, is_proxy=$8, template=$9, dry_run=$10, at_most_once=$11, quiet_hours=$12, labels=$13, recipients=$14, synchronous_policy=$15, max_buffered_bytes=$16, delivery_options=$19, filter=$20, forward_presence=$21, full_sync=$22, sync_backend=$23, homeserver_url=$25, drop_device_list_left=$26, retry_policy=$27, otk_count_threshold=$28, otk_count_delta=$29, device_list_dedup_minutes=$30, masquerade_device=$31
+	`, target.storageID(), target.DeviceKey, botAccessToken, hsToken, target.Address, target.UserID, target.DeviceID, target.IsProxy, target.Template, target.DryRun, target.AtMostOnce, target.quietHoursJSON(), target.labelsJSON(), target.recipientsJSON(), target.SynchronousPolicy, target.MaxBufferedBytes, target.NextBatch, target.Active, target.deliveryOptionsJSON(), target.syncFilterJSON(), target.ForwardPresence, target.FullSync, target.SyncBackend, target.registeredAt, target.HomeserverURL, target.DropDeviceListLeft, target.retryPolicyJSON(), target.OTKCountThreshold, target.OTKCountDelta, target.DeviceListDedupMinutes, target.MasqueradeDevice)
+	return err
+}
+
+func (ss *sqlStore) SetTargetActive(ctx context.Context, appserviceID, deviceKey string, active bool) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET active=$3 WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey, active)
+	return err
+}
+
+func (ss *sqlStore) SetTargetPaused(ctx context.Context, appserviceID, deviceKey string, paused bool) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET paused=$3 WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey, paused)
+	return err
+}
+
+func (ss *sqlStore) SetTargetNextBatch(ctx context.Context, appserviceID, deviceKey, nextBatch string) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET next_batch=$3 WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey, nextBatch)
+	return err
+}
+
+func (ss *sqlStore) SetTargetTxnSequence(ctx context.Context, appserviceID, deviceKey string, sequence uint64) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET txn_sequence=$3 WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey, sequence)
+	return err
+}
+
+func (ss *sqlStore) SetTargetSlidingSyncPosition(ctx context.Context, appserviceID, deviceKey string, position SlidingSyncPosition) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET sliding_sync_pos=$3, sliding_to_device_since=$4 WHERE appservice_id=$1 AND device_key=$2",
+		appserviceID, deviceKey, position.Pos, position.ToDeviceSince)
+	return err
+}
+
+func (ss *sqlStore) SetTargetFirstSyncedAt(ctx context.Context, appserviceID, deviceKey string, firstSyncedAt int64) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET first_synced_at=$3 WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey, firstSyncedAt)
+	return err
+}
+
+func (ss *sqlStore) SetTargetLastStop(ctx context.Context, appserviceID, deviceKey string, lastStop *LastStop) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET last_stop_reason=$3, last_stop_error=$4, last_stop_at=$5 WHERE appservice_id=$1 AND device_key=$2",
+		appserviceID, deviceKey, lastStop.Reason, lastStop.Error, lastStop.Timestamp)
+	return err
+}
+
+func (ss *sqlStore) SetTargetSyncRetry(ctx context.Context, appserviceID, deviceKey string, retry *SyncRetryState) error {
+	if retry == nil {
+		retry = &SyncRetryState{}
+	}
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET sync_retry_attempts=$3, sync_retry_interval=$4, sync_retry_at=$5, sync_retry_error=$6 WHERE appservice_id=$1 AND device_key=$2",
+		appserviceID, deviceKey, retry.Attempts, retry.IntervalMS, retry.NextRetryAt, retry.Error)
+	return err
+}
+
+func (ss *sqlStore) SetTargetCredentials(ctx context.Context, appserviceID, deviceKey, botAccessToken, hsToken string) error {
+	botAccessToken, hsToken, err := encryptTokens(appserviceID, deviceKey, botAccessToken, hsToken)
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.ExecContext(ctx, "UPDATE targets SET bot_access_token=$3, hs_token=$4 WHERE appservice_id=$1 AND device_key=$2",
+		appserviceID, deviceKey, botAccessToken, hsToken)
+	return err
+}
+
+// targetDataTables are the tables that have per-target rows, deleted along with the target itself.
+var targetDataTables = []string{"pending_transactions", "transaction_history", "target_errors", "dead_letters", "target_leases", "targets"}
+
+func (ss *sqlStore) DeleteTarget(ctx context.Context, appserviceID, deviceKey string) error {
+	tx, err := ss.db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	for _, table := range targetDataTables {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE appservice_id=$1 AND device_key=$2", table), appserviceID, deviceKey)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (ss *sqlStore) QueueTransaction(ctx context.Context, appserviceID, deviceKey string, txn QueuedTransaction) error {
+	_, err := ss.db.ExecContext(ctx, `
+		INSERT INTO pending_transactions (txn_id, appservice_id, device_key, sequence, data, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (txn_id) DO NOTHING
+	`, txn.TxnID, appserviceID, deviceKey, txn.Sequence, string(txn.Data), txn.CreatedAt)
+	return err
+}
+
+func (ss *sqlStore) DeleteQueuedTransaction(ctx context.Context, txnID string) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM pending_transactions WHERE txn_id=$1", txnID)
+	return err
+}
+
+func (ss *sqlStore) GetQueuedTransactions(ctx context.Context, appserviceID, deviceKey string, after PendingCursor, maxBytes int64) ([]QueuedTransaction, error) {
+	rows, err := ss.db.QueryContext(ctx, `
+		SELECT txn_id, sequence, data, created_at FROM pending_transactions
+		WHERE appservice_id=$1 AND device_key=$2 AND (created_at>$3 OR (created_at=$3 AND txn_id>$4))
+		ORDER BY created_at, txn_id
+	`, appserviceID, deviceKey, after.CreatedAt, after.TxnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var queued []QueuedTransaction
+	var totalSize int64
+	for rows.Next() {
+		var txn QueuedTransaction
+		var data string
+		if err = rows.Scan(&txn.TxnID, &txn.Sequence, &data, &txn.CreatedAt); err != nil {
+			return nil, err
+		}
+		txn.Data = []byte(data)
+		queued = append(queued, txn)
+		totalSize += int64(len(data))
+		if maxBytes > 0 && totalSize >= maxBytes {
+			break
+		}
+	}
+	return queued, rows.Err()
+}
+
+func (ss *sqlStore) InsertHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error {
+	events, err := json.Marshal(entry.Events)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event list: %w", err)
+	}
+	_, err = ss.db.ExecContext(ctx, `
+		INSERT INTO transaction_history (txn_id, appservice_id, device_key, status, attempts, created_at, events, device_list_changed, device_list_left, otk_count)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (txn_id) DO NOTHING
+	`, entry.TxnID, entry.AppserviceID, entry.DeviceKey, entry.Status, entry.Attempts, entry.CreatedAt, string(events), entry.DeviceListChanged, entry.DeviceListLeft, entry.OTKCount)
+	return err
+}
+
+func (ss *sqlStore) UpdateHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error {
+	var sentAt sql.NullInt64
+	if entry.SentAt != 0 {
+		sentAt = sql.NullInt64{Int64: entry.SentAt, Valid: true}
+	}
+	var sentTo string
+	if len(entry.SentTo) > 0 {
+		data, _ := json.Marshal(entry.SentTo)
+		sentTo = string(data)
+	}
+	_, err := ss.db.ExecContext(ctx, "UPDATE transaction_history SET status=$2, attempts=$3, sent_at=$4, sent_to=$5 WHERE txn_id=$1", entry.TxnID, entry.Status, entry.Attempts, sentAt, sentTo)
+	return err
+}
+
+const historyColumns = "txn_id, appservice_id, device_key, status, attempts, created_at, sent_at, sent_to, events, device_list_changed, device_list_left, otk_count"
+
+func scanHistoryEntry(row scannable) (*TransactionHistoryEntry, error) {
+	var entry TransactionHistoryEntry
+	var sentAt sql.NullInt64
+	var events, sentTo string
+	err := row.Scan(&entry.TxnID, &entry.AppserviceID, &entry.DeviceKey, &entry.Status, &entry.Attempts, &entry.CreatedAt, &sentAt, &sentTo, &events, &entry.DeviceListChanged, &entry.DeviceListLeft, &entry.OTKCount)
+	if err != nil {
+		return nil, err
+	}
+	entry.SentAt = sentAt.Int64
+	if err = json.Unmarshal([]byte(events), &entry.Events); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event list: %w", err)
+	} else if len(sentTo) > 0 {
+		if err = json.Unmarshal([]byte(sentTo), &entry.SentTo); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal recipient statuses: %w", err)
+		}
+	}
+	return &entry, nil
+}
+
+func (ss *sqlStore) GetHistoryEntry(ctx context.Context, appserviceID, txnID string) (*TransactionHistoryEntry, error) {
+	row := ss.db.QueryRowContext(ctx, "SELECT "+historyColumns+" FROM transaction_history WHERE appservice_id=$1 AND txn_id=$2", appserviceID, txnID)
+	entry, err := scanHistoryEntry(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (ss *sqlStore) GetRecentHistory(ctx context.Context, appserviceID, deviceKey string, limit int) ([]*TransactionHistoryEntry, error) {
+	rows, err := ss.db.QueryContext(ctx, `
+		SELECT `+historyColumns+` FROM transaction_history WHERE appservice_id=$1 AND device_key=$2
+		ORDER BY created_at DESC LIMIT $3
+	`, appserviceID, deviceKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*TransactionHistoryEntry
+	for rows.Next() {
+		entry, err := scanHistoryEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (ss *sqlStore) QueryHistory(ctx context.Context, appserviceID, deviceKey string, query HistoryQuery) ([]*TransactionHistoryEntry, error) {
+	conditions := []string{"appservice_id=$1", "device_key=$2"}
+	args := []interface{}{appserviceID, deviceKey}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if len(query.Status) > 0 {
+		addCondition("status=$%d", query.Status)
+	}
+	if query.Since > 0 {
+		addCondition("created_at>=$%d", query.Since)
+	}
+	if query.Before > 0 {
+		addCondition("created_at<$%d", query.Before)
+	}
+	if pattern := query.eventPattern(); len(pattern) > 0 {
+		addCondition(`events LIKE $%d ESCAPE '\'`, pattern)
+	}
+	args = append(args, query.Limit)
+	rows, err := ss.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT "+historyColumns+" FROM transaction_history WHERE %s ORDER BY created_at DESC LIMIT $%d",
+		strings.Join(conditions, " AND "), len(args),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*TransactionHistoryEntry
+	for rows.Next() {
+		entry, err := scanHistoryEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (ss *sqlStore) PruneHistory(ctx context.Context, before int64) (int64, error) {
+	res, err := ss.db.ExecContext(ctx, "DELETE FROM transaction_history WHERE created_at<$1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (ss *sqlStore) PruneCheckpointedHistory(ctx context.Context, before int64) (int64, error) {
+	res, err := ss.db.ExecContext(ctx, `
+		DELETE FROM transaction_history
+		WHERE created_at<$1 AND created_at<=(
+			SELECT checkpoint_at FROM targets
+			WHERE targets.appservice_id=transaction_history.appservice_id AND targets.device_key=transaction_history.device_key
+		)
+	`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (ss *sqlStore) SetTargetSuspendedUntil(ctx context.Context, appserviceID, deviceKey string, until int64) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET suspended_until=$3 WHERE appservice_id=$1 AND device_key=$2", appserviceID, deviceKey, until)
+	return err
+}
+
+func (ss *sqlStore) SetTargetCheckpoint(ctx context.Context, appserviceID, deviceKey string, checkpoint *Checkpoint) (int64, error) {
+	_, err := ss.db.ExecContext(ctx, "UPDATE targets SET checkpoint_txn_id=$3, checkpoint_at=$4 WHERE appservice_id=$1 AND device_key=$2",
+		appserviceID, deviceKey, checkpoint.TxnID, checkpoint.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	res, err := ss.db.ExecContext(ctx, "DELETE FROM pending_transactions WHERE appservice_id=$1 AND device_key=$2 AND created_at<=$3",
+		appserviceID, deviceKey, checkpoint.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (ss *sqlStore) InsertDeadLetter(ctx context.Context, appserviceID, deviceKey string, letter StoredDeadLetter) error {
+	var data sql.NullString
+	if letter.Data != nil {
+		data = sql.NullString{String: string(letter.Data), Valid: true}
+	}
+	_, err := ss.db.ExecContext(ctx, `
+		INSERT INTO dead_letters (txn_id, appservice_id, device_key, reason, data, created_at, sequence, txn_created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (txn_id) DO NOTHING
+	`, letter.TxnID, appserviceID, deviceKey, letter.Reason, data, letter.CreatedAt, letter.Sequence, letter.TxnCreatedAt)
+	return err
+}
+
+func (ss *sqlStore) GetDeadLetters(ctx context.Context, appserviceID, deviceKey string, before int64, limit int) ([]StoredDeadLetter, error) {
+	conditions := []string{"appservice_id=$1", "device_key=$2"}
+	args := []interface{}{appserviceID, deviceKey}
+	if before > 0 {
+		args = append(args, before)
+		conditions = append(conditions, fmt.Sprintf("created_at<$%d", len(args)))
+	}
+	query := "SELECT txn_id, reason, data, created_at, sequence, txn_created_at FROM dead_letters WHERE " +
+		strings.Join(conditions, " AND ") + " ORDER BY created_at DESC"
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var letters []StoredDeadLetter
+	for rows.Next() {
+		var letter StoredDeadLetter
+		var data sql.NullString
+		err = rows.Scan(&letter.TxnID, &letter.Reason, &data, &letter.CreatedAt, &letter.Sequence, &letter.TxnCreatedAt)
+		if err != nil {
+			return nil, err
+		} else if data.Valid {
+			letter.Data = []byte(data.String)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (ss *sqlStore) DeleteDeadLetter(ctx context.Context, txnID string) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE txn_id=$1", txnID)
+	return err
+}
+
+func (ss *sqlStore) InsertTargetError(ctx context.Context, appserviceID, deviceKey string, entry TargetError, keep int) error {
+	_, err := ss.db.ExecContext(ctx, `
+		INSERT INTO target_errors (appservice_id, device_key, timestamp, source, category, message)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, appserviceID, deviceKey, entry.Timestamp, entry.Source, entry.Category, entry.Message)
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.ExecContext(ctx, `
+		DELETE FROM target_errors
+		WHERE appservice_id=$1 AND device_key=$2 AND timestamp < (
+			SELECT MIN(timestamp) FROM (
+				SELECT timestamp FROM target_errors
+				WHERE appservice_id=$1 AND device_key=$2
+				ORDER BY timestamp DESC LIMIT $3
+			) AS recent
+		)
+	`, appserviceID, deviceKey, keep)
+	return err
+}
+
+func (ss *sqlStore) GetTargetErrors(ctx context.Context, appserviceID, deviceKey string, limit int) ([]TargetError, error) {
+	rows, err := ss.db.QueryContext(ctx, `
+		SELECT timestamp, source, category, message FROM target_errors
+		WHERE appservice_id=$1 AND device_key=$2
+		ORDER BY timestamp DESC LIMIT $3
+	`, appserviceID, deviceKey, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	errs := []TargetError{}
+	for rows.Next() {
+		var entry TargetError
+		if err = rows.Scan(&entry.Timestamp, &entry.Source, &entry.Category, &entry.Message); err != nil {
+			return nil, err
+		}
+		errs = append(errs, entry)
+	}
+	return errs, rows.Err()
+}
+
+func (ss *sqlStore) AcquireLease(ctx context.Context, appserviceID, deviceKey, holder string, expiresAt, takeOverBefore int64) (bool, error) {
+	res, err := ss.db.ExecContext(ctx, `
+		INSERT INTO target_leases (appservice_id, device_key, holder, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (appservice_id, device_key) DO UPDATE SET holder=$3, expires_at=$4
+		WHERE target_leases.holder=$3 OR target_leases.expires_at<$5
+	`, appserviceID, deviceKey, holder, expiresAt, takeOverBefore)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (ss *sqlStore) ReleaseLease(ctx context.Context, appserviceID, deviceKey, holder string) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM target_leases WHERE appservice_id=$1 AND device_key=$2 AND holder=$3",
+		appserviceID, deviceKey, holder)
+	return err
+}
+
+func (ss *sqlStore) SetManagementToken(ctx context.Context, appserviceID, tokenHash string, createdAt int64) error {
+	_, err := ss.db.ExecContext(ctx, `
+		INSERT INTO management_tokens (appservice_id, token_hash, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (appservice_id) DO UPDATE SET token_hash=excluded.token_hash, created_at=excluded.created_at
+	`, appserviceID, tokenHash, createdAt)
+	return err
+}
+
+func (ss *sqlStore) DeleteManagementToken(ctx context.Context, appserviceID string) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM management_tokens WHERE appservice_id=$1", appserviceID)
+	return err
+}
+
+func (ss *sqlStore) CheckManagementToken(ctx context.Context, appserviceID, tokenHash string) (bool, error) {
+	var count int
+	err := ss.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM management_tokens WHERE token_hash=$1 AND appservice_id=$2",
+		tokenHash, appserviceID,
+	).Scan(&count)
+	return count > 0, err
+}
+
+func (ss *sqlStore) InsertRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, createdAt, expiresAt int64) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM registration_tokens WHERE expires_at<$1", createdAt)
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.ExecContext(ctx,
+		"INSERT INTO registration_tokens (token_hash, appservice_id, device_key, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		tokenHash, appserviceID, deviceKey, createdAt, expiresAt)
+	return err
+}
+
+func (ss *sqlStore) CheckRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, now int64) (bool, error) {
+	var count int
+	err := ss.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM registration_tokens WHERE token_hash=$1 AND appservice_id=$2 AND (device_key='' OR device_key=$3) AND expires_at>=$4",
+		tokenHash, appserviceID, deviceKey, now,
+	).Scan(&count)
+	return count > 0, err
+}
+
+func (ss *sqlStore) ConsumeRegistrationToken(ctx context.Context, tokenHash string) (bool, error) {
+	res, err := ss.db.ExecContext(ctx, "DELETE FROM registration_tokens WHERE token_hash=$1", tokenHash)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0, nil
+}
+
+func (ss *sqlStore) GetFilterID(ctx context.Context, userID id.UserID, filterHash string) (string, error) {
+	var filterID string
+	err := ss.db.QueryRowContext(ctx, "SELECT filter_id FROM sync_filters WHERE user_id=$1 AND filter_hash=$2", userID, filterHash).Scan(&filterID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return filterID, err
+}
+
+func (ss *sqlStore) SetFilterID(ctx context.Context, userID id.UserID, filterHash, filterID string, createdAt int64) error {
+	_, err := ss.db.ExecContext(ctx, `
+		INSERT INTO sync_filters (user_id, filter_hash, filter_id, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, filter_hash) DO UPDATE SET filter_id=excluded.filter_id, created_at=excluded.created_at
+	`, userID, filterHash, filterID, createdAt)
+	return err
+}
+
+func (ss *sqlStore) DeleteFilterID(ctx context.Context, userID id.UserID, filterHash string) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM sync_filters WHERE user_id=$1 AND filter_hash=$2", userID, filterHash)
+	return err
+}
+
+func (ss *sqlStore) CountFilters(ctx context.Context, userID id.UserID) (count int, err error) {
+	err = ss.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sync_filters WHERE user_id=$1", userID).Scan(&count)
+	return
+}
+
+func (ss *sqlStore) CountOrphanedFilters(ctx context.Context) (count int, err error) {
+	err = ss.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sync_filters WHERE user_id NOT IN (SELECT user_id FROM targets)").Scan(&count)
+	return
+}
+
+func (ss *sqlStore) GetTxnIDClockReservation(ctx context.Context) (int64, error) {
+	var reserved int64
+	err := ss.db.QueryRowContext(ctx, "SELECT reserved_until FROM txn_id_clock").Scan(&reserved)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return reserved, err
+}
+
+func (ss *sqlStore) SetTxnIDClockReservation(ctx context.Context, reservedUntil int64) error {
+	_, err := ss.db.ExecContext(ctx, "UPDATE txn_id_clock SET reserved_until=$1", reservedUntil)
+	return err
+}
@@ -0,0 +1,526 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testStores are the Store implementations that storeTests are run against.
+var testStores = []struct {
+	name string
+	new  func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+	{"sqlite-memory", newMemorySQLiteTestStore},
+}
+
+// newMemorySQLiteTestStore returns an SQL store backed by memory://, which only has a single connection,
+// so a query made while the rows of another query are open deadlocks. The query timeout turns that into
+// a test failure instead of a hang.
+func newMemorySQLiteTestStore(t *testing.T) Store {
+	testDB, err := Connect("memory://", DatabaseOpts{QueryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() {
+		_ = testDB.conn.Close()
+	})
+	if err = testDB.Upgrade(false); err != nil {
+		t.Fatal("Failed to upgrade database:", err)
+	}
+	return NewSQLStore(testDB)
+}
+
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, st Store)
+}{
+	{"Targets", testStoreTargets},
+	{"Queue", testStoreQueue},
+	{"History", testStoreHistory},
+	{"Checkpoint", testStoreCheckpoint},
+	{"DeadLetters", testStoreDeadLetters},
+	{"Errors", testStoreErrors},
+	{"Leases", testStoreLeases},
+	{"DeleteTarget", testStoreDeleteTarget},
+	{"ManagementTokens", testStoreManagementTokens},
+	{"RegistrationTokens", testStoreRegistrationTokens},
+	{"Filters", testStoreFilters},
+	{"TxnIDClock", testStoreTxnIDClock},
+}
+
+func TestStore(t *testing.T) {
+	for _, impl := range testStores {
+		impl := impl
+		t.Run(impl.name, func(t *testing.T) {
+			for _, tc := range storeTests {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					tc.test(t, impl.new(t))
+				})
+			}
+		})
+	}
+}
+
+func TestSQLStoreCanceledContext(t *testing.T) {
+	st := newMemorySQLiteTestStore(t)
+	upsertTestTarget(t, st, "as", "dev")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := st.SetTargetNextBatch(ctx, "as", "dev", "batch1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected write with canceled context to fail with context.Canceled, got %v", err)
+	}
+	target, err := st.GetTarget(context.Background(), "as", "dev")
+	mustStore(t, err)
+	if target.NextBatch != "" {
+		t.Errorf("Write with canceled context was stored: next_batch=%q", target.NextBatch)
+	}
+}
+
+func mustStore(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal("Store returned an error:", err)
+	}
+}
+
+func upsertTestTarget(t *testing.T, st Store, appserviceID, deviceKey string) {
+	ctx := context.Background()
+	t.Helper()
+	mustStore(t, st.UpsertTarget(ctx, &SyncTarget{
+		AppserviceID:   appserviceID,
+		DeviceKey:      deviceKey,
+		BotAccessToken: "bot_token",
+		HSToken:        "hs_token",
+		Address:        "http://localhost:29317",
+		UserID:         "@bot:example.com",
+		DeviceID:       "DEVICE",
+	}))
+}
+
+func testStoreTargets(t *testing.T, st Store) {
+	ctx := context.Background()
+	target, err := st.GetTarget(ctx, "as", "dev")
+	mustStore(t, err)
+	if target != nil {
+		t.Fatal("Expected nil for a target that doesn't exist")
+	}
+	upsertTestTarget(t, st, "as", "dev")
+	upsertTestTarget(t, st, "as2", "dev")
+	mustStore(t, st.SetTargetActive(ctx, "as", "dev", true))
+	mustStore(t, st.SetTargetNextBatch(ctx, "as", "dev", "batch1"))
+	mustStore(t, st.SetTargetCredentials(ctx, "as", "dev", "new_bot_token", "new_hs_token"))
+	// Upserting an existing target must not reset the sync state.
+	upsertTestTarget(t, st, "as", "dev")
+	mustStore(t, st.SetTargetCredentials(ctx, "as", "dev", "new_bot_token", "new_hs_token"))
+
+	target, err = st.GetTarget(ctx, "as", "dev")
+	mustStore(t, err)
+	if target == nil {
+		t.Fatal("Target wasn't found after upserting it")
+	} else if target.NextBatch != "batch1" || !target.Active {
+		t.Errorf("Sync state wasn't kept: next_batch=%q active=%t", target.NextBatch, target.Active)
+	} else if target.BotAccessToken != "new_bot_token" || target.HSToken != "new_hs_token" {
+		t.Errorf("Credentials weren't updated: %q %q", target.BotAccessToken, target.HSToken)
+	}
+
+	startable, err := st.GetTargets(ctx, true)
+	mustStore(t, err)
+	if len(startable) != 1 || startable[0].AppserviceID != "as" {
+		t.Errorf("Expected only the active target to be startable, got %d targets", len(startable))
+	}
+	mustStore(t, st.SetTargetSuspendedUntil(ctx, "as2", "dev", 12345))
+	startable, err = st.GetTargets(ctx, true)
+	mustStore(t, err)
+	if len(startable) != 2 {
+		t.Errorf("Expected suspended target to be startable, got %d targets", len(startable))
+	}
+	all, err := st.GetTargets(ctx, false)
+	mustStore(t, err)
+	if len(all) != 2 {
+		t.Errorf("Expected 2 targets, got %d", len(all))
+	}
+}
+
+func testStoreQueue(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	for _, txn := range []QueuedTransaction{
+		{TxnID: "txn2", Sequence: 2, Data: []byte(`{"n":2}`), CreatedAt: 200},
+		{TxnID: "txn1", Sequence: 1, Data: []byte(`{"n":1}`), CreatedAt: 100},
+		{TxnID: "txn3", Sequence: 3, Data: []byte(`{"n":3}`), CreatedAt: 300},
+	} {
+		mustStore(t, st.QueueTransaction(ctx, "as", "dev", txn))
+	}
+	// Queueing the same ID twice is ignored.
+	mustStore(t, st.QueueTransaction(ctx, "as", "dev", QueuedTransaction{TxnID: "txn1", Data: []byte(`{}`), CreatedAt: 999}))
+
+	queued, err := st.GetQueuedTransactions(ctx, "as", "dev", PendingCursor{}, 0)
+	mustStore(t, err)
+	if len(queued) != 3 || queued[0].TxnID != "txn1" || queued[1].TxnID != "txn2" || queued[2].TxnID != "txn3" {
+		t.Fatalf("Expected queue to be sorted by creation time, got %+v", queued)
+	} else if string(queued[0].Data) != `{"n":1}` {
+		t.Errorf("Duplicate transaction replaced the original data: %s", queued[0].Data)
+	}
+	queued, err = st.GetQueuedTransactions(ctx, "as", "dev", PendingCursor{CreatedAt: 100, TxnID: "txn1"}, 0)
+	mustStore(t, err)
+	if len(queued) != 2 || queued[0].TxnID != "txn2" {
+		t.Errorf("Expected cursor to skip the first transaction, got %+v", queued)
+	}
+	queued, err = st.GetQueuedTransactions(ctx, "as", "dev", PendingCursor{}, 1)
+	mustStore(t, err)
+	if len(queued) != 1 {
+		t.Errorf("Expected byte limit to return one transaction, got %d", len(queued))
+	}
+
+	mustStore(t, st.DeleteQueuedTransaction(ctx, "txn2"))
+	queued, err = st.GetQueuedTransactions(ctx, "as", "dev", PendingCursor{}, 0)
+	mustStore(t, err)
+	if len(queued) != 2 || queued[1].TxnID != "txn3" {
+		t.Errorf("Expected deleted transaction to be removed from the queue, got %+v", queued)
+	}
+}
+
+func testStoreHistory(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	for i, txnID := range []string{"txn1", "txn2", "txn3"} {
+		mustStore(t, st.InsertHistoryEntry(ctx, &TransactionHistoryEntry{
+			TxnID:        txnID,
+			AppserviceID: "as",
+			DeviceKey:    "dev",
+			Status:       TransactionStatusPending,
+			CreatedAt:    int64(i+1) * 100,
+			Events:       []HistoryEvent{},
+		}))
+	}
+	mustStore(t, st.UpdateHistoryEntry(ctx, &TransactionHistoryEntry{
+		TxnID:        "txn1",
+		AppserviceID: "as",
+		DeviceKey:    "dev",
+		Status:       TransactionStatusSent,
+		Attempts:     2,
+		SentAt:       150,
+		Events:       []HistoryEvent{},
+	}))
+
+	entry, err := st.GetHistoryEntry(ctx, "as", "txn1")
+	mustStore(t, err)
+	if entry == nil || entry.Status != TransactionStatusSent || entry.Attempts != 2 || entry.CreatedAt != 100 {
+		t.Errorf("History entry wasn't updated correctly: %+v", entry)
+	}
+	entry, err = st.GetHistoryEntry(ctx, "other", "txn1")
+	mustStore(t, err)
+	if entry != nil {
+		t.Error("History entry of another appservice was returned")
+	}
+
+	recent, err := st.GetRecentHistory(ctx, "as", "dev", 2)
+	mustStore(t, err)
+	if len(recent) != 2 || recent[0].TxnID != "txn3" || recent[1].TxnID != "txn2" {
+		t.Errorf("Expected the two newest entries, got %+v", recent)
+	}
+
+	pruned, err := st.PruneHistory(ctx, 250)
+	mustStore(t, err)
+	if pruned != 2 {
+		t.Errorf("Expected 2 pruned entries, got %d", pruned)
+	}
+	recent, err = st.GetRecentHistory(ctx, "as", "dev", 10)
+	mustStore(t, err)
+	if len(recent) != 1 || recent[0].TxnID != "txn3" {
+		t.Errorf("Expected only the newest entry to be left, got %+v", recent)
+	}
+}
+
+func testStoreCheckpoint(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	for i, txnID := range []string{"txn1", "txn2", "txn3"} {
+		createdAt := int64(i+1) * 100
+		mustStore(t, st.QueueTransaction(ctx, "as", "dev", QueuedTransaction{TxnID: txnID, Data: []byte(`{}`), CreatedAt: createdAt}))
+		mustStore(t, st.InsertHistoryEntry(ctx, &TransactionHistoryEntry{
+			TxnID:        txnID,
+			AppserviceID: "as",
+			DeviceKey:    "dev",
+			Status:       TransactionStatusSent,
+			CreatedAt:    createdAt,
+			Events:       []HistoryEvent{},
+		}))
+	}
+
+	deleted, err := st.SetTargetCheckpoint(ctx, "as", "dev", &Checkpoint{TxnID: "txn2", CreatedAt: 200})
+	mustStore(t, err)
+	if deleted != 2 {
+		t.Errorf("Expected checkpoint to delete 2 pending transactions, got %d", deleted)
+	}
+	target, err := st.GetTarget(ctx, "as", "dev")
+	mustStore(t, err)
+	if target.checkpoint == nil || target.checkpoint.TxnID != "txn2" {
+		t.Errorf("Checkpoint wasn't stored: %+v", target.checkpoint)
+	}
+
+	pruned, err := st.PruneCheckpointedHistory(ctx, 1000)
+	mustStore(t, err)
+	if pruned != 2 {
+		t.Errorf("Expected 2 checkpointed history entries to be pruned, got %d", pruned)
+	}
+	entry, err := st.GetHistoryEntry(ctx, "as", "txn3")
+	mustStore(t, err)
+	if entry == nil {
+		t.Error("History entry after the checkpoint was pruned")
+	}
+}
+
+func testStoreDeadLetters(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	mustStore(t, st.InsertDeadLetter(ctx, "as", "dev", StoredDeadLetter{TxnID: "txn1", Reason: "failed", Data: []byte(`{}`), CreatedAt: 100, TxnCreatedAt: 50, Sequence: 1}))
+	mustStore(t, st.InsertDeadLetter(ctx, "as", "dev", StoredDeadLetter{TxnID: "txn2", Reason: "dropped", CreatedAt: 200}))
+	mustStore(t, st.InsertDeadLetter(ctx, "as", "dev", StoredDeadLetter{TxnID: "txn1", Reason: "duplicate", CreatedAt: 300}))
+
+	letters, err := st.GetDeadLetters(ctx, "as", "dev", 0, 0)
+	mustStore(t, err)
+	if len(letters) != 2 || letters[0].TxnID != "txn2" || letters[1].TxnID != "txn1" {
+		t.Fatalf("Expected two dead letters, newest first, got %+v", letters)
+	} else if letters[0].Data != nil {
+		t.Error("Dead letter without data returned data")
+	} else if letters[1].Reason != "failed" || string(letters[1].Data) != `{}` || letters[1].TxnCreatedAt != 50 || letters[1].Sequence != 1 {
+		t.Errorf("Dead letter wasn't stored correctly: %+v", letters[1])
+	}
+	letters, err = st.GetDeadLetters(ctx, "as", "dev", 200, 0)
+	mustStore(t, err)
+	if len(letters) != 1 || letters[0].TxnID != "txn1" {
+		t.Errorf("Expected before filter to return only the older dead letter, got %+v", letters)
+	}
+	letters, err = st.GetDeadLetters(ctx, "as", "dev", 0, 1)
+	mustStore(t, err)
+	if len(letters) != 1 || letters[0].TxnID != "txn2" {
+		t.Errorf("Expected limit to return only the newest dead letter, got %+v", letters)
+	}
+
+	mustStore(t, st.DeleteDeadLetter(ctx, "txn2"))
+	letters, err = st.GetDeadLetters(ctx, "as", "dev", 0, 0)
+	mustStore(t, err)
+	if len(letters) != 1 {
+		t.Errorf("Expected deleted dead letter to be removed, got %+v", letters)
+	}
+}
+
+func testStoreErrors(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	for i := int64(1); i <= 5; i++ {
+		mustStore(t, st.InsertTargetError(ctx, "as", "dev", TargetError{Timestamp: i, Source: ErrorSourceSync, Category: "test", Message: "error"}, 3))
+	}
+	errs, err := st.GetTargetErrors(ctx, "as", "dev", 10)
+	mustStore(t, err)
+	if len(errs) != 3 || errs[0].Timestamp != 5 || errs[2].Timestamp != 3 {
+		t.Errorf("Expected the newest 3 errors to be kept, got %+v", errs)
+	}
+	errs, err = st.GetTargetErrors(ctx, "as", "dev", 1)
+	mustStore(t, err)
+	if len(errs) != 1 || errs[0].Timestamp != 5 {
+		t.Errorf("Expected limit to return only the newest error, got %+v", errs)
+	}
+	errs, err = st.GetTargetErrors(ctx, "as", "other", 10)
+	mustStore(t, err)
+	if len(errs) != 0 {
+		t.Errorf("Expected no errors for another target, got %+v", errs)
+	}
+}
+
+func testStoreLeases(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	acquire := func(holder string, expiresAt, takeOverBefore int64, expected bool) {
+		t.Helper()
+		acquired, err := st.AcquireLease(ctx, "as", "dev", holder, expiresAt, takeOverBefore)
+		mustStore(t, err)
+		if acquired != expected {
+			t.Errorf("Expected lease acquisition by %s at %d to return %t", holder, takeOverBefore, expected)
+		}
+	}
+	acquire("a", 200, 100, true)
+	acquire("a", 300, 150, true)
+	acquire("b", 400, 200, false)
+	// The lease expires at 300, so it can be taken over after that.
+	acquire("b", 500, 301, true)
+	acquire("a", 600, 400, false)
+
+	// Releasing someone else's lease does nothing.
+	mustStore(t, st.ReleaseLease(ctx, "as", "dev", "a"))
+	acquire("a", 600, 400, false)
+	mustStore(t, st.ReleaseLease(ctx, "as", "dev", "b"))
+	acquire("a", 600, 400, true)
+}
+
+func testStoreManagementTokens(t *testing.T, st Store) {
+	ctx := context.Background()
+	check := func(appserviceID, tokenHash string, expected bool) {
+		t.Helper()
+		valid, err := st.CheckManagementToken(ctx, appserviceID, tokenHash)
+		mustStore(t, err)
+		if valid != expected {
+			t.Errorf("Expected management token %s of %s to be valid: %t", tokenHash, appserviceID, expected)
+		}
+	}
+	mustStore(t, st.SetManagementToken(ctx, "as", "hash1", 100))
+	check("as", "hash1", true)
+	check("other", "hash1", false)
+	mustStore(t, st.SetManagementToken(ctx, "as", "hash2", 200))
+	check("as", "hash1", false)
+	check("as", "hash2", true)
+	mustStore(t, st.DeleteManagementToken(ctx, "as"))
+	check("as", "hash2", false)
+}
+
+func testStoreRegistrationTokens(t *testing.T, st Store) {
+	ctx := context.Background()
+	check := func(tokenHash, deviceKey string, now int64, expected bool) {
+		t.Helper()
+		valid, err := st.CheckRegistrationToken(ctx, tokenHash, "as", deviceKey, now)
+		mustStore(t, err)
+		if valid != expected {
+			t.Errorf("Expected registration token %s for device %q at %d to be valid: %t", tokenHash, deviceKey, now, expected)
+		}
+	}
+	mustStore(t, st.InsertRegistrationToken(ctx, "any", "as", "", 100, 200))
+	mustStore(t, st.InsertRegistrationToken(ctx, "dev", "as", "dev", 100, 200))
+	check("any", "dev", 150, true)
+	check("any", "other", 150, true)
+	check("dev", "dev", 200, true)
+	check("dev", "other", 150, false)
+	check("dev", "dev", 201, false)
+	if valid, err := st.CheckRegistrationToken(ctx, "any", "other", "", 150); err != nil || valid {
+		t.Errorf("Registration token was valid for another appservice (error: %v)", err)
+	}
+
+	consumed, err := st.ConsumeRegistrationToken(ctx, "dev")
+	mustStore(t, err)
+	if !consumed {
+		t.Error("Registration token wasn't consumed")
+	}
+	consumed, err = st.ConsumeRegistrationToken(ctx, "dev")
+	mustStore(t, err)
+	if consumed {
+		t.Error("Registration token was consumed twice")
+	}
+
+	// Inserting a token deletes the expired ones.
+	mustStore(t, st.InsertRegistrationToken(ctx, "new", "as", "", 300, 400))
+	consumed, err = st.ConsumeRegistrationToken(ctx, "any")
+	mustStore(t, err)
+	if consumed {
+		t.Error("Expired registration token wasn't deleted")
+	}
+}
+
+func testStoreFilters(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	filterID, err := st.GetFilterID(ctx, "@bot:example.com", "hash")
+	mustStore(t, err)
+	if filterID != "" {
+		t.Errorf("Expected no filter ID before storing one, got %q", filterID)
+	}
+	mustStore(t, st.SetFilterID(ctx, "@bot:example.com", "hash", "1", 100))
+	mustStore(t, st.SetFilterID(ctx, "@bot:example.com", "hash", "2", 200))
+	mustStore(t, st.SetFilterID(ctx, "@bot:example.com", "hash2", "3", 200))
+	mustStore(t, st.SetFilterID(ctx, "@orphan:example.com", "hash", "4", 200))
+	filterID, err = st.GetFilterID(ctx, "@bot:example.com", "hash")
+	mustStore(t, err)
+	if filterID != "2" {
+		t.Errorf("Expected the filter ID to be replaced, got %q", filterID)
+	}
+	count, err := st.CountFilters(ctx, "@bot:example.com")
+	mustStore(t, err)
+	orphaned, err := st.CountOrphanedFilters(ctx)
+	mustStore(t, err)
+	if count != 2 || orphaned != 1 {
+		t.Errorf("Expected 2 filters and 1 orphaned filter, got %d and %d", count, orphaned)
+	}
+	mustStore(t, st.DeleteFilterID(ctx, "@bot:example.com", "hash"))
+	filterID, err = st.GetFilterID(ctx, "@bot:example.com", "hash")
+	mustStore(t, err)
+	if filterID != "" {
+		t.Errorf("Filter ID wasn't deleted, got %q", filterID)
+	}
+}
+
+func testStoreTxnIDClock(t *testing.T, st Store) {
+	ctx := context.Background()
+	reserved, err := st.GetTxnIDClockReservation(ctx)
+	mustStore(t, err)
+	if reserved != 0 {
+		t.Errorf("Expected no reservation in a new store, got %d", reserved)
+	}
+	mustStore(t, st.SetTxnIDClockReservation(ctx, 12345))
+	reserved, err = st.GetTxnIDClockReservation(ctx)
+	mustStore(t, err)
+	if reserved != 12345 {
+		t.Errorf("Expected the stored reservation to be returned, got %d", reserved)
+	}
+}
+
+func testStoreDeleteTarget(t *testing.T, st Store) {
+	ctx := context.Background()
+	upsertTestTarget(t, st, "as", "dev")
+	upsertTestTarget(t, st, "as", "dev2")
+	for _, deviceKey := range []string{"dev", "dev2"} {
+		mustStore(t, st.QueueTransaction(ctx, "as", deviceKey, QueuedTransaction{TxnID: "txn-" + deviceKey, Data: []byte(`{}`), CreatedAt: 100}))
+		mustStore(t, st.InsertHistoryEntry(ctx, &TransactionHistoryEntry{TxnID: "txn-" + deviceKey, AppserviceID: "as", DeviceKey: deviceKey, CreatedAt: 100, Events: []HistoryEvent{}}))
+		mustStore(t, st.InsertDeadLetter(ctx, "as", deviceKey, StoredDeadLetter{TxnID: "dead-" + deviceKey, Reason: "failed", CreatedAt: 100}))
+		mustStore(t, st.InsertTargetError(ctx, "as", deviceKey, TargetError{Timestamp: 100, Source: ErrorSourceSync, Message: "error"}, 10))
+		_, err := st.AcquireLease(ctx, "as", deviceKey, "a", 200, 100)
+		mustStore(t, err)
+	}
+
+	mustStore(t, st.DeleteTarget(ctx, "as", "dev"))
+	target, err := st.GetTarget(ctx, "as", "dev")
+	mustStore(t, err)
+	if target != nil {
+		t.Error("Target wasn't deleted")
+	}
+	queued, err := st.GetQueuedTransactions(ctx, "as", "dev", PendingCursor{}, 0)
+	mustStore(t, err)
+	entry, err := st.GetHistoryEntry(ctx, "as", "txn-dev")
+	mustStore(t, err)
+	letters, err := st.GetDeadLetters(ctx, "as", "dev", 0, 0)
+	mustStore(t, err)
+	errs, err := st.GetTargetErrors(ctx, "as", "dev", 10)
+	mustStore(t, err)
+	acquired, err := st.AcquireLease(ctx, "as", "dev", "b", 200, 100)
+	mustStore(t, err)
+	if len(queued) != 0 || entry != nil || len(letters) != 0 || len(errs) != 0 || !acquired {
+		t.Errorf("Target data wasn't deleted: queued=%d history=%t dead letters=%d errors=%d lease free=%t",
+			len(queued), entry != nil, len(letters), len(errs), acquired)
+	}
+
+	queued, err = st.GetQueuedTransactions(ctx, "as", "dev2", PendingCursor{}, 0)
+	mustStore(t, err)
+	letters, err = st.GetDeadLetters(ctx, "as", "dev2", 0, 0)
+	mustStore(t, err)
+	if len(queued) != 1 || len(letters) != 1 {
+		t.Error("Data of another device of the same appservice was deleted")
+	}
+}
@@ -0,0 +1,86 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/maulogger/v2"
+)
+
+// singleAttemptContextKey makes tryPostTransactionWithID return after the first failed attempt instead of retrying.
+const singleAttemptContextKey = "single-attempt"
+
+// storeAndForward returns whether transactions of the target go through the persistent outbound queue.
+// At-most-once targets never queue transactions with to-device events, so they always send directly.
+func (target *SyncTarget) storeAndForward() bool {
+	return cfg.StoreAndForward && !target.AtMostOnce
+}
+
+// queueOutbound writes a new transaction to the outbound (pending) queue before it's delivered.
+func (target *SyncTarget) queueOutbound(txn *Transaction) error {
+	txnID, meta, err := target.newDataTxn()
+	if err == nil {
+		err = target.queuePendingTransaction(txnID, meta, txn)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store transaction in outbound queue: %w", err)
+	}
+	target.backlogged = true
+	return nil
+}
+
+// drainBacklog tries to deliver the outbound queue in order, making a single attempt per transaction.
+// If the target is unreachable, the rest of the queue is kept and retried after a backoff, while the sync loop
+// keeps syncing and queueing new transactions behind it.
+func (target *SyncTarget) drainBacklog(ctx context.Context) error {
+	if !target.backlogged || time.Now().Before(target.backlogRetryAt) {
+		return nil
+	}
+	syncLog := ctx.Value(logContextKey).(maulogger.Logger)
+	err := target.deliverPendingTransactions(context.WithValue(ctx, singleAttemptContextKey, true))
+	var dErr *deliveryError
+	if err == nil {
+		if target.backlogRetryIn > 0 {
+			syncLog.Infoln("Target is reachable again, outbound queue delivered")
+		}
+		target.backlogged = false
+		target.backlogRetryIn = 0
+		target.backlogFailingSince = time.Time{}
+		return nil
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if errors.Is(err, errWebsocketNotConnected) || !errors.As(err, &dErr) {
+		return err
+	}
+	retryPolicy := target.getRetryPolicy()
+	if target.backlogRetryIn == 0 {
+		target.backlogRetryIn = retryPolicy.TransactionInitial
+	} else {
+		target.backlogRetryIn = retryPolicy.NextTransaction(target.backlogRetryIn)
+	}
+	target.backlogRetryAt = time.Now().Add(target.backlogRetryIn)
+	if target.backlogFailingSince.IsZero() {
+		target.backlogFailingSince = time.Now()
+	}
+	target.checkFailing(WebhookFailureDelivery, target.backlogFailingSince, dErr.Err)
+	syncLog.Warnfln("Failed to deliver outbound queue: %v. Keeping transactions queued and retrying in %v", dErr.Err, target.backlogRetryIn)
+	return nil
+}
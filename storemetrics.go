@@ -0,0 +1,279 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// instrumentedStore wraps a Store to record the duration of each operation in the
+// syncproxy_db_operation_duration_seconds metric and to log operations that are slower than
+// the slow query threshold, since slow sync token writes show up as sync lag.
+type instrumentedStore struct {
+	Store
+}
+
+func instrumentStore(store Store) Store {
+	return &instrumentedStore{Store: store}
+}
+
+// observe starts timing an operation. The returned function must be called when the operation is done.
+func (is *instrumentedStore) observe(operation string) func() {
+	start := time.Now()
+	return func() {
+		duration := time.Since(start)
+		dbOperationDuration.WithLabelValues(operation).Observe(duration.Seconds())
+		if threshold := cfg.DatabaseOpts.SlowQueryThreshold; threshold > 0 && duration >= threshold {
+			log.Warnfln("Slow database operation: %s took %v", operation, duration.Round(time.Millisecond))
+		}
+	}
+}
+
+func (is *instrumentedStore) GetTarget(ctx context.Context, appserviceID, deviceKey string) (*SyncTarget, error) {
+	defer is.observe("GetTarget")()
+	return is.Store.GetTarget(ctx, appserviceID, deviceKey)
+}
+
+func (is *instrumentedStore) GetTargets(ctx context.Context, onlyStartable bool) ([]*SyncTarget, error) {
+	defer is.observe("GetTargets")()
+	return is.Store.GetTargets(ctx, onlyStartable)
+}
+
+func (is *instrumentedStore) UpsertTarget(ctx context.Context, target *SyncTarget) error {
+	defer is.observe("UpsertTarget")()
+	return is.Store.UpsertTarget(ctx, target)
+}
+
+func (is *instrumentedStore) SetTargetActive(ctx context.Context, appserviceID, deviceKey string, active bool) error {
+	defer is.observe("SetTargetActive")()
+	return is.Store.SetTargetActive(ctx, appserviceID, deviceKey, active)
+}
+
+func (is *instrumentedStore) SetTargetPaused(ctx context.Context, appserviceID, deviceKey string, paused bool) error {
+	defer is.observe("SetTargetPaused")()
+	return is.Store.SetTargetPaused(ctx, appserviceID, deviceKey, paused)
+}
+
+func (is *instrumentedStore) SetTargetNextBatch(ctx context.Context, appserviceID, deviceKey, nextBatch string) error {
+	defer is.observe("SetTargetNextBatch")()
+	return is.Store.SetTargetNextBatch(ctx, appserviceID, deviceKey, nextBatch)
+}
+
+func (is *instrumentedStore) SetTargetTxnSequence(ctx context.Context, appserviceID, deviceKey string, sequence uint64) error {
+	defer is.observe("SetTargetTxnSequence")()
+	return is.Store.SetTargetTxnSequence(ctx, appserviceID, deviceKey, sequence)
+}
+
+func (is *instrumentedStore) SetTargetSlidingSyncPosition(ctx context.Context, appserviceID, deviceKey string, position SlidingSyncPosition) error {
+	defer is.observe("SetTargetSlidingSyncPosition")()
+	return is.Store.SetTargetSlidingSyncPosition(ctx, appserviceID, deviceKey, position)
+}
+
+func (is *instrumentedStore) SetTargetFirstSyncedAt(ctx context.Context, appserviceID, deviceKey string, firstSyncedAt int64) error {
+	defer is.observe("SetTargetFirstSyncedAt")()
+	return is.Store.SetTargetFirstSyncedAt(ctx, appserviceID, deviceKey, firstSyncedAt)
+}
+
+func (is *instrumentedStore) SetTargetLastStop(ctx context.Context, appserviceID, deviceKey string, lastStop *LastStop) error {
+	defer is.observe("SetTargetLastStop")()
+	return is.Store.SetTargetLastStop(ctx, appserviceID, deviceKey, lastStop)
+}
+
+func (is *instrumentedStore) SetTargetSyncRetry(ctx context.Context, appserviceID, deviceKey string, retry *SyncRetryState) error {
+	defer is.observe("SetTargetSyncRetry")()
+	return is.Store.SetTargetSyncRetry(ctx, appserviceID, deviceKey, retry)
+}
+
+func (is *instrumentedStore) SetTargetCredentials(ctx context.Context, appserviceID, deviceKey, botAccessToken, hsToken string) error {
+	defer is.observe("SetTargetCredentials")()
+	return is.Store.SetTargetCredentials(ctx, appserviceID, deviceKey, botAccessToken, hsToken)
+}
+
+func (is *instrumentedStore) DeleteTarget(ctx context.Context, appserviceID, deviceKey string) error {
+	defer is.observe("DeleteTarget")()
+	return is.Store.DeleteTarget(ctx, appserviceID, deviceKey)
+}
+
+func (is *instrumentedStore) QueueTransaction(ctx context.Context, appserviceID, deviceKey string, txn QueuedTransaction) error {
+	defer is.observe("QueueTransaction")()
+	return is.Store.QueueTransaction(ctx, appserviceID, deviceKey, txn)
+}
+
+func (is *instrumentedStore) DeleteQueuedTransaction(ctx context.Context, txnID string) error {
+	defer is.observe("DeleteQueuedTransaction")()
+	return is.Store.DeleteQueuedTransaction(ctx, txnID)
+}
+
+func (is *instrumentedStore) GetQueuedTransactions(ctx context.Context, appserviceID, deviceKey string, after PendingCursor, maxBytes int64) ([]QueuedTransaction, error) {
+	defer is.observe("GetQueuedTransactions")()
+	return is.Store.GetQueuedTransactions(ctx, appserviceID, deviceKey, after, maxBytes)
+}
+
+func (is *instrumentedStore) InsertHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error {
+	defer is.observe("InsertHistoryEntry")()
+	return is.Store.InsertHistoryEntry(ctx, entry)
+}
+
+func (is *instrumentedStore) UpdateHistoryEntry(ctx context.Context, entry *TransactionHistoryEntry) error {
+	defer is.observe("UpdateHistoryEntry")()
+	return is.Store.UpdateHistoryEntry(ctx, entry)
+}
+
+func (is *instrumentedStore) GetHistoryEntry(ctx context.Context, appserviceID, txnID string) (*TransactionHistoryEntry, error) {
+	defer is.observe("GetHistoryEntry")()
+	return is.Store.GetHistoryEntry(ctx, appserviceID, txnID)
+}
+
+func (is *instrumentedStore) GetRecentHistory(ctx context.Context, appserviceID, deviceKey string, limit int) ([]*TransactionHistoryEntry, error) {
+	defer is.observe("GetRecentHistory")()
+	return is.Store.GetRecentHistory(ctx, appserviceID, deviceKey, limit)
+}
+
+func (is *instrumentedStore) QueryHistory(ctx context.Context, appserviceID, deviceKey string, query HistoryQuery) ([]*TransactionHistoryEntry, error) {
+	defer is.observe("QueryHistory")()
+	return is.Store.QueryHistory(ctx, appserviceID, deviceKey, query)
+}
+
+func (is *instrumentedStore) PruneHistory(ctx context.Context, before int64) (int64, error) {
+	defer is.observe("PruneHistory")()
+	return is.Store.PruneHistory(ctx, before)
+}
+
+func (is *instrumentedStore) PruneCheckpointedHistory(ctx context.Context, before int64) (int64, error) {
+	defer is.observe("PruneCheckpointedHistory")()
+	return is.Store.PruneCheckpointedHistory(ctx, before)
+}
+
+func (is *instrumentedStore) SetTargetSuspendedUntil(ctx context.Context, appserviceID, deviceKey string, until int64) error {
+	defer is.observe("SetTargetSuspendedUntil")()
+	return is.Store.SetTargetSuspendedUntil(ctx, appserviceID, deviceKey, until)
+}
+
+func (is *instrumentedStore) SetTargetCheckpoint(ctx context.Context, appserviceID, deviceKey string, checkpoint *Checkpoint) (int64, error) {
+	defer is.observe("SetTargetCheckpoint")()
+	return is.Store.SetTargetCheckpoint(ctx, appserviceID, deviceKey, checkpoint)
+}
+
+func (is *instrumentedStore) InsertDeadLetter(ctx context.Context, appserviceID, deviceKey string, letter StoredDeadLetter) error {
+	defer is.observe("InsertDeadLetter")()
+	return is.Store.InsertDeadLetter(ctx, appserviceID, deviceKey, letter)
+}
+
+func (is *instrumentedStore) GetDeadLetters(ctx context.Context, appserviceID, deviceKey string, before int64, limit int) ([]StoredDeadLetter, error) {
+	defer is.observe("GetDeadLetters")()
+	return is.Store.GetDeadLetters(ctx, appserviceID, deviceKey, before, limit)
+}
+
+func (is *instrumentedStore) DeleteDeadLetter(ctx context.Context, txnID string) error {
+	defer is.observe("DeleteDeadLetter")()
+	return is.Store.DeleteDeadLetter(ctx, txnID)
+}
+
+func (is *instrumentedStore) InsertTargetError(ctx context.Context, appserviceID, deviceKey string, entry TargetError, keep int) error {
+	defer is.observe("InsertTargetError")()
+	return is.Store.InsertTargetError(ctx, appserviceID, deviceKey, entry, keep)
+}
+
+func (is *instrumentedStore) GetTargetErrors(ctx context.Context, appserviceID, deviceKey string, limit int) ([]TargetError, error) {
+	defer is.observe("GetTargetErrors")()
+	return is.Store.GetTargetErrors(ctx, appserviceID, deviceKey, limit)
+}
+
+func (is *instrumentedStore) AcquireLease(ctx context.Context, appserviceID, deviceKey, holder string, expiresAt, takeOverBefore int64) (bool, error) {
+	defer is.observe("AcquireLease")()
+	return is.Store.AcquireLease(ctx, appserviceID, deviceKey, holder, expiresAt, takeOverBefore)
+}
+
+func (is *instrumentedStore) ReleaseLease(ctx context.Context, appserviceID, deviceKey, holder string) error {
+	defer is.observe("ReleaseLease")()
+	return is.Store.ReleaseLease(ctx, appserviceID, deviceKey, holder)
+}
+
+func (is *instrumentedStore) EncryptStoredTokens(ctx context.Context) (int, error) {
+	defer is.observe("EncryptStoredTokens")()
+	return is.Store.EncryptStoredTokens(ctx)
+}
+
+func (is *instrumentedStore) SetManagementToken(ctx context.Context, appserviceID, tokenHash string, createdAt int64) error {
+	defer is.observe("SetManagementToken")()
+	return is.Store.SetManagementToken(ctx, appserviceID, tokenHash, createdAt)
+}
+
+func (is *instrumentedStore) DeleteManagementToken(ctx context.Context, appserviceID string) error {
+	defer is.observe("DeleteManagementToken")()
+	return is.Store.DeleteManagementToken(ctx, appserviceID)
+}
+
+func (is *instrumentedStore) CheckManagementToken(ctx context.Context, appserviceID, tokenHash string) (bool, error) {
+	defer is.observe("CheckManagementToken")()
+	return is.Store.CheckManagementToken(ctx, appserviceID, tokenHash)
+}
+
+func (is *instrumentedStore) InsertRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, createdAt, expiresAt int64) error {
+	defer is.observe("InsertRegistrationToken")()
+	return is.Store.InsertRegistrationToken(ctx, tokenHash, appserviceID, deviceKey, createdAt, expiresAt)
+}
+
+func (is *instrumentedStore) CheckRegistrationToken(ctx context.Context, tokenHash, appserviceID, deviceKey string, now int64) (bool, error) {
+	defer is.observe("CheckRegistrationToken")()
+	return is.Store.CheckRegistrationToken(ctx, tokenHash, appserviceID, deviceKey, now)
+}
+
+func (is *instrumentedStore) ConsumeRegistrationToken(ctx context.Context, tokenHash string) (bool, error) {
+	defer is.observe("ConsumeRegistrationToken")()
+	return is.Store.ConsumeRegistrationToken(ctx, tokenHash)
+}
+
+func (is *instrumentedStore) GetFilterID(ctx context.Context, userID id.UserID, filterHash string) (string, error) {
+	defer is.observe("GetFilterID")()
+	return is.Store.GetFilterID(ctx, userID, filterHash)
+}
+
+func (is *instrumentedStore) SetFilterID(ctx context.Context, userID id.UserID, filterHash, filterID string, createdAt int64) error {
+	defer is.observe("SetFilterID")()
+	return is.Store.SetFilterID(ctx, userID, filterHash, filterID, createdAt)
+}
+
+func (is *instrumentedStore) DeleteFilterID(ctx context.Context, userID id.UserID, filterHash string) error {
+	defer is.observe("DeleteFilterID")()
+	return is.Store.DeleteFilterID(ctx, userID, filterHash)
+}
+
+func (is *instrumentedStore) CountFilters(ctx context.Context, userID id.UserID) (int, error) {
+	defer is.observe("CountFilters")()
+	return is.Store.CountFilters(ctx, userID)
+}
+
+func (is *instrumentedStore) CountOrphanedFilters(ctx context.Context) (int, error) {
+	defer is.observe("CountOrphanedFilters")()
+	return is.Store.CountOrphanedFilters(ctx)
+}
+
+func (is *instrumentedStore) GetTxnIDClockReservation(ctx context.Context) (int64, error) {
+	defer is.observe("GetTxnIDClockReservation")()
+	return is.Store.GetTxnIDClockReservation(ctx)
+}
+
+func (is *instrumentedStore) SetTxnIDClockReservation(ctx context.Context, reservedUntil int64) error {
+	defer is.observe("SetTxnIDClockReservation")()
+	return is.Store.SetTxnIDClockReservation(ctx, reservedUntil)
+}
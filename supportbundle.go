@@ -0,0 +1,230 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const redactedValue = "<redacted>"
+
+// bundleConfig is the configuration included in support bundles, with secrets masked.
+type bundleConfig struct {
+	Config `yaml:",inline"`
+	// TrustedProxyRanges replaces TrustedProxies, which doesn't serialize to a readable form.
+	TrustedProxyRanges []string `yaml:"trusted_proxy_ranges,omitempty"`
+	// ManagementAllowedRanges replaces ManagementAllowedCIDRs for the same reason.
+	ManagementAllowedRanges []string `yaml:"management_allowed_ranges,omitempty"`
+}
+
+// redactURL masks the password in a URL. Values that can't be parsed are masked entirely.
+func redactURL(val string) string {
+	if parsedURL, err := url.Parse(val); err == nil {
+		return parsedURL.Redacted()
+	}
+	return redactedValue
+}
+
+func redactedConfig() *bundleConfig {
+	runtimeLock.RLock()
+	redacted := bundleConfig{Config: cfg}
+	runtimeLock.RUnlock()
+	redacted.SharedSecret = redactedValue
+	if len(redacted.TokenEncryptionKey) > 0 {
+		redacted.TokenEncryptionKey = redactedValue
+	}
+	if len(redacted.SentryDSN) > 0 {
+		redacted.SentryDSN = redactedValue
+	}
+	if len(redacted.Webhook.Secret) > 0 {
+		redacted.Webhook.Secret = redactedValue
+	}
+	redacted.Webhook.URL = redactURL(cfg.Webhook.URL)
+	redacted.DatabaseURL = redactURL(cfg.DatabaseURL)
+	redacted.Proxies.Homeserver = redactURL(redacted.Proxies.Homeserver)
+	redacted.Proxies.Delivery = redactURL(redacted.Proxies.Delivery)
+	for _, ipNet := range cfg.TrustedProxies {
+		redacted.TrustedProxyRanges = append(redacted.TrustedProxyRanges, ipNet.String())
+	}
+	redacted.TrustedProxies = nil
+	for _, ipNet := range cfg.ManagementAllowedCIDRs {
+		redacted.ManagementAllowedRanges = append(redacted.ManagementAllowedRanges, ipNet.String())
+	}
+	redacted.ManagementAllowedCIDRs = nil
+	redacted.Profiles = make([]*Profile, len(cfg.Profiles))
+	for i, profile := range cfg.Profiles {
+		redactedProfile := *profile
+		redactedProfile.SharedSecret = redactedValue
+		redacted.Profiles[i] = &redactedProfile
+	}
+	return &redacted
+}
+
+type bundleDatabaseInfo struct {
+	Scheme        string `json:"scheme"`
+	SchemaVersion int    `json:"schema_version"`
+	LatestVersion int    `json:"latest_version"`
+	Error         string `json:"error,omitempty"`
+}
+
+type supportBundle struct {
+	tw *tar.Writer
+	ts time.Time
+}
+
+func (sb *supportBundle) addFile(name string, data []byte) error {
+	err := sb.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: sb.ts,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sb.tw.Write(data)
+	return err
+}
+
+func (sb *supportBundle) addJSON(name string, data interface{}) error {
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", name, err)
+	}
+	return sb.addFile(name, encoded)
+}
+
+func (sb *supportBundle) addYAML(name string, data interface{}) error {
+	encoded, err := yaml.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", name, err)
+	}
+	return sb.addFile(name, encoded)
+}
+
+func (sb *supportBundle) addGoroutines() error {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return fmt.Errorf("failed to dump goroutines: %w", err)
+	}
+	return sb.addFile("goroutines.txt", buf.Bytes())
+}
+
+func (sb *supportBundle) addDatabaseInfo() error {
+	if db == nil {
+		return nil
+	}
+	info := bundleDatabaseInfo{
+		Scheme:        db.scheme,
+		LatestVersion: len(migrations),
+	}
+	var err error
+	if info.SchemaVersion, err = db.SchemaVersion(); err != nil {
+		info.Error = err.Error()
+	}
+	return sb.addJSON("database.json", &info)
+}
+
+func (sb *supportBundle) addTargets() error {
+	statuses, err := loadTargetStatuses(nil)
+	if err != nil {
+		return err
+	}
+	return sb.addJSON("targets.json", statuses)
+}
+
+// addRecentErrors adds the recent errors of all targets that are loaded in memory.
+func (sb *supportBundle) addRecentErrors() error {
+	loaded := registry.Snapshot()
+	recentErrors := make(map[string][]TargetError, len(loaded))
+	for _, target := range loaded {
+		errs, err := target.RecentErrors()
+		if err != nil {
+			return fmt.Errorf("failed to get recent errors of %s: %w", target.ID(), err)
+		} else if len(errs) > 0 {
+			recentErrors[target.ID()] = errs
+		}
+	}
+	return sb.addJSON("errors.json", recentErrors)
+}
+
+// writeSupportBundle writes a gzipped tarball with diagnostic information. Parts that fail are replaced
+// with an error file, so that a partially broken proxy can still produce a useful bundle.
+func writeSupportBundle(buf *bytes.Buffer) error {
+	gz := gzip.NewWriter(buf)
+	sb := &supportBundle{tw: tar.NewWriter(gz), ts: time.Now()}
+	parts := []struct {
+		name string
+		fn   func() error
+	}{
+		{"version", func() error {
+			return sb.addJSON("version.json", &VersionResponse{
+				Version:   Version,
+				Commit:    Commit,
+				BuildTime: BuildTime,
+				GoVersion: runtime.Version(),
+				Features:  EnabledFeatures(),
+			})
+		}},
+		{"config", func() error { return sb.addYAML("config.yaml", redactedConfig()) }},
+		{"database", sb.addDatabaseInfo},
+		{"targets", sb.addTargets},
+		{"errors", sb.addRecentErrors},
+		{"goroutines", sb.addGoroutines},
+	}
+	for _, part := range parts {
+		if err := part.fn(); err != nil {
+			log.Warnfln("Failed to add %s to support bundle: %v", part.name, err)
+			if err = sb.addFile(part.name+".error.txt", []byte(err.Error())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sb.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func getSupportBundle(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	log.Infofln("Generating support bundle for %s", clientIP(r))
+	var buf bytes.Buffer
+	if err := writeSupportBundle(&buf); err != nil {
+		log.Errorln("Failed to generate support bundle:", err)
+		errSupportBundleFailed.Write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="syncproxy-support-%s.tar.gz"`, time.Now().UTC().Format("20060102-150405")))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,121 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxSuspendDuration = 7 * 24 * time.Hour
+
+type reqSuspend struct {
+	DurationMS int64 `json:"duration_ms"`
+}
+
+type respSuspend struct {
+	SuspendedUntil int64 `json:"suspended_until"`
+}
+
+func (target *SyncTarget) setSuspendedUntil(until int64) error {
+	target.statusLock.Lock()
+	target.SuspendedUntil = until
+	target.statusLock.Unlock()
+	return store.SetTargetSuspendedUntil(context.Background(), target.storageID(), target.DeviceKey, until)
+}
+
+// scheduleResume starts a timer that resumes syncing at the target's SuspendedUntil time.
+func (target *SyncTarget) scheduleResume() {
+	target.statusLock.Lock()
+	defer target.statusLock.Unlock()
+	if target.resumeTimer != nil {
+		target.resumeTimer.Stop()
+	}
+	resumeIn := time.Until(time.Unix(0, target.SuspendedUntil*int64(time.Millisecond)))
+	target.resumeTimer = time.AfterFunc(resumeIn, target.resume)
+}
+
+func (target *SyncTarget) resume() {
+	target.log.Infoln("Suspension ended, resuming syncing")
+	if err := target.setSuspendedUntil(0); err != nil {
+		target.log.Warnln("Failed to clear suspension in database:", err)
+	}
+	target.Start()
+}
+
+// CancelSuspension stops the resume timer and clears the suspension. It returns false if the target wasn't suspended.
+func (target *SyncTarget) CancelSuspension() bool {
+	target.statusLock.Lock()
+	suspended := target.SuspendedUntil > 0
+	if target.resumeTimer != nil {
+		target.resumeTimer.Stop()
+		target.resumeTimer = nil
+	}
+	target.statusLock.Unlock()
+	if suspended {
+		if err := target.setSuspendedUntil(0); err != nil {
+			target.log.Warnln("Failed to clear suspension in database:", err)
+		}
+	}
+	return suspended
+}
+
+// Suspend stops syncing and schedules it to be resumed after the given duration.
+func (target *SyncTarget) Suspend(duration time.Duration) (int64, error) {
+	until := time.Now().Add(duration).UnixNano() / int64(time.Millisecond)
+	if err := target.setSuspendedUntil(until); err != nil {
+		return 0, err
+	}
+	<-target.Stop(StopReasonSuspended)
+	target.scheduleResume()
+	return until, nil
+}
+
+func suspendTarget(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	target := registry.Get(requestTargetID(r, vars["appserviceID"], vars["deviceID"]))
+	if target == nil {
+		errTargetNotFound.Write(w)
+		return
+	}
+	var req reqSuspend
+	if !getJSON(w, r, &req) {
+		return
+	}
+	duration := time.Duration(req.DurationMS) * time.Millisecond
+	if duration <= 0 || duration > maxSuspendDuration {
+		errInvalidSuspendDuration.Write(w)
+		return
+	} else if !target.Active && target.SuspendedUntil == 0 {
+		errTargetNotActive.Write(w)
+		return
+	}
+	until, err := target.Suspend(duration)
+	if err != nil {
+		target.log.Warnln("Failed to store suspension in database:", err)
+		errUpsertFailed.Write(w)
+		return
+	}
+	target.log.Infofln("Suspended syncing for %v after suspend request", duration)
+	writeJSON(w, http.StatusOK, &respSuspend{SuspendedUntil: until})
+}
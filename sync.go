@@ -14,18 +14,18 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package syncproxy
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"maunium.net/go/maulogger/v2"
 
 	"maunium.net/go/mautrix"
-	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -48,20 +48,100 @@ const initialSyncRetrySleep = 2 * time.Second
 const maxSyncRetryInterval = 120 * time.Second
 
 func (target *SyncTarget) sync(ctx context.Context) error {
-	var filterID string
-	if resp, err := target.client.CreateFilter(syncFilter); err != nil {
-		return fmt.Errorf("failed to create filter: %w", err)
-	} else {
-		filterID = resp.FilterID
+	syncLog := ctx.Value(logContextKey).(maulogger.Logger)
+	resumeWait, resumeInterval, resumed := target.resumeSyncRetry()
+	if resumed && resumeWait > 0 {
+		syncLog.Infofln("Syncing was failing before the restart, waiting %v before the first request", resumeWait.Round(time.Second))
+		target.heartbeat(resumeWait)
+		select {
+		case <-time.After(resumeWait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := waitForSyncStart(ctx, target); err != nil {
+		return err
+	}
+	target.heartbeat(homeserverClientTimeout)
+	hsInfo := target.getHomeserverInfo()
+	sliding := target.useSlidingSync(hsInfo, syncLog)
+	var filter string
+	for !sliding {
+		var err error
+		filter, err = target.createSyncFilter(hsInfo)
+		if delay, limited := rateLimitDelay(err); limited {
+			if delay <= 0 {
+				delay = initialSyncRetrySleep
+			}
+			syncLog.Warnfln("Homeserver rate limited filter creation, retrying in %v", delay)
+			if err = target.waitForRateLimit(ctx, delay); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to create filter: %w", err)
+		}
+		break
 	}
 
-	var otkCountSent bool
+	// filterRecreated is set when the filter was uploaded again after an unknown filter error,
+	// so that it isn't recreated in a loop if the homeserver keeps rejecting it.
+	filterRecreated := false
+	var otkCountSent, fallbackKeysSent bool
 	var prevOTKCount mautrix.OTKCount
-	syncLog := ctx.Value(logContextKey).(maulogger.Logger)
-	retryIn := initialSyncRetrySleep
+	var prevFallbackKeys []id.KeyAlgorithm
+	retryPolicy := target.getRetryPolicy()
+	retryIn := retryPolicy.SyncInitial
+	if resumed {
+		retryIn = retryPolicy.NextSync(resumeInterval)
+	}
+	// Targets resuming from an old token catch up with immediate syncs before switching to long-polling.
+	catchingUp := cfg.CatchUp.Enabled && len(target.NextBatch) > 0
+	if catchingUp {
+		syncLog.Infoln("Starting catch-up sync")
+		target.startCatchUp()
+		defer target.stopCatchUp()
+	}
 
 	for {
-		resp, err := target.client.SyncRequest(30000, target.NextBatch, filterID, false, event.PresenceOffline, ctx)
+		target.heartbeat(0)
+		if atomic.CompareAndSwapInt32(&target.replayQueued, 1, 0) {
+			target.hasDeferred = true
+		}
+		if target.hasDeferred && !target.QuietHours.Active(time.Now()) {
+			syncLog.Debugln("Quiet hours ended, delivering deferred events")
+			if target.storeAndForward() {
+				target.backlogged = true
+			} else if err := target.deliverPendingTransactions(ctx); err != nil {
+				return err
+			}
+			target.hasDeferred = false
+		}
+		if err := target.drainBacklog(ctx); err != nil {
+			return err
+		}
+		pollCtx, cancelPoll, poked := target.pollContext(ctx)
+		timeout := 30000
+		if catchingUp || poked || target.hasSyncWaiters() {
+			timeout = 0
+		}
+		target.heartbeat(homeserverClientTimeout)
+		var resp *mautrix.RespSync
+		var extras syncExtras
+		var err error
+		if sliding {
+			resp, extras, err = target.slidingSyncRequest(pollCtx, timeout)
+		} else {
+			resp, extras, err = target.syncRequest(pollCtx, hsInfo, timeout, filter)
+		}
+		target.clearPollContext()
+		interrupted := pollCtx.Err() != nil
+		cancelPoll()
+		if err != nil && ctx.Err() == nil && interrupted && target.wasPoked() {
+			// The poke flag is still set, so the next request won't long-poll.
+			syncLog.Debugln("Long-poll interrupted by poke, syncing again immediately")
+			continue
+		}
 		if err != nil {
 			if errors.Is(err, mautrix.MUnknownToken) {
 				return err
@@ -71,48 +151,172 @@ func (target *SyncTarget) sync(ctx context.Context) error {
 				}
 				return ctx.Err()
 			}
+			if !sliding && !filterRecreated && isUnknownFilterError(err) {
+				syncLog.Warnfln("Homeserver doesn't know filter %s anymore (%v), recreating it", filter, err)
+				target.recordError(ErrorSourceSync, "unknown-filter", err)
+				if newFilter, filterErr := target.recreateSyncFilter(hsInfo); filterErr != nil {
+					syncLog.Warnln("Failed to recreate filter:", filterErr)
+				} else {
+					filter = newFilter
+					filterRecreated = true
+					continue
+				}
+			}
+			if delay, limited := rateLimitDelay(err); limited {
+				// The homeserver said how long to wait, so the backoff isn't increased.
+				if delay <= 0 {
+					delay = retryIn
+					retryIn = retryPolicy.NextSync(retryIn)
+				}
+				syncLog.Warnfln("Homeserver rate limited sync, retrying in %v", delay)
+				target.recordError(ErrorSourceSync, "rate-limited", err)
+				target.recordSyncRetry(err, delay)
+				if err = target.waitForRateLimit(ctx, delay); err != nil {
+					syncLog.Debugfln("Context returned error while waiting for rate limit")
+					return err
+				}
+				continue
+			}
 			syncLog.Warnfln("Error syncing: %v. Retrying in %v", err, retryIn)
+			target.recordError(ErrorSourceSync, "sync-failed", err)
+			target.recordSyncRetry(err, retryIn)
+			target.heartbeat(retryIn)
 			select {
 			case <-time.After(retryIn):
 			case <-ctx.Done():
 				syncLog.Debugfln("Context returned error while waiting to retry sync")
 				return ctx.Err()
 			}
-			retryIn *= 2
-			if retryIn > maxSyncRetryInterval {
-				retryIn = maxSyncRetryInterval
-			}
+			retryIn = retryPolicy.NextSync(retryIn)
 			continue
 		}
-		retryIn = initialTransactionRetrySleep
-		if len(resp.ToDevice.Events) > 0 || resp.DeviceOTKCount != prevOTKCount || !otkCountSent || len(resp.DeviceLists.Changed) > 0 {
-			txn := syncToTransaction(resp, target.UserID, target.DeviceID, resp.DeviceOTKCount != prevOTKCount || !otkCountSent)
-			prevOTKCount = resp.DeviceOTKCount
-			otkCountSent = true
-			err = target.tryPostTransaction(ctx, txn, nil)
-			if err != nil {
-				return fmt.Errorf("error sending transaction: %w", err)
+		retryIn = retryPolicy.SyncInitial
+		filterRecreated = false
+		syncedAt := time.Now()
+		// queuedTxn is the transaction that was written to the outbound queue in store-and-forward mode.
+		var queuedTxn *Transaction
+		target.recordSyncSuccess(resp.NextBatch)
+		target.checkSelfTests(resp.ToDevice.Events, false)
+		resp.ToDevice.Events = target.dedup.Filter(resp.ToDevice.Events)
+		resp.ToDevice.Events = target.keyRequests.Filter(target, resp.ToDevice.Events)
+		resp.ToDevice.Events, err = target.deferQuietEvents(resp.ToDevice.Events)
+		if err != nil {
+			return err
+		}
+		if !target.ForwardPresence {
+			resp.Presence.Events = nil
+		}
+		if target.DropDeviceListLeft {
+			resp.DeviceLists.Left = nil
+		}
+		target.deviceLists.Filter(&resp.DeviceLists, target.deviceListDedupWindow())
+		if !target.FullSync {
+			stripRoomData(resp)
+		}
+		otkCountChanged := extras.OTKCountKnown && (!otkCountSent ||
+			(resp.DeviceOTKCount != prevOTKCount && target.shouldForwardOTKCount(prevOTKCount, resp.DeviceOTKCount)))
+		var fallbackKeys []id.KeyAlgorithm
+		if extras.FallbackKeyTypes != nil && (!fallbackKeysSent || !equalKeyAlgorithms(extras.FallbackKeyTypes, prevFallbackKeys)) {
+			fallbackKeys = extras.FallbackKeyTypes
+		}
+		if len(resp.ToDevice.Events) > 0 || len(resp.Presence.Events) > 0 || hasRoomData(resp) || otkCountChanged || fallbackKeys != nil || len(resp.DeviceLists.Changed) > 0 || len(resp.DeviceLists.Left) > 0 {
+			txn := syncToTransaction(resp, target.UserID, target.DeviceID, otkCountChanged, fallbackKeys)
+			if otkCountChanged {
+				prevOTKCount = resp.DeviceOTKCount
+				otkCountSent = true
+			}
+			if fallbackKeys != nil {
+				prevFallbackKeys = fallbackKeys
+				fallbackKeysSent = true
+			}
+			iterCtx := withCorrelationID(ctx)
+			chunks := splitTransaction(txn, cfg.MaxTransactionEvents, cfg.MaxTransactionBytes)
+			if len(chunks) > 1 {
+				syncLog.Debugfln("Splitting sync response into %d transactions", len(chunks))
+			}
+			if target.storeAndForward() {
+				// The transaction is written to the outbound queue first, so the sync token can be advanced
+				// below even if the target is unreachable, and the backlog is drained after that.
+				for _, chunk := range chunks {
+					if err = target.queueOutbound(chunk); err != nil {
+						return err
+					}
+				}
+				queuedTxn = txn
+			} else {
+				// If a chunk fails without being queued, the sync token isn't advanced, so the chunks before it
+				// are delivered again when the response is synced again. Split responses are at-least-once.
+				for i, chunk := range chunks {
+					err = target.tryPostTransaction(iterCtx, chunk, nil)
+					var qErr *queuedError
+					if errors.As(err, &qErr) {
+						// The rest of the split response is queued behind the failed part to keep the order,
+						// and then the whole response is safely in the pending queue.
+						for _, rest := range chunks[i+1:] {
+							txnID, meta, err := target.newDataTxn()
+							if err == nil {
+								err = target.queuePendingTransaction(txnID, meta, rest)
+							}
+							if err != nil {
+								return &deliveryError{Err: fmt.Errorf("failed to queue rest of split transaction: %w", err)}
+							}
+						}
+						target.commitSyncPosition(outcomeContext(ctx), resp.NextBatch, extras)
+						return qErr
+					} else if err != nil {
+						return &deliveryError{Err: err}
+					}
+				}
+				target.latency.Record(time.Since(syncedAt), len(txn.EphemeralEvents))
 			}
 		}
 		syncLog.Debugln("Storing new next batch token:", resp.NextBatch)
-		err = target.SetNextBatch(resp.NextBatch)
-		if err != nil {
-			syncLog.Warnln("Failed to store next batch in database:", err)
+		target.commitSyncPosition(outcomeContext(ctx), resp.NextBatch, extras)
+		if queuedTxn != nil {
+			if err = target.drainBacklog(ctx); err != nil {
+				return err
+			} else if !target.backlogged {
+				target.latency.Record(time.Since(syncedAt), len(queuedTxn.EphemeralEvents))
+			}
+		}
+		target.markFirstSync()
+		if catchingUp {
+			catchingUp = target.recordCatchUpBatch(resp)
+			if catchingUp && cfg.CatchUp.MinInterval > 0 {
+				target.heartbeat(cfg.CatchUp.MinInterval)
+				select {
+				case <-time.After(cfg.CatchUp.MinInterval):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
 		}
 	}
 }
 
-func syncToTransaction(resp *mautrix.RespSync, userID id.UserID, deviceID id.DeviceID, sendOTKs bool) *appservice.Transaction {
-	var txn appservice.Transaction
+// syncToTransaction converts a sync response into a transaction. fallbackKeys is only included if it's not nil,
+// an empty list means that the device has no unused fallback keys.
+func syncToTransaction(resp *mautrix.RespSync, userID id.UserID, deviceID id.DeviceID, sendOTKs bool, fallbackKeys []id.KeyAlgorithm) *Transaction {
+	var txn Transaction
 	if resp != nil {
 		if len(resp.ToDevice.Events) > 0 {
 			txn.EphemeralEvents = resp.ToDevice.Events
-			txn.MSC2409EphemeralEvents = txn.EphemeralEvents
 			for _, evt := range txn.EphemeralEvents {
 				evt.ToUserID = userID
 				evt.ToDeviceID = deviceID
 			}
 		}
+		// Room ephemeral events like typing notifications and receipts are only in the response
+		// if the target's filter includes them, the default filter doesn't.
+		for roomID, room := range resp.Rooms.Join {
+			for _, evt := range room.Ephemeral.Events {
+				evt.RoomID = roomID
+				txn.EphemeralEvents = append(txn.EphemeralEvents, evt)
+			}
+		}
+		txn.EphemeralEvents = append(txn.EphemeralEvents, resp.Presence.Events...)
+		addRoomData(resp, &txn)
+		txn.MSC2409EphemeralEvents = txn.EphemeralEvents
 		if len(resp.DeviceLists.Changed) > 0 || len(resp.DeviceLists.Left) > 0 {
 			txn.DeviceLists = &resp.DeviceLists
 			txn.MSC3202DeviceLists = txn.DeviceLists
@@ -123,6 +327,41 @@ func syncToTransaction(resp *mautrix.RespSync, userID id.UserID, deviceID id.Dev
 			}
 			txn.MSC3202DeviceOTKCount = txn.DeviceOTKCount
 		}
+		if fallbackKeys != nil {
+			txn.DeviceUnusedFallbackKeyTypes = map[id.UserID][]id.KeyAlgorithm{
+				userID: fallbackKeys,
+			}
+			txn.MSC3202DeviceUnusedFallbackKeyTypes = txn.DeviceUnusedFallbackKeyTypes
+		}
 	}
 	return &txn
 }
+
+func equalKeyAlgorithms(a, b []id.KeyAlgorithm) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldForwardOTKCount decides whether a changed OTK count is worth a transaction, based on the thresholds
+// of the target. prev is the last count that was forwarded. Without thresholds, every change is forwarded.
+func (target *SyncTarget) shouldForwardOTKCount(prev, cur mautrix.OTKCount) bool {
+	if target.OTKCountThreshold <= 0 && target.OTKCountDelta <= 0 {
+		return true
+	}
+	// Crossing the threshold upwards is forwarded too, so that the target doesn't keep acting on the low count.
+	if target.OTKCountThreshold > 0 && (cur.SignedCurve25519 < target.OTKCountThreshold || prev.SignedCurve25519 < target.OTKCountThreshold) {
+		return true
+	}
+	delta := cur.SignedCurve25519 - prev.SignedCurve25519
+	if delta < 0 {
+		delta = -delta
+	}
+	return target.OTKCountDelta > 0 && delta > target.OTKCountDelta
+}
@@ -0,0 +1,52 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+)
+
+// SynchronousPolicy defines what happens when the target doesn't confirm synchronous delivery of a transaction.
+type SynchronousPolicy string
+
+const (
+	// SynchronousPolicyRequire treats missing confirmation as a delivery failure, so the transaction is retried.
+	SynchronousPolicyRequire SynchronousPolicy = "require"
+	// SynchronousPolicyPrefer logs a warning and increments a metric, but treats the transaction as delivered.
+	SynchronousPolicyPrefer SynchronousPolicy = "prefer"
+	// SynchronousPolicyIgnore treats the transaction as delivered without complaints.
+	SynchronousPolicyIgnore SynchronousPolicy = "ignore"
+)
+
+func (sp SynchronousPolicy) Validate() error {
+	switch sp {
+	case "", SynchronousPolicyRequire, SynchronousPolicyPrefer, SynchronousPolicyIgnore:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q, expected require, prefer or ignore", string(sp))
+	}
+}
+
+// getSynchronousPolicy returns the policy of the target, or the global default set with EXPECT_SYNCHRONOUS.
+func (target *SyncTarget) getSynchronousPolicy() SynchronousPolicy {
+	if len(target.SynchronousPolicy) > 0 {
+		return target.SynchronousPolicy
+	} else if cfg.ExpectSynchronous {
+		return SynchronousPolicyRequire
+	}
+	return SynchronousPolicyIgnore
+}
@@ -0,0 +1,145 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// defaultPutWaitTimeout is how long PUT requests with wait=true wait for the first sync if wait_timeout_ms isn't set.
+const defaultPutWaitTimeout = 30 * time.Second
+const maxPutWaitTimeout = 2 * time.Minute
+
+// syncResult is the outcome of the first sync request that a syncWaiter was waiting for.
+type syncResult struct {
+	NextBatch string
+	Err       error
+}
+
+// syncWaiter is notified when the next /sync request of the target completes successfully or the sync loop stops.
+type syncWaiter chan syncResult
+
+func newSyncWaiter() syncWaiter {
+	return make(syncWaiter, 1)
+}
+
+type respPutWait struct {
+	// NextBatch is the sync token returned by the first successful /sync request.
+	NextBatch string `json:"next_batch"`
+}
+
+// addSyncWaiter registers a waiter that is notified by the sync loop.
+// Sync requests don't long-poll while there are waiters, so that they don't have to wait for new events.
+func (target *SyncTarget) addSyncWaiter(waiter syncWaiter) {
+	target.statusLock.Lock()
+	target.syncWaiters = append(target.syncWaiters, waiter)
+	target.statusLock.Unlock()
+}
+
+func (target *SyncTarget) removeSyncWaiter(waiter syncWaiter) {
+	target.statusLock.Lock()
+	defer target.statusLock.Unlock()
+	for i, existing := range target.syncWaiters {
+		if existing == waiter {
+			target.syncWaiters = append(target.syncWaiters[:i], target.syncWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (target *SyncTarget) hasSyncWaiters() bool {
+	target.statusLock.RLock()
+	defer target.statusLock.RUnlock()
+	return len(target.syncWaiters) > 0
+}
+
+// notifySyncWaiters sends the result to all registered waiters and removes them.
+func (target *SyncTarget) notifySyncWaiters(result syncResult) {
+	target.statusLock.Lock()
+	waiters := target.syncWaiters
+	target.syncWaiters = nil
+	target.statusLock.Unlock()
+	for _, waiter := range waiters {
+		waiter <- result
+	}
+}
+
+// parsePutWait checks whether a PUT request has wait=true and returns how long it should wait for the first sync.
+func parsePutWait(r *http.Request) (time.Duration, bool, error) {
+	if r.URL.Query().Get("wait") != "true" {
+		return 0, false, nil
+	}
+	timeoutMS, err := parsePositiveIntParam(r, "wait_timeout_ms")
+	if err != nil {
+		return 0, false, err
+	}
+	timeout := time.Duration(timeoutMS) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultPutWaitTimeout
+	} else if timeout > maxPutWaitTimeout {
+		timeout = maxPutWaitTimeout
+	}
+	return timeout, true, nil
+}
+
+// waitForFirstSync waits until the waiter is notified or the timeout is reached and returns the response of the PUT request.
+func waitForFirstSync(w http.ResponseWriter, target *SyncTarget, waiter syncWaiter, timeout time.Duration) {
+	select {
+	case result := <-waiter:
+		if result.Err != nil {
+			formatError(errInitialSyncFailed, result.Err).Write(w)
+		} else {
+			writeJSON(w, http.StatusOK, &respPutWait{NextBatch: result.NextBatch})
+		}
+	case <-time.After(timeout):
+		target.removeSyncWaiter(waiter)
+		lastErr := "no response from the homeserver yet"
+		target.statusLock.RLock()
+		if target.syncRetry != nil {
+			lastErr = target.syncRetry.Error
+		}
+		target.statusLock.RUnlock()
+		formatError(errInitialSyncTimeout, timeout.String(), lastErr).Write(w)
+	}
+}
+
+// putTargetAndWait is putTarget for requests with wait=true.
+func putTargetAndWait(w http.ResponseWriter, r *http.Request, req *SyncTarget, timeout time.Duration) {
+	req.syncWaiter = newSyncWaiter()
+	apiErr, ok := upsertTarget(r.Context(), req)
+	if !ok {
+		apiErr.Write(w)
+		return
+	}
+	target := registry.Get(req.ID())
+	if target == nil {
+		appservice.WriteBlankOK(w)
+		return
+	}
+	waitForFirstSync(w, target, req.syncWaiter, timeout)
+}
+
+func stoppedBeforeSyncError(reason StopReason, err error) error {
+	if err != nil {
+		return fmt.Errorf("sync loop stopped (%s): %w", reason, err)
+	}
+	return fmt.Errorf("sync loop stopped (%s)", reason)
+}
@@ -0,0 +1,116 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync/atomic"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// targetLRU tracks the order in which targets were used. It's protected by the registry lock.
+type targetLRU struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+var targetCache = &targetLRU{
+	order:    list.New(),
+	elements: make(map[string]*list.Element),
+}
+
+func (lru *targetLRU) Touch(targetID string) {
+	if cfg.TargetCacheSize <= 0 {
+		return
+	} else if elem, ok := lru.elements[targetID]; ok {
+		lru.order.MoveToFront(elem)
+	} else {
+		lru.elements[targetID] = lru.order.PushFront(targetID)
+	}
+}
+
+func (lru *targetLRU) Remove(targetID string) {
+	if elem, ok := lru.elements[targetID]; ok {
+		lru.order.Remove(elem)
+		delete(lru.elements, targetID)
+	}
+}
+
+// evictable returns whether the target can be dropped from memory. Targets that are syncing, about to be
+// started or waiting to be resumed have state that only exists in memory, so they're never evicted.
+func (target *SyncTarget) evictable() bool {
+	target.lock.Lock()
+	defer target.lock.Unlock()
+	return target.loop == nil && atomic.LoadInt32(&target.pendingStarts) == 0 && !target.Active && target.SuspendedUntil == 0
+}
+
+// evict removes the least recently used evictable targets until the cache fits in the configured size.
+// The caller must hold the registry lock and dispatch the returned events after unlocking.
+func (tr *targetRegistry) evict() (events []TargetEvent) {
+	for elem := targetCache.order.Back(); elem != nil && len(tr.targets) > cfg.TargetCacheSize; {
+		prev := elem.Prev()
+		targetID := elem.Value.(string)
+		// Targets whose ID is locked are being modified, e.g. by a PUT request that's about to start them,
+		// so they're pinned until the lock is released.
+		if target, ok := tr.targets[targetID]; !ok || (!tr.isLocked(targetID) && target.evictable()) {
+			if ok {
+				events = append(events, TargetEvent{Type: TargetRemoved, Target: target})
+			}
+			delete(tr.targets, targetID)
+			targetCache.Remove(targetID)
+			targetCacheEvictions.Inc()
+		}
+		elem = prev
+	}
+	return
+}
+
+func loadTarget(appserviceID, deviceKey string) (*SyncTarget, error) {
+	target, err := store.GetTarget(context.Background(), appserviceID, deviceKey)
+	if target == nil || err != nil {
+		return nil, err
+	} else if err = target.Init(); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// loadByID loads a target that isn't in memory from the database and adds it to the cache.
+// The caller must hold the registry lock and dispatch the returned events after unlocking.
+func (tr *targetRegistry) loadByID(targetID string) (*SyncTarget, []TargetEvent) {
+	target, err := loadTarget(targetID, "")
+	if target == nil && err == nil {
+		if sep := strings.LastIndexByte(targetID, '/'); sep > 0 {
+			target, err = loadTarget(targetID[:sep], targetID[sep+1:])
+		}
+	}
+	if err != nil {
+		log.Warnfln("Failed to load target %s from database: %v", targetID, err)
+		return nil, nil
+	} else if target == nil {
+		targetCacheMisses.Inc()
+		return nil, nil
+	}
+	targetCacheLoads.Inc()
+	tr.targets[targetID] = target
+	targetCache.Touch(targetID)
+	events := append([]TargetEvent{{Type: TargetAdded, Target: target}}, tr.evict()...)
+	return target, events
+}
@@ -0,0 +1,58 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestEvictPinnedTargets(t *testing.T) {
+	prevSize := cfg.TargetCacheSize
+	cfg.TargetCacheSize = 1
+	tr := &targetRegistry{targets: make(map[string]*SyncTarget), idLocks: make(map[string]*targetIDLock)}
+	locked := &SyncTarget{AppserviceID: "locked"}
+	starting := &SyncTarget{AppserviceID: "starting"}
+	other := &SyncTarget{AppserviceID: "other"}
+	t.Cleanup(func() {
+		cfg.TargetCacheSize = prevSize
+		for _, target := range []*SyncTarget{locked, starting, other} {
+			targetCache.Remove(target.ID())
+		}
+	})
+
+	unlock := tr.LockTarget(locked.ID())
+	tr.Add(locked)
+	tr.Add(other)
+	if tr.GetLoaded(locked.ID()) != locked {
+		t.Fatal("Target was evicted while its ID was locked")
+	}
+	unlock()
+
+	atomic.AddInt32(&starting.pendingStarts, 1)
+	tr.Add(starting)
+	if tr.GetLoaded(starting.ID()) != starting {
+		t.Fatal("Target was evicted before its pending start")
+	} else if tr.GetLoaded(locked.ID()) != nil {
+		t.Error("Unlocked target wasn't evicted")
+	}
+	atomic.AddInt32(&starting.pendingStarts, -1)
+	tr.Add(other)
+	if tr.GetLoaded(starting.ID()) != nil || tr.Len() != 1 {
+		t.Errorf("Expected only the most recently used target to be left, got %d targets", tr.Len())
+	}
+}
@@ -14,15 +14,17 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package syncproxy
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -30,92 +32,230 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-var targets = make(map[string]*SyncTarget)
-var targetLock sync.Mutex
-
 type SyncTarget struct {
 	AppserviceID   string      `json:"appservice_id"`
+	Profile        string      `json:"-"`
+	DeviceKey      string      `json:"-"`
 	BotAccessToken string      `json:"bot_access_token"`
 	HSToken        string      `json:"hs_token"`
 	Address        string      `json:"address"`
 	UserID         id.UserID   `json:"user_id"`
 	DeviceID       id.DeviceID `json:"device_id"`
 	IsProxy        bool        `json:"is_proxy"`
+	Template       string      `json:"template,omitempty"`
+	DryRun         bool        `json:"dry_run,omitempty"`
+	AtMostOnce     bool        `json:"at_most_once,omitempty"`
+	QuietHours     *QuietHours `json:"quiet_hours,omitempty"`
+
+	// SynchronousPolicy overrides EXPECT_SYNCHRONOUS for this target.
+	SynchronousPolicy SynchronousPolicy `json:"synchronous_policy,omitempty"`
+	// Recipients are additional addresses that receive every transaction along with Address.
+	// A transaction is only considered delivered once all of them have confirmed it.
+	Recipients []string `json:"recipients,omitempty"`
+	// MaxBufferedBytes overrides MAX_TARGET_BUFFERED_BYTES for this target.
+	MaxBufferedBytes int64 `json:"max_buffered_bytes,omitempty"`
+	// Delivery contains settings for the HTTP client used to send transactions to the target.
+	Delivery *DeliveryOptions `json:"delivery,omitempty"`
+	// Retry overrides the retry policy of the target's template and the default retry policy.
+	Retry *RetryPolicyJSON `json:"retry,omitempty"`
+	// Filter replaces the default sync filter and the filter of the target's template.
+	Filter *mautrix.Filter `json:"filter,omitempty"`
+	// ForwardPresence makes the sync loop request presence and forward it as ephemeral events.
+	ForwardPresence bool `json:"forward_presence,omitempty"`
+	// DropDeviceListLeft stops the sync loop from forwarding users in the left section of device list updates.
+	DropDeviceListLeft bool `json:"drop_device_list_left,omitempty"`
+	// DeviceListDedupMinutes stops the sync loop from forwarding device list changes of users whose change
+	// was already delivered within the given number of minutes. Zero disables deduplication.
+	DeviceListDedupMinutes int `json:"device_list_dedup_minutes,omitempty"`
+	// MasqueradeDevice means that BotAccessToken is the as_token of the appservice, and homeserver requests
+	// masquerade as UserID and DeviceID instead of using an access token of the bot device.
+	MasqueradeDevice bool `json:"masquerade_device,omitempty"`
+	// OTKCountThreshold and OTKCountDelta limit which changes of the signed_curve25519 one-time key count are
+	// forwarded: changes while the count is below the threshold, or changes by more than the delta. Zero disables each.
+	OTKCountThreshold int `json:"otk_count_threshold,omitempty"`
+	OTKCountDelta     int `json:"otk_count_delta,omitempty"`
+	// FullSync makes the sync loop request room events and account data and forward them in transactions.
+	FullSync bool `json:"full_sync,omitempty"`
+	// SyncBackend selects the sync endpoint used by the sync loop.
+	SyncBackend SyncBackend `json:"sync_backend,omitempty"`
+	// HomeserverURL overrides the homeserver URL of the target's profile.
+	HomeserverURL string `json:"homeserver_url,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	NextBatch      string `json:"-"`
+	Active         bool   `json:"-"`
+	SuspendedUntil int64  `json:"-"`
+	// Paused is set when syncing was stopped with the pause endpoint, until the target is resumed or PUT again.
+	Paused bool `json:"-"`
+
+	retryPolicy RetryPolicy
+	// skipBacklog is set from the skip_backlog field of a PUT request, see skipInitialBacklog.
+	skipBacklog bool
+	// syncWaiter is set for PUT requests with wait=true and is notified when the first sync completes.
+	syncWaiter syncWaiter
+
+	client         *mautrix.Client
+	deliveryClient *http.Client
+	credsLock      sync.RWMutex
+	log            log.Logger
+	// running is 1 while a sync loop is running. It's accessed atomically, use isRunning to read it.
+	running int32
+	// pendingStarts is the number of startInBackground calls whose Start hasn't returned yet. It's accessed
+	// atomically and keeps the target from being evicted before the new sync loop has been set up.
+	pendingStarts int32
+	// loop is the currently running sync loop. lock only guards swapping it, it's not held while syncing.
+	loop *syncLoop
+	lock sync.Mutex
+
+	inFlight     *inFlightTransaction
+	inFlightLock sync.Mutex
+
+	// deliveryWebsockets are the open connections to ws(s):// addresses of the target, guarded by credsLock.
+	deliveryWebsockets map[string]*deliveryWebsocket
+
+	dedup       toDeviceDeduplicator
+	deviceLists deviceListDeduplicator
+	keyRequests keyRequestLimiter
+	latency     latencyTracker
+	eventTypes  eventTypeCounter
+
+	recentErrors errorRing
 
-	NextBatch string `json:"-"`
-	Active    bool   `json:"-"`
+	hasDeferred bool
+	// replayQueued is set to 1 when transactions were moved to the pending queue from outside the sync loop.
+	replayQueued int32
+	// backlogged is set when the outbound queue may contain transactions in store-and-forward mode.
+	// These fields are only used by the sync loop.
+	backlogged     bool
+	backlogRetryAt time.Time
+	backlogRetryIn time.Duration
+	// backlogFailingSince is when delivering the outbound queue started failing.
+	backlogFailingSince time.Time
+	// backlogRejections is the number of times the target has rejected the first transaction in the outbound queue.
+	backlogRejections int
 
-	client  *mautrix.Client
-	log     log.Logger
-	running bool
-	cancel  func()
-	wg      sync.WaitGroup
-	lock    sync.Mutex
+	poked      bool
+	pollCancel context.CancelFunc
+	pokeLock   sync.Mutex
+
+	// webhookSyncFailing and webhookDeliveryFailing are set to 1 when a failing webhook event has been sent.
+	webhookSyncFailing     int32
+	webhookDeliveryFailing int32
+
+	droppedTxns []string
+	droppedLock sync.Mutex
+
+	selfTests    map[string]*selfTest
+	selfTestLock sync.Mutex
+
+	lastStop          *LastStop
+	checkpoint        *Checkpoint
+	resumeTimer       *time.Timer
+	labelMetricValues []string
+	bufferedBytes     int64
+	catchUp           *CatchUpProgress
+	reachability      *Reachability
+	syncWaiters       []syncWaiter
+	txnSequence       uint64
+	sequenceLock      sync.Mutex
+	slidingSync       SlidingSyncPosition
+	registeredAt      int64
+	firstSyncedAt     int64
+	lastSyncAt        int64
+	lastDeliveryAt    int64
+	loopStartedAt     int64
+	syncRetry         *SyncRetryState
+	syncFailingSince  time.Time
+	statusLock        sync.RWMutex
+
+	// sessionTransactions is the number of transactions delivered since the sync loop was last started.
+	sessionTransactions uint64
+	// watchdogDeadline is the unix nano timestamp by which the sync loop is expected to show activity again.
+	watchdogDeadline int64
+	// leaseExpiresAt is the unix millisecond timestamp when the lease held by this instance expires.
+	leaseExpiresAt int64
+	// leaseTakeover makes the next sync loop take the lease from other instances instead of waiting for it to expire.
+	leaseTakeover bool
 }
 
-func (target *SyncTarget) Upsert() error {
-	query := `
-		INSERT INTO targets (appservice_id, bot_access_token, hs_token, address, user_id, device_id, is_proxy, next_batch, active)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		ON CONFLICT (appservice_id) DO UPDATE
-		SET bot_access_token=$2, hs_token=$3, address=$4, user_id=$5, device_id=$6, is_proxy=$7
-	`
-	if db.scheme == "sqlite3" {
-		query = "INSERT OR REPLACE INTO targets (appservice_id, bot_access_token, hs_token, address, user_id, device_id, is_proxy, next_batch, active)"
+// TargetID returns the key of the target in the targets map. Targets registered without an explicit
+// device in the path are keyed by the appservice ID alone, additional devices are suffixed with the device ID.
+func TargetID(appserviceID, deviceKey string) string {
+	if len(deviceKey) == 0 {
+		return appserviceID
 	}
-	_, err := db.conn.Exec(query, target.AppserviceID, target.BotAccessToken, target.HSToken, target.Address, target.UserID, target.DeviceID, target.IsProxy, target.NextBatch, target.Active)
-	return err
+	return fmt.Sprintf("%s/%s", appserviceID, deviceKey)
+}
+
+// isRunning returns whether a sync loop is currently running for the target.
+func (target *SyncTarget) isRunning() bool {
+	return atomic.LoadInt32(&target.running) == 1
+}
+
+func (target *SyncTarget) ID() string {
+	return TargetID(target.storageID(), target.DeviceKey)
 }
 
-func (target *SyncTarget) SetActive(active bool) error {
+func (target *SyncTarget) Upsert(ctx context.Context) error {
+	return store.UpsertTarget(ctx, target)
+}
+
+// SetActive updates the active flag in memory and in the database.
+// If the database is unavailable, the write is retried in the background.
+func (target *SyncTarget) SetActive(active bool) {
 	if target.Active == active {
-		return nil
+		return
 	}
 	target.Active = active
-	_, err := db.conn.Exec("UPDATE targets SET active=$2 WHERE appservice_id=$1", target.AppserviceID, target.Active)
-	return err
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	deferredWrites.Exec(context.Background(), target, "active", func(ctx context.Context) error {
+		return store.SetTargetActive(ctx, appserviceID, deviceKey, active)
+	})
 }
 
-func (target *SyncTarget) SetNextBatch(nextBatch string) error {
+// SetNextBatch updates the sync token in memory and in the database.
+// If the database is unavailable, syncing continues with the in-memory token and the write is retried in the background.
+func (target *SyncTarget) SetNextBatch(ctx context.Context, nextBatch string) {
 	if target.NextBatch == nextBatch {
-		return nil
+		return
 	}
+	target.statusLock.Lock()
 	target.NextBatch = nextBatch
-	_, err := db.conn.Exec("UPDATE targets SET next_batch=$2 WHERE appservice_id=$1", target.AppserviceID, target.NextBatch)
-	return err
+	target.statusLock.Unlock()
+	appserviceID, deviceKey := target.storageID(), target.DeviceKey
+	deferredWrites.Exec(ctx, target, "next_batch", func(ctx context.Context) error {
+		return store.SetTargetNextBatch(ctx, appserviceID, deviceKey, nextBatch)
+	})
 }
 
-func GetOrSetTarget(appserviceID string, newTarget *SyncTarget) *SyncTarget {
-	targetLock.Lock()
-	defer targetLock.Unlock()
-	target, ok := targets[appserviceID]
-	if !ok {
-		if newTarget != nil {
-			targets[appserviceID] = newTarget
-		}
-		return nil
+// Purge deletes the target and all its data from the database and removes it from memory.
+// The sync loop must be stopped first.
+func (target *SyncTarget) Purge(ctx context.Context) error {
+	if err := store.DeleteTarget(ctx, target.storageID(), target.DeviceKey); err != nil {
+		return err
 	}
-	return target
+	registry.Remove(target)
+	target.removeLabelMetric()
+	deleteTargetSeries(target.ID())
+	seriesLimiter.Forget(target.ID())
+	updateOrphanedFilterMetric()
+	return nil
 }
 
+// LoadTargets loads targets from the database into memory. If the target cache is enabled,
+// only targets that need to be started are loaded, the rest are loaded when they're first used.
 func LoadTargets() error {
-	res, err := db.conn.Query("SELECT appservice_id, bot_access_token, hs_token, address, is_proxy, user_id, device_id, active FROM targets")
+	loaded, err := store.GetTargets(context.Background(), cfg.TargetCacheSize > 0)
 	if err != nil {
 		return fmt.Errorf("failed to query targets: %w", err)
 	}
-	targetLock.Lock()
-	defer targetLock.Unlock()
-	for res.Next() {
-		var target SyncTarget
-		err = res.Scan(&target.AppserviceID, &target.BotAccessToken, &target.HSToken, &target.Address, &target.IsProxy, &target.UserID, &target.DeviceID, &target.Active)
-		if err != nil {
-			return fmt.Errorf("failed to scan target: %w", err)
-		}
+	for _, target := range loaded {
 		err = target.Init()
 		if err != nil {
 			target.log.Warnln("Failed to initialize target (startup):", err)
 		} else {
-			targets[target.AppserviceID] = &target
+			registry.Add(target)
 		}
 	}
 	return nil
@@ -126,75 +266,229 @@ var globalSyncID uint64
 const logContextKey = "log"
 
 func (target *SyncTarget) Init() error {
-	target.log = log.Sub(fmt.Sprintf("Target-%s", target.AppserviceID))
+	target.log = log.DefaultLogger.Subm(fmt.Sprintf("Target-%s", target.ID()), target.logFields())
+	if getProfile(target.Profile) == nil {
+		return fmt.Errorf("unknown profile %s", target.Profile)
+	}
+	target.updateLabelMetric()
 	var err error
-	target.client, err = mautrix.NewClient(cfg.HomeserverURL, target.UserID, target.BotAccessToken)
+	target.client, err = target.newClient(target.UserID, target.BotAccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	return nil
+}
+
+func (target *SyncTarget) getClient() *mautrix.Client {
+	target.credsLock.RLock()
+	defer target.credsLock.RUnlock()
+	return target.client
+}
+
+func (target *SyncTarget) getHSToken() string {
+	target.credsLock.RLock()
+	defer target.credsLock.RUnlock()
+	return target.HSToken
+}
+
+// UpdateCredentials replaces the tokens of the target. The client is replaced instead of modified,
+// so that requests already in progress in the sync loop aren't affected.
+func (target *SyncTarget) UpdateCredentials(botAccessToken, hsToken string) error {
+	client, err := target.newClient(target.UserID, botAccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	client.DeviceID = target.DeviceID
+	target.credsLock.Lock()
+	target.BotAccessToken = botAccessToken
+	target.HSToken = hsToken
+	target.client = client
+	target.credsLock.Unlock()
+	return nil
+}
+
+// FetchIdentity fills the user ID (and device ID if not already set) of the target using /whoami.
+func (target *SyncTarget) FetchIdentity() error {
+	client, err := target.newClient("", target.BotAccessToken)
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
+	resp, err := client.Whoami()
+	if err != nil {
+		return fmt.Errorf("failed to get bot user ID: %w", err)
+	}
+	target.UserID = resp.UserID
+	if len(target.DeviceID) == 0 {
+		target.DeviceID = resp.DeviceID
+	}
+	if len(target.DeviceID) == 0 {
+		return errors.New("device ID not specified and homeserver didn't return one")
+	}
 	return nil
 }
 
+// syncLoop is a single run of the sync loop of a target.
+type syncLoop struct {
+	cancel     context.CancelFunc
+	done       chan struct{}
+	stopReason StopReason
+}
+
+// startInBackground runs Start in a new goroutine. Unlike a plain "go target.Start()", the target can't be evicted
+// from the target cache between the call and the sync loop being set up, which would let a second copy of the
+// target be loaded and started.
+func (target *SyncTarget) startInBackground() {
+	atomic.AddInt32(&target.pendingStarts, 1)
+	go func() {
+		defer atomic.AddInt32(&target.pendingStarts, -1)
+		target.Start()
+	}()
+}
+
 func (target *SyncTarget) Start() {
-	syncLog := target.log.Sub(fmt.Sprintf("Sync-%d", atomic.AddUint64(&globalSyncID, 1)))
-	if target.running {
-		syncLog.Debugln("There seems to be an existing syncer running, stopping it first")
-		target.Stop()
+	if isShuttingDown() {
+		target.log.Debugln("Not starting syncing as the proxy is shutting down")
+		return
 	}
+	syncID := atomic.AddUint64(&globalSyncID, 1)
+	syncFields := target.logFields().with("sync_id", syncID)
+	syncLog := target.log.Subm(fmt.Sprintf("Sync-%d", syncID), syncFields)
+	ctx := context.WithValue(context.WithValue(context.Background(), logContextKey, syncLog), logFieldsContextKey, syncFields)
+	ctx, cancelFunc := context.WithCancel(ctx)
+	loop := &syncLoop{cancel: cancelFunc, done: make(chan struct{})}
 
-	syncLog.Debugln("Locking mutex to start syncing")
 	target.lock.Lock()
-	target.wg = sync.WaitGroup{}
-	target.wg.Add(1)
-	target.running = true
+	prevLoop := target.loop
+	target.loop = loop
+	atomic.StoreInt32(&target.running, 1)
+	target.lock.Unlock()
+
+	if prevLoop != nil {
+		// The old loop only blocks on things that are interrupted by canceling the context,
+		// so this returns as soon as it has finished storing its state.
+		syncLog.Debugln("There seems to be an existing syncer running, stopping it first")
+		target.stopLoop(prevLoop, StopReasonRestart)
+		<-prevLoop.done
+	}
 
 	defer func() {
-		target.running = false
-		target.cancel = nil
-		target.wg.Done()
-		syncLog.Debugln("Unlocking mutex")
-		target.lock.Unlock()
 		err := recover()
 		if err != nil {
-			syncLog.Errorfln("Syncing panicked: %v\n%s", err, debug.Stack())
+			stack := debug.Stack()
+			syncLog.Errorfln("Syncing panicked: %v\n%s", err, stack)
+			target.recordStop(StopReasonPanic, fmt.Errorf("panic: %v", err))
+			target.reportError("Syncing panicked", fmt.Errorf("panic: %v", err), map[string]interface{}{"stack": string(stack)})
 		}
-	}()
-
-	if err := target.SetActive(true); err != nil {
-		syncLog.Warnln("Failed to mark target as active:", err)
-	}
-	defer func() {
-		if err := target.SetActive(false); err != nil {
-			syncLog.Warnln("Failed to mark target as inactive:", err)
+		target.lock.Lock()
+		superseded := target.loop != loop
+		if !superseded {
+			target.loop = nil
+			atomic.StoreInt32(&target.running, 0)
+		}
+		target.lock.Unlock()
+		if !superseded {
+			target.statusLock.RLock()
+			shutdown := loop.stopReason == StopReasonShutdown
+			target.statusLock.RUnlock()
+			// Targets stopped by a shutdown stay active, so that they're started again on boot.
+			if !shutdown {
+				target.SetActive(false)
+			}
+			target.closeDeliveryClient()
 		}
+		cancelFunc()
+		close(loop.done)
 	}()
 
-	ctx, cancelFunc := context.WithCancel(context.WithValue(context.Background(), logContextKey, syncLog))
-	target.cancel = cancelFunc
+	target.SetActive(true)
+	target.heartbeat(0)
+	atomic.StoreUint64(&target.sessionTransactions, 0)
+	target.recordLoopStart()
 
 	syncLog.Infoln("Starting syncing")
-	err := target.sync(ctx)
+	target.notifyWebhook(&WebhookEvent{Type: WebhookEventStarted})
+	var err error
+	for {
+		var leaseCtx context.Context
+		var leaseLost func() bool
+		if leaseCtx, leaseLost, err = target.holdLease(ctx); err != nil {
+			break
+		}
+		if target.storeAndForward() {
+			// The queue is delivered by the sync loop, so an unreachable target doesn't prevent syncing.
+			target.backlogged = true
+			target.backlogRetryAt = time.Time{}
+			target.backlogRetryIn = 0
+		} else {
+			err = target.deliverPendingTransactions(leaseCtx)
+		}
+		if err == nil {
+			err = target.sync(leaseCtx)
+		}
+		if !leaseLost() {
+			break
+		}
+		// Another instance is syncing the target now, so this loop waits until it can take over again.
+		target.recordStop(StopReasonLeaseLost, nil)
+	}
+	if errors.Is(err, errTargetNotActiveInDatabase) {
+		// The last stop was already recorded by the instance that stopped the target.
+		syncLog.Infoln("Not syncing after acquiring lease:", err)
+		return
+	}
+	target.statusLock.RLock()
+	reason := classifyTermination(err, loop.stopReason)
+	target.statusLock.RUnlock()
+	target.recordStop(reason, err)
 	if errors.Is(err, context.Canceled) {
-		syncLog.Infoln("Syncing stopped")
+		syncLog.Infofln("Syncing stopped (%s)", reason)
 	} else if err != nil {
-		syncLog.Errorfln("Syncing failed: %v, notifying target...", err)
+		syncLog.Errorfln("Syncing failed (%s): %v, notifying target...", reason, err)
 		proxyErr := &errorRequest{
 			Error:   ProxyErrorUnknown,
 			Message: err.Error(),
 		}
-		if errors.Is(err, mautrix.MUnknownToken) {
+		notifyCtx := ctx
+		if reason == StopReasonCircuitOpen {
+			target.openCircuit(syncLog)
+			proxyErr.Error = ProxyErrorCircuitOpen
+			// The target is most likely still down, so the notification isn't retried.
+			notifyCtx = context.WithValue(ctx, singleAttemptContextKey, true)
+		} else if isSoftLogout(err) {
+			proxyErr.Error = ProxyErrorSoftLoggedOut
+			proxyErr.Message = "The access token was soft logged out, PUT the target again with a new bot_access_token for the same device to resume syncing"
+		} else if errors.Is(err, mautrix.MUnknownToken) {
 			proxyErr.Error = ProxyErrorLoggedOut
 		}
-		err = target.tryPostTransaction(ctx, nil, proxyErr)
+		err = target.tryPostTransaction(notifyCtx, nil, proxyErr)
 		if err != nil {
 			syncLog.Warnln("Failed to notify target about sync error:", err)
 		}
 	}
 }
 
-func (target *SyncTarget) Stop() {
-	if cancelFn := target.cancel; cancelFn != nil {
-		target.log.Debugln("Stopping syncing...")
-		cancelFn()
+func (target *SyncTarget) stopLoop(loop *syncLoop, reason StopReason) {
+	target.statusLock.Lock()
+	loop.stopReason = reason
+	target.statusLock.Unlock()
+	loop.cancel()
+}
+
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// Stop cancels the current sync loop. The returned channel is closed once the loop has exited.
+func (target *SyncTarget) Stop(reason StopReason) <-chan struct{} {
+	target.lock.Lock()
+	loop := target.loop
+	target.lock.Unlock()
+	if loop == nil {
+		return closedChan
 	}
+	target.log.Debugfln("Stopping syncing (%s)...", reason)
+	target.stopLoop(loop, reason)
+	return loop.done
 }
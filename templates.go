@@ -0,0 +1,253 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"maunium.net/go/mautrix"
+)
+
+// RetryPolicy configures the backoff used when retrying /sync requests and transaction deliveries.
+// Zero values mean the built-in defaults.
+type RetryPolicy struct {
+	SyncInitial        time.Duration `yaml:"sync_initial"`
+	SyncMax            time.Duration `yaml:"sync_max"`
+	TransactionInitial time.Duration `yaml:"transaction_initial"`
+	TransactionMax     time.Duration `yaml:"transaction_max"`
+	// SyncMultiplier and TransactionMultiplier are the factors the retry interval grows by after each failure.
+	SyncMultiplier        float64 `yaml:"sync_multiplier"`
+	TransactionMultiplier float64 `yaml:"transaction_multiplier"`
+}
+
+const defaultRetryMultiplier = 2
+const maxRetryMultiplier = 10
+
+// withFallback fills the zero values of the policy from the fallback policy.
+func (policy RetryPolicy) withFallback(fallback RetryPolicy) RetryPolicy {
+	if policy.SyncInitial <= 0 {
+		policy.SyncInitial = fallback.SyncInitial
+	}
+	if policy.SyncMax <= 0 {
+		policy.SyncMax = fallback.SyncMax
+	}
+	if policy.TransactionInitial <= 0 {
+		policy.TransactionInitial = fallback.TransactionInitial
+	}
+	if policy.TransactionMax <= 0 {
+		policy.TransactionMax = fallback.TransactionMax
+	}
+	if policy.SyncMultiplier <= 0 {
+		policy.SyncMultiplier = fallback.SyncMultiplier
+	}
+	if policy.TransactionMultiplier <= 0 {
+		policy.TransactionMultiplier = fallback.TransactionMultiplier
+	}
+	return policy
+}
+
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.SyncInitial <= 0 {
+		policy.SyncInitial = initialSyncRetrySleep
+	}
+	if policy.SyncMax <= 0 {
+		policy.SyncMax = maxSyncRetryInterval
+	}
+	if policy.TransactionInitial <= 0 {
+		policy.TransactionInitial = initialTransactionRetrySleep
+	}
+	if policy.TransactionMax <= 0 {
+		policy.TransactionMax = maxTransactionRetryInterval
+	}
+	if policy.SyncMultiplier <= 0 {
+		policy.SyncMultiplier = defaultRetryMultiplier
+	}
+	if policy.TransactionMultiplier <= 0 {
+		policy.TransactionMultiplier = defaultRetryMultiplier
+	}
+	return policy
+}
+
+func validateRetryMultiplier(name string, multiplier float64) error {
+	if multiplier != 0 && (multiplier < 1 || multiplier > maxRetryMultiplier) {
+		return fmt.Errorf("%s must be between 1 and %d", name, maxRetryMultiplier)
+	}
+	return nil
+}
+
+func nextRetryInterval(current time.Duration, multiplier float64, max time.Duration) time.Duration {
+	next := time.Duration(float64(current) * multiplier)
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// NextSync returns the sync retry interval to use after a retry with the given interval failed.
+func (policy RetryPolicy) NextSync(current time.Duration) time.Duration {
+	return nextRetryInterval(current, policy.SyncMultiplier, policy.SyncMax)
+}
+
+// NextTransaction returns the transaction retry interval to use after a retry with the given interval failed.
+func (policy RetryPolicy) NextTransaction(current time.Duration) time.Duration {
+	return nextRetryInterval(current, policy.TransactionMultiplier, policy.TransactionMax)
+}
+
+// YAMLFilter is a sync filter that can be unmarshaled from YAML using the same field names as the JSON filter.
+type YAMLFilter struct {
+	mautrix.Filter
+}
+
+func (filter *YAMLFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	data, err := json.Marshal(yamlToJSONCompatible(raw))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &filter.Filter)
+}
+
+// yamlToJSONCompatible converts the map[interface{}]interface{}s produced by yaml.v2 into map[string]interface{}s.
+func yamlToJSONCompatible(val interface{}) interface{} {
+	switch typedVal := val.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typedVal))
+		for key, item := range typedVal {
+			converted[fmt.Sprint(key)] = yamlToJSONCompatible(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range typedVal {
+			typedVal[i] = yamlToJSONCompatible(item)
+		}
+		return typedVal
+	default:
+		return val
+	}
+}
+
+// TargetTemplate contains defaults for sync targets. Targets refer to templates by name,
+// so changes to a template apply to all targets using it after a restart.
+type TargetTemplate struct {
+	// Address is the default target address. {appservice_id} and {device_id} are replaced with the target's values.
+	Address string      `yaml:"address"`
+	Retry   RetryPolicy `yaml:"retry"`
+	Filter  *YAMLFilter `yaml:"filter"`
+	// TransactionPath and ErrorPath are the default path templates for targets using the template.
+	TransactionPath string `yaml:"transaction_path"`
+	ErrorPath       string `yaml:"error_path"`
+}
+
+func validateTemplates(templates map[string]*TargetTemplate) error {
+	for name, tpl := range templates {
+		if tpl == nil {
+			continue
+		} else if err := validateTxnPathTemplate("transaction_path", tpl.TransactionPath); err != nil {
+			return fmt.Errorf("template %s: %w", name, err)
+		} else if err = validateTxnPathTemplate("error_path", tpl.ErrorPath); err != nil {
+			return fmt.Errorf("template %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func loadTemplates(path string) (map[string]*TargetTemplate, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var templates map[string]*TargetTemplate
+	err = yaml.NewDecoder(file).Decode(&templates)
+	return templates, err
+}
+
+func (target *SyncTarget) getTemplate() *TargetTemplate {
+	if len(target.Template) == 0 {
+		return nil
+	}
+	return cfg.Templates[target.Template]
+}
+
+func (target *SyncTarget) getAddress() string {
+	if len(target.Address) > 0 {
+		return target.Address
+	} else if tpl := target.getTemplate(); tpl != nil {
+		return strings.NewReplacer(
+			"{appservice_id}", target.AppserviceID,
+			"{device_id}", target.DeviceID.String(),
+		).Replace(tpl.Address)
+	}
+	return ""
+}
+
+// getRetryPolicy returns the retry policy of the target, filling unset values from its template,
+// the default policy of the admin config API and the built-in defaults, in that order.
+func (target *SyncTarget) getRetryPolicy() RetryPolicy {
+	policy := target.retryPolicy
+	if tpl := target.getTemplate(); tpl != nil {
+		policy = policy.withFallback(tpl.Retry)
+	}
+	return policy.withFallback(getDefaultRetryPolicy()).withDefaults()
+}
+
+func (target *SyncTarget) retryPolicyJSON() string {
+	if target.Retry == nil {
+		return ""
+	}
+	data, _ := json.Marshal(target.Retry)
+	return string(data)
+}
+
+func parseRetryPolicyJSON(data string) (*RetryPolicyJSON, RetryPolicy, error) {
+	if len(data) == 0 {
+		return nil, RetryPolicy{}, nil
+	}
+	var rpj RetryPolicyJSON
+	if err := json.Unmarshal([]byte(data), &rpj); err != nil {
+		return nil, RetryPolicy{}, err
+	}
+	policy, err := rpj.Parse()
+	return &rpj, policy, err
+}
+
+func (target *SyncTarget) getSyncFilter() *mautrix.Filter {
+	filter := syncFilter
+	if target.FullSync {
+		filter = fullSyncFilter
+	}
+	if target.Filter != nil {
+		filter = target.Filter
+	} else if tpl := target.getTemplate(); tpl != nil && tpl.Filter != nil {
+		filter = &tpl.Filter.Filter
+	}
+	if target.ForwardPresence {
+		withPresence := *filter
+		withPresence.Presence = mautrix.FilterPart{}
+		filter = &withPresence
+	}
+	return filter
+}
@@ -0,0 +1,138 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// ReceivedTransaction is a transaction that the mock appservice received from syncproxy.
+type ReceivedTransaction struct {
+	TxnID string
+	// IsError is true for error notifications sent to the syncproxy error endpoint instead of normal transactions.
+	IsError bool
+	Query   map[string][]string
+	Raw     json.RawMessage
+	// Body is the parsed transaction. It's empty for error notifications.
+	Body appservice.Transaction
+}
+
+// MockAppservice is an appservice that records the transactions it receives.
+type MockAppservice struct {
+	*httptest.Server
+	HSToken string
+
+	// Respond can be set to choose the HTTP status code of the response to each transaction,
+	// e.g. to simulate delivery failures. By default every transaction is accepted.
+	Respond func(txn *ReceivedTransaction) int
+
+	txns     []*ReceivedTransaction
+	notify   chan struct{}
+	txnsLock sync.Mutex
+}
+
+// NewMockAppservice starts a mock appservice that accepts transactions with the given hs_token.
+// It's closed when the test finishes.
+func NewMockAppservice(t testing.TB, hsToken string) *MockAppservice {
+	as := &MockAppservice{HSToken: hsToken, notify: make(chan struct{})}
+	router := mux.NewRouter()
+	router.HandleFunc("/_matrix/app/v1/transactions/{txnID}", as.handleTransaction).Methods(http.MethodPut)
+	router.HandleFunc("/_matrix/app/unstable/fi.mau.syncproxy/error/{txnID}", as.handleTransaction).Methods(http.MethodPut)
+	as.Server = httptest.NewServer(router)
+	t.Cleanup(as.Close)
+	return as
+}
+
+// Transactions returns the transactions received so far.
+func (as *MockAppservice) Transactions() []*ReceivedTransaction {
+	as.txnsLock.Lock()
+	defer as.txnsLock.Unlock()
+	return append([]*ReceivedTransaction(nil), as.txns...)
+}
+
+// WaitForTransaction waits until a transaction matching the given function has been received and returns it.
+// Transactions received before the call are checked too. If match is nil, any transaction matches.
+func (as *MockAppservice) WaitForTransaction(ctx context.Context, match func(txn *ReceivedTransaction) bool) (*ReceivedTransaction, error) {
+	checked := 0
+	for {
+		as.txnsLock.Lock()
+		txns := as.txns[checked:]
+		notify := as.notify
+		as.txnsLock.Unlock()
+		for _, txn := range txns {
+			if match == nil || match(txn) {
+				return txn, nil
+			}
+		}
+		checked += len(txns)
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (as *MockAppservice) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != as.HSToken {
+		writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid hs_token")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", "Failed to read request body")
+		return
+	}
+	txn := &ReceivedTransaction{
+		TxnID:   mux.Vars(r)["txnID"],
+		IsError: strings.Contains(r.URL.Path, "/fi.mau.syncproxy/error/"),
+		Query:   r.URL.Query(),
+		Raw:     data,
+	}
+	if !txn.IsError {
+		if err = json.Unmarshal(data, &txn.Body); err != nil {
+			writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", "Request body is not valid JSON")
+			return
+		}
+	}
+	status := http.StatusOK
+	if as.Respond != nil {
+		status = as.Respond(txn)
+	}
+	if status == http.StatusOK {
+		as.txnsLock.Lock()
+		as.txns = append(as.txns, txn)
+		close(as.notify)
+		as.notify = make(chan struct{})
+		as.txnsLock.Unlock()
+		writeJSON(w, status, struct{}{})
+	} else {
+		writeMatrixError(w, status, "M_UNKNOWN", "Transaction rejected by test")
+	}
+}
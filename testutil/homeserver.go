@@ -0,0 +1,232 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package testutil contains helpers for integration tests that cover the syncproxy hop: a mock homeserver
+// with scripted /sync responses, a mock appservice that records the transactions it receives, and a helper
+// that runs mautrix-syncproxy against an in-memory SQLite database.
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxSyncWait caps the long-polling timeout of the mock homeserver, so that tests don't hang on empty syncs.
+const maxSyncWait = 5 * time.Second
+
+type mockUser struct {
+	UserID   id.UserID
+	DeviceID id.DeviceID
+	queue    chan mockSyncResponse
+	requests []SyncRequest
+}
+
+// mockSyncResponse is a scripted /sync response. If status is set, the error is returned instead of resp.
+type mockSyncResponse struct {
+	resp   *mautrix.RespSync
+	status int
+	err    mautrix.RespError
+}
+
+// SyncRequest is a /sync request that the mock homeserver received.
+type SyncRequest struct {
+	Since   string
+	Filter  string
+	Timeout time.Duration
+}
+
+// MockHomeserver is a homeserver that only implements the endpoints syncproxy uses. /sync responses
+// are scripted with QueueSync and QueueSyncError, and requests without a queued response return an empty sync
+// after the timeout.
+type MockHomeserver struct {
+	*httptest.Server
+
+	users     map[string]*mockUser
+	filters   int
+	batch     int
+	usersLock sync.Mutex
+}
+
+// NewMockHomeserver starts a mock homeserver that's closed when the test finishes.
+func NewMockHomeserver(t testing.TB) *MockHomeserver {
+	hs := &MockHomeserver{users: make(map[string]*mockUser)}
+	router := mux.NewRouter()
+	router.HandleFunc("/_matrix/client/versions", hs.versions).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/federation/v1/version", hs.serverVersion).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/r0/account/whoami", hs.whoami).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/r0/user/{userID}/filter", hs.createFilter).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/r0/sync", hs.sync).Methods(http.MethodGet)
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMatrixError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+	})
+	hs.Server = httptest.NewServer(router)
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// AddUser registers an access token for the given user and device.
+func (hs *MockHomeserver) AddUser(accessToken string, userID id.UserID, deviceID id.DeviceID) {
+	hs.usersLock.Lock()
+	hs.users[accessToken] = &mockUser{
+		UserID:   userID,
+		DeviceID: deviceID,
+		queue:    make(chan mockSyncResponse, 64),
+	}
+	hs.usersLock.Unlock()
+}
+
+// QueueSync adds a response to be returned from the next /sync request of the given access token.
+// If the response doesn't have a next_batch token, a new one is generated.
+func (hs *MockHomeserver) QueueSync(accessToken string, resp *mautrix.RespSync) {
+	hs.usersLock.Lock()
+	user, ok := hs.users[accessToken]
+	if len(resp.NextBatch) == 0 {
+		hs.batch++
+		resp.NextBatch = "s" + strconv.Itoa(hs.batch)
+	}
+	hs.usersLock.Unlock()
+	if !ok {
+		panic(fmt.Errorf("QueueSync called with unknown access token"))
+	}
+	user.queue <- mockSyncResponse{resp: resp}
+}
+
+// QueueSyncError makes the next /sync request of the given access token fail with the given HTTP status and
+// Matrix error, e.g. to test how the proxy retries when the homeserver is unavailable.
+func (hs *MockHomeserver) QueueSyncError(accessToken string, status int, errcode, message string) {
+	hs.usersLock.Lock()
+	user, ok := hs.users[accessToken]
+	hs.usersLock.Unlock()
+	if !ok {
+		panic(fmt.Errorf("QueueSyncError called with unknown access token"))
+	}
+	user.queue <- mockSyncResponse{status: status, err: mautrix.RespError{ErrCode: errcode, Err: message}}
+}
+
+// SyncRequests returns the /sync requests that have been made with the given access token.
+func (hs *MockHomeserver) SyncRequests(accessToken string) []SyncRequest {
+	hs.usersLock.Lock()
+	defer hs.usersLock.Unlock()
+	user, ok := hs.users[accessToken]
+	if !ok {
+		return nil
+	}
+	return append([]SyncRequest(nil), user.requests...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, errcode, message string) {
+	writeJSON(w, status, map[string]string{"errcode": errcode, "error": message})
+}
+
+func (hs *MockHomeserver) authenticate(w http.ResponseWriter, r *http.Request) *mockUser {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(token) == 0 {
+		token = r.URL.Query().Get("access_token")
+	}
+	hs.usersLock.Lock()
+	user, ok := hs.users[token]
+	hs.usersLock.Unlock()
+	if !ok {
+		writeMatrixError(w, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Unknown access token")
+		return nil
+	}
+	return user
+}
+
+func (hs *MockHomeserver) versions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, mautrix.RespVersions{Versions: []string{"r0.6.1"}})
+}
+
+func (hs *MockHomeserver) serverVersion(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"server": map[string]string{"name": "Synapse", "version": "mock"},
+	})
+}
+
+func (hs *MockHomeserver) whoami(w http.ResponseWriter, r *http.Request) {
+	if user := hs.authenticate(w, r); user != nil {
+		writeJSON(w, http.StatusOK, mautrix.RespWhoami{UserID: user.UserID, DeviceID: user.DeviceID})
+	}
+}
+
+func (hs *MockHomeserver) createFilter(w http.ResponseWriter, r *http.Request) {
+	if user := hs.authenticate(w, r); user == nil {
+		return
+	} else if mux.Vars(r)["userID"] != string(user.UserID) {
+		writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "Can't create filters for other users")
+		return
+	}
+	hs.usersLock.Lock()
+	hs.filters++
+	filterID := strconv.Itoa(hs.filters)
+	hs.usersLock.Unlock()
+	writeJSON(w, http.StatusOK, mautrix.RespCreateFilter{FilterID: filterID})
+}
+
+func (hs *MockHomeserver) sync(w http.ResponseWriter, r *http.Request) {
+	user := hs.authenticate(w, r)
+	if user == nil {
+		return
+	}
+	query := r.URL.Query()
+	timeoutMS, _ := strconv.Atoi(query.Get("timeout"))
+	req := SyncRequest{
+		Since:   query.Get("since"),
+		Filter:  query.Get("filter"),
+		Timeout: time.Duration(timeoutMS) * time.Millisecond,
+	}
+	hs.usersLock.Lock()
+	user.requests = append(user.requests, req)
+	hs.usersLock.Unlock()
+
+	wait := req.Timeout
+	if wait > maxSyncWait {
+		wait = maxSyncWait
+	}
+	select {
+	case scripted := <-user.queue:
+		if scripted.status != 0 {
+			writeMatrixError(w, scripted.status, scripted.err.ErrCode, scripted.err.Err)
+		} else {
+			writeJSON(w, http.StatusOK, scripted.resp)
+		}
+	case <-time.After(wait):
+		nextBatch := req.Since
+		if len(nextBatch) == 0 {
+			nextBatch = "s0"
+		}
+		writeJSON(w, http.StatusOK, &mautrix.RespSync{NextBatch: nextBatch})
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,272 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const proxyPackage = "go.mau.fi/mautrix-syncproxy/cmd/mautrix-syncproxy"
+const proxyStartTimeout = 30 * time.Second
+
+// ProxyOptions are the settings for starting a syncproxy instance.
+type ProxyOptions struct {
+	// Binary is the path to a mautrix-syncproxy binary. If empty, the binary is built once per test process
+	// with `go build go.mau.fi/mautrix-syncproxy/cmd/mautrix-syncproxy`, which requires the module to be in the caller's go.mod.
+	Binary string
+	// HomeserverURL is the URL of the homeserver, usually MockHomeserver.URL.
+	HomeserverURL string
+	// SharedSecret is the secret for the target management API. A random one is generated if empty.
+	SharedSecret string
+	// Env contains additional environment variables in the KEY=value format, e.g. "DEBUG=true".
+	Env []string
+}
+
+// Proxy is a running syncproxy instance.
+type Proxy struct {
+	URL          string
+	SharedSecret string
+
+	cmd  *exec.Cmd
+	logs bytes.Buffer
+	done chan struct{}
+}
+
+var builtBinary string
+var buildErr error
+var buildOnce sync.Once
+
+func buildProxy() (string, error) {
+	buildOnce.Do(func() {
+		var dir string
+		dir, buildErr = os.MkdirTemp("", "syncproxy-testutil")
+		if buildErr != nil {
+			return
+		}
+		builtBinary = filepath.Join(dir, "mautrix-syncproxy")
+		output, err := exec.Command("go", "build", "-o", builtBinary, proxyPackage).CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("failed to build %s: %w\n%s", proxyPackage, err, output)
+		}
+	})
+	return builtBinary, buildErr
+}
+
+func randomString() string {
+	data := make([]byte, 16)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func freeAddress() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr, nil
+}
+
+// StartProxy runs syncproxy with an in-memory SQLite database and waits until it accepts requests.
+// The process is stopped when the test finishes, and its logs are included in the test output if the test failed.
+func StartProxy(t testing.TB, opts ProxyOptions) *Proxy {
+	t.Helper()
+	binary := opts.Binary
+	if len(binary) == 0 {
+		var err error
+		if binary, err = buildProxy(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr, err := freeAddress()
+	if err != nil {
+		t.Fatal("Failed to find free port for syncproxy:", err)
+	}
+	proxy := &Proxy{
+		URL:          "http://" + addr,
+		SharedSecret: opts.SharedSecret,
+		done:         make(chan struct{}),
+	}
+	if len(proxy.SharedSecret) == 0 {
+		proxy.SharedSecret = randomString()
+	}
+	proxy.cmd = exec.Command(binary, "-config", "env")
+	proxy.cmd.Env = append([]string{
+		"PATH=" + os.Getenv("PATH"),
+		"LISTEN_ADDRESS=" + addr,
+		"HOMESERVER_URL=" + opts.HomeserverURL,
+		"SHARED_SECRET=" + proxy.SharedSecret,
+		"DATABASE_URL=sqlite://:memory:",
+	}, opts.Env...)
+	proxy.cmd.Stdout = &lockedWriter{w: &proxy.logs}
+	proxy.cmd.Stderr = proxy.cmd.Stdout
+	if err = proxy.cmd.Start(); err != nil {
+		t.Fatal("Failed to start syncproxy:", err)
+	}
+	go func() {
+		_ = proxy.cmd.Wait()
+		close(proxy.done)
+	}()
+	t.Cleanup(func() {
+		proxy.Stop()
+		if t.Failed() {
+			t.Logf("syncproxy logs:\n%s", proxy.Logs())
+		}
+	})
+	if err = proxy.waitReady(); err != nil {
+		t.Fatalf("syncproxy didn't start: %v\n%s", err, proxy.Logs())
+	}
+	return proxy
+}
+
+// lockedWriter makes the log buffer safe to read while the process is writing to it.
+type lockedWriter struct {
+	w    *bytes.Buffer
+	lock sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	return lw.w.Write(p)
+}
+
+// Logs returns the output of the syncproxy process so far.
+func (proxy *Proxy) Logs() string {
+	lw := proxy.cmd.Stdout.(*lockedWriter)
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	return lw.w.String()
+}
+
+func (proxy *Proxy) waitReady() error {
+	deadline := time.Now().Add(proxyStartTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(proxy.URL + "/version")
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-proxy.done:
+			return fmt.Errorf("process exited")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("timed out after %v", proxyStartTimeout)
+}
+
+// Stop stops the syncproxy process and waits for it to exit.
+func (proxy *Proxy) Stop() {
+	select {
+	case <-proxy.done:
+		return
+	default:
+	}
+	_ = proxy.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-proxy.done:
+	case <-time.After(10 * time.Second):
+		_ = proxy.cmd.Process.Kill()
+		<-proxy.done
+	}
+}
+
+// Target is the body of a target PUT request. See the README for the other supported fields,
+// which can be included in Extra.
+type Target struct {
+	BotAccessToken string `json:"bot_access_token"`
+	HSToken        string `json:"hs_token"`
+	Address        string `json:"address"`
+	UserID         string `json:"user_id"`
+	DeviceID       string `json:"device_id"`
+	IsProxy        bool   `json:"is_proxy"`
+
+	Extra map[string]interface{} `json:"-"`
+}
+
+func (target *Target) MarshalJSON() ([]byte, error) {
+	type plainTarget Target
+	data, err := json.Marshal((*plainTarget)(target))
+	if err != nil || len(target.Extra) == 0 {
+		return data, err
+	}
+	merged := make(map[string]interface{}, len(target.Extra)+6)
+	for key, value := range target.Extra {
+		merged[key] = value
+	}
+	if err = json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	return json.Marshal(merged)
+}
+
+func (proxy *Proxy) targetRequest(ctx context.Context, method, appserviceID string, body interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%s/_matrix/client/unstable/fi.mau.syncproxy/%s", proxy.URL, appserviceID)
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+proxy.SharedSecret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var respErr struct {
+			ErrCode string `json:"errcode"`
+			Err     string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&respErr)
+		return fmt.Errorf("%s %s returned HTTP %d: %s: %s", method, url, resp.StatusCode, respErr.ErrCode, respErr.Err)
+	}
+	return nil
+}
+
+// PutTarget creates or updates a target, which makes syncproxy start syncing on its behalf.
+func (proxy *Proxy) PutTarget(ctx context.Context, appserviceID string, target *Target) error {
+	return proxy.targetRequest(ctx, http.MethodPut, appserviceID, target)
+}
+
+// DeleteTarget stops syncing for a target.
+func (proxy *Proxy) DeleteTarget(ctx context.Context, appserviceID string) error {
+	return proxy.targetRequest(ctx, http.MethodDelete, appserviceID, nil)
+}
@@ -0,0 +1,324 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+const testTimeout = 30 * time.Second
+
+var testEventType = event.Type{Type: "fi.mau.syncproxy.test", Class: event.ToDeviceEventType}
+
+type testEnv struct {
+	hs    *MockHomeserver
+	as    *MockAppservice
+	proxy *Proxy
+	ctx   context.Context
+}
+
+// newTestEnv starts a mock homeserver, a mock appservice and a syncproxy, and registers a target that syncs
+// as the appservice's bot. Transaction retries are fast so that tests don't wait for the default backoff.
+func newTestEnv(t *testing.T, env ...string) *testEnv {
+	hs := NewMockHomeserver(t)
+	hs.AddUser("bot_token", "@bot:example.com", "DEVICE")
+	as := NewMockAppservice(t, "hs_token")
+	proxy := StartProxy(t, ProxyOptions{HomeserverURL: hs.URL, Env: env})
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return &testEnv{hs: hs, as: as, proxy: proxy, ctx: ctx}
+}
+
+func (env *testEnv) putTarget(t *testing.T) {
+	t.Helper()
+	err := env.proxy.PutTarget(env.ctx, "testbridge", &Target{
+		BotAccessToken: "bot_token",
+		HSToken:        "hs_token",
+		Address:        env.as.URL,
+		UserID:         "@bot:example.com",
+		DeviceID:       "DEVICE",
+		Extra: map[string]interface{}{
+			"retry": map[string]interface{}{
+				"transaction_initial":    "100ms",
+				"transaction_max":        "1s",
+				"transaction_multiplier": 2,
+				"sync_initial":           "100ms",
+				"sync_max":               "1s",
+				"sync_multiplier":        2,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create target:", err)
+	}
+}
+
+func testSyncResponse(n int) *mautrix.RespSync {
+	var resp mautrix.RespSync
+	resp.ToDevice.Events = []*event.Event{{
+		Sender:  "@alice:example.com",
+		Type:    testEventType,
+		Content: event.Content{Raw: map[string]interface{}{"n": n}},
+	}}
+	return &resp
+}
+
+func hasTestEvent(n int) func(txn *ReceivedTransaction) bool {
+	return func(txn *ReceivedTransaction) bool {
+		return txn.toDeviceNumber() == n
+	}
+}
+
+// toDeviceNumber returns the n field of the first test to-device event in the transaction, or -1.
+func (txn *ReceivedTransaction) toDeviceNumber() int {
+	for _, evt := range txn.Body.EphemeralEvents {
+		if evt.Type.Type == testEventType.Type {
+			if n, ok := evt.Content.Raw["n"].(float64); ok {
+				return int(n)
+			}
+		}
+	}
+	return -1
+}
+
+func TestSyncDelivery(t *testing.T) {
+	env := newTestEnv(t)
+	env.putTarget(t)
+	env.hs.QueueSync("bot_token", testSyncResponse(1))
+	env.hs.QueueSync("bot_token", testSyncResponse(2))
+
+	txn, err := env.as.WaitForTransaction(env.ctx, hasTestEvent(2))
+	if err != nil {
+		t.Fatal("Second transaction wasn't delivered:", err)
+	}
+	txns := env.as.Transactions()
+	if len(txns) != 2 || txns[0].toDeviceNumber() != 1 || txns[1] != txn {
+		t.Fatalf("Expected the two sync responses to be delivered in order, got %d transactions", len(txns))
+	}
+	evt := txn.Body.EphemeralEvents[0]
+	if evt.Sender != "@alice:example.com" || evt.ToUserID != "@bot:example.com" || evt.ToDeviceID != "DEVICE" {
+		t.Errorf("To-device event doesn't have the expected sender and recipient: %s -> %s/%s", evt.Sender, evt.ToUserID, evt.ToDeviceID)
+	}
+
+	// The request after the second response is sent asynchronously after delivering it.
+	requests := env.hs.SyncRequests("bot_token")
+	for deadline := time.Now().Add(5 * time.Second); len(requests) < 3 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		requests = env.hs.SyncRequests("bot_token")
+	}
+	if len(requests) < 3 {
+		t.Fatalf("Expected at least 3 sync requests, got %d", len(requests))
+	} else if requests[0].Since != "" || requests[1].Since == "" || requests[2].Since == requests[1].Since {
+		t.Errorf("Sync requests didn't continue from the previous next_batch: %+v", requests)
+	}
+
+	if err = env.proxy.DeleteTarget(env.ctx, "testbridge"); err != nil {
+		t.Error("Failed to delete target:", err)
+	}
+}
+
+func TestSyncErrorRetry(t *testing.T) {
+	env := newTestEnv(t)
+	env.hs.QueueSyncError("bot_token", http.StatusBadGateway, "M_UNKNOWN", "Homeserver is restarting")
+	env.hs.QueueSyncError("bot_token", http.StatusBadGateway, "M_UNKNOWN", "Homeserver is restarting")
+	env.hs.QueueSync("bot_token", testSyncResponse(1))
+	start := time.Now()
+	env.putTarget(t)
+
+	if _, err := env.as.WaitForTransaction(env.ctx, hasTestEvent(1)); err != nil {
+		t.Fatal("Transaction wasn't delivered after sync errors:", err)
+	}
+	// The sync retries back off from 100ms, so the two failures take at least 100ms + 200ms.
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Sync was retried without backing off (delivered after %v)", elapsed)
+	}
+	requests := env.hs.SyncRequests("bot_token")
+	if len(requests) < 3 {
+		t.Fatalf("Expected at least 3 sync requests, got %d", len(requests))
+	}
+	for _, req := range requests[:3] {
+		if req.Since != "" {
+			t.Errorf("Failed sync requests shouldn't advance the sync token: %+v", requests)
+			break
+		}
+	}
+	if len(env.as.Transactions()) != 1 {
+		t.Errorf("Expected only the sync response to be delivered, got %d transactions", len(env.as.Transactions()))
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	env := newTestEnv(t)
+	var attempts []time.Time
+	var attemptsLock sync.Mutex
+	env.as.Respond = func(txn *ReceivedTransaction) int {
+		if txn.toDeviceNumber() != 1 {
+			return http.StatusOK
+		}
+		attemptsLock.Lock()
+		defer attemptsLock.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 3 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	}
+	env.putTarget(t)
+	env.hs.QueueSync("bot_token", testSyncResponse(1))
+	env.hs.QueueSync("bot_token", testSyncResponse(2))
+
+	if _, err := env.as.WaitForTransaction(env.ctx, hasTestEvent(2)); err != nil {
+		t.Fatal("Transaction after the retried one wasn't delivered:", err)
+	}
+	txns := env.as.Transactions()
+	if len(txns) != 2 || txns[0].toDeviceNumber() != 1 {
+		t.Fatalf("Expected the retried transaction to be delivered before the next one, got %d transactions", len(txns))
+	}
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+	if len(attempts) != 3 {
+		t.Fatalf("Expected 3 delivery attempts, got %d", len(attempts))
+	}
+	// The retry interval starts at 100ms and doubles after each failure.
+	if gap := attempts[1].Sub(attempts[0]); gap < 100*time.Millisecond {
+		t.Errorf("First retry happened after %v, expected at least 100ms", gap)
+	}
+	if gap := attempts[2].Sub(attempts[1]); gap < 200*time.Millisecond {
+		t.Errorf("Second retry happened after %v, expected at least 200ms", gap)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	env := newTestEnv(t, "DEAD_LETTER_ATTEMPTS=2")
+	var rejected int
+	var rejectedLock sync.Mutex
+	env.as.Respond = func(txn *ReceivedTransaction) int {
+		if txn.toDeviceNumber() != 1 {
+			return http.StatusOK
+		}
+		rejectedLock.Lock()
+		rejected++
+		rejectedLock.Unlock()
+		return http.StatusBadRequest
+	}
+	env.putTarget(t)
+	env.hs.QueueSync("bot_token", testSyncResponse(1))
+	env.hs.QueueSync("bot_token", testSyncResponse(2))
+
+	// Delivery continues with the next transaction once the rejected one is dead-lettered.
+	if _, err := env.as.WaitForTransaction(env.ctx, hasTestEvent(2)); err != nil {
+		t.Fatal("Transaction after the dead-lettered one wasn't delivered:", err)
+	}
+	rejectedLock.Lock()
+	if rejected != 2 {
+		t.Errorf("Expected the transaction to be rejected twice before being dead-lettered, got %d", rejected)
+	}
+	rejectedLock.Unlock()
+
+	var resp struct {
+		DeadLetters []struct {
+			TxnID      string `json:"txn_id"`
+			Reason     string `json:"reason"`
+			Replayable bool   `json:"replayable"`
+		} `json:"dead_letters"`
+	}
+	if err := env.proxy.getJSON(env.ctx, "testbridge/dead-letters", &resp); err != nil {
+		t.Fatal("Failed to get dead letters:", err)
+	} else if len(resp.DeadLetters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(resp.DeadLetters))
+	} else if !resp.DeadLetters[0].Replayable || len(resp.DeadLetters[0].Reason) == 0 {
+		t.Errorf("Dead letter should be replayable and have a reason: %+v", resp.DeadLetters[0])
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	env := newTestEnv(t, "LOG_FORMAT=json", "DEBUG=true")
+	env.putTarget(t)
+	env.hs.QueueSync("bot_token", testSyncResponse(1))
+	txn, err := env.as.WaitForTransaction(env.ctx, hasTestEvent(1))
+	if err != nil {
+		t.Fatal("Transaction wasn't delivered:", err)
+	}
+
+	// The output of the proxy is copied from a pipe, so the log line may arrive after the transaction.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if checkJSONLogs(t, env.proxy.Logs(), txn.TxnID) {
+			return
+		}
+	}
+	t.Errorf("No log line has the txn_id %s", txn.TxnID)
+}
+
+// checkJSONLogs checks that every complete line of the output is a JSON log entry with a time and level,
+// and returns whether the line of the transaction was found.
+func checkJSONLogs(t *testing.T, output, txnID string) bool {
+	t.Helper()
+	lines := strings.Split(output, "\n")
+	// The last line is either empty or still being written.
+	for _, line := range lines[:len(lines)-1] {
+		var entry struct {
+			Time     string `json:"time"`
+			Level    string `json:"level"`
+			Message  string `json:"message"`
+			Metadata struct {
+				AppserviceID string `json:"appservice_id"`
+				SyncID       int    `json:"sync_id"`
+				TxnID        string `json:"txn_id"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line isn't a JSON object: %v\n%s", err, line)
+		} else if len(entry.Time) == 0 || len(entry.Level) == 0 {
+			t.Fatalf("Log line is missing time or level: %s", line)
+		}
+		if entry.Metadata.TxnID == txnID {
+			if entry.Metadata.AppserviceID != "testbridge" || entry.Metadata.SyncID == 0 {
+				t.Errorf("Transaction log line is missing the appservice or sync ID: %s", line)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) getJSON(ctx context.Context, path string, into interface{}) error {
+	url := fmt.Sprintf("%s/_matrix/client/unstable/fi.mau.syncproxy/%s", proxy.URL, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+proxy.SharedSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned HTTP %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
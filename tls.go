@@ -0,0 +1,118 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const certReloadInterval = 30 * time.Second
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (tc *TLSConfig) Enabled() bool {
+	return len(tc.Cert) > 0 || len(tc.Key) > 0
+}
+
+// certReloader serves the certificate from the configured files and reloads it when the files change,
+// so that renewed certificates are picked up without restarting.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lock        sync.RWMutex
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// reload loads the certificate if either file has changed since the last load. It returns whether it was reloaded.
+func (cr *certReloader) reload() (bool, error) {
+	certModTime, err := modTime(cr.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyModTime, err := modTime(cr.keyPath)
+	if err != nil {
+		return false, err
+	}
+	cr.lock.RLock()
+	unchanged := cr.cert != nil && certModTime.Equal(cr.certModTime) && keyModTime.Equal(cr.keyModTime)
+	cr.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return false, err
+	}
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.certModTime = certModTime
+	cr.keyModTime = keyModTime
+	cr.lock.Unlock()
+	return true, nil
+}
+
+// Loop checks the certificate files for changes until the process exits. If a changed certificate
+// can't be loaded (e.g. because only one of the files has been replaced so far), the old one is kept.
+func (cr *certReloader) Loop() {
+	for range time.Tick(certReloadInterval) {
+		if reloaded, err := cr.reload(); err != nil {
+			log.Warnln("Failed to reload TLS certificate:", err)
+		} else if reloaded {
+			log.Infoln("Reloaded TLS certificate")
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+// GetClientCertificate returns the certificate for servers that request a client certificate.
+func (cr *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
@@ -0,0 +1,170 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedTokenPrefix marks bot_access_token and hs_token values that are encrypted with TOKEN_ENCRYPTION_KEY.
+// Values without a prefix are plaintext, either from before encryption was enabled or because it isn't enabled.
+// The target and column are authenticated as additional data, so encrypted values can't be swapped between
+// targets or between the two columns in the database.
+const encryptedTokenPrefix = "enc:v2:"
+
+// legacyEncryptedTokenPrefix marks values that were encrypted without additional data. They can still be read,
+// and they're encrypted again with the target and column on startup.
+const legacyEncryptedTokenPrefix = "enc:v1:"
+
+const (
+	tokenColumnBotAccessToken = "bot_access_token"
+	tokenColumnHSToken        = "hs_token"
+)
+
+var errNoTokenEncryptionKey = errors.New("token is encrypted, but TOKEN_ENCRYPTION_KEY is not set")
+
+// tokenCipher encrypts the access tokens of targets in the database. It's nil if encryption is disabled.
+var tokenCipher cipher.AEAD
+
+// parseTokenEncryptionKey parses a base64-encoded 256-bit AES key. An empty key disables encryption.
+func parseTokenEncryptionKey(key string) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(rawKey) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes encoded as base64")
+	}
+	block, err := aes.NewCipher(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tokenAAD returns the additional data that binds an encrypted token to its target and column.
+// appserviceID is the storage ID, i.e. including the profile prefix.
+func tokenAAD(appserviceID, deviceKey, column string) []byte {
+	return []byte(appserviceID + "|" + deviceKey + "|" + column)
+}
+
+// encryptToken encrypts a token for storing it in the given column of the target,
+// or returns it as-is if encryption is disabled.
+func encryptToken(token, appserviceID, deviceKey, column string) (string, error) {
+	if tokenCipher == nil || len(token) == 0 {
+		return token, nil
+	}
+	nonce := make([]byte, tokenCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := tokenCipher.Seal(nonce, nonce, []byte(token), tokenAAD(appserviceID, deviceKey, column))
+	return encryptedTokenPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func encryptTokens(appserviceID, deviceKey, botAccessToken, hsToken string) (string, string, error) {
+	encryptedBotAccessToken, err := encryptToken(botAccessToken, appserviceID, deviceKey, tokenColumnBotAccessToken)
+	if err != nil {
+		return "", "", err
+	}
+	encryptedHSToken, err := encryptToken(hsToken, appserviceID, deviceKey, tokenColumnHSToken)
+	return encryptedBotAccessToken, encryptedHSToken, err
+}
+
+// decryptToken decrypts a token read from the given column of the target. Plaintext tokens are returned as-is.
+func decryptToken(stored, appserviceID, deviceKey, column string) (string, error) {
+	var aad []byte
+	if strings.HasPrefix(stored, encryptedTokenPrefix) {
+		stored = stored[len(encryptedTokenPrefix):]
+		aad = tokenAAD(appserviceID, deviceKey, column)
+	} else if strings.HasPrefix(stored, legacyEncryptedTokenPrefix) {
+		stored = stored[len(legacyEncryptedTokenPrefix):]
+	} else {
+		return stored, nil
+	}
+	if tokenCipher == nil {
+		return "", errNoTokenEncryptionKey
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted token: %w", err)
+	} else if len(sealed) < tokenCipher.NonceSize() {
+		return "", fmt.Errorf("encrypted token is too short")
+	}
+	nonceSize := tokenCipher.NonceSize()
+	plaintext, err := tokenCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], aad)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token (wrong TOKEN_ENCRYPTION_KEY or moved value?): %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// needsTokenEncryption returns whether the stored token is plaintext or encrypted without additional data.
+func needsTokenEncryption(stored string) bool {
+	return len(stored) > 0 && !strings.HasPrefix(stored, encryptedTokenPrefix)
+}
+
+// EncryptStoredTokens encrypts the tokens of targets that were stored before encryption was enabled,
+// and encrypts tokens that were encrypted without additional data again.
+func (ss *sqlStore) EncryptStoredTokens(ctx context.Context) (int, error) {
+	if tokenCipher == nil {
+		return 0, nil
+	}
+	rows, err := ss.db.QueryContext(ctx, "SELECT appservice_id, device_key, bot_access_token, hs_token FROM targets")
+	if err != nil {
+		return 0, err
+	}
+	type plaintextRow struct {
+		appserviceID, deviceKey, botAccessToken, hsToken string
+	}
+	var plaintextRows []plaintextRow
+	for rows.Next() {
+		var row plaintextRow
+		if err = rows.Scan(&row.appserviceID, &row.deviceKey, &row.botAccessToken, &row.hsToken); err != nil {
+			_ = rows.Close()
+			return 0, err
+		} else if needsTokenEncryption(row.botAccessToken) || needsTokenEncryption(row.hsToken) {
+			plaintextRows = append(plaintextRows, row)
+		}
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, row := range plaintextRows {
+		// Rows where one of the tokens is already encrypted are decrypted first, so that the key is checked.
+		botAccessToken, err := decryptToken(row.botAccessToken, row.appserviceID, row.deviceKey, tokenColumnBotAccessToken)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read bot access token of %s: %w", row.appserviceID, err)
+		}
+		hsToken, err := decryptToken(row.hsToken, row.appserviceID, row.deviceKey, tokenColumnHSToken)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read hs_token of %s: %w", row.appserviceID, err)
+		}
+		if err = ss.SetTargetCredentials(ctx, row.appserviceID, row.deviceKey, botAccessToken, hsToken); err != nil {
+			return 0, fmt.Errorf("failed to encrypt tokens of %s: %w", row.appserviceID, err)
+		}
+	}
+	return len(plaintextRows), nil
+}
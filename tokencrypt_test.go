@@ -0,0 +1,138 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func newTestTokenKey(t *testing.T) string {
+	rawKey := make([]byte, 32)
+	if _, err := rand.Read(rawKey); err != nil {
+		t.Fatal("Failed to generate key:", err)
+	}
+	return base64.StdEncoding.EncodeToString(rawKey)
+}
+
+// withTokenCipher sets the global token cipher to one with the given key for the rest of the test.
+func withTokenCipher(t *testing.T, key string) {
+	prevCipher := tokenCipher
+	var err error
+	if tokenCipher, err = parseTokenEncryptionKey(key); err != nil {
+		t.Fatal("Failed to parse key:", err)
+	}
+	t.Cleanup(func() {
+		tokenCipher = prevCipher
+	})
+}
+
+func TestTokenEncryptionRoundTrip(t *testing.T) {
+	withTokenCipher(t, newTestTokenKey(t))
+	encrypted, err := encryptToken("secret", "as", "dev", tokenColumnHSToken)
+	if err != nil {
+		t.Fatal("Failed to encrypt token:", err)
+	} else if !strings.HasPrefix(encrypted, encryptedTokenPrefix) || strings.Contains(encrypted, "secret") {
+		t.Fatalf("Token wasn't encrypted: %s", encrypted)
+	}
+	decrypted, err := decryptToken(encrypted, "as", "dev", tokenColumnHSToken)
+	if err != nil {
+		t.Fatal("Failed to decrypt token:", err)
+	} else if decrypted != "secret" {
+		t.Errorf("Expected decrypted token to be secret, got %q", decrypted)
+	}
+	if plaintext, err := decryptToken("plaintext", "as", "dev", tokenColumnHSToken); err != nil || plaintext != "plaintext" {
+		t.Errorf("Plaintext token wasn't returned as-is: %q (error: %v)", plaintext, err)
+	}
+}
+
+func TestTokenEncryptionWrongKey(t *testing.T) {
+	withTokenCipher(t, newTestTokenKey(t))
+	encrypted, err := encryptToken("secret", "as", "dev", tokenColumnHSToken)
+	if err != nil {
+		t.Fatal("Failed to encrypt token:", err)
+	}
+	withTokenCipher(t, newTestTokenKey(t))
+	if _, err = decryptToken(encrypted, "as", "dev", tokenColumnHSToken); err == nil {
+		t.Error("Token was decrypted with the wrong key")
+	}
+	withTokenCipher(t, "")
+	if _, err = decryptToken(encrypted, "as", "dev", tokenColumnHSToken); err != errNoTokenEncryptionKey {
+		t.Errorf("Expected errNoTokenEncryptionKey without a key, got %v", err)
+	}
+}
+
+func TestTokenEncryptionMovedValue(t *testing.T) {
+	withTokenCipher(t, newTestTokenKey(t))
+	encrypted, err := encryptToken("secret", "as", "dev", tokenColumnHSToken)
+	if err != nil {
+		t.Fatal("Failed to encrypt token:", err)
+	}
+	for _, tc := range []struct {
+		name, appserviceID, deviceKey, column string
+	}{
+		{"other column", "as", "dev", tokenColumnBotAccessToken},
+		{"other device", "as", "dev2", tokenColumnHSToken},
+		{"other appservice", "as2", "dev", tokenColumnHSToken},
+	} {
+		if _, err = decryptToken(encrypted, tc.appserviceID, tc.deviceKey, tc.column); err == nil {
+			t.Errorf("Token moved to %s was decrypted", tc.name)
+		}
+	}
+}
+
+func TestEncryptStoredTokens(t *testing.T) {
+	ctx := context.Background()
+	key := newTestTokenKey(t)
+	withTokenCipher(t, "")
+	st := newMemorySQLiteTestStore(t)
+	upsertTestTarget(t, st, "plain", "")
+
+	// Values encrypted without additional data by older versions are encrypted again too.
+	withTokenCipher(t, key)
+	upsertTestTarget(t, st, "legacy", "")
+	nonce := make([]byte, tokenCipher.NonceSize())
+	legacyToken := legacyEncryptedTokenPrefix + base64.RawStdEncoding.EncodeToString(tokenCipher.Seal(nonce, nonce, []byte("hs_token"), nil))
+	_, err := st.(*sqlStore).db.ExecContext(ctx, "UPDATE targets SET hs_token=$1 WHERE appservice_id='legacy'", legacyToken)
+	mustStore(t, err)
+
+	encrypted, err := st.EncryptStoredTokens(ctx)
+	mustStore(t, err)
+	if encrypted != 2 {
+		t.Errorf("Expected tokens of 2 targets to be encrypted, got %d", encrypted)
+	}
+	for _, appserviceID := range []string{"plain", "legacy"} {
+		var botAccessToken, hsToken string
+		err = st.(*sqlStore).db.QueryRowContext(ctx, "SELECT bot_access_token, hs_token FROM targets WHERE appservice_id=$1", appserviceID).
+			Scan(&botAccessToken, &hsToken)
+		mustStore(t, err)
+		if !strings.HasPrefix(botAccessToken, encryptedTokenPrefix) || !strings.HasPrefix(hsToken, encryptedTokenPrefix) {
+			t.Errorf("Tokens of %s weren't encrypted: %s, %s", appserviceID, botAccessToken, hsToken)
+		}
+		target, err := st.GetTarget(ctx, appserviceID, "")
+		mustStore(t, err)
+		if target.BotAccessToken != "bot_token" || target.HSToken != "hs_token" {
+			t.Errorf("Tokens of %s changed: %q, %q", appserviceID, target.BotAccessToken, target.HSToken)
+		}
+	}
+	if encrypted, err = st.EncryptStoredTokens(ctx); err != nil || encrypted != 0 {
+		t.Errorf("Expected already encrypted tokens to be left alone, got %d (error: %v)", encrypted, err)
+	}
+}
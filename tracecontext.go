@@ -0,0 +1,55 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Transactions are sent with a W3C trace context (https://www.w3.org/TR/trace-context/) traceparent header,
+// so that bridges can correlate their own traces and logs with the delivery. The trace ID is derived from
+// the transaction ID, so it stays the same across retries and restarts, while the parent (span) ID is random for
+// each attempt, so that the attempts can be told apart. The proxy doesn't record or export any spans itself.
+
+const traceparentHeader = "traceparent"
+
+// txnTraceID returns the trace ID of the transaction as 32 hex characters.
+func txnTraceID(txnID string) string {
+	hash := sha256.Sum256([]byte(txnID))
+	return hex.EncodeToString(hash[:16])
+}
+
+// newSpanID returns a random span ID as 16 hex characters. An all-zero ID is invalid, so it's never returned.
+func newSpanID() string {
+	spanID := make([]byte, 8)
+	for {
+		_, _ = rand.Read(spanID)
+		for _, b := range spanID {
+			if b != 0 {
+				return hex.EncodeToString(spanID)
+			}
+		}
+	}
+}
+
+// txnTraceparent returns a traceparent header value for a new attempt of the transaction.
+func txnTraceparent(txnID string) string {
+	return fmt.Sprintf("00-%s-%s-01", txnTraceID(txnID), newSpanID())
+}
@@ -0,0 +1,39 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTxnTraceparent(t *testing.T) {
+	first := strings.Split(txnTraceparent("txn1"), "-")
+	second := strings.Split(txnTraceparent("txn1"), "-")
+	other := strings.Split(txnTraceparent("txn2"), "-")
+	if len(first) != 4 || first[0] != "00" || len(first[1]) != 32 || len(first[2]) != 16 || first[3] != "01" {
+		t.Fatalf("Invalid traceparent %q", strings.Join(first, "-"))
+	}
+	if first[1] != second[1] {
+		t.Error("Attempts of the same transaction have different trace IDs")
+	} else if first[1] == other[1] {
+		t.Error("Different transactions have the same trace ID")
+	}
+	if first[2] == second[2] {
+		t.Error("Attempts of the same transaction have the same span ID")
+	}
+}
@@ -0,0 +1,132 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+// txnIDClockReservation is how far ahead of the current time transaction ID timestamps are reserved in the database.
+const txnIDClockReservation = int64(1 * time.Minute)
+
+// txnIDClock makes the timestamps in transaction IDs monotonic, even if the system clock steps backwards
+// or the proxy is restarted on a host whose clock is behind. The highest timestamp that may be used is
+// reserved in the database in advance, and timestamps after a restart always start above the reservation.
+type txnIDClock struct {
+	last     int64
+	reserved int64
+	lock     sync.Mutex
+}
+
+var txnClock txnIDClock
+
+// Load reads the reservation of the previous run from the store.
+func (clock *txnIDClock) Load(ctx context.Context) error {
+	reserved, err := store.GetTxnIDClockReservation(ctx)
+	if err != nil {
+		return err
+	}
+	clock.lock.Lock()
+	clock.last = reserved
+	clock.reserved = reserved
+	clock.lock.Unlock()
+	return nil
+}
+
+// Next returns a timestamp in nanoseconds that is higher than any previously returned one.
+func (clock *txnIDClock) Next() int64 {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	ts := time.Now().UnixNano()
+	if ts <= clock.last {
+		ts = clock.last + 1
+	}
+	clock.last = ts
+	if ts > clock.reserved && store != nil {
+		reserved := ts + txnIDClockReservation
+		err := store.SetTxnIDClockReservation(context.Background(), reserved)
+		if err != nil {
+			// The in-memory clock stays monotonic, only IDs after a restart could go backwards.
+			log.Warnln("Failed to store transaction ID clock reservation:", err)
+		} else {
+			clock.reserved = reserved
+		}
+	}
+	return ts
+}
+
+// txnMetadata is information about a transaction that stays the same across retries and the pending queue.
+type txnMetadata struct {
+	Sequence uint64
+	// CreatedAt is the unix millisecond timestamp when the transaction was created from a /sync response.
+	CreatedAt int64
+}
+
+// newTxnMetadata returns metadata for a new transaction. Only transactions with data get a sequence number.
+func (target *SyncTarget) newTxnMetadata(hasData bool) (meta txnMetadata, err error) {
+	meta.CreatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	if hasData {
+		meta.Sequence, err = target.nextSequence()
+	}
+	return
+}
+
+const sequenceTxnIDFormat = "fi.mau.syncproxy.seq_%d_%d"
+const deviceSequenceTxnIDFormat = "fi.mau.syncproxy.seq_%d_%s_%d"
+
+// newDataTxn returns the ID and metadata of a new transaction with data. The ID is derived from the
+// per-target sequence, which is stored in the database before the transaction is sent, so bridges can
+// detect gaps and deduplicate transactions by ID across restarts. The registration time of the target is
+// included so that IDs aren't reused if the target is purged and registered again.
+//
+// If the sequence can't be stored, an error is returned and the transaction must not be sent or queued.
+func (target *SyncTarget) newDataTxn() (string, txnMetadata, error) {
+	meta, err := target.newTxnMetadata(true)
+	if err != nil {
+		return "", meta, err
+	} else if len(target.DeviceKey) > 0 {
+		return fmt.Sprintf(deviceSequenceTxnIDFormat, target.registeredAt, target.DeviceKey, meta.Sequence), meta, nil
+	}
+	return fmt.Sprintf(sequenceTxnIDFormat, target.registeredAt, meta.Sequence), meta, nil
+}
+
+// nextSequence returns the next number in the per-target transaction sequence.
+// Targets can use it to detect gaps and duplicates, since unlike the transaction ID it increases by exactly one.
+//
+// The new value is written to the database before it's returned, so a number is never handed out twice, even if
+// the proxy is restarted right after. If the write fails, the sequence isn't advanced and the error is returned,
+// so that the caller fails and the transaction is retried with the same number later.
+func (target *SyncTarget) nextSequence() (uint64, error) {
+	target.sequenceLock.Lock()
+	defer target.sequenceLock.Unlock()
+	target.statusLock.RLock()
+	sequence := target.txnSequence + 1
+	target.statusLock.RUnlock()
+	err := store.SetTargetTxnSequence(context.Background(), target.storageID(), target.DeviceKey, sequence)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store transaction sequence: %w", err)
+	}
+	target.statusLock.Lock()
+	target.txnSequence = sequence
+	target.statusLock.Unlock()
+	return sequence, nil
+}
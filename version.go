@@ -0,0 +1,129 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// Information to find out exactly which commit the proxy was built from.
+// These are filled at build time with the -X linker flag.
+var (
+	Tag       = "unknown"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// Version is the tag if the build was made from a tag, and otherwise "dev" followed by the short commit hash.
+var Version = "dev"
+
+func init() {
+	if len(Tag) > 0 && Tag != "unknown" {
+		Version = Tag
+	} else if len(Commit) >= 8 {
+		Version = "dev+" + Commit[:8]
+	}
+}
+
+// VersionString returns a human-readable description of the build, e.g. for the --version flag.
+func VersionString() string {
+	return fmt.Sprintf("mautrix-syncproxy %s (commit %s, built at %s with %s)", Version, Commit, BuildTime, runtime.Version())
+}
+
+// unstableFeatures are the unstable API namespaces that the proxy implements, in the same format as
+// the unstable_features of the Matrix /versions endpoint. The value is false if the namespace is disabled.
+var unstableFeatures = map[string]bool{
+	"fi.mau.syncproxy": true,
+}
+
+// alwaysEnabledFeatures are the features that don't depend on configuration.
+var alwaysEnabledFeatures = []string{
+	"multi-device",
+	"registration-import",
+	"transaction-history",
+	"pending-queue",
+	"self-test",
+	"recent-errors",
+	"latency-slo",
+	"fan-out",
+}
+
+// EnabledFeatures returns the list of features that are available with the current configuration,
+// so that clients can check whether a feature is supported before trying to use it.
+func EnabledFeatures() []string {
+	features := append([]string{}, alwaysEnabledFeatures...)
+	if len(cfg.Templates) > 0 {
+		features = append(features, "templates")
+	}
+	if len(cfg.DryRunCaptureDir) > 0 {
+		features = append(features, "dry-run-capture")
+	}
+	if cfg.ToDeviceDedupWindow > 0 {
+		features = append(features, "to-device-dedup")
+	}
+	if getKeyRequestRateLimit() > 0 {
+		features = append(features, "key-request-rate-limit")
+	}
+	if cfg.StartupProbeTimeout > 0 {
+		features = append(features, "startup-probe")
+	}
+	if len(cfg.Profiles) > 0 {
+		features = append(features, "profiles")
+	}
+	if cfg.CatchUp.Enabled {
+		features = append(features, "catch-up-sync")
+	}
+	if cfg.RecentErrors.Persist {
+		features = append(features, "persistent-recent-errors")
+	}
+	return features
+}
+
+type VersionResponse struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildTime string   `json:"build_time"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"`
+	// UnstableFeatures contains the supported management API namespaces.
+	UnstableFeatures map[string]bool `json:"unstable_features"`
+
+	InstanceID string      `json:"instance_id,omitempty"`
+	Database   *SchemaInfo `json:"database,omitempty"`
+}
+
+func getVersion(w http.ResponseWriter, _ *http.Request) {
+	var schema *SchemaInfo
+	if db != nil {
+		info := db.Schema()
+		schema = &info
+	}
+	writeJSON(w, http.StatusOK, &VersionResponse{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Features:  EnabledFeatures(),
+
+		UnstableFeatures: unstableFeatures,
+
+		InstanceID: cfg.InstanceID,
+		Database:   schema,
+	})
+}
@@ -0,0 +1,88 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bytes"
+	"os"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const heartbeatInterval = 10 * time.Second
+
+// expectedDeliveryDuration is how long a single transaction request is expected to take at most.
+// Transaction requests don't have a client timeout by default, so a target that never responds is reported as a stall.
+const expectedDeliveryDuration = 2 * time.Minute
+
+// heartbeat tells the watchdog that the sync loop is alive and expects to do something again within expectedWait,
+// e.g. because it's about to sleep before a retry or make a long-polling request.
+func (target *SyncTarget) heartbeat(expectedWait time.Duration) {
+	atomic.StoreInt64(&target.watchdogDeadline, time.Now().Add(expectedWait).UnixNano())
+}
+
+// stalledFor returns how long the sync loop has been past its last heartbeat's expected wait.
+func (target *SyncTarget) stalledFor(now time.Time) time.Duration {
+	deadline := atomic.LoadInt64(&target.watchdogDeadline)
+	if deadline == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, deadline))
+}
+
+// findStalledTargets returns running targets whose sync loop hasn't sent a heartbeat for longer than the stall timeout.
+func findStalledTargets(now time.Time) []*SyncTarget {
+	var stalled []*SyncTarget
+	for _, target := range registry.Snapshot() {
+		if target.isRunning() && target.stalledFor(now) > cfg.Watchdog.StallTimeout {
+			stalled = append(stalled, target)
+		}
+	}
+	return stalled
+}
+
+// loopHeartbeat updates the heartbeat metric and checks sync loops for stalls until the process exits.
+func loopHeartbeat() {
+	warned := make(map[*SyncTarget]int64)
+	for now := range time.Tick(heartbeatInterval) {
+		processHeartbeat.Set(float64(now.Unix()))
+		if cfg.Watchdog.StallTimeout <= 0 {
+			continue
+		}
+		stalled := findStalledTargets(now)
+		stalledSyncLoops.Set(float64(len(stalled)))
+		// Each stall is only warned about once, a new heartbeat changes the deadline.
+		stillWarned := make(map[*SyncTarget]int64, len(stalled))
+		for _, target := range stalled {
+			deadline := atomic.LoadInt64(&target.watchdogDeadline)
+			if warned[target] != deadline {
+				target.log.Warnfln("Sync loop seems to be stuck, no activity for %v", target.stalledFor(now).Round(time.Second))
+			}
+			stillWarned[target] = deadline
+		}
+		warned = stillWarned
+		if len(stalled) > 0 && cfg.Watchdog.ExitOnStall {
+			var buf bytes.Buffer
+			_ = pprof.Lookup("goroutine").WriteTo(&buf, 2)
+			log.Fatalfln("%d sync loops are stuck, exiting so that the process can be restarted. Goroutines:\n%s", len(stalled), buf.String())
+			os.Exit(7)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const webhookQueueSize = 1000
+const webhookRequestTimeout = 10 * time.Second
+const webhookAttempts = 3
+const webhookRetryInterval = 5 * time.Second
+
+const webhookSignatureHeader = "X-Syncproxy-Signature"
+const webhookTimestampHeader = "X-Syncproxy-Timestamp"
+
+type WebhookConfig struct {
+	// URL is where lifecycle events are POSTed. Empty disables webhooks.
+	URL string `yaml:"url"`
+	// Secret is the key for the HMAC-SHA256 signature of the payload.
+	Secret string `yaml:"secret"`
+	// FailingAfter is how long syncing or delivery must fail before a failing event is sent. Zero disables failing events.
+	FailingAfter time.Duration `yaml:"failing_after"`
+}
+
+type WebhookEventType string
+
+const (
+	WebhookEventStarted   WebhookEventType = "started"
+	WebhookEventStopped   WebhookEventType = "stopped"
+	WebhookEventLoggedOut WebhookEventType = "logged-out"
+	// WebhookEventFailing is sent once syncing or delivery has been failing for longer than the configured time.
+	WebhookEventFailing WebhookEventType = "failing"
+	// WebhookEventRecovered is sent when syncing or delivery succeeds again after a failing event.
+	WebhookEventRecovered WebhookEventType = "recovered"
+)
+
+// WebhookFailureSource is the part of the sync loop that a failing or recovered event is about.
+type WebhookFailureSource string
+
+const (
+	WebhookFailureSync     WebhookFailureSource = "sync"
+	WebhookFailureDelivery WebhookFailureSource = "delivery"
+)
+
+type WebhookEvent struct {
+	Type         WebhookEventType  `json:"type"`
+	AppserviceID string            `json:"appservice_id"`
+	DeviceKey    string            `json:"device_key,omitempty"`
+	Profile      string            `json:"profile,omitempty"`
+	UserID       id.UserID         `json:"user_id"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	InstanceID   string            `json:"instance_id"`
+	Timestamp    int64             `json:"timestamp"`
+
+	// Reason is set for stopped and logged-out events.
+	Reason StopReason `json:"reason,omitempty"`
+	// Source and FailingSince are set for failing and recovered events.
+	Source       WebhookFailureSource `json:"source,omitempty"`
+	FailingSince int64                `json:"failing_since,omitempty"`
+	Error        string               `json:"error,omitempty"`
+}
+
+// webhookNotifier POSTs target lifecycle events to the configured webhook URL.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan *WebhookEvent
+}
+
+// webhook is the notifier for WEBHOOK_URL, or nil if webhooks aren't configured.
+var webhook *webhookNotifier
+
+// newWebhookNotifier validates the webhook config. An empty URL returns nil.
+func newWebhookNotifier(config WebhookConfig) (*webhookNotifier, error) {
+	if len(config.URL) == 0 {
+		return nil, nil
+	} else if parsed, err := url.Parse(config.URL); err != nil {
+		return nil, err
+	} else if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	} else if len(config.Secret) == 0 {
+		return nil, errors.New("a secret is required for signing the payloads")
+	}
+	return &webhookNotifier{
+		url:    config.URL,
+		secret: []byte(config.Secret),
+		client: &http.Client{Timeout: webhookRequestTimeout},
+		queue:  make(chan *WebhookEvent, webhookQueueSize),
+	}, nil
+}
+
+// Loop sends queued events until the process exits. Events are sent one at a time, so they arrive in order.
+func (wn *webhookNotifier) Loop() {
+	for evt := range wn.queue {
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = wn.send(evt); err == nil {
+				break
+			} else if attempt < webhookAttempts {
+				time.Sleep(webhookRetryInterval)
+			}
+		}
+		if err != nil {
+			webhookDeliveries.WithLabelValues("failed").Inc()
+			log.Warnfln("Failed to send %s webhook for %s: %v", evt.Type, TargetID(evt.AppserviceID, evt.DeviceKey), err)
+		} else {
+			webhookDeliveries.WithLabelValues("sent").Inc()
+		}
+	}
+}
+
+// signWebhook returns the hex-encoded HMAC-SHA256 of the timestamp and the body, separated by a dot.
+// Including the timestamp lets receivers reject replayed requests.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wn *webhookNotifier) send(evt *WebhookEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, wn.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(wn.secret, timestamp, data))
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notifyWebhook fills in the target fields of the event and queues it. It doesn't block, events are dropped
+// if the queue is full.
+func (target *SyncTarget) notifyWebhook(evt *WebhookEvent) {
+	if webhook == nil {
+		return
+	}
+	evt.AppserviceID = target.AppserviceID
+	evt.DeviceKey = target.DeviceKey
+	evt.Profile = target.Profile
+	evt.UserID = target.UserID
+	evt.Labels = target.Labels
+	evt.InstanceID = cfg.InstanceID
+	evt.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	select {
+	case webhook.queue <- evt:
+	default:
+		webhookDeliveries.WithLabelValues("dropped").Inc()
+		target.log.Warnfln("Webhook queue is full, dropping %s event", evt.Type)
+	}
+}
+
+// notifyStopped sends a stopped event, or a logged-out event if the homeserver invalidated the access token.
+func (target *SyncTarget) notifyStopped(reason StopReason, err error) {
+	evt := &WebhookEvent{Type: WebhookEventStopped, Reason: reason}
+	if reason == StopReasonSoftLogout || errors.Is(err, mautrix.MUnknownToken) {
+		evt.Type = WebhookEventLoggedOut
+	}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	target.notifyWebhook(evt)
+}
+
+// webhookFailureFlag returns the flag that tracks whether a failing event was sent for the source.
+func (target *SyncTarget) webhookFailureFlag(source WebhookFailureSource) *int32 {
+	if source == WebhookFailureSync {
+		return &target.webhookSyncFailing
+	}
+	return &target.webhookDeliveryFailing
+}
+
+// checkFailing sends a failing event if the source has been failing for longer than the configured time.
+// Only one event is sent until the source recovers.
+func (target *SyncTarget) checkFailing(source WebhookFailureSource, since time.Time, err error) {
+	if webhook == nil || cfg.Webhook.FailingAfter <= 0 || since.IsZero() || time.Since(since) < cfg.Webhook.FailingAfter {
+		return
+	} else if !atomic.CompareAndSwapInt32(target.webhookFailureFlag(source), 0, 1) {
+		return
+	}
+	target.notifyWebhook(&WebhookEvent{
+		Type:         WebhookEventFailing,
+		Source:       source,
+		FailingSince: since.UnixNano() / int64(time.Millisecond),
+		Error:        err.Error(),
+	})
+}
+
+// clearFailing sends a recovered event if a failing event was sent for the source.
+func (target *SyncTarget) clearFailing(source WebhookFailureSource) {
+	if atomic.CompareAndSwapInt32(target.webhookFailureFlag(source), 1, 0) {
+		target.notifyWebhook(&WebhookEvent{Type: WebhookEventRecovered, Source: source})
+	}
+}
+
+// resetFailing forgets failing events without sending recovered events, e.g. when the sync loop stops.
+func (target *SyncTarget) resetFailing() {
+	atomic.StoreInt32(&target.webhookSyncFailing, 0)
+	atomic.StoreInt32(&target.webhookDeliveryFailing, 0)
+}
@@ -0,0 +1,311 @@
+// mautrix-syncproxy - A /sync proxy for encrypted Matrix appservices.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package syncproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"maunium.net/go/maulogger/v2"
+)
+
+const deliveryWebsocketPingInterval = 30 * time.Second
+const deliveryWebsocketHandshakeTimeout = 30 * time.Second
+
+var errDeliveryWebsocketClosed = errors.New("websocket to target was closed")
+
+// isWebsocketAddress returns whether transactions to the address are pushed over a persistent websocket
+// instead of being sent as HTTP requests.
+func isWebsocketAddress(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+// deliveryWebsocketCommand is a message received from the target. Like in the appservice websocket protocol,
+// every transaction is answered with a response or error command that has the same request ID.
+type deliveryWebsocketCommand struct {
+	ReqID   int             `json:"id"`
+	Command string          `json:"command"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type deliveryWebsocketError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// deliveryWebsocket is a persistent websocket connection from the proxy to a target.
+// A closed connection fails all requests waiting on it immediately, and the next transaction reconnects.
+type deliveryWebsocket struct {
+	conn *websocket.Conn
+	log  maulogger.Logger
+
+	writeLock   sync.Mutex
+	waiters     map[int]chan<- *deliveryWebsocketCommand
+	waitersLock sync.Mutex
+	lastReqID   int32
+
+	closed    chan struct{}
+	closeErr  error
+	closeOnce sync.Once
+}
+
+// createWebsocketURL adds the appservice ID to the websocket address the same way as createTxnURL does.
+func createWebsocketURL(address, appserviceIDParam, appserviceID string) (string, error) {
+	parsedURL, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse target URL: %w", err)
+	}
+	if len(appserviceIDParam) > 0 {
+		q := parsedURL.Query()
+		q.Add(appserviceIDParam, appserviceID)
+		parsedURL.RawQuery = q.Encode()
+	}
+	return parsedURL.String(), nil
+}
+
+func (target *SyncTarget) dialDeliveryWebsocket(ctx context.Context, address string) (*deliveryWebsocket, error) {
+	opts := target.Delivery
+	wsURL, err := createWebsocketURL(address, opts.appserviceIDParam(), target.AppserviceID)
+	if err != nil {
+		return nil, err
+	}
+	hsToken := target.getHSToken()
+	if len(hsToken) == 0 {
+		return nil, fmt.Errorf("target is missing hs_token")
+	}
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", hsToken))
+	clientCfg, proxy := getDeliveryClientConfig()
+	dialer := websocket.Dialer{
+		Proxy:            proxy,
+		HandshakeTimeout: deliveryWebsocketHandshakeTimeout,
+		NetDialContext:   deliveryDialer(clientCfg, opts).DialContext,
+	}
+	if opts != nil {
+		if opts.Auth != nil {
+			if err = opts.Auth.setHeaders(header); err != nil {
+				return nil, err
+			}
+		}
+		if len(opts.pins) > 0 && !strings.HasPrefix(wsURL, "wss://") {
+			return nil, errPinnedNotHTTPS
+		}
+	}
+	dialer.TLSClientConfig = opts.tlsConfig()
+	conn, resp, err := dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket handshake returned HTTP %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to connect websocket: %w", err)
+	}
+	dws := &deliveryWebsocket{
+		conn:    conn,
+		log:     target.log.Subm("Websocket", target.logFields()),
+		waiters: make(map[int]chan<- *deliveryWebsocketCommand),
+		closed:  make(chan struct{}),
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * deliveryWebsocketPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * deliveryWebsocketPingInterval))
+	})
+	go dws.readLoop()
+	go dws.pingLoop()
+	dws.log.Debugln("Connected to", address)
+	return dws, nil
+}
+
+func (dws *deliveryWebsocket) readLoop() {
+	for {
+		var cmd deliveryWebsocketCommand
+		err := dws.conn.ReadJSON(&cmd)
+		if err != nil {
+			dws.close(fmt.Errorf("%w: %v", errDeliveryWebsocketClosed, err))
+			return
+		}
+		_ = dws.conn.SetReadDeadline(time.Now().Add(2 * deliveryWebsocketPingInterval))
+		if cmd.Command != "response" && cmd.Command != "error" {
+			dws.log.Debugfln("Ignoring unknown command %q from target", cmd.Command)
+			continue
+		}
+		dws.waitersLock.Lock()
+		waiter, ok := dws.waiters[cmd.ReqID]
+		delete(dws.waiters, cmd.ReqID)
+		dws.waitersLock.Unlock()
+		if ok {
+			waiter <- &cmd
+		} else {
+			dws.log.Debugfln("Got %s to unknown request %d", cmd.Command, cmd.ReqID)
+		}
+	}
+}
+
+func (dws *deliveryWebsocket) pingLoop() {
+	ticker := time.NewTicker(deliveryWebsocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dws.writeLock.Lock()
+			err := dws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(deliveryWebsocketPingInterval))
+			dws.writeLock.Unlock()
+			if err != nil {
+				dws.close(fmt.Errorf("%w: failed to send ping: %v", errDeliveryWebsocketClosed, err))
+				return
+			}
+		case <-dws.closed:
+			return
+		}
+	}
+}
+
+func (dws *deliveryWebsocket) close(err error) {
+	dws.closeOnce.Do(func() {
+		dws.log.Debugln("Closing websocket:", err)
+		dws.closeErr = err
+		close(dws.closed)
+		_ = dws.conn.Close()
+	})
+}
+
+func (dws *deliveryWebsocket) isClosed() bool {
+	select {
+	case <-dws.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// request sends the message with a new request ID and waits for the target to respond to it.
+func (dws *deliveryWebsocket) request(ctx context.Context, msg map[string]json.RawMessage) (*deliveryWebsocketCommand, error) {
+	reqID := int(atomic.AddInt32(&dws.lastReqID, 1))
+	msg["id"] = json.RawMessage(strconv.Itoa(reqID))
+	respChan := make(chan *deliveryWebsocketCommand, 1)
+	dws.waitersLock.Lock()
+	dws.waiters[reqID] = respChan
+	dws.waitersLock.Unlock()
+	defer func() {
+		dws.waitersLock.Lock()
+		delete(dws.waiters, reqID)
+		dws.waitersLock.Unlock()
+	}()
+	dws.writeLock.Lock()
+	_ = dws.conn.SetWriteDeadline(time.Now().Add(deliveryWebsocketPingInterval))
+	err := dws.conn.WriteJSON(msg)
+	dws.writeLock.Unlock()
+	if err != nil {
+		dws.close(fmt.Errorf("%w: failed to write: %v", errDeliveryWebsocketClosed, err))
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-dws.closed:
+		return nil, dws.closeErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// getDeliveryWebsocket returns the open websocket to the given address, connecting if necessary.
+func (target *SyncTarget) getDeliveryWebsocket(ctx context.Context, address string) (*deliveryWebsocket, error) {
+	target.credsLock.RLock()
+	dws := target.deliveryWebsockets[address]
+	target.credsLock.RUnlock()
+	if dws != nil && !dws.isClosed() {
+		return dws, nil
+	}
+	dws, err := target.dialDeliveryWebsocket(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	target.credsLock.Lock()
+	defer target.credsLock.Unlock()
+	if existing := target.deliveryWebsockets[address]; existing != nil && existing != dws && !existing.isClosed() {
+		// Someone else connected at the same time, keep the connection that was there first.
+		dws.close(errors.New("duplicate connection"))
+		return existing, nil
+	}
+	if target.deliveryWebsockets == nil {
+		target.deliveryWebsockets = make(map[string]*deliveryWebsocket)
+	}
+	target.deliveryWebsockets[address] = dws
+	return dws, nil
+}
+
+// closeDeliveryWebsockets closes all websockets of the target. It's called with credsLock held.
+func (target *SyncTarget) closeDeliveryWebsockets() {
+	for address, dws := range target.deliveryWebsockets {
+		dws.close(errors.New("delivery settings changed or target was removed"))
+		delete(target.deliveryWebsockets, address)
+	}
+}
+
+// postWebsocketTransaction pushes an encoded transaction or error over the websocket to the address
+// and waits for the target to acknowledge it.
+func (target *SyncTarget) postWebsocketTransaction(ctx context.Context, address, txnID string, body []byte, isError bool) (*transactionResponse, error) {
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("failed to re-decode transaction JSON: %w", err)
+	}
+	command := "transaction"
+	if isError {
+		command = "fi.mau.syncproxy.error"
+	}
+	msg["command"], _ = json.Marshal(command)
+	msg["txn_id"], _ = json.Marshal(txnID)
+	msg["status"] = json.RawMessage(`"ok"`)
+	dws, err := target.getDeliveryWebsocket(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if opts := target.Delivery; opts != nil && opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	resp, err := dws.request(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send transaction over websocket: %w", err)
+	} else if resp.Command == "error" {
+		var respErr deliveryWebsocketError
+		if err = json.Unmarshal(resp.Data, &respErr); err != nil {
+			return nil, fmt.Errorf("websocket transaction returned non-JSON error")
+		} else if respErr.Code == errFiMauWsNotConnected.ErrCode {
+			return nil, errWebsocketNotConnected
+		}
+		return nil, fmt.Errorf("websocket transaction returned error %s: %s", respErr.Code, respErr.Message)
+	}
+	var respData transactionResponse
+	if len(resp.Data) > 0 {
+		if err = json.Unmarshal(resp.Data, &respData); err != nil {
+			return nil, fmt.Errorf("websocket transaction was acknowledged, but had non-JSON data: %v", err)
+		}
+	}
+	return &respData, nil
+}